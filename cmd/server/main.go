@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"instagram-user-processor/pkg/api"
+	"instagram-user-processor/pkg/api/instagram"
 	"instagram-user-processor/pkg/database"
 	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/tracing"
 	"instagram-user-processor/pkg/utils"
 
 	"github.com/gin-gonic/gin"
@@ -21,19 +27,98 @@ import (
 // @BasePath /api/v1
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx); err != nil {
+		log.Fatal().Err(err).Msg("server exited with error")
+	}
+}
+
+// run starts the server and blocks until ctx is cancelled, then drains
+// in-flight requests, stops running jobs and closes the database
+func run(ctx context.Context) error {
 	// Load configuration
 	config := utils.LoadConfig()
 
 	// Initialize logging
-	utils.InitLogger(config.Environment)
+	if err := utils.InitLogger(config); err != nil {
+		return fmt.Errorf("failed to initialize logger: %w", err)
+	}
+
+	// Initialize tracing, a no-op without an OTLP endpoint
+	shutdownTracing, err := tracing.Init(ctx, config)
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Error().Err(err).Msg("failed to flush traces")
+		}
+	}()
+
+	// Configure response rendering of missing text fields
+	database.EmptyAsNull = config.EmptyAsNull
+
+	// Bound stored text fields
+	database.MaxFullNameRunes = config.MaxFullNameLength
+	database.MaxBiographyRunes = config.MaxBiographyLength
 
 	// Initialize database
-	if err := database.Initialize(config.DatabaseURL); err != nil {
-		log.Fatal().Err(err).Msg("failed to initialize database")
+	err = database.Initialize(config.DatabaseURL, database.Options{
+		MaxOpenConns:     config.DBMaxOpenConns,
+		MaxIdleConns:     config.DBMaxIdleConns,
+		ConnMaxLifetime:  time.Duration(config.DBConnMaxLifetime) * time.Second,
+		StatementTimeout: time.Duration(config.DBQueryTimeout) * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer func() {
+		if err := database.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close database")
+		}
+	}()
+
+	// Optionally bring the schema up to date before serving traffic
+	if config.RunMigrations {
+		if err := database.Migrate(ctx); err != nil {
+			return fmt.Errorf("failed to run migrations: %w", err)
+		}
+	}
+
+	// Optionally warm the connection pool before serving traffic
+	if config.DBWarmPool {
+		warmCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := database.WarmPool(warmCtx); err != nil {
+			log.Warn().Err(err).Msg("failed to warm database connection pool")
+		}
+		cancel()
+	}
+
+	// Log database outages and recoveries
+	if config.DBHealthInterval > 0 {
+		database.StartHealthMonitor(ctx, time.Duration(config.DBHealthInterval)*time.Second)
+	}
+
+	// Periodically precompute stats for heavy accounts
+	if config.StatsCacheRefreshInterval > 0 {
+		database.StartStatsCacheRefresher(ctx,
+			time.Duration(config.StatsCacheRefreshInterval)*time.Second, config.StatsCacheMinPosts)
 	}
 
 	// Initialize RocketAPI client
-	external.InitRocketAPI()
+	external.InitRocketAPI(config)
+
+	// Initialize profile picture storage
+	if err := external.InitStorage(ctx, config); err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	// Initialize batch job callbacks
+	external.InitWebhooks(config)
 
 	// Set Gin mode
 	if config.Environment == "production" {
@@ -60,7 +145,35 @@ func main() {
 	log.Info().Msgf("Environment: %s", config.Environment)
 	log.Info().Msgf("Rate limit: %d requests/second", config.RateLimit)
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal().Err(err).Msg("failed to start server")
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("failed to start server: %w", err)
+	case <-ctx.Done():
 	}
-}
\ No newline at end of file
+
+	drainTimeout := time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+	log.Info().
+		Int64("in_flight_requests", api.InFlightRequests()).
+		Dur("drain_timeout", drainTimeout).
+		Msg("shutdown signal received, draining requests")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Error().Err(err).Int64("in_flight_requests", api.InFlightRequests()).Msg("failed to drain requests before timeout")
+	}
+
+	// Cancel running batch jobs and wait for them to record their final state
+	if err := instagram.Shutdown(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("batch jobs did not stop before timeout")
+	}
+
+	log.Info().Msg("server stopped")
+	return nil
+}
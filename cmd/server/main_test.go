@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"instagram-user-processor/pkg/database"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunShutsDownWhenContextIsCancelled(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	// Reserve a free port for the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	t.Setenv("DATABASE_URL", url)
+	t.Setenv("PORT", fmt.Sprint(port))
+	t.Setenv("RUN_MIGRATIONS", "true")
+	t.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "5")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- run(ctx) }()
+
+	healthURL := fmt.Sprintf("http://127.0.0.1:%d/health", port)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(healthURL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not healthy: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not return after cancellation")
+	}
+
+	if _, err := http.Get(healthURL); err == nil {
+		t.Error("server still accepting connections after shutdown")
+	}
+	if err := database.DB.Ping(); err == nil {
+		t.Error("database still open after shutdown")
+	}
+}
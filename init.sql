@@ -1,4 +1,7 @@
 -- Instagram User Processor Database Schema
+--
+-- Mirrors pkg/database/migrations. Schema changes go in a new migration
+-- file there, applied on startup with RUN_MIGRATIONS=true.
 
 -- Enable necessary extensions
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
@@ -17,11 +20,16 @@ CREATE TABLE IF NOT EXISTS instagram_users (
     followers BIGINT DEFAULT 0,
     following BIGINT DEFAULT 0,
     posts BIGINT DEFAULT 0,
+    profile_pic_url TEXT,
     scraped_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- Add columns introduced after the initial schema
+ALTER TABLE instagram_users ADD COLUMN IF NOT EXISTS profile_pic_url TEXT;
+ALTER TABLE instagram_users ADD COLUMN IF NOT EXISTS profile_pic_storage_url TEXT;
+
 -- Create instagram_posts table (for complex query demonstrations)
 CREATE TABLE IF NOT EXISTS instagram_posts (
     id VARCHAR(50) PRIMARY KEY,
@@ -60,10 +68,43 @@ CREATE TABLE IF NOT EXISTS processing_jobs (
     started_at TIMESTAMP WITH TIME ZONE,
     completed_at TIMESTAMP WITH TIME ZONE,
     errors JSONB DEFAULT '{}',
+    parent_job_id UUID REFERENCES processing_jobs(id) ON DELETE SET NULL, -- job whose failures this one retries
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- Create user_stats_cache table (precomputed stats for users with many posts)
+CREATE TABLE IF NOT EXISTS user_stats_cache (
+    user_id VARCHAR(50) PRIMARY KEY REFERENCES instagram_users(id) ON DELETE CASCADE,
+    user_json JSON NOT NULL,
+    tagged_usernames JSON NOT NULL DEFAULT '[]',
+    coauthored_usernames JSON NOT NULL DEFAULT '[]',
+    total_posted_count INTEGER NOT NULL DEFAULT 0,
+    total_tagged_in_count INTEGER NOT NULL DEFAULT 0,
+    total_coauthored_count INTEGER NOT NULL DEFAULT 0,
+    engagement_rate DOUBLE PRECISION,
+    average_posts_per_week DOUBLE PRECISION,
+    refreshed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create username_history table (last known owner of each username, so
+-- renamed accounts can still be found by an old username)
+CREATE TABLE IF NOT EXISTS username_history (
+    username VARCHAR(100) PRIMARY KEY,
+    user_id VARCHAR(50) NOT NULL REFERENCES instagram_users(id) ON DELETE CASCADE,
+    seen_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create audit_log table (records mutating operations)
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor VARCHAR(100) NOT NULL,
+    operation VARCHAR(50) NOT NULL,
+    target TEXT NOT NULL,
+    details JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- Create indexes for better performance
 CREATE INDEX IF NOT EXISTS idx_instagram_users_username ON instagram_users(username);
 CREATE INDEX IF NOT EXISTS idx_instagram_users_scraped_at ON instagram_users(scraped_at);
@@ -81,6 +122,10 @@ CREATE INDEX IF NOT EXISTS idx_instagram_assets_tagged_users ON instagram_assets
 CREATE INDEX IF NOT EXISTS idx_processing_jobs_status ON processing_jobs(status);
 CREATE INDEX IF NOT EXISTS idx_processing_jobs_created_at ON processing_jobs(created_at DESC);
 
+CREATE INDEX IF NOT EXISTS idx_username_history_user_id ON username_history(user_id);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at DESC);
+
 -- Create trigger to update updated_at column
 CREATE OR REPLACE FUNCTION update_updated_at_column()
 RETURNS TRIGGER AS $$
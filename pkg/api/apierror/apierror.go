@@ -0,0 +1,91 @@
+// Package apierror writes the JSON error envelope shared by all API
+// endpoints
+package apierror
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable error codes, returned in the code field
+const (
+	CodeInvalidRequest       = "INVALID_REQUEST"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeForbidden            = "FORBIDDEN"
+	CodeNotFound             = "NOT_FOUND"
+	CodeUserNotFound         = "USER_NOT_FOUND"
+	CodeJobNotFound          = "JOB_NOT_FOUND"
+	CodeRouteNotFound        = "ROUTE_NOT_FOUND"
+	CodeRequestTimeout       = "REQUEST_TIMEOUT"
+	CodeConflict             = "CONFLICT"
+	CodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	CodeURITooLong           = "URI_TOO_LONG"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeInternalError        = "INTERNAL_ERROR"
+	CodeNotImplemented       = "NOT_IMPLEMENTED"
+	CodeUpstreamError        = "UPSTREAM_ERROR"
+	CodeServiceUnavailable   = "SERVICE_UNAVAILABLE"
+	CodeUpstreamTimeout      = "UPSTREAM_TIMEOUT"
+)
+
+// statusCodes are the default codes for statuses without a more specific one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusRequestTimeout:        CodeRequestTimeout,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusRequestURITooLong:     CodeURITooLong,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternalError,
+	http.StatusNotImplemented:        CodeNotImplemented,
+	http.StatusBadGateway:            CodeUpstreamError,
+	http.StatusServiceUnavailable:    CodeServiceUnavailable,
+	http.StatusGatewayTimeout:        CodeUpstreamTimeout,
+}
+
+// CodeForStatus returns the default code for an HTTP status, falling back
+// to INVALID_REQUEST for other 4xx and INTERNAL_ERROR for other 5xx
+func CodeForStatus(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status < 500 {
+		return CodeInvalidRequest
+	}
+	return CodeInternalError
+}
+
+// Body builds an error response body: the code, the HTTP status and a
+// human-readable message, plus the fields in extra (e.g. details or
+// validation_errors). error repeats the message for clients written
+// against the earlier {"error": "..."} body.
+func Body(status int, code, message string, extra ...gin.H) gin.H {
+	body := gin.H{}
+	for _, fields := range extra {
+		for key, value := range fields {
+			body[key] = value
+		}
+	}
+	body["code"] = code
+	body["http_status"] = status
+	body["message"] = message
+	body["error"] = message
+	return body
+}
+
+// Respond writes an error response
+func Respond(c *gin.Context, status int, code, message string, extra ...gin.H) {
+	c.JSON(status, Body(status, code, message, extra...))
+}
+
+// Abort writes an error response and stops the handler chain, for
+// middleware
+func Abort(c *gin.Context, status int, code, message string, extra ...gin.H) {
+	c.AbortWithStatusJSON(status, Body(status, code, message, extra...))
+}
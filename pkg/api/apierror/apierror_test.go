@@ -0,0 +1,87 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCodeForStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusBadRequest, CodeInvalidRequest},
+		{http.StatusNotFound, CodeNotFound},
+		{http.StatusTooManyRequests, CodeRateLimited},
+		{http.StatusBadGateway, CodeUpstreamError},
+		{http.StatusGatewayTimeout, CodeUpstreamTimeout},
+		{http.StatusTeapot, CodeInvalidRequest},
+		{http.StatusInternalServerError, CodeInternalError},
+		{http.StatusInsufficientStorage, CodeInternalError},
+	}
+	for _, tt := range tests {
+		if got := CodeForStatus(tt.status); got != tt.want {
+			t.Errorf("CodeForStatus(%d) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRespondWritesEnvelope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	// extra fields can't replace the envelope's own
+	Respond(c, http.StatusNotFound, CodeUserNotFound, "user not found: ghost", gin.H{
+		"username": "ghost",
+		"code":     "OVERRIDDEN",
+	})
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+	}
+	want := map[string]interface{}{
+		"code":        CodeUserNotFound,
+		"http_status": float64(http.StatusNotFound),
+		"message":     "user not found: ghost",
+		"error":       "user not found: ghost",
+		"username":    "ghost",
+	}
+	for key, value := range want {
+		if body[key] != value {
+			t.Errorf("%s = %v, want %v", key, body[key], value)
+		}
+	}
+}
+
+func TestAbortStopsChain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		Abort(c, http.StatusUnauthorized, CodeUnauthorized, "missing API key")
+	})
+	r.GET("/", func(c *gin.Context) {
+		t.Error("handler ran after Abort")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var body struct {
+		Code       string `json:"code"`
+		HTTPStatus int    `json:"http_status"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusUnauthorized || body.Code != CodeUnauthorized || body.HTTPStatus != http.StatusUnauthorized {
+		t.Errorf("got %d %+v, want 401 UNAUTHORIZED", w.Code, body)
+	}
+}
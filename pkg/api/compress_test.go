@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql/driver"
+	"instagram-user-processor/pkg/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// gzipRouter serves body as JSON on /json, as an event stream on /events,
+// and in two flushed halves on /flushed, behind GzipMiddleware(minSize)
+func gzipRouter(minSize int, body string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(GzipMiddleware(minSize))
+	r.GET("/json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(body))
+	})
+	r.GET("/events", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/event-stream", []byte(body))
+	})
+	r.GET("/flushed", func(c *gin.Context) {
+		c.Header("Content-Type", "application/json")
+		half := len(body) / 2
+		c.Writer.WriteString(body[:half])
+		c.Writer.Flush()
+		c.Writer.WriteString(body[half:])
+	})
+	return r
+}
+
+func getWithEncoding(r http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestGzipMiddlewareCompressesLargeResponses(t *testing.T) {
+	body := `{"results":[` + strings.Repeat(`{"username":"alice","followers":42},`, 200) + `{}]}`
+	r := gzipRouter(1024, body)
+
+	// Without the accept header the body is sent as is
+	w := getWithEncoding(r, "/json", "")
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q without Accept-Encoding, want none", got)
+	}
+	if w.Body.String() != body {
+		t.Errorf("uncompressed body differs from the handler's")
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+
+	w = getWithEncoding(r, "/json", "deflate, gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	if w.Body.Len() >= len(body) {
+		t.Errorf("compressed body is %d bytes, want less than %d", w.Body.Len(), len(body))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	decompressed, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if string(decompressed) != body {
+		t.Errorf("decompressed body differs from the handler's")
+	}
+}
+
+func TestGzipMiddlewareSkips(t *testing.T) {
+	large := strings.Repeat("x", 4096)
+
+	tests := []struct {
+		name           string
+		minSize        int
+		body           string
+		path           string
+		acceptEncoding string
+	}{
+		{"below the threshold", 1024, `{"ok":true}`, "/json", "gzip"},
+		{"event stream", 1024, large, "/events", "gzip"},
+		{"flushed before the threshold", 8192, large, "/flushed", "gzip"},
+		{"gzip refused", 1024, large, "/json", "gzip;q=0, identity"},
+		{"disabled", 0, large, "/json", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := getWithEncoding(gzipRouter(tt.minSize, tt.body), tt.path, tt.acceptEncoding)
+			if got := w.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body was altered: got %d bytes, want %d", w.Body.Len(), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.5", true},
+		{"br, gzip ; q=1", true},
+		{"gzip;q=0", false},
+		{"deflate, br", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestWriteDeadlinesSurviveGzip(t *testing.T) {
+	// Batch workers log concurrently
+	var logs bytes.Buffer
+	prev := log.Logger
+	log.Logger = zerolog.New(zerolog.SyncWriter(&logs))
+	t.Cleanup(func() { log.Logger = prev })
+
+	fake := stubDatabase(t)
+	now := time.Now()
+	fake.OnRows("FROM processing_jobs", []string{
+		"id", "status", "total_users", "processed_users", "successful_users",
+		"failed_users", "max_concurrency", "started_at", "completed_at",
+		"errors", "failed_targets", "parent_job_id", "created_at", "updated_at",
+	}, []driver.Value{"00000000-0000-0000-0000-000000000001", "completed", 1, 1, 1, 0, 1, now, now, nil, nil, nil, now, now})
+	fake.OnRows("FROM instagram_users WHERE username", []string{
+		"id", "username", "full_name", "biography", "is_verified",
+		"is_business_account", "is_professional_account", "is_private",
+		"category_name", "followers", "following", "posts", "profile_pic_url",
+		"profile_pic_storage_url", "scraped_at", "created_at", "updated_at",
+	}, []driver.Value{"1", "alice", nil, nil, false, false, false, false, nil, 100, 10, 5, nil, nil, now, now, now})
+
+	// A real server, since recorders don't support write deadlines
+	cfg := utils.LoadConfig()
+	cfg.GzipMinBytes = 1
+	server := httptest.NewServer(InitRouter(cfg))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"progress stream", http.MethodGet, "/api/v1/instagram/jobs/00000000-0000-0000-0000-000000000001/progress", ""},
+		{"sync batch", http.MethodPost, "/api/v1/instagram/users/batch", `{"usernames":["alice"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if strings.Contains(logs.String(), "write deadline") {
+				t.Errorf("setting the write deadline failed: %s", logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/external"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessTimeout bounds each dependency check in ReadyHandler
+const readinessTimeout = 3 * time.Second
+
+// Dependency checks used by ReadyHandler
+var (
+	checkDatabase  = database.IsHealthyContext
+	checkRocketAPI = external.Ping
+)
+
+// HealthHandler is a liveness probe; it reports ok as long as the process
+// is serving requests
+func HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "ok",
+		"service":   "instagram-user-processor",
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// ReadyHandler is a readiness probe; it returns 503 listing the failed
+// dependencies when the database or RocketAPI is unavailable
+func ReadyHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"database":  checkDatabase,
+		"rocketapi": checkRocketAPI,
+	}
+
+	failed := make(map[string]string)
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			failed[name] = err.Error()
+		}
+	}
+
+	if len(failed) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":    "unavailable",
+			"failed":    failed,
+			"timestamp": time.Now().Unix(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "ready",
+		"timestamp": time.Now().Unix(),
+	})
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/database/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stubDatabase installs a fake database.DB for the duration of the test
+func stubDatabase(t *testing.T) *dbtest.DB {
+	t.Helper()
+	fake := dbtest.New()
+	prev := database.DB
+	database.DB = fake.Open()
+	t.Cleanup(func() {
+		database.DB.Close()
+		database.DB = prev
+	})
+	return fake
+}
+
+func serveReady(t *testing.T) (int, map[string]interface{}) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ready", ReadyHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, body
+}
+
+func stubRocketAPICheck(t *testing.T, err error) {
+	t.Helper()
+	prev := checkRocketAPI
+	checkRocketAPI = func(context.Context) error { return err }
+	t.Cleanup(func() { checkRocketAPI = prev })
+}
+
+func TestReadyHandlerReportsFailedDatabasePing(t *testing.T) {
+	fake := stubDatabase(t)
+	fake.SetPingError(errors.New("connection refused"))
+	stubRocketAPICheck(t, nil)
+
+	status, body := serveReady(t)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	failed, _ := body["failed"].(map[string]interface{})
+	if failed["database"] != "connection refused" {
+		t.Errorf("failed = %v, want database: connection refused", body["failed"])
+	}
+	if _, ok := failed["rocketapi"]; ok {
+		t.Error("rocketapi reported failed")
+	}
+}
+
+func TestReadyHandlerReady(t *testing.T) {
+	stubDatabase(t)
+	stubRocketAPICheck(t, nil)
+
+	if status, body := serveReady(t); status != http.StatusOK || body["status"] != "ready" {
+		t.Errorf("got %d %v, want 200 ready", status, body)
+	}
+}
+
+func TestCheckDatabaseHonorsContext(t *testing.T) {
+	stubDatabase(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := checkDatabase(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("checkDatabase with cancelled ctx = %v, want context.Canceled", err)
+	}
+}
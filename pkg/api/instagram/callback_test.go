@@ -0,0 +1,116 @@
+package instagram
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/external"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signedCallback is a job callback as received, with its signature headers
+type signedCallback struct {
+	signature, timestamp string
+	body                 []byte
+}
+
+// useWebhooks installs a webhook client signing with secret and allowing
+// loopback receivers, restoring disabled callbacks when the test ends
+func useWebhooks(t *testing.T, secret string) {
+	t.Helper()
+	external.SetWebhookClient(external.NewWebhookClient(external.WebhookOptions{Secret: secret, AllowPrivate: true}))
+	t.Cleanup(func() { external.SetWebhookClient(nil) })
+}
+
+func TestAsyncBatchDeliversSignedCallback(t *testing.T) {
+	store := newTestStore(t)
+	useMockScraper(t, &MockScraper{Users: map[string]*database.User{
+		"alice": {ID: "1", Username: "alice"},
+	}})
+	useWebhooks(t, "s3cret")
+
+	received := make(chan signedCallback, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- signedCallback{
+			signature: r.Header.Get(external.WebhookSignatureHeader),
+			timestamp: r.Header.Get(external.WebhookTimestampHeader),
+			body:      body,
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames":    []string{"alice", "ghost"},
+		"async":        true,
+		"callback_url": receiver.URL + "/hooks/batch",
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var accepted BatchJobResponse
+	decode(t, w, &accepted)
+
+	var cb signedCallback
+	select {
+	case cb = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not delivered")
+	}
+
+	want := external.SignWebhookPayload([]byte("s3cret"), cb.timestamp, cb.body)
+	if !hmac.Equal([]byte(cb.signature), []byte(want)) {
+		t.Errorf("signature = %q, want %q", cb.signature, want)
+	}
+
+	var payload JobCallback
+	if err := json.Unmarshal(cb.body, &payload); err != nil {
+		t.Fatalf("callback body %s: %v", cb.body, err)
+	}
+	if payload.JobID != accepted.JobID || payload.Status != database.JobStatusCompleted {
+		t.Errorf("callback for job %s status %q, want job %s completed", payload.JobID, payload.Status, accepted.JobID)
+	}
+	if payload.TotalUsers != 2 || payload.SuccessfulUsers != 1 || payload.FailedUsers != 1 || payload.Errors["ghost"] == "" {
+		t.Errorf("callback = %+v, want 1 successful and ghost failed", payload)
+	}
+	if job := store.job(accepted.JobID); job.Status != database.JobStatusCompleted {
+		t.Errorf("job status = %q, want completed", job.Status)
+	}
+}
+
+func TestBatchRejectsInvalidCallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		webhooks bool
+		async    bool
+		url      string
+	}{
+		{"sync batch", true, false, "http://127.0.0.1:9/hooks"},
+		{"not http", true, true, "ftp://93.184.216.34/hooks"},
+		{"callbacks disabled", false, true, "https://93.184.216.34/hooks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			if tt.webhooks {
+				useWebhooks(t, "s3cret")
+			}
+
+			w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+				"usernames":    []string{"alice"},
+				"async":        tt.async,
+				"callback_url": tt.url,
+			})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+			if n := len(store.Calls("INSERT INTO processing_jobs")); n != 0 {
+				t.Errorf("created %d jobs, want none", n)
+			}
+		})
+	}
+}
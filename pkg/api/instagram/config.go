@@ -0,0 +1,48 @@
+package instagram
+
+import (
+	"instagram-user-processor/pkg/cache"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/utils"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// config holds the application configuration used by the handlers
+var config = &utils.Config{
+	MaxBodyBytes:       64 * 1024,
+	MaxBatchSize:       100,
+	MaxConcurrency:     5,
+	MaxSummaryFailures: 50,
+	StatsQueryTimeout:  10,
+}
+
+// userCache caches users by username in front of the database; nil when disabled
+var userCache *cache.TTLCache[string, *database.User]
+
+// scraper fetches users missing from the database
+var scraper external.Scraper = external.DefaultScraper
+
+// tracer records the spans of user fetches, resolved through the global
+// provider so it picks up the exporter installed at startup
+var tracer = otel.Tracer("instagram-user-processor/pkg/api/instagram")
+
+// Init configures the Instagram handlers
+func Init(cfg *utils.Config) {
+	config = cfg
+
+	if cfg.CacheTTLSeconds > 0 {
+		userCache = cache.NewTTLCache[string, *database.User](time.Duration(cfg.CacheTTLSeconds)*time.Second, cfg.CacheMaxEntries)
+	}
+}
+
+// SetScraper replaces the scraper used by the handlers, e.g. with a stub
+// in tests. A nil scraper restores the RocketAPI default.
+func SetScraper(s external.Scraper) {
+	if s == nil {
+		s = external.DefaultScraper
+	}
+	scraper = s
+}
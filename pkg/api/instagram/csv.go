@@ -0,0 +1,53 @@
+package instagram
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchCSVHeader is the column row of CSV batch results
+var batchCSVHeader = []string{"username", "status", "id", "full_name", "followers", "following", "posts", "error"}
+
+// wantsCSV reports whether the client asked for CSV with ?format=csv or an
+// Accept header preferring text/csv
+func wantsCSV(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return strings.EqualFold(format, "csv")
+	}
+	return c.NegotiateFormat(gin.MIMEJSON, "text/csv") == "text/csv"
+}
+
+// writeBatchCSV writes batch results as a CSV attachment, one row per user.
+// Fields are quoted by encoding/csv, so commas and newlines in names are
+// preserved.
+func writeBatchCSV(c *gin.Context, results []UserResult) {
+	filename := fmt.Sprintf("batch-%s.csv", time.Now().UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write(batchCSVHeader)
+	for _, result := range results {
+		row := []string{result.Username, result.Status, "", "", "", "", "", result.Error}
+		if user := result.User; user != nil {
+			row[2] = user.ID
+			row[3] = user.FullName.String
+			row[4] = strconv.FormatInt(user.Followers, 10)
+			row[5] = strconv.FormatInt(user.Following, 10)
+			row[6] = strconv.FormatInt(user.Posts, 10)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		c.Error(err)
+	}
+}
@@ -0,0 +1,106 @@
+package instagram
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"instagram-user-processor/pkg/database"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWantsCSV(t *testing.T) {
+	tests := []struct {
+		target, accept string
+		want           bool
+	}{
+		{"/batch", "", false},
+		{"/batch?format=csv", "", true},
+		{"/batch?format=CSV", "", true},
+		{"/batch?format=json", "text/csv", false},
+		{"/batch", "text/csv", true},
+		{"/batch", "application/json", false},
+		{"/batch", "application/json, text/csv;q=0.5", false},
+		{"/batch", "*/*", false},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, tt.target, nil)
+		if tt.accept != "" {
+			c.Request.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsCSV(c); got != tt.want {
+			t.Errorf("wantsCSV(%s, Accept %q) = %v, want %v", tt.target, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestBatchCSVExport(t *testing.T) {
+	for _, tt := range []struct{ name, target, accept string }{
+		{"format query", "/batch?format=csv", ""},
+		{"accept header", "/batch", "text/csv"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			useMockScraper(t, &MockScraper{Users: map[string]*database.User{
+				"alice": {ID: "1", Username: "alice", FullName: sql.NullString{String: "Alice, \"Al\"\nSmith", Valid: true}, Followers: 1200, Following: 30, Posts: 7},
+				"bob":   {ID: "2", Username: "bob", Followers: 5},
+			}})
+
+			r := gin.New()
+			r.POST("/batch", BatchProcessUsersHandler)
+			body, _ := json.Marshal(map[string]interface{}{"usernames": []string{"alice", "ghost", "bob"}})
+			req := httptest.NewRequest(http.MethodPost, tt.target, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want text/csv", ct)
+			}
+			if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="batch-`) || !strings.HasSuffix(cd, `.csv"`) {
+				t.Errorf("Content-Disposition = %q, want a CSV attachment", cd)
+			}
+
+			records, err := csv.NewReader(w.Body).ReadAll()
+			if err != nil {
+				t.Fatalf("response isn't valid CSV: %v", err)
+			}
+			if len(records) != 4 {
+				t.Fatalf("got %d records, want a header and 3 rows: %q", len(records), records)
+			}
+			if !slices.Equal(records[0], batchCSVHeader) {
+				t.Errorf("header = %q, want %q", records[0], batchCSVHeader)
+			}
+
+			rows := map[string][]string{}
+			for _, record := range records[1:] {
+				rows[record[0]] = record
+			}
+			want := map[string][]string{
+				"alice": {"alice", "success", "1", "Alice, \"Al\"\nSmith", "1200", "30", "7", ""},
+				"bob":   {"bob", "success", "2", "", "5", "0", "0", ""},
+			}
+			for username, row := range want {
+				if !slices.Equal(rows[username], row) {
+					t.Errorf("%s row = %q, want %q", username, rows[username], row)
+				}
+			}
+			if ghost := rows["ghost"]; ghost == nil || ghost[1] != "error" || ghost[2] != "" || ghost[7] == "" {
+				t.Errorf("ghost row = %q, want an error row without user fields", ghost)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package instagram
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/api/apierror"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errBodyTooLarge marks decodeJSONBody failures caused by the body size cap
+var errBodyTooLarge = errors.New("request body too large")
+
+// requireJSON checks the request declares a JSON body, writing a 415 and
+// returning false otherwise. Parameters such as charset are ignored.
+func requireJSON(c *gin.Context) bool {
+	if c.ContentType() == "application/json" {
+		return true
+	}
+	apierror.Respond(c, http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType, "Content-Type must be application/json")
+	return false
+}
+
+// decodeJSONBody decodes a single JSON object from the request body into dst,
+// enforcing the configured body size cap (reading stops at the cap, and the
+// error wraps errBodyTooLarge) and, in strict mode, rejecting unknown fields
+func decodeJSONBody(c *gin.Context, dst interface{}) error {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, config.MaxBodyBytes)
+
+	decoder := json.NewDecoder(c.Request.Body)
+	if config.StrictJSON {
+		decoder.DisallowUnknownFields()
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if err := decoder.Decode(dst); err != nil {
+		if errors.As(err, &maxBytesErr) {
+			return fmt.Errorf("%w: limit is %d bytes", errBodyTooLarge, maxBytesErr.Limit)
+		}
+		if errors.Is(err, io.EOF) {
+			return errors.New("request body is empty")
+		}
+		return err
+	}
+
+	// Reject trailing data after the first JSON value, which also counts
+	// towards the size cap
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		if errors.As(err, &maxBytesErr) {
+			return fmt.Errorf("%w: limit is %d bytes", errBodyTooLarge, maxBytesErr.Limit)
+		}
+		return errors.New("request body must contain a single JSON object")
+	}
+
+	return nil
+}
+
+// respondDecodeError writes the response for a decodeJSONBody failure: 413
+// for an oversized body, 400 otherwise
+func respondDecodeError(c *gin.Context, err error) {
+	if errors.Is(err, errBodyTooLarge) {
+		apierror.Respond(c, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, "request body too large", gin.H{
+			"details": err.Error(),
+		})
+		return
+	}
+	apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "invalid request format", gin.H{
+		"details": err.Error(),
+	})
+}
@@ -0,0 +1,189 @@
+package instagram
+
+import (
+	"instagram-user-processor/pkg/api/apierror"
+	"instagram-user-processor/pkg/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// postBatch posts a raw body to the batch handler, without a Content-Type
+// when contentType is empty
+func postBatch(body, contentType string) *httptest.ResponseRecorder {
+	return postRaw(BatchProcessUsersHandler, body, contentType)
+}
+
+// postRaw posts a raw body to handler
+func postRaw(handler gin.HandlerFunc, body, contentType string) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.POST("/batch", handler)
+
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestBatchBodyDecoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+		body   string
+		want   int
+	}{
+		{"valid", false, `{"usernames":["alice"]}`, http.StatusOK},
+		{"unknown field allowed", false, `{"usernames":["alice"],"priority":"high"}`, http.StatusOK},
+		{"unknown field in strict mode", true, `{"usernames":["alice"],"priority":"high"}`, http.StatusBadRequest},
+		{"known fields in strict mode", true, `{"usernames":["alice"],"max_concurrency":2}`, http.StatusOK},
+		{"malformed", false, `{"usernames":["alice"`, http.StatusBadRequest},
+		{"empty", false, ``, http.StatusBadRequest},
+		{"trailing data", false, `{"usernames":["alice"]} {"usernames":["bob"]}`, http.StatusBadRequest},
+		{"oversized", false, `{"usernames":["` + strings.Repeat("a", 2048) + `"]}`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			stubScraper(t, scrapeAs)
+			useConfig(t, func(cfg *utils.Config) {
+				cfg.StrictJSON = tt.strict
+				cfg.MaxBodyBytes = 1024
+			})
+
+			w := postBatch(tt.body, "application/json")
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestBatchRequiresJSONContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		want        int
+	}{
+		{"missing", "", http.StatusUnsupportedMediaType},
+		{"plain text", "text/plain", http.StatusUnsupportedMediaType},
+		{"form", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"xml", "application/xml", http.StatusUnsupportedMediaType},
+		{"json", "application/json", http.StatusOK},
+		{"json with charset", "application/json; charset=utf-8", http.StatusOK},
+	}
+
+	handlers := map[string]gin.HandlerFunc{
+		"batch":  BatchProcessUsersHandler,
+		"stream": StreamBatchUsersHandler,
+	}
+	for endpoint, handler := range handlers {
+		for _, tt := range tests {
+			t.Run(endpoint+"/"+tt.name, func(t *testing.T) {
+				newTestStore(t)
+				calls := countingScraper(t)
+
+				w := postRaw(handler, `{"usernames":["alice"]}`, tt.contentType)
+				if w.Code != tt.want {
+					t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body.String())
+				}
+				if tt.want != http.StatusUnsupportedMediaType {
+					return
+				}
+				var body struct {
+					Code    string `json:"code"`
+					Message string `json:"message"`
+				}
+				decode(t, w, &body)
+				if body.Code != apierror.CodeUnsupportedMediaType || !strings.Contains(body.Message, "application/json") {
+					t.Errorf("body = %+v, want an UNSUPPORTED_MEDIA_TYPE error naming application/json", body)
+				}
+				if n := atomic.LoadInt32(calls); n != 0 {
+					t.Errorf("scraped %d users for a rejected request", n)
+				}
+			})
+		}
+	}
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	r    io.Reader
+	read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestBodyOverLimitIs413BeforeFullRead(t *testing.T) {
+	const limit = 1024
+	// A 4 MB array of usernames, far above both the body and batch limits
+	huge := `{"usernames":[` + strings.Repeat(`"abcdefgh",`, 400000) + `"last"]}`
+
+	handlers := map[string]gin.HandlerFunc{
+		"batch":            BatchProcessUsersHandler,
+		"stream":           StreamBatchUsersHandler,
+		"refresh if stale": RefreshIfStaleHandler,
+	}
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			newTestStore(t)
+			calls := countingScraper(t)
+			useConfig(t, func(cfg *utils.Config) { cfg.MaxBodyBytes = limit })
+
+			r := gin.New()
+			r.POST("/batch", handler)
+			body := &countingReader{r: strings.NewReader(huge)}
+			req := httptest.NewRequest(http.MethodPost, "/batch", body)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d, want 413, body %s", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want a JSON error", ct)
+			}
+			var response struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			decode(t, w, &response)
+			if response.Code != apierror.CodePayloadTooLarge {
+				t.Errorf("code = %q, want %q", response.Code, apierror.CodePayloadTooLarge)
+			}
+			if body.read > 64*1024 {
+				t.Errorf("read %d bytes of the body, want reading to stop near the %d byte limit", body.read, limit)
+			}
+			if n := atomic.LoadInt32(calls); n != 0 {
+				t.Errorf("scraped %d users for an oversized body", n)
+			}
+		})
+	}
+}
+
+func TestBodyAtLimitIsAccepted(t *testing.T) {
+	newTestStore(t)
+	stubScraper(t, scrapeAs)
+	body := `{"usernames":["alice"]}`
+	useConfig(t, func(cfg *utils.Config) { cfg.MaxBodyBytes = int64(len(body)) })
+
+	if w := postBatch(body, "application/json"); w.Code != http.StatusOK {
+		t.Errorf("status = %d for a body at the limit, want 200 (body %s)", w.Code, w.Body.String())
+	}
+	if w := postBatch(body+" ", "application/json"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d for a body one byte over, want 413", w.Code)
+	}
+}
@@ -0,0 +1,56 @@
+package instagram
+
+import (
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/api/apierror"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/utils"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// respondError writes a JSON error response with the default code for
+// status. In development the underlying error is included in the details
+// field to speed up debugging; in other environments it stays hidden.
+func respondError(c *gin.Context, status int, message string, err error) {
+	var extra gin.H
+	if err != nil && config.IsDevelopment() {
+		extra = gin.H{"details": err.Error()}
+	}
+	apierror.Respond(c, status, apierror.CodeForStatus(status), message, extra)
+}
+
+// respondRateLimited writes a 429 for a RocketAPI rate limit rejection,
+// passing on its Retry-After hint so clients know when to try again
+func respondRateLimited(c *gin.Context, err error) {
+	if retryAfter := external.RetryAfterHint(err); retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	respondError(c, http.StatusTooManyRequests, "RocketAPI rate limit exceeded, try again later", err)
+}
+
+// respondScrapeError writes the response for a failed RocketAPI scrape of
+// identifier: 400 for an invalid username, 404 for an unknown user, 429 for
+// a rate limit, 504 for a timeout, 502 for any other upstream failure and
+// 500 for everything else
+func respondScrapeError(c *gin.Context, err error, identifier string) {
+	var notFound external.UserNotFoundError
+	switch {
+	case errors.Is(err, utils.ErrInvalidUsername):
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+	case errors.As(err, &notFound):
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeUserNotFound, fmt.Sprintf("user not found: %s", identifier))
+	case external.IsRateLimited(err):
+		respondRateLimited(c, err)
+	case external.IsTimeout(err):
+		respondError(c, http.StatusGatewayTimeout, "RocketAPI timed out", err)
+	case external.IsUpstream(err):
+		respondError(c, http.StatusBadGateway, "failed to scrape user", err)
+	default:
+		respondError(c, http.StatusInternalServerError, "failed to scrape user", err)
+	}
+}
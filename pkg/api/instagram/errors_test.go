@@ -0,0 +1,337 @@
+package instagram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/api/apierror"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/utils"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetUserHandlerScrapeErrorStatuses(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"not found", external.UserNotFoundError{Username: "ghost", Message: "user not found"}, http.StatusNotFound, apierror.CodeUserNotFound},
+		{"rate limited", external.RateLimitedError{RetryAfter: 3 * time.Second}, http.StatusTooManyRequests, apierror.CodeRateLimited},
+		{"timeout", fmt.Errorf("HTTP request failed: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, apierror.CodeUpstreamTimeout},
+		{"retries exhausted", external.RetryError{Operation: "ScrapeInstagramUser", Attempts: []external.RetryAttempt{
+			{Attempt: 1, Err: external.UpstreamError{StatusCode: 503}},
+		}}, http.StatusBadGateway, apierror.CodeUpstreamError},
+		{"upstream 5xx", external.UpstreamError{StatusCode: 500}, http.StatusBadGateway, apierror.CodeUpstreamError},
+		{"circuit open", external.ErrCircuitOpen, http.StatusBadGateway, apierror.CodeUpstreamError},
+		{"internal", errors.New("failed to parse user data"), http.StatusInternalServerError, apierror.CodeInternalError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			stubScraper(t, func(context.Context, string) (*database.User, error) {
+				return nil, tt.err
+			})
+
+			w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/ghost?stats=false", nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			decode(t, w, &body)
+			if body.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestGetUserHandlerRateLimitSetsRetryAfter(t *testing.T) {
+	newTestStore(t)
+	stubScraper(t, func(context.Context, string) (*database.User, error) {
+		return nil, external.RateLimitedError{RetryAfter: 2500 * time.Millisecond}
+	})
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/ghost?stats=false", nil)
+	if got := w.Header().Get("Retry-After"); got != "3" {
+		t.Errorf("Retry-After = %q, want %q", got, "3")
+	}
+}
+
+func TestGetUserHandlerRejectsInvalidUsername(t *testing.T) {
+	newTestStore(t)
+	scraped := false
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		scraped = true
+		return scrapeAs(ctx, username)
+	})
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/bad..name?stats=false", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if scraped {
+		t.Error("invalid username was scraped")
+	}
+}
+
+func TestGetUserHandlerDatabaseErrorIs500(t *testing.T) {
+	store := newTestStore(t)
+	store.OnError("FROM instagram_users WHERE username", errors.New("connection refused"))
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice?stats=false", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestGetUserHandlerNormalizesUsername(t *testing.T) {
+	newTestStore(t, testUser("1", "alice"))
+	stubScraper(t, func(context.Context, string) (*database.User, error) {
+		t.Error("stored user was scraped")
+		return nil, errors.New("unexpected scrape")
+	})
+
+	for _, target := range []string{"/user/Alice", "/user/@ALICE"} {
+		w := serve(GetUserHandler, http.MethodGet, "/user/:username", target+"?stats=false", nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d (body %s)", target, w.Code, http.StatusOK, w.Body.String())
+		}
+	}
+}
+
+func TestDatabaseErrorDetailsOnlyInDevelopment(t *testing.T) {
+	tests := []struct {
+		environment string
+		wantDetails bool
+	}{
+		{"development", true},
+		{"Development", true},
+		{"staging", false},
+		{"production", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.environment, func(t *testing.T) {
+			useConfig(t, func(cfg *utils.Config) { cfg.Environment = tt.environment })
+			store := newTestStore(t)
+			store.OnError("FROM instagram_users WHERE id = $1", errors.New("pq: relation \"instagram_users\" does not exist"))
+
+			w := serve(DeleteUserHandler, http.MethodDelete, "/users/:id", "/users/1", nil)
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			var body struct {
+				Message string  `json:"message"`
+				Details *string `json:"details"`
+			}
+			decode(t, w, &body)
+			if body.Message != "failed to delete user" {
+				t.Errorf("message = %q", body.Message)
+			}
+			switch {
+			case tt.wantDetails && (body.Details == nil || !strings.Contains(*body.Details, "does not exist")):
+				t.Errorf("details = %v, want the database error", body.Details)
+			case !tt.wantDetails && body.Details != nil:
+				t.Errorf("details = %q, want none", *body.Details)
+			}
+			if !tt.wantDetails && strings.Contains(w.Body.String(), "does not exist") {
+				t.Errorf("response leaks the database error: %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetUserHandlerWithMockScraper(t *testing.T) {
+	newTestStore(t)
+	mock := &MockScraper{Users: map[string]*database.User{"alice": {ID: "1", Username: "alice", Followers: 42}}}
+	useMockScraper(t, mock)
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice?stats=false", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response UserResponse
+	decode(t, w, &response)
+	if response.User.ID != "1" || response.User.Followers != 42 || response.Meta.Source != "rocketapi" {
+		t.Errorf("got user %s with %d followers from %q, want the mock's user 1", response.User.ID, response.User.Followers, response.Meta.Source)
+	}
+
+	w = serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/ghost?stats=false", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown user status = %d, want 404", w.Code)
+	}
+
+	mock.Err = errors.New("connection reset")
+	w = serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/bob?stats=false", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("scrape failure status = %d, want 500", w.Code)
+	}
+
+	if want := []string{"alice", "ghost", "bob"}; strings.Join(mock.Calls, ",") != strings.Join(want, ",") {
+		t.Errorf("scraped %v, want %v", mock.Calls, want)
+	}
+}
+
+func TestBatchHandlerWithMockScraper(t *testing.T) {
+	newTestStore(t)
+	useMockScraper(t, &MockScraper{Users: map[string]*database.User{
+		"alice": {ID: "1", Username: "alice"},
+		"bob":   {ID: "2", Username: "bob"},
+	}})
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice", "ghost", "bob"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchResponse
+	decode(t, w, &response)
+	got := map[string]string{}
+	for _, result := range response.Results {
+		got[result.Identifier] = result.Status
+	}
+	want := map[string]string{"alice": "success", "ghost": "error", "bob": "success"}
+	for username, status := range want {
+		if got[username] != status {
+			t.Errorf("%s status = %q, want %q", username, got[username], status)
+		}
+	}
+
+	// Every lookup failing fails every user in the batch
+	newTestStore(t)
+	useMockScraper(t, &MockScraper{Err: external.UpstreamError{StatusCode: 502}})
+	w = serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice", "bob"},
+	})
+	decode(t, w, &response)
+	if response.Summary.Failed != 2 || response.Summary.Successful != 0 {
+		t.Errorf("summary successful=%d failed=%d, want 0/2", response.Summary.Successful, response.Summary.Failed)
+	}
+}
+
+func TestRefreshByIDRateLimitIs429(t *testing.T) {
+	store := newTestStore(t)
+	SetScraper(idScraper{
+		ScraperFunc: scrapeAs,
+		byID: func(context.Context, string) (*database.User, error) {
+			return nil, external.RateLimitedError{RetryAfter: 5 * time.Second, Body: "quota exceeded"}
+		},
+	})
+
+	w := serve(RefreshUserByIDHandler, http.MethodGet, "/users/:id/refresh", "/users/42/refresh", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusTooManyRequests, w.Body.String())
+	}
+	if got := w.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want %q", got, "5")
+	}
+	if n := len(store.Calls("INSERT INTO instagram_users")); n != 0 {
+		t.Errorf("stored %d users, want none", n)
+	}
+}
+
+func TestBatchReportsRateLimitedUsersDistinctly(t *testing.T) {
+	newTestStore(t)
+	fastTransientRetry(t)
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		switch username {
+		case "bob":
+			return nil, external.RateLimitedError{Body: "quota exceeded"}
+		case "carol":
+			return nil, external.UpstreamError{StatusCode: 500}
+		}
+		return scrapeAs(ctx, username)
+	})
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice", "bob", "carol"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchResponse
+	decode(t, w, &response)
+	got := map[string]string{}
+	for _, result := range response.Results {
+		got[result.Identifier] = result.Status
+	}
+	want := map[string]string{"alice": "success", "bob": "rate_limited", "carol": "error"}
+	for username, status := range want {
+		if got[username] != status {
+			t.Errorf("%s status = %q, want %q", username, got[username], status)
+		}
+	}
+	if s := response.Summary; s.Successful != 1 || s.Failed != 2 || s.RateLimited != 1 {
+		t.Errorf("summary successful=%d failed=%d rate_limited=%d, want 1/2/1", s.Successful, s.Failed, s.RateLimited)
+	}
+}
+
+func TestErrorResponsesCarryCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    gin.HandlerFunc
+		method     string
+		route      string
+		target     string
+		body       interface{}
+		wantStatus int
+		wantCode   string
+	}{
+		{"invalid username", GetUserHandler, http.MethodGet, "/user/:username", "/user/bad..name", nil, http.StatusBadRequest, apierror.CodeInvalidRequest},
+		{"invalid limit", ListUsersHandler, http.MethodGet, "/users", "/users?limit=0", nil, http.StatusBadRequest, apierror.CodeInvalidRequest},
+		{"empty batch", BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{"usernames": []string{}}, http.StatusBadRequest, apierror.CodeInvalidRequest},
+		{"unknown user id", GetUserPostsHandler, http.MethodGet, "/users/:id/posts", "/users/404/posts", nil, http.StatusNotFound, apierror.CodeUserNotFound},
+		{"unknown user to delete", DeleteUserHandler, http.MethodDelete, "/users/:id", "/users/404", nil, http.StatusNotFound, apierror.CodeUserNotFound},
+		{"unknown job", GetJobHandler, http.MethodGet, "/jobs/:id", "/jobs/00000000-0000-0000-0000-000000000000", nil, http.StatusNotFound, apierror.CodeJobNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+
+			w := serve(tt.handler, tt.method, tt.route, tt.target, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			var body struct {
+				Code       string `json:"code"`
+				HTTPStatus int    `json:"http_status"`
+				Message    string `json:"message"`
+				Error      string `json:"error"`
+			}
+			decode(t, w, &body)
+			if body.Code != tt.wantCode || body.HTTPStatus != tt.wantStatus {
+				t.Errorf("code = %q, http_status = %d, want %q and %d", body.Code, body.HTTPStatus, tt.wantCode, tt.wantStatus)
+			}
+			if body.Message == "" || body.Error != body.Message {
+				t.Errorf("message = %q, error = %q, want the same non-empty text", body.Message, body.Error)
+			}
+		})
+	}
+}
+
+func TestDatabaseErrorIsInternalErrorCode(t *testing.T) {
+	store := newTestStore(t)
+	store.OnError("FROM instagram_users WHERE username", errors.New("connection refused"))
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice?stats=false", nil)
+	var body struct {
+		Code string `json:"code"`
+	}
+	decode(t, w, &body)
+	if w.Code != http.StatusInternalServerError || body.Code != apierror.CodeInternalError {
+		t.Errorf("got %d %q, want %d %q", w.Code, body.Code, http.StatusInternalServerError, apierror.CodeInternalError)
+	}
+}
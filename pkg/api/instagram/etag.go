@@ -0,0 +1,38 @@
+package instagram
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"instagram-user-processor/pkg/database"
+	"strings"
+)
+
+// userETag returns a strong ETag for the response to a user request. It
+// changes whenever the stored user is written (updated_at), re-scraped
+// (scraped_at) or gets a new profile picture upload, and differs per query
+// string since that selects the stats included. Times are truncated to
+// microseconds so a freshly scraped user matches its stored copy.
+func userETag(user *database.User, rawQuery string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%d\n%s\n%s",
+		user.ID,
+		user.UpdatedAt.UnixMicro(),
+		user.ScrapedAt.UnixMicro(),
+		user.ProfilePicStorageURL.String,
+		rawQuery,
+	)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag. As
+// required for If-None-Match, weak and strong tags compare equal.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
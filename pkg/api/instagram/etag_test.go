@@ -0,0 +1,119 @@
+package instagram
+
+import (
+	"context"
+	"database/sql"
+	"instagram-user-processor/pkg/database"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getUser serves GET target, sending ifNoneMatch when set
+func getUser(target, ifNoneMatch string) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.GET("/user/:username", GetUserHandler)
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestGetUserETagThenNotModified(t *testing.T) {
+	stored := testUser("1", "alice")
+	stored.ScrapedAt = time.Now().Add(-time.Hour)
+	newTestStore(t, stored)
+	stubScraper(t, func(context.Context, string) (*database.User, error) {
+		return testUser("1", "alice"), nil
+	})
+
+	w := getUser("/user/alice?stats=false", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		t.Fatalf("ETag = %q, want a quoted strong tag", etag)
+	}
+
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w = getUser("/user/alice?stats=false", ifNoneMatch)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: status = %d, want 304", ifNoneMatch, w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: 304 has body %q", ifNoneMatch, w.Body.String())
+		}
+		if got := w.Header().Get("ETag"); got != etag {
+			t.Errorf("If-None-Match %s: ETag = %q, want %q", ifNoneMatch, got, etag)
+		}
+	}
+
+	if w = getUser("/user/alice?stats=false", `"stale"`); w.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match: status = %d, want 200", w.Code)
+	}
+
+	// A re-scrape changes the tag, so the old one no longer matches
+	if w = getUser("/user/alice?stats=false&refresh=true", ""); w.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d, body %s", w.Code, w.Body.String())
+	}
+	w = getUser("/user/alice?stats=false", etag)
+	if w.Code != http.StatusOK {
+		t.Errorf("status after refresh = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("ETag"); got == "" || got == etag {
+		t.Errorf("ETag after refresh = %q, want a new tag", got)
+	}
+}
+
+func TestGetUserNotModifiedSkipsStatsQuery(t *testing.T) {
+	user := testUser("1", "alice")
+	store := newTestStore(t, user)
+
+	w := getUser("/user/alice", userETag(user, ""))
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304 (body %s)", w.Code, w.Body.String())
+	}
+	if n := len(store.Calls("json_agg")); n != 0 {
+		t.Errorf("ran the stats query %d times, want none", n)
+	}
+}
+
+func TestUserETag(t *testing.T) {
+	now := time.Now()
+	base := &database.User{ID: "1", Username: "alice", ScrapedAt: now, UpdatedAt: now}
+	etag := userETag(base, "")
+
+	// Postgres keeps microseconds, so the stored copy tags the same
+	stored := *base
+	stored.ScrapedAt = now.Truncate(time.Microsecond)
+	stored.UpdatedAt = now.Truncate(time.Microsecond)
+	if got := userETag(&stored, ""); got != etag {
+		t.Errorf("stored copy ETag = %s, want %s", got, etag)
+	}
+
+	changes := map[string]func(u *database.User){
+		"updated":    func(u *database.User) { u.UpdatedAt = u.UpdatedAt.Add(time.Second) },
+		"re-scraped": func(u *database.User) { u.ScrapedAt = u.ScrapedAt.Add(time.Second) },
+		"picture": func(u *database.User) {
+			u.ProfilePicStorageURL = sql.NullString{String: "https://cdn/p.jpg", Valid: true}
+		},
+		"another id": func(u *database.User) { u.ID = "2" },
+	}
+	for name, change := range changes {
+		changed := *base
+		change(&changed)
+		if userETag(&changed, "") == etag {
+			t.Errorf("%s user has the same ETag", name)
+		}
+	}
+	if userETag(base, "stats=false") == etag {
+		t.Error("query string doesn't change the ETag")
+	}
+}
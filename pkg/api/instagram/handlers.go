@@ -1,181 +1,1488 @@
 package instagram
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"instagram-user-processor/pkg/api/apierror"
 	"instagram-user-processor/pkg/database"
 	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/metrics"
+	"instagram-user-processor/pkg/queue"
+	"instagram-user-processor/pkg/tracing"
+	"instagram-user-processor/pkg/utils"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // GetUserHandler handles single user requests - WORKING IMPLEMENTATION
-// GET /api/v1/instagram/user/:username
+// GET /api/v1/instagram/user/:username?stats=true&refresh=false&max_age=24h
 func GetUserHandler(c *gin.Context) {
-	username := c.Param("username")
-	if username == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "username is required",
+	// Normalize first so "/user/Alice" and "/user/alice" share a cache entry
+	username, err := utils.NormalizeUsername(c.Param("username"))
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	statsOpts, err := parseStatsOptions(c)
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	// ?stats=false skips the stats query for callers that only need the user
+	includeStats, err := strconv.ParseBool(c.DefaultQuery("stats", "true"))
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "stats must be true or false")
+		return
+	}
+
+	fetchOpts, err := parseFetchOptions(c)
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	user, source, _, err := fetchUser(c.Request.Context(), username, fetchOpts)
+	if err != nil {
+		if errors.Is(err, errDatabase) {
+			respondError(c, http.StatusInternalServerError, "database error", err)
+			return
+		}
+		respondScrapeError(c, err, username)
+		return
+	}
+
+	// Unchanged users are answered with 304 before the stats query runs
+	etag := userETag(user, c.Request.URL.RawQuery)
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	response := buildUserResponse(c.Request.Context(), user, source, includeStats, statsOpts)
+	response.Meta.RefreshFailed = source != "rocketapi" && fetchOpts.wantsRefresh(user)
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UserExistsHandler reports whether a username resolves, answering from the
+// cache or database when possible and scraping otherwise. Scraped users are
+// stored, but no stats are computed and no profile picture is uploaded.
+// GET|HEAD /api/v1/instagram/user/:username/exists
+func UserExistsHandler(c *gin.Context) {
+	username, err := utils.NormalizeUsername(c.Param("username"))
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	user, source, _, err := fetchUser(c.Request.Context(), username, fetchOptions{SkipUpload: true})
+	if err != nil {
+		if errors.Is(err, errDatabase) {
+			respondError(c, http.StatusInternalServerError, "database error", err)
+			return
+		}
+		respondScrapeError(c, err, username)
+		return
+	}
+
+	c.JSON(http.StatusOK, UserExistsResponse{
+		Username: user.Username,
+		ID:       user.ID,
+		Exists:   true,
+		Source:   source,
+	})
+}
+
+// parseFetchOptions reads the ?refresh= and ?max_age= query parameters.
+// max_age is a duration such as "30m" or "24h".
+func parseFetchOptions(c *gin.Context) (fetchOptions, error) {
+	var opts fetchOptions
+
+	if raw := c.Query("refresh"); raw != "" {
+		refresh, err := strconv.ParseBool(raw)
+		if err != nil {
+			return opts, fmt.Errorf("refresh must be true or false")
+		}
+		opts.Refresh = refresh
+	}
+
+	if raw := c.Query("max_age"); raw != "" {
+		maxAge, err := time.ParseDuration(raw)
+		if err != nil || maxAge <= 0 {
+			return opts, fmt.Errorf("max_age must be a positive duration such as 30m or 24h")
+		}
+		opts.MaxAge = maxAge
+	}
+
+	return opts, nil
+}
+
+// buildUserResponse assembles the response for a fetched user. The stats
+// query is only run when includeStats is set; a stats failure is logged
+// and the response is returned without stats, flagged in meta.stats_error
+// so clients can tell it apart from a user without activity.
+func buildUserResponse(ctx context.Context, user *database.User, source string, includeStats bool, opts database.StatsOptions) UserResponse {
+	logger := utils.LoggerFromContext(ctx)
+
+	response := UserResponse{
+		User: *user,
+		Meta: ResponseMeta{
+			ProcessedAt:       time.Now(),
+			Source:            source,
+			UpstreamRequestID: user.UpstreamRequestID,
+		},
+	}
+
+	if includeStats {
+		stats, err := getUserStats(ctx, user.ID, opts)
+		if err != nil {
+			logger.Error().Err(err).Str("user_id", user.ID).Msg("failed to get user stats")
+			// Continue without stats
+			response.Meta.StatsError = "stats unavailable"
+		}
+		response.Stats = stats
+	}
+
+	if config.Provenance {
+		response.Meta.Provenance = provenance(user, source, response.Stats)
+	}
+
+	return response
+}
+
+// provenance reports where each section of a user response came from:
+// the user's fetch source; "stats_cache", "partial" or "database" for
+// stats; "s3" or "instagram" for the profile picture. Missing sections are
+// left out.
+func provenance(user *database.User, source string, stats *database.UserStats) map[string]string {
+	sections := map[string]string{"user": source}
+
+	switch {
+	case stats == nil:
+	case stats.CachedAt != nil:
+		sections["stats"] = "stats_cache"
+	case stats.Partial:
+		sections["stats"] = "partial"
+	default:
+		sections["stats"] = "database"
+	}
+
+	if user.ProfilePicStorageURL.Valid && user.ProfilePicStorageURL.String != "" {
+		sections["profile_pic"] = "s3"
+	} else if user.ProfilePicURL.Valid && user.ProfilePicURL.String != "" {
+		sections["profile_pic"] = "instagram"
+	}
+
+	return sections
+}
+
+// Store outcomes reported by fetchUser for freshly scraped users
+const (
+	storeInserted = "inserted" // a newly discovered account
+	storeUpdated  = "updated"
+	storeSkipped  = "skipped" // a newer scrape was already stored
+)
+
+// errDatabase marks fetchUser failures caused by the database rather than RocketAPI
+var errDatabase = errors.New("database error")
+
+// fetchOptions controls when fetchUser re-scrapes a stored user
+type fetchOptions struct {
+	Refresh    bool          // always re-scrape
+	MaxAge     time.Duration // re-scrape when scraped_at is older, 0 disables
+	SkipUpload bool          // don't upload a scraped user's profile picture
+	Strict     bool          // a failed refresh returns the scrape error, not the stored user
+}
+
+// wantsRefresh reports whether a stored user should be re-scraped
+func (o fetchOptions) wantsRefresh(user *database.User) bool {
+	return o.Refresh || (o.MaxAge > 0 && time.Since(user.ScrapedAt) > o.MaxAge)
+}
+
+// fetchUser returns a user from the cache or database, scraping and storing
+// it via RocketAPI when it isn't stored yet or opts asks for a refresh. If a
+// refresh fails the stored user is returned, unless opts.Strict is set.
+// The returned source is "cache", "database" or "rocketapi".
+func fetchUser(ctx context.Context, username string, opts fetchOptions) (_ *database.User, source string, _ string, err error) {
+	ctx, span := tracer.Start(ctx, "fetchUser", trace.WithAttributes(
+		attribute.String("username", username),
+		attribute.Bool("refresh", opts.Refresh),
+	))
+	defer func() {
+		span.SetAttributes(attribute.String("source", source))
+		tracing.EndSpan(span, err)
+	}()
+
+	logger := utils.LoggerFromContext(ctx)
+
+	if userCache != nil && !opts.Refresh {
+		if user, ok := userCache.Get(username); ok && !opts.wantsRefresh(user) {
+			return user, "cache", "", nil
+		}
+	}
+
+	// Get user data from database next
+	stored, err := database.GetUserByUsername(ctx, username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Error().Err(err).Str("username", username).Msg("database error")
+		return nil, "", "", fmt.Errorf("%w: %v", errDatabase, err)
+	}
+
+	// A renamed account can still be found through its old username
+	if stored == nil && config.UsernameFallback {
+		if stored, err = resolveRenamedUser(ctx, username); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	if stored != nil && !opts.wantsRefresh(stored) {
+		if userCache != nil {
+			userCache.Set(username, stored)
+		}
+		return stored, "database", "", nil
+	}
+
+	scrapeUsername := username
+	if stored == nil {
+		logger.Info().Str("username", username).Msg("user not found in database, scraping from RocketAPI")
+	} else {
+		// Refresh by the stored username, which differs for renamed accounts
+		scrapeUsername = stored.Username
+		logger.Info().Str("username", scrapeUsername).Time("scraped_at", stored.ScrapedAt).Msg("refreshing user from RocketAPI")
+	}
+
+	scrapedUser, err := scrapeWithRetry(ctx, scrapeUsername)
+	if err != nil {
+		logger.Error().Err(err).Str("username", scrapeUsername).Msg("failed to scrape user")
+		if stored != nil && !opts.Strict {
+			return stored, "database", "", nil
+		}
+		return nil, "", "", err
+	}
+
+	// Store in database
+	outcome, err := storeUser(ctx, scrapedUser)
+	if err != nil {
+		logger.Error().Err(err).Str("username", username).Msg("failed to store user")
+	} else if outcome != storeSkipped && !opts.SkipUpload {
+		uploadProfilePicture(ctx, scrapedUser, stored)
+	}
+	// Don't cache a scrape that lost to a newer one
+	if userCache != nil && outcome != storeSkipped {
+		userCache.Set(username, scrapedUser)
+	}
+
+	return scrapedUser, "rocketapi", outcome, nil
+}
+
+// transientRetryDelay is the pause before retrying a transient scrape
+// failure
+var transientRetryDelay = time.Second
+
+// minRetryBudget is the least time that must remain before ctx's deadline
+// for a transient failure to be retried
+const minRetryBudget = 5 * time.Second
+
+// scrapeWithRetry scrapes username, retrying once after a transient
+// failure if ctx has at least minRetryBudget left. A RetryError means the
+// client already spent its own attempts, so it isn't retried again, which
+// would double the upstream calls for one user.
+func scrapeWithRetry(ctx context.Context, username string) (_ *database.User, err error) {
+	ctx, span := tracer.Start(ctx, "scrapeWithRetry", trace.WithAttributes(attribute.String("username", username)))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	logger := utils.LoggerFromContext(ctx)
+
+	span.SetAttributes(attribute.Int("scrape.attempts", 1))
+	user, err := scraper.ScrapeInstagramUser(ctx, username)
+	if err == nil || !external.IsTransient(err) {
+		return user, err
+	}
+
+	var retryErr external.RetryError
+	if errors.As(err, &retryErr) {
+		logger.Debug().Err(err).Str("username", username).Msg("not retrying scrape, client retries exhausted")
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < transientRetryDelay+minRetryBudget {
+		logger.Debug().Err(err).Str("username", username).Msg("not retrying transient scrape failure, deadline too close")
+		return nil, err
+	}
+
+	logger.Warn().Err(err).Str("username", username).Msg("transient scrape failure, retrying")
+
+	timer := time.NewTimer(transientRetryDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("scrape.attempts", 2))
+	return scraper.ScrapeInstagramUser(ctx, username)
+}
+
+// uploadProfilePicture copies a stored, freshly scraped user's profile
+// picture to storage and records the upload URL on the user. It is skipped
+// when stored already has the same picture uploaded. Failures are logged
+// and don't fail the scrape.
+func uploadProfilePicture(ctx context.Context, user, stored *database.User) {
+	logger := utils.LoggerFromContext(ctx)
+
+	if !user.ProfilePicURL.Valid || user.ProfilePicURL.String == "" {
+		return
+	}
+	if stored != nil && stored.ProfilePicStorageURL.Valid && stored.ProfilePicURL == user.ProfilePicURL {
+		user.ProfilePicStorageURL = stored.ProfilePicStorageURL
+		return
+	}
+
+	storage := external.GetStorageClient()
+	if err := storage.UploadProfilePicture(ctx, user.ID, user.ProfilePicURL.String); err != nil {
+		logger.Warn().Err(err).Str("user_id", user.ID).Msg("failed to upload profile picture")
+		return
+	}
+
+	url := storage.GetUploadURL(user.ID)
+	if err := database.SetProfilePicStorageURL(ctx, user.ID, url); err != nil {
+		logger.Warn().Err(err).Str("user_id", user.ID).Msg("failed to record profile picture upload")
+		return
+	}
+	user.ProfilePicStorageURL = sql.NullString{String: url, Valid: url != ""}
+}
+
+// resolveRenamedUser looks up the account last seen with username by its
+// id. Returns nil without error when the username was never seen.
+func resolveRenamedUser(ctx context.Context, username string) (*database.User, error) {
+	logger := utils.LoggerFromContext(ctx)
+
+	userID, err := database.ResolveUserID(ctx, username)
+	if err == nil {
+		var user *database.User
+		if user, err = database.GetUserByID(ctx, userID); err == nil {
+			logger.Info().Str("username", username).Str("current_username", user.Username).Msg("resolved renamed user by id")
+			return user, nil
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	logger.Error().Err(err).Str("username", username).Msg("database error")
+	return nil, fmt.Errorf("%w: %v", errDatabase, err)
+}
+
+// storeUser upserts a user and invalidates its cache entry, returning the
+// store outcome
+func storeUser(ctx context.Context, user *database.User) (string, error) {
+	if userCache != nil {
+		userCache.Delete(user.Username)
+	}
+
+	result, err := database.UpsertUserWithResult(ctx, user)
+	if err != nil {
+		return "", err
+	}
+
+	outcome := storeSkipped
+	switch {
+	case result.Inserted:
+		outcome = storeInserted
+	case result.Applied:
+		outcome = storeUpdated
+	}
+	metrics.ObserveUserUpsert(outcome)
+	return outcome, nil
+}
+
+// getUserStats runs the full stats query with its own timeout
+// (STATS_QUERY_TIMEOUT_SECONDS), derived from ctx so a slow query can't use
+// up the whole request budget, falling back to partial stats (cheap counts
+// only) when it times out
+func getUserStats(ctx context.Context, userID string, opts database.StatsOptions) (*database.UserStats, error) {
+	logger := utils.LoggerFromContext(ctx)
+
+	statsQueryTimeout := time.Duration(config.StatsQueryTimeout) * time.Second
+	statsCtx, cancel := context.WithTimeout(ctx, statsQueryTimeout)
+	defer cancel()
+
+	stats, err := database.GetUserStats(statsCtx, userID, opts)
+	if err == nil || !database.IsQueryTimeout(err) || ctx.Err() != nil {
+		return stats, err
+	}
+
+	logger.Warn().Str("user_id", userID).Dur("timeout", statsQueryTimeout).Msg("stats query timed out, returning partial stats")
+	return database.GetPartialUserStats(ctx, userID)
+}
+
+// ListUsersHandler returns a page of stored users, or the stored users
+// among a list of usernames when ?usernames= is set
+// GET /api/v1/instagram/users?limit=&offset=&sort=
+// GET /api/v1/instagram/users?usernames=a,b,c
+func ListUsersHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	if usernames, ok := c.GetQuery("usernames"); ok {
+		lookupStoredUsers(c, strings.Split(usernames, ","))
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "limit must be a positive integer")
+		return
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	users, total, err := database.ListUsers(c.Request.Context(), limit, offset, c.DefaultQuery("sort", "followers"))
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidSort) {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "sort must be one of: followers, posts, username, created_at")
+			return
+		}
+		logger.Error().Err(err).Msg("failed to list users")
+		respondError(c, http.StatusInternalServerError, "failed to list users", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, UserListResponse{
+		Users: users,
+		Pagination: Pagination{
+			Total:   total,
+			Limit:   limit,
+			Offset:  offset,
+			HasMore: offset+len(users) < total,
+		},
+	})
+}
+
+// minSearchQueryLength is the shortest query SearchUsersHandler accepts
+const minSearchQueryLength = 2
+
+// SearchUsersHandler searches stored users by username or full name for
+// typeahead, most followed first
+// GET /api/v1/instagram/users/search?q=&limit=10
+func SearchUsersHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	q := strings.TrimSpace(c.Query("q"))
+	if utf8.RuneCountInString(q) < minSearchQueryLength {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("q must be at least %d characters", minSearchQueryLength))
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit <= 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "limit must be a positive integer")
+		return
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	users, err := database.SearchUsers(c.Request.Context(), q, limit)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to search users")
+		respondError(c, http.StatusInternalServerError, "failed to search users", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, UserSearchResponse{
+		Users: users,
+		Query: q,
+		Limit: limit,
+	})
+}
+
+// maxStoredUsersLookup caps the usernames accepted by lookupStoredUsers
+const maxStoredUsersLookup = 100
+
+// lookupStoredUsers responds with the stored users among usernames without
+// scraping, listing the valid usernames that aren't stored in not_found.
+// Users are returned in request order, with duplicates removed.
+func lookupStoredUsers(c *gin.Context, usernames []string) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	targets, invalid := validateTargets(usernames, nil)
+	unique := uniqueIdentifiers(targets)
+
+	if len(unique) == 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "no valid usernames provided", gin.H{
+			"validation_errors": invalid,
 		})
 		return
 	}
 
-	// Get user data from database first
-	user, err := database.GetUserByUsername(c.Request.Context(), username)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		log.Error().Err(err).Str("username", username).Msg("database error")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "database error",
-		})
+	if len(unique) > maxStoredUsersLookup {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("maximum %d usernames per lookup", maxStoredUsersLookup))
+		return
+	}
+
+	users, err := database.GetUsersByUsernames(c.Request.Context(), unique)
+	if err != nil {
+		logger.Error().Err(err).Int("count", len(unique)).Msg("failed to look up stored users")
+		respondError(c, http.StatusInternalServerError, "failed to look up users", err)
+		return
+	}
+
+	byUsername := make(map[string]*database.User, len(users))
+	for _, user := range users {
+		byUsername[user.Username] = user
+	}
+
+	response := StoredUsersResponse{
+		Users:        make([]*database.User, 0, len(users)),
+		NotFound:     make([]string, 0, len(unique)-len(users)),
+		InvalidUsers: invalid,
+	}
+	for _, username := range unique {
+		if user, ok := byUsername[username]; ok {
+			response.Users = append(response.Users, user)
+		} else {
+			response.NotFound = append(response.NotFound, username)
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetUserPostsHandler returns a page of a stored user's posts, newest first
+// GET /api/v1/instagram/users/:id/posts?limit=&offset=
+func GetUserPostsHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	userID := c.Param("id")
+	if userID == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "user ID is required")
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "limit must be a positive integer")
+		return
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	if _, err := database.GetUserByID(ctx, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeUserNotFound, "user not found")
+			return
+		}
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to get user")
+		respondError(c, http.StatusInternalServerError, "failed to get user", err)
+		return
+	}
+
+	total, err := database.CountPostsByUser(ctx, userID)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to count posts")
+		respondError(c, http.StatusInternalServerError, "failed to get posts", err)
+		return
+	}
+
+	posts, err := database.GetPostsByUser(ctx, userID, limit, offset)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to get posts")
+		respondError(c, http.StatusInternalServerError, "failed to get posts", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, PostListResponse{
+		Posts: posts,
+		Pagination: Pagination{
+			Total:   total,
+			Limit:   limit,
+			Offset:  offset,
+			HasMore: offset+len(posts) < total,
+		},
+	})
+}
+
+// GetUserTaggedHandler returns a page of the accounts tagged in a stored
+// user's posts, most tagged first
+// GET /api/v1/instagram/users/:id/tagged?limit=20&offset=0
+func GetUserTaggedHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	userID, limit, offset, ok := bindUserPage(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	total, err := database.CountTaggedUsernames(ctx, userID)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to count tagged usernames")
+		respondError(c, http.StatusInternalServerError, "failed to get tagged usernames", err)
+		return
+	}
+
+	tagged, err := database.GetTaggedUsernames(ctx, userID, limit, offset)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to get tagged usernames")
+		respondError(c, http.StatusInternalServerError, "failed to get tagged usernames", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, TaggedUsernameListResponse{
+		TaggedUsernames: tagged,
+		Pagination: Pagination{
+			Total:   total,
+			Limit:   limit,
+			Offset:  offset,
+			HasMore: offset+len(tagged) < total,
+		},
+	})
+}
+
+// GetUserCoauthoredHandler returns a page of the authors of a stored
+// user's posts, most posts first
+// GET /api/v1/instagram/users/:id/coauthored?limit=20&offset=0
+func GetUserCoauthoredHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	userID, limit, offset, ok := bindUserPage(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	total, err := database.CountCoauthoredUsernames(ctx, userID)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to count coauthored usernames")
+		respondError(c, http.StatusInternalServerError, "failed to get coauthored usernames", err)
+		return
+	}
+
+	coauthored, err := database.GetCoauthoredUsernames(ctx, userID, limit, offset)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to get coauthored usernames")
+		respondError(c, http.StatusInternalServerError, "failed to get coauthored usernames", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, CoauthoredUsernameListResponse{
+		CoauthoredUsernames: coauthored,
+		Pagination: Pagination{
+			Total:   total,
+			Limit:   limit,
+			Offset:  offset,
+			HasMore: offset+len(coauthored) < total,
+		},
+	})
+}
+
+// bindUserPage reads the :id path parameter and the ?limit= (default 20,
+// capped at 100) and ?offset= query parameters of a per-user list, and
+// checks the user is stored. On failure it writes the error response and
+// returns ok false.
+func bindUserPage(c *gin.Context) (userID string, limit, offset int, ok bool) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	userID = c.Param("id")
+	if userID == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "user ID is required")
+		return "", 0, 0, false
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "limit must be a positive integer")
+		return "", 0, 0, false
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	offset, err = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "offset must be a non-negative integer")
+		return "", 0, 0, false
+	}
+
+	if _, err := database.GetUserByID(c.Request.Context(), userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeUserNotFound, "user not found")
+			return "", 0, 0, false
+		}
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to get user")
+		respondError(c, http.StatusInternalServerError, "failed to get user", err)
+		return "", 0, 0, false
+	}
+
+	return userID, limit, offset, true
+}
+
+// TopEngagementHandler lists users ranked by engagement rate
+// GET /api/v1/instagram/stats/top-engagement?limit=10&min_followers=0&engagement_window_days=30
+func TopEngagementHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit <= 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "limit must be a positive integer")
 		return
 	}
+	if limit > 100 {
+		limit = 100
+	}
 
-	source := "database"
-	// If user not found in database, scrape from RocketAPI
-	if errors.Is(err, sql.ErrNoRows) {
-		log.Info().Str("username", username).Msg("user not found in database, scraping from RocketAPI")
+	minFollowers, err := strconv.ParseInt(c.DefaultQuery("min_followers", "0"), 10, 64)
+	if err != nil || minFollowers < 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "min_followers must be a non-negative integer")
+		return
+	}
 
-		scrapedUser, err := external.ScrapeInstagramUser(c.Request.Context(), username)
-		if err != nil {
-			log.Error().Err(err).Str("username", username).Msg("failed to scrape user")
-			c.JSON(http.StatusNotFound, gin.H{
-				"error": fmt.Sprintf("user not found: %s", username),
-			})
+	windowDays := database.DefaultStatsOptions.EngagementWindowDays
+	if raw := c.Query("engagement_window_days"); raw != "" {
+		windowDays, err = strconv.Atoi(raw)
+		if err != nil || windowDays < 1 || windowDays > 365 {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "engagement_window_days must be between 1 and 365")
 			return
 		}
+	}
 
-		// Store in database
-		if err := database.UpsertUser(c.Request.Context(), scrapedUser); err != nil {
-			log.Error().Err(err).Str("username", username).Msg("failed to store user")
-		}
-
-		user = scrapedUser
-		source = "rocketapi"
+	users, err := database.GetTopUsersByEngagement(c.Request.Context(), limit, minFollowers, windowDays)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get top users by engagement")
+		respondError(c, http.StatusInternalServerError, "failed to get top users by engagement", err)
+		return
 	}
 
-	// Get detailed stats
-	stats, err := database.GetUserStats(c.Request.Context(), user.ID)
+	c.JSON(http.StatusOK, TopEngagementResponse{
+		Users:                users,
+		Limit:                limit,
+		MinFollowers:         minFollowers,
+		EngagementWindowDays: windowDays,
+	})
+}
+
+// StatsOverviewHandler returns headline numbers across all stored users
+// GET /api/v1/instagram/stats/overview
+func StatsOverviewHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	stats, err := database.GetAggregateStats(c.Request.Context())
 	if err != nil {
-		log.Error().Err(err).Str("user_id", user.ID).Msg("failed to get user stats")
-		// Continue without stats
+		logger.Error().Err(err).Msg("failed to get aggregate stats")
+		respondError(c, http.StatusInternalServerError, "failed to get aggregate stats", err)
+		return
 	}
 
-	response := UserResponse{
-		User:  *user,
-		Stats: stats,
-		Meta: ResponseMeta{
-			ProcessedAt: time.Now(),
-			Source:      source,
-		},
+	c.JSON(http.StatusOK, stats)
+}
+
+// parseStatsOptions reads the ?tagged_limit= and ?coauthored_limit= query
+// parameters (1-50, default 10) and ?engagement_window_days= (1-365,
+// default 30)
+func parseStatsOptions(c *gin.Context) (database.StatsOptions, error) {
+	opts := database.DefaultStatsOptions
+
+	for _, param := range []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"tagged_limit", &opts.TaggedLimit, 1, 50},
+		{"coauthored_limit", &opts.CoauthoredLimit, 1, 50},
+		{"engagement_window_days", &opts.EngagementWindowDays, 1, 365},
+	} {
+		raw := c.Query(param.name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < param.min || value > param.max {
+			return opts, fmt.Errorf("%s must be between %d and %d", param.name, param.min, param.max)
+		}
+		*param.value = value
 	}
 
-	c.JSON(http.StatusOK, response)
+	return opts, nil
 }
 
 // GetUserStatsHandler gets detailed user statistics
 // GET /api/v1/instagram/users/:id/stats
 func GetUserStatsHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
 	userID := c.Param("id")
 	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "user ID is required",
-		})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "user ID is required")
 		return
 	}
 
-	stats, err := database.GetUserStats(c.Request.Context(), userID)
+	statsOpts, err := parseStatsOptions(c)
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	stats, err := getUserStats(c.Request.Context(), userID, statsOpts)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			c.JSON(http.StatusNotFound, gin.H{
-				"error": "user not found",
-			})
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeUserNotFound, "user not found")
 			return
 		}
-		log.Error().Err(err).Str("user_id", userID).Msg("failed to get user stats")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "failed to get user stats",
-		})
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to get user stats")
+		respondError(c, http.StatusInternalServerError, "failed to get user stats", err)
 		return
 	}
 
 	c.JSON(http.StatusOK, stats)
 }
 
-// BatchProcessUsersHandler handles batch user processing requests
+// BatchProcessUsersHandler handles batch user processing requests. Results
+// are returned as CSV for ?format=csv or Accept: text/csv, and streamed as
+// NDJSON for Accept: application/x-ndjson.
 // POST /api/v1/instagram/users/batch
-//
-// THIS IS THE MAIN CHALLENGE FOR CANDIDATES TO IMPLEMENT
 func BatchProcessUsersHandler(c *gin.Context) {
-	var req BatchRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "invalid request format",
-			"details": err.Error(),
-		})
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	req, targets, invalid, ok := bindBatchRequest(c)
+	if !ok {
 		return
 	}
 
-	// Validate request
-	if len(req.Usernames) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "usernames array cannot be empty",
-		})
+	timeout := time.Duration(req.TimeoutSeconds) * time.Second
+
+	if req.CallbackURL != "" {
+		if !req.Async {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "callback_url requires async")
+			return
+		}
+		if err := external.ValidateCallbackURL(c.Request.Context(), req.CallbackURL); err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "invalid callback_url", gin.H{
+				"details": err.Error(),
+			})
+			return
+		}
+	}
+
+	if req.Async {
+		startBatchJob(c, targets, invalid, req.MaxConcurrency, timeout, req.CallbackURL)
 		return
 	}
 
-	if len(req.Usernames) > 100 {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "maximum 100 users per batch",
-		})
+	if wantsNDJSON(c) {
+		streamBatch(c, req, targets, invalid)
+		return
+	}
+
+	// The whole batch aborts at the deadline, returning partial results
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	// Leave time to write the partial results once the deadline passes
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(timeout + batchWriteGrace)); err != nil {
+		logger.Warn().Err(err).Msg("failed to extend write deadline for batch")
+	}
+
+	startedAt := time.Now()
+	results := fetchDataForUsers(ctx, targets, req.MaxConcurrency, nil)
+
+	if req.SeparatePrivate {
+		results = markPrivate(results)
+	}
+
+	completedAt := time.Now()
+	metrics.ObserveBatch("sync", completedAt.Sub(startedAt))
+
+	if wantsCSV(c) {
+		writeBatchCSV(c, results)
 		return
 	}
 
-	// Set defaults
+	c.JSON(http.StatusOK, BatchResponse{
+		Results: results,
+		Summary: newSummary(req.total(), invalid, results, startedAt, completedAt),
+	})
+}
+
+// bindBatchRequest decodes and validates a batch request and applies
+// defaults. On failure it writes a 400 response (413 for an oversized body,
+// 415 for a non-JSON Content-Type) and returns ok=false.
+func bindBatchRequest(c *gin.Context) (req *BatchRequest, targets []batchTarget, invalid []ValidationError, ok bool) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	if !requireJSON(c) {
+		return nil, nil, nil, false
+	}
+
+	req = &BatchRequest{}
+	if err := decodeJSONBody(c, req); err != nil {
+		respondDecodeError(c, err)
+		return nil, nil, nil, false
+	}
+
+	// Validate request
+	if req.total() == 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "usernames and ids cannot both be empty")
+		return nil, nil, nil, false
+	}
+
+	if req.total() > config.MaxBatchSize {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("maximum %d users per batch", config.MaxBatchSize))
+		return nil, nil, nil, false
+	}
+
+	// Reject invalid entries up front so no scraping is wasted on them
+	targets, invalid = validateTargets(req.Usernames, req.IDs)
+	if len(invalid) > 0 && config.StrictBatch {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "batch contains invalid usernames or ids", gin.H{
+			"validation_errors": invalid,
+		})
+		return nil, nil, nil, false
+	}
+	if len(targets) == 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "no valid usernames or ids in batch", gin.H{
+			"validation_errors": invalid,
+		})
+		return nil, nil, nil, false
+	}
+
+	// Set defaults, capped at the service-wide MAX_CONCURRENCY
 	if req.MaxConcurrency <= 0 {
-		req.MaxConcurrency = 5 // Default concurrency
+		req.MaxConcurrency = defaultBatchConcurrency
 	}
-	if req.MaxConcurrency > 20 {
-		req.MaxConcurrency = 20 // Max allowed concurrency
+	if req.MaxConcurrency > config.MaxConcurrency {
+		req.MaxConcurrency = config.MaxConcurrency
 	}
 
 	if req.TimeoutSeconds <= 0 {
-		req.TimeoutSeconds = 300 // Default 5 minutes
+		req.TimeoutSeconds = defaultBatchTimeoutSeconds
 	}
 
-	log.Info().
-		Int("user_count", len(req.Usernames)).
+	logger.Info().
+		Int("user_count", len(targets)).
+		Int("invalid_count", len(invalid)).
 		Int("max_concurrency", req.MaxConcurrency).
 		Int("timeout", req.TimeoutSeconds).
 		Msg("starting batch user processing")
 
-	// TODO: CANDIDATE IMPLEMENTS THIS
-
-	// PLACEHOLDER RESPONSE - REPLACE WITH ACTUAL IMPLEMENTATION
-	c.JSON(http.StatusNotImplemented, gin.H{
-		"error": "batch processing not implemented yet",
-		"task":  "Implement parallel processing of Instagram users",
-		"requirements": []string{
-			"Process users in parallel with configurable concurrency",
-			"Respect RocketAPI rate limits (10 req/sec)",
-			"Handle individual user failures gracefully",
-			"Return detailed status for each user",
-			"Implement timeout handling",
-		},
-		"hints": map[string]interface{}{
-			"functions_to_use": []string{
-				"external.ScrapeInstagramUser(ctx, username)",
-				"database.UpsertUser(ctx, user)",
-			},
-			"patterns_to_implement": []string{
-				"Worker pool pattern",
-				"Rate limiting across workers",
-				"Error aggregation",
-				"Progress tracking",
+	return req, targets, invalid, true
+}
+
+// total returns the number of submitted usernames and ids
+func (r *BatchRequest) total() int {
+	return len(r.Usernames) + len(r.IDs)
+}
+
+// newSummary tallies batch results. total counts every submitted username
+// and id, including the invalid and repeated ones.
+func newSummary(total int, invalid []ValidationError, results []UserResult, startedAt, completedAt time.Time) Summary {
+	summary := Summary{
+		Total:           total,
+		Invalid:         len(invalid),
+		Duplicates:      total - len(invalid) - len(results),
+		InvalidUsers:    invalid,
+		DurationSeconds: completedAt.Sub(startedAt).Seconds(),
+		StartedAt:       startedAt,
+		CompletedAt:     completedAt,
+	}
+	for _, result := range results {
+		switch result.Stored {
+		case storeInserted:
+			summary.Inserted++
+		case storeUpdated:
+			summary.Updated++
+		}
+
+		switch result.Status {
+		case "success":
+			summary.Successful++
+		case "private":
+			summary.Private++
+		default:
+			if result.Status == "rate_limited" {
+				summary.RateLimited++
+			}
+			summary.Failed++
+			summary.addFailure(result)
+		}
+	}
+	return summary
+}
+
+// addFailure lists a failed result's error in the summary, up to
+// MAX_SUMMARY_FAILURES entries
+func (s *Summary) addFailure(result UserResult) {
+	if len(s.Failures) >= config.MaxSummaryFailures {
+		s.FailuresTruncated = true
+		return
+	}
+	if s.Failures == nil {
+		s.Failures = make(map[string]string)
+	}
+	s.Failures[result.Identifier] = result.Error
+}
+
+// markPrivate returns a copy of results with successful private accounts
+// given status "private". Results may be shared with other requests, so the
+// input is never modified.
+func markPrivate(results []UserResult) []UserResult {
+	marked := make([]UserResult, len(results))
+	copy(marked, results)
+	for i := range marked {
+		if marked[i].Status == "success" && marked[i].User != nil && marked[i].User.IsPrivate {
+			marked[i].Status = "private"
+		}
+	}
+	return marked
+}
+
+// Batch target types, reported as UserResult.Type
+const (
+	targetTypeUsername = "username"
+	targetTypeID       = "id"
+)
+
+// maxUserIDLength matches the instagram_users.id column
+const maxUserIDLength = 50
+
+// errUserIDNotFound is reported for ids with no stored user when the
+// configured scraper can't look up users by id
+var errUserIDNotFound = errors.New("no stored user with this id")
+
+// batchTarget is a validated batch entry, either a normalized username or
+// a user id. Refresh re-scrapes a stored username instead of returning it.
+type batchTarget struct {
+	Identifier string
+	Type       string
+	Refresh    bool
+}
+
+// jobTarget records the target on its processing job
+func (t batchTarget) jobTarget() database.JobTarget {
+	return database.JobTarget{Identifier: t.Identifier, Type: t.Type, Refresh: t.Refresh}
+}
+
+// key identifies the target in batch dedup hashes and task ids. Usernames
+// can't contain ':', so ids and refreshes never collide with them.
+func (t batchTarget) key() string {
+	key := t.Identifier
+	if t.Type == targetTypeID {
+		key = "id:" + key
+	}
+	if t.Refresh {
+		key = "refresh:" + key
+	}
+	return key
+}
+
+// uniqueIdentifiers returns the targets' identifiers in order without
+// duplicates. Targets are normalized, so "@User" and "user" count once.
+func uniqueIdentifiers(targets []batchTarget) []string {
+	seen := make(map[string]struct{}, len(targets))
+	unique := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if _, ok := seen[target.Identifier]; ok {
+			continue
+		}
+		seen[target.Identifier] = struct{}{}
+		unique = append(unique, target.Identifier)
+	}
+	return unique
+}
+
+// targetKeys returns the key of each target
+func targetKeys(targets []batchTarget) []string {
+	keys := make([]string, len(targets))
+	for i, target := range targets {
+		keys[i] = target.key()
+	}
+	return keys
+}
+
+// validateTargets normalizes each username and checks each id, returning
+// the valid entries (usernames first) and a validation error for each
+// rejected entry. Repeated entries are collapsed into their first
+// occurrence; usernames compare after normalization, so "ABC" repeats "abc".
+func validateTargets(usernames, ids []string) ([]batchTarget, []ValidationError) {
+	valid := make([]batchTarget, 0, len(usernames)+len(ids))
+	seen := make(map[string]struct{}, len(usernames)+len(ids))
+	var invalid []ValidationError
+
+	for i, username := range usernames {
+		normalized, err := utils.NormalizeUsername(username)
+		if err != nil {
+			invalid = append(invalid, ValidationError{
+				Index:    i,
+				Type:     targetTypeUsername,
+				Username: username,
+				Error:    err.Error(),
+			})
+			continue
+		}
+		target := batchTarget{Identifier: normalized, Type: targetTypeUsername}
+		if _, ok := seen[target.key()]; ok {
+			continue
+		}
+		seen[target.key()] = struct{}{}
+		valid = append(valid, target)
+	}
+
+	for i, id := range ids {
+		if err := validateUserID(id); err != nil {
+			invalid = append(invalid, ValidationError{
+				Index: i,
+				Type:  targetTypeID,
+				ID:    id,
+				Error: err.Error(),
+			})
+			continue
+		}
+		target := batchTarget{Identifier: id, Type: targetTypeID}
+		if _, ok := seen[target.key()]; ok {
+			continue
+		}
+		seen[target.key()] = struct{}{}
+		valid = append(valid, target)
+	}
+
+	return valid, invalid
+}
+
+// validateUserID checks that id looks like an Instagram user id
+func validateUserID(id string) error {
+	if id == "" {
+		return errors.New("id is empty")
+	}
+	if len(id) > maxUserIDLength {
+		return fmt.Errorf("id exceeds %d characters", maxUserIDLength)
+	}
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return errors.New("id must contain only digits")
+		}
+	}
+	return nil
+}
+
+// fetchTarget fetches a username like the single user endpoint does, and
+// an id like fetchUserByID. A refresh target fails when its re-scrape does,
+// rather than counting the stale stored user as a success. The store
+// outcome is set only when a scraped user was written.
+func fetchTarget(ctx context.Context, target batchTarget) (*database.User, string, error) {
+	if target.Type == targetTypeID {
+		return fetchUserByID(ctx, target.Identifier)
+	}
+
+	user, _, outcome, err := fetchUser(ctx, target.Identifier, fetchOptions{Refresh: target.Refresh, Strict: target.Refresh})
+	return user, outcome, err
+}
+
+// fetchUserByID returns a stored user by id, scraping and storing it by id
+// via RocketAPI when it isn't stored yet. Returns errUserIDNotFound for an
+// unstored id when the scraper can't look up ids. The store outcome is set
+// only when a scraped user was written.
+func fetchUserByID(ctx context.Context, userID string) (*database.User, string, error) {
+	logger := utils.LoggerFromContext(ctx)
+
+	user, err := database.GetUserByID(ctx, userID)
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return user, "", err
+	}
+
+	idScraper, ok := scraper.(external.IDScraper)
+	if !ok {
+		return nil, "", errUserIDNotFound
+	}
+
+	logger.Info().Str("user_id", userID).Msg("user id not found in database, scraping from RocketAPI")
+	user, err = idScraper.ScrapeInstagramUserByID(ctx, userID)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to scrape user by id")
+		return nil, "", err
+	}
+
+	outcome, err := storeUser(ctx, user)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to store user")
+		return user, "", nil
+	}
+	if outcome != storeSkipped {
+		uploadProfilePicture(ctx, user, nil)
+		if userCache != nil {
+			userCache.Set(user.Username, user)
+		}
+	}
+	return user, outcome, nil
+}
+
+const (
+	defaultBatchConcurrency    = 5
+	defaultBatchTimeoutSeconds = 300
+)
+
+// batchWriteGrace is the time allowed past a batch deadline to write the
+// response
+const batchWriteGrace = 10 * time.Second
+
+// errBatchTimeout is reported for users left unfinished when a batch
+// deadline passes
+var errBatchTimeout = errors.New("timeout")
+
+// fetchDataForUsers processes batch targets on a worker pool with
+// maxConcurrency workers. RocketAPI calls are paced by the client's shared
+// rate limiter, so cache and database hits aren't slowed. Results are returned
+// in input order; onResult, if set, is called as each user completes and
+// may be called concurrently. When ctx's deadline passes, unfinished users
+// are reported as errors with "timeout". Users not yet dispatched when ctx
+// ends are only in the returned results, not passed to onResult.
+func fetchDataForUsers(ctx context.Context, targets []batchTarget, maxConcurrency int, onResult func(index int, result UserResult)) []UserResult {
+	logger := utils.LoggerFromContext(ctx)
+
+	results := make([]UserResult, len(targets))
+
+	// Enqueues block while the buffer is full, so it needn't hold the batch
+	pool := queue.NewWorkerPool(queue.WorkerPoolOptions{
+		NumWorkers: maxConcurrency,
+		MaxErrors:  len(targets),
+		Logger:     logger,
+	})
+	pool.Start()
+
+	for i, target := range targets {
+		i, target := i, target
+		task := &queue.UserProcessingTask{
+			Username: target.key(),
+			Processor: func(_ context.Context, _ string) error {
+				result := newUserResult(target)
+				user, outcome, err := fetchTarget(ctx, target)
+				if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					err = errBatchTimeout
+				}
+				if err != nil {
+					result.Status = "error"
+					if external.IsRateLimited(err) {
+						result.Status = "rate_limited"
+					}
+					result.Error = err.Error()
+				} else {
+					result.Status = "success"
+					result.Username = user.Username
+					result.User = user
+					result.Stored = outcome
+				}
+				result.ProcessedAt = time.Now()
+
+				// Each task owns its index, so no locking is needed
+				results[i] = result
+				if onResult != nil {
+					onResult(i, result)
+				}
+				return err
 			},
-		},
+		}
+
+		// Stop dispatching once ctx ends, even if the queue has room
+		err := ctx.Err()
+		if err == nil {
+			err = pool.EnqueueTaskBlocking(ctx, task)
+		}
+		if err != nil {
+			message := fmt.Sprintf("failed to enqueue user: %v", err)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				message = errBatchTimeout.Error()
+			}
+			results[i] = newUserResult(target)
+			results[i].Status = "error"
+			results[i].Error = message
+			results[i].ProcessedAt = time.Now()
+
+			// A user never dispatched before ctx ended wasn't processed
+			if onResult != nil && ctx.Err() == nil {
+				onResult(i, results[i])
+			}
+		}
+	}
+
+	pool.Stop()
+
+	processed, failed := pool.GetStats()
+	logger.Info().
+		Int64("processed", processed).
+		Int64("failed", failed).
+		Int("total", len(targets)).
+		Msg("batch worker pool finished")
+
+	return results
+}
+
+// newUserResult starts the result for a target. Username is known up front
+// only for username targets.
+func newUserResult(target batchTarget) UserResult {
+	result := UserResult{Identifier: target.Identifier, Type: target.Type}
+	if target.Type == targetTypeUsername {
+		result.Username = target.Identifier
+	}
+	return result
+}
+
+// DeleteUserHandler deletes a stored user with their posts, e.g. for GDPR
+// deletion requests
+// DELETE /api/v1/instagram/users/:id
+func DeleteUserHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	userID := c.Param("id")
+	if userID == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "user ID is required")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Look the user up first so its cache entry (keyed by username) can be evicted
+	user, err := database.GetUserByID(ctx, userID)
+	if err == nil {
+		err = database.DeleteUser(ctx, userID)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeUserNotFound, "user not found")
+			return
+		}
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to delete user")
+		respondError(c, http.StatusInternalServerError, "failed to delete user", err)
+		return
+	}
+
+	if userCache != nil {
+		userCache.Delete(user.Username)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ReuploadProfilePictureHandler re-uploads a stored user's profile picture
+// through the configured storage client
+// POST /api/v1/instagram/users/:id/profile-pic/reupload
+func ReuploadProfilePictureHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	userID := c.Param("id")
+	if userID == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "user ID is required")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	user, err := database.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeUserNotFound, "user not found")
+			return
+		}
+		logger.Error().Err(err).Str("user_id", userID).Msg("database error")
+		respondError(c, http.StatusInternalServerError, "database error", err)
+		return
+	}
+
+	// Fall back to a fresh scrape when no profile picture URL is stored
+	source := "database"
+	if !user.ProfilePicURL.Valid || user.ProfilePicURL.String == "" {
+		scrapedUser, err := scraper.ScrapeInstagramUser(ctx, user.Username)
+		if err != nil {
+			logger.Error().Err(err).Str("username", user.Username).Msg("failed to scrape user")
+			respondError(c, http.StatusBadGateway, "failed to fetch current profile picture", err)
+			return
+		}
+
+		if _, err := storeUser(ctx, scrapedUser); err != nil {
+			logger.Error().Err(err).Str("username", user.Username).Msg("failed to store user")
+		}
+
+		user = scrapedUser
+		source = "rocketapi"
+	}
+
+	if !user.ProfilePicURL.Valid || user.ProfilePicURL.String == "" {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "user has no profile picture")
+		return
+	}
+
+	storage := external.GetStorageClient()
+	if err := storage.UploadProfilePicture(ctx, user.ID, user.ProfilePicURL.String); err != nil {
+		logger.Error().Err(err).Str("user_id", user.ID).Msg("failed to upload profile picture")
+		respondError(c, http.StatusBadGateway, "failed to upload profile picture", err)
+		return
+	}
+
+	url := storage.GetUploadURL(user.ID)
+	if err := database.SetProfilePicStorageURL(ctx, user.ID, url); err != nil {
+		logger.Warn().Err(err).Str("user_id", user.ID).Msg("failed to record profile picture upload")
+	}
+	if userCache != nil {
+		userCache.Delete(user.Username)
+	}
+
+	logger.Info().Str("user_id", user.ID).Str("source", source).Msg("re-uploaded profile picture")
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":    user.ID,
+		"source_url": user.ProfilePicURL.String,
+		"url":        url,
+		"source":     source,
+	})
+}
+
+// GetAuditLogHandler returns the most recent audit log entries
+// GET /api/v1/instagram/admin/audit?limit=
+func GetAuditLogHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "limit must be between 1 and 500")
+		return
+	}
+
+	entries, err := database.GetRecentAuditEntries(c.Request.Context(), limit)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get audit log")
+		respondError(c, http.StatusInternalServerError, "failed to get audit log", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"count":   len(entries),
 	})
 }
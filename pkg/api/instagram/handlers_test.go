@@ -0,0 +1,2164 @@
+package instagram
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/api/apierror"
+	"instagram-user-processor/pkg/cache"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/database/dbtest"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/utils"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestBatchUpstreamCallsRespectRateLimit(t *testing.T) {
+	newTestStore(t)
+
+	var mu sync.Mutex
+	var calls []time.Time
+	srv := rocketAPIServer(t, func(*http.Request) {
+		mu.Lock()
+		calls = append(calls, time.Now())
+		mu.Unlock()
+	})
+
+	const rps = 20
+	SetScraper(external.NewRocketAPIClient(external.RocketAPIOptions{BaseURL: srv.URL, RateLimit: rps}))
+
+	// More workers than the rate allows per interval, so only the shared
+	// limiter keeps calls apart
+	usernames := make([]string, 10)
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("user_%d", i)
+	}
+	results := fetchDataForUsers(context.Background(), usernameTargets(usernames...), 10, nil)
+
+	for _, result := range results {
+		if result.Status != "success" {
+			t.Fatalf("%s: status %q, error %q", result.Identifier, result.Status, result.Error)
+		}
+	}
+	if len(calls) != len(usernames) {
+		t.Fatalf("RocketAPI called %d times, want %d", len(calls), len(usernames))
+	}
+
+	// Call i can't arrive before i intervals after the first. Gaps between
+	// neighbours vary with delivery jitter, so each call is checked against
+	// the first, allowing for the first arriving late.
+	interval := time.Second / rps
+	for i := 1; i < len(calls); i++ {
+		if elapsed := calls[i].Sub(calls[0]); elapsed < interval*time.Duration(i)-interval/2 {
+			t.Errorf("call %d arrived %v after the first, want at least %v", i, elapsed, interval*time.Duration(i))
+		}
+	}
+}
+
+func TestBatchStoredUsersAreNotPaced(t *testing.T) {
+	users := make([]*database.User, 10)
+	usernames := make([]string, len(users))
+	for i := range users {
+		usernames[i] = fmt.Sprintf("stored_%d", i)
+		users[i] = testUser(fmt.Sprint(i+1), usernames[i])
+	}
+	newTestStore(t, users...)
+
+	// One call per second would make the batch take seconds if stored
+	// users waited on the limiter
+	srv := rocketAPIServer(t, nil)
+	SetScraper(external.NewRocketAPIClient(external.RocketAPIOptions{BaseURL: srv.URL, RateLimit: 1}))
+
+	startedAt := time.Now()
+	results := fetchDataForUsers(context.Background(), usernameTargets(usernames...), 2, nil)
+	if elapsed := time.Since(startedAt); elapsed > 500*time.Millisecond {
+		t.Errorf("batch of stored users took %v", elapsed)
+	}
+	for _, result := range results {
+		if result.Status != "success" {
+			t.Errorf("%s: status %q, error %q", result.Identifier, result.Status, result.Error)
+		}
+	}
+}
+
+// idScraper stubs both username and id lookups
+type idScraper struct {
+	external.ScraperFunc
+	byID func(ctx context.Context, userID string) (*database.User, error)
+}
+
+func (s idScraper) ScrapeInstagramUserByID(ctx context.Context, userID string) (*database.User, error) {
+	return s.byID(ctx, userID)
+}
+
+// scrapeIDAs is an id scraper that returns a user named after the id
+func scrapeIDAs(_ context.Context, userID string) (*database.User, error) {
+	return &database.User{ID: userID, Username: "user" + userID, ScrapedAt: time.Now()}, nil
+}
+
+func TestBatchMixesUsernamesAndIDs(t *testing.T) {
+	store := newTestStore(t, testUser("7", "stored_seven"))
+	SetScraper(idScraper{ScraperFunc: scrapeAs, byID: scrapeIDAs})
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice"},
+		"ids":       []string{"42", "7"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchResponse
+	decode(t, w, &response)
+
+	want := []struct{ identifier, typ, username string }{
+		{"alice", targetTypeUsername, "alice"},
+		{"42", targetTypeID, "user42"},
+		{"7", targetTypeID, "stored_seven"},
+	}
+	if len(response.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(response.Results), len(want))
+	}
+	for i, w := range want {
+		got := response.Results[i]
+		if got.Identifier != w.identifier || got.Type != w.typ || got.Username != w.username || got.Status != "success" {
+			t.Errorf("result %d = %s/%s/%s/%s, want %s/%s/%s/success", i,
+				got.Identifier, got.Type, got.Username, got.Status, w.identifier, w.typ, w.username)
+		}
+	}
+
+	// The unknown id was scraped by id and stored; the stored one wasn't
+	if store.user("42") == nil {
+		t.Error("scraped id 42 not stored")
+	}
+	if response.Results[2].Stored != "" {
+		t.Errorf("stored id 7 has store outcome %q", response.Results[2].Stored)
+	}
+}
+
+func TestBatchUnknownIDWithoutIDScraper(t *testing.T) {
+	newTestStore(t)
+	stubScraper(t, scrapeAs)
+
+	results := fetchDataForUsers(context.Background(), []batchTarget{{Identifier: "42", Type: targetTypeID}}, 1, nil)
+	if results[0].Error != errUserIDNotFound.Error() {
+		t.Errorf("error = %q, want %q", results[0].Error, errUserIDNotFound.Error())
+	}
+}
+
+func TestBatchIDNotFoundUpstream(t *testing.T) {
+	newTestStore(t)
+	SetScraper(idScraper{ScraperFunc: scrapeAs, byID: func(_ context.Context, userID string) (*database.User, error) {
+		return nil, external.UserNotFoundError{Username: userID, Message: "user not found"}
+	}})
+
+	results := fetchDataForUsers(context.Background(), []batchTarget{{Identifier: "42", Type: targetTypeID}}, 1, nil)
+	if results[0].Status != "error" || results[0].Type != targetTypeID {
+		t.Errorf("result = %+v, want an id error", results[0])
+	}
+}
+
+func TestTopEngagementWindow(t *testing.T) {
+	store := newTestStore(t)
+	store.OnRows("WITH recent AS", append(userColumnNames, "engagement_rate", "recent_posts"))
+
+	tests := []struct {
+		query      string
+		status     int
+		windowDays int
+	}{
+		{"", http.StatusOK, 30},
+		{"?engagement_window_days=7", http.StatusOK, 7},
+		{"?engagement_window_days=365", http.StatusOK, 365},
+		{"?engagement_window_days=0", http.StatusBadRequest, 0},
+		{"?engagement_window_days=366", http.StatusBadRequest, 0},
+		{"?engagement_window_days=week", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		before := len(store.Calls("WITH recent AS"))
+		w := serve(TopEngagementHandler, http.MethodGet, "/top", "/top"+tt.query, nil)
+		if w.Code != tt.status {
+			t.Errorf("%q: status = %d, want %d", tt.query, w.Code, tt.status)
+			continue
+		}
+		calls := store.Calls("WITH recent AS")
+		if tt.status != http.StatusOK {
+			if len(calls) != before {
+				t.Errorf("%q: queried despite invalid window", tt.query)
+			}
+			continue
+		}
+
+		if got := calls[len(calls)-1].Args[2]; got != int64(tt.windowDays) {
+			t.Errorf("%q: window bound as %v, want %d", tt.query, got, tt.windowDays)
+		}
+		var response TopEngagementResponse
+		decode(t, w, &response)
+		if response.EngagementWindowDays != tt.windowDays {
+			t.Errorf("%q: echoed window %d, want %d", tt.query, response.EngagementWindowDays, tt.windowDays)
+		}
+	}
+}
+
+func TestTopEngagementLimitAndFollowerFloor(t *testing.T) {
+	store := newTestStore(t)
+	store.OnRows("WITH recent AS", append(userColumnNames, "engagement_rate", "recent_posts"))
+
+	tests := []struct {
+		query        string
+		status       int
+		limit        int64
+		minFollowers int64
+	}{
+		{"", http.StatusOK, 10, 0},
+		{"?limit=3&min_followers=1000", http.StatusOK, 3, 1000},
+		{"?limit=500", http.StatusOK, 100, 0},
+		{"?limit=0", http.StatusBadRequest, 0, 0},
+		{"?min_followers=-1", http.StatusBadRequest, 0, 0},
+		{"?min_followers=many", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		before := len(store.Calls("WITH recent AS"))
+		w := serve(TopEngagementHandler, http.MethodGet, "/top", "/top"+tt.query, nil)
+		if w.Code != tt.status {
+			t.Errorf("%q: status = %d, want %d", tt.query, w.Code, tt.status)
+			continue
+		}
+		calls := store.Calls("WITH recent AS")
+		if tt.status != http.StatusOK {
+			if len(calls) != before {
+				t.Errorf("%q: queried despite invalid parameters", tt.query)
+			}
+			continue
+		}
+		if args := calls[len(calls)-1].Args; args[0] != tt.limit || args[1] != tt.minFollowers {
+			t.Errorf("%q: bound limit %v and min followers %v, want %d and %d", tt.query, args[0], args[1], tt.limit, tt.minFollowers)
+		}
+	}
+}
+
+func TestDeleteUserRemovesUserAndCacheEntry(t *testing.T) {
+	store := newTestStore(t, testUser("1", "alice"), testUser("2", "bob"))
+	userCache = cache.NewTTLCache[string, *database.User](time.Minute, 10)
+	userCache.Set("alice", testUser("1", "alice"))
+	userCache.Set("bob", testUser("2", "bob"))
+
+	w := serve(DeleteUserHandler, http.MethodDelete, "/users/:id", "/users/1", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d, body %s", w.Code, http.StatusNoContent, w.Body.String())
+	}
+	if store.user("1") != nil {
+		t.Error("user still stored")
+	}
+	if store.user("2") == nil {
+		t.Error("other user deleted")
+	}
+	if _, ok := userCache.Get("alice"); ok {
+		t.Error("deleted user still cached")
+	}
+	if _, ok := userCache.Get("bob"); !ok {
+		t.Error("other user evicted from the cache")
+	}
+
+	// The deletion is audited by id, and nothing else written keeps the
+	// username
+	audits := store.Calls("INSERT INTO audit_log")
+	if len(audits) != 1 || audits[0].Args[1] != "delete_user" || audits[0].Args[2] != "1" {
+		t.Fatalf("audit entries = %v, want one delete_user of 1", audits)
+	}
+	for _, substr := range []string{"INSERT INTO audit_log", "UPDATE audit_log", "DELETE FROM"} {
+		for _, call := range store.Calls(substr) {
+			for _, arg := range call.Args {
+				if b, ok := arg.([]byte); ok {
+					arg = string(b)
+				}
+				if s, ok := arg.(string); ok && strings.Contains(s, "alice") {
+					t.Errorf("%s written with the deleted username: %v", substr, call.Args)
+				}
+			}
+		}
+	}
+}
+
+func TestDeleteUserNotFound(t *testing.T) {
+	store := newTestStore(t, testUser("1", "alice"))
+	userCache = cache.NewTTLCache[string, *database.User](time.Minute, 10)
+	userCache.Set("alice", testUser("1", "alice"))
+
+	w := serve(DeleteUserHandler, http.MethodDelete, "/users/:id", "/users/2", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if store.user("1") == nil {
+		t.Error("existing user deleted")
+	}
+	if _, ok := userCache.Get("alice"); !ok {
+		t.Error("existing user evicted from the cache")
+	}
+	if n := len(store.Calls("INSERT INTO audit_log")); n != 0 {
+		t.Errorf("recorded %d audit entries for a missing user", n)
+	}
+}
+
+func TestFetchDataForUsersProcessesEveryUserOnce(t *testing.T) {
+	for _, count := range []int{0, 1, 4, 5, 6, 23} {
+		t.Run(fmt.Sprint(count), func(t *testing.T) {
+			newTestStore(t)
+
+			var mu sync.Mutex
+			scraped := make(map[string]int)
+			stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+				mu.Lock()
+				scraped[username]++
+				mu.Unlock()
+				return scrapeAs(ctx, username)
+			})
+
+			usernames := make([]string, count)
+			for i := range usernames {
+				usernames[i] = fmt.Sprintf("user%d", i)
+			}
+			results := fetchDataForUsers(context.Background(), usernameTargets(usernames...), 5, nil)
+
+			if len(results) != count {
+				t.Fatalf("got %d results, want %d", len(results), count)
+			}
+			for i, result := range results {
+				if result.Identifier != usernames[i] || result.Status != "success" || result.User == nil {
+					t.Errorf("result %d = %s %q, want success for %s", i, result.Identifier, result.Status, usernames[i])
+				}
+			}
+			if len(scraped) != count {
+				t.Errorf("scraped %d distinct users, want %d", len(scraped), count)
+			}
+			for username, n := range scraped {
+				if n != 1 {
+					t.Errorf("%s scraped %d times", username, n)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchSummaryCountsFoundAndMissingUsers(t *testing.T) {
+	newTestStore(t, testUser("1", "stored"))
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		if strings.HasPrefix(username, "ghost") {
+			return nil, external.UserNotFoundError{Username: username, Message: "user not found"}
+		}
+		return scrapeAs(ctx, username)
+	})
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice", "ghost1", "stored", "ghost2", "bob"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchResponse
+	decode(t, w, &response)
+
+	summary := response.Summary
+	if summary.Total != 5 || summary.Successful != 3 || summary.Failed != 2 {
+		t.Errorf("summary total=%d successful=%d failed=%d, want 5/3/2", summary.Total, summary.Successful, summary.Failed)
+	}
+	if summary.StartedAt.IsZero() || summary.CompletedAt.Before(summary.StartedAt) {
+		t.Errorf("summary timestamps started=%v completed=%v", summary.StartedAt, summary.CompletedAt)
+	}
+
+	wantStatus := map[string]string{"alice": "success", "ghost1": "error", "stored": "success", "ghost2": "error", "bob": "success"}
+	if len(response.Results) != len(wantStatus) {
+		t.Fatalf("got %d results, want %d", len(response.Results), len(wantStatus))
+	}
+	for _, result := range response.Results {
+		if result.Status != wantStatus[result.Identifier] {
+			t.Errorf("%s status = %q, want %q", result.Identifier, result.Status, wantStatus[result.Identifier])
+		}
+		if (result.Status == "success") != (result.User != nil) || (result.Status == "error") != (result.Error != "") {
+			t.Errorf("%s result = %+v, want a user on success and an error on failure", result.Identifier, result)
+		}
+		if result.ProcessedAt.IsZero() {
+			t.Errorf("%s has no processed_at", result.Identifier)
+		}
+	}
+}
+
+func TestBatchSummaryCountsInsertsAndUpdates(t *testing.T) {
+	// bob was stored under an old username, so scraping him updates his row
+	store := newTestStore(t, testUser("2", "old_bob"))
+	useMockScraper(t, &MockScraper{Users: map[string]*database.User{
+		"alice": {ID: "1", Username: "alice"},
+		"bob":   {ID: "2", Username: "bob"},
+		"carol": {ID: "3", Username: "carol"},
+	}})
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice", "bob", "carol"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchResponse
+	decode(t, w, &response)
+
+	if s := response.Summary; s.Successful != 3 || s.Inserted != 2 || s.Updated != 1 {
+		t.Errorf("summary successful=%d inserted=%d updated=%d, want 3/2/1", s.Successful, s.Inserted, s.Updated)
+	}
+	if got := store.user("2").Username; got != "bob" {
+		t.Errorf("user 2 username = %q, want bob", got)
+	}
+}
+
+// mockUploads returns the profile pictures uploaded to the default mock
+// storage client, by user id
+func mockUploads(t *testing.T) map[string]string {
+	t.Helper()
+	storage, ok := external.GetStorageClient().(*external.MockStorageClient)
+	if !ok {
+		t.Fatalf("storage client is %T, want the mock", external.GetStorageClient())
+	}
+	return storage.GetUploads()
+}
+
+func TestReuploadProfilePictureUploadsStoredURL(t *testing.T) {
+	user := testUser("992001", "alice")
+	user.ProfilePicURL = sql.NullString{String: "https://cdn.example.com/alice.jpg", Valid: true}
+	store := newTestStore(t, user)
+	stubScraper(t, func(context.Context, string) (*database.User, error) {
+		t.Error("scraped a user whose profile picture URL is stored")
+		return nil, errors.New("unexpected scrape")
+	})
+
+	w := serve(ReuploadProfilePictureHandler, http.MethodPost, "/users/:id/profile-pic/reupload", "/users/992001/profile-pic/reupload", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		URL    string `json:"url"`
+		Source string `json:"source"`
+	}
+	decode(t, w, &body)
+
+	if got := mockUploads(t)["992001"]; got != user.ProfilePicURL.String {
+		t.Errorf("storage received %q, want %q", got, user.ProfilePicURL.String)
+	}
+	if body.Source != "database" || body.URL == "" {
+		t.Errorf("response = %+v, want the upload URL from the database source", body)
+	}
+	if got := store.user("992001").ProfilePicStorageURL.String; got != body.URL {
+		t.Errorf("stored upload URL = %q, want %q", got, body.URL)
+	}
+}
+
+func TestReuploadProfilePictureScrapesMissingURL(t *testing.T) {
+	newTestStore(t, testUser("992002", "bob"))
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		user := testUser("992002", username)
+		user.ProfilePicURL = sql.NullString{String: "https://cdn.example.com/bob.jpg", Valid: true}
+		return user, nil
+	})
+
+	w := serve(ReuploadProfilePictureHandler, http.MethodPost, "/users/:id/profile-pic/reupload", "/users/992002/profile-pic/reupload", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if got := mockUploads(t)["992002"]; got != "https://cdn.example.com/bob.jpg" {
+		t.Errorf("storage received %q, want the scraped URL", got)
+	}
+}
+
+func TestReuploadProfilePictureUnknownUser(t *testing.T) {
+	newTestStore(t)
+
+	w := serve(ReuploadProfilePictureHandler, http.MethodPost, "/users/:id/profile-pic/reupload", "/users/992003/profile-pic/reupload", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, ok := mockUploads(t)["992003"]; ok {
+		t.Error("uploaded a picture for an unknown user")
+	}
+}
+
+// countingScraper stubs scrapeAs and returns how many scrapes were made
+func countingScraper(t *testing.T) *int32 {
+	var calls int32
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		atomic.AddInt32(&calls, 1)
+		return scrapeAs(ctx, username)
+	})
+	return &calls
+}
+
+func TestBatchAllInvalidRejectedBeforeScraping(t *testing.T) {
+	newTestStore(t)
+	calls := countingScraper(t)
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"", "has space", "bad!char"},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	var body struct {
+		ValidationErrors []ValidationError `json:"validation_errors"`
+	}
+	decode(t, w, &body)
+	if len(body.ValidationErrors) != 3 {
+		t.Errorf("got %d validation errors, want 3: %+v", len(body.ValidationErrors), body.ValidationErrors)
+	}
+	for i, verr := range body.ValidationErrors {
+		if verr.Index != i || verr.Error == "" {
+			t.Errorf("validation error %d = %+v", i, verr)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 0 {
+		t.Errorf("scraped %d users for an all-invalid batch", n)
+	}
+}
+
+func TestBatchPartiallyInvalidProcessesValidUsers(t *testing.T) {
+	newTestStore(t)
+	calls := countingScraper(t)
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice", "bad!char", "bob"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchResponse
+	decode(t, w, &response)
+
+	if len(response.Results) != 2 || response.Summary.Successful != 2 {
+		t.Errorf("processed %d users with %d successes, want the 2 valid ones", len(response.Results), response.Summary.Successful)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("scraped %d users, want 2", n)
+	}
+	invalid := response.Summary.InvalidUsers
+	if response.Summary.Invalid != 1 || len(invalid) != 1 || invalid[0].Username != "bad!char" || invalid[0].Index != 1 {
+		t.Errorf("summary invalid = %d %+v, want bad!char at index 1", response.Summary.Invalid, invalid)
+	}
+}
+
+func TestBatchBlankUsernames(t *testing.T) {
+	tests := []struct {
+		name        string
+		strict      bool
+		usernames   []string
+		wantStatus  int
+		wantIndices []int
+		wantScraped []string
+	}{
+		{"skipped alongside valid users", false, []string{"alice", "", "  ", "bob"}, http.StatusOK, []int{1, 2}, []string{"alice", "bob"}},
+		{"rejected in strict mode", true, []string{"alice", "", "  ", "bob"}, http.StatusBadRequest, []int{1, 2}, nil},
+		{"only blanks", false, []string{"", "  "}, http.StatusBadRequest, []int{0, 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			useConfig(t, func(cfg *utils.Config) { cfg.StrictBatch = tt.strict })
+			mock := &MockScraper{Users: map[string]*database.User{
+				"alice": {ID: "1", Username: "alice"},
+				"bob":   {ID: "2", Username: "bob"},
+			}}
+			useMockScraper(t, mock)
+
+			w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+				"usernames": tt.usernames,
+			})
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+
+			var invalid []ValidationError
+			if tt.wantStatus == http.StatusOK {
+				var response BatchResponse
+				decode(t, w, &response)
+				invalid = response.Summary.InvalidUsers
+				if response.Summary.Successful != len(tt.wantScraped) || response.Summary.Invalid != len(tt.wantIndices) {
+					t.Errorf("summary successful=%d invalid=%d, want %d/%d",
+						response.Summary.Successful, response.Summary.Invalid, len(tt.wantScraped), len(tt.wantIndices))
+				}
+			} else {
+				var body struct {
+					ValidationErrors []ValidationError `json:"validation_errors"`
+				}
+				decode(t, w, &body)
+				invalid = body.ValidationErrors
+			}
+
+			indices := make([]int, 0, len(invalid))
+			for _, verr := range invalid {
+				indices = append(indices, verr.Index)
+				if verr.Error == "" {
+					t.Errorf("index %d has no error message", verr.Index)
+				}
+			}
+			if !slices.Equal(indices, tt.wantIndices) {
+				t.Errorf("invalid indices = %v, want %v", indices, tt.wantIndices)
+			}
+			slices.Sort(mock.Calls)
+			if !slices.Equal(mock.Calls, tt.wantScraped) {
+				t.Errorf("scraped %q, want %q", mock.Calls, tt.wantScraped)
+			}
+		})
+	}
+}
+
+func TestStrictBatchRejectsAnyInvalidUser(t *testing.T) {
+	newTestStore(t)
+	calls := countingScraper(t)
+	useConfig(t, func(cfg *utils.Config) { cfg.StrictBatch = true })
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice", "bad!char"},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if n := atomic.LoadInt32(calls); n != 0 {
+		t.Errorf("scraped %d users for a rejected batch", n)
+	}
+}
+
+func TestGetUserReturnsUpstreamRequestID(t *testing.T) {
+	newTestStore(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"done","request_id":"rk-123","response":{"status_code":200,"body":{"user":{"id":"1000","username":"alice"}}}}`)
+	}))
+	defer srv.Close()
+	SetScraper(external.NewRocketAPIClient(external.RocketAPIOptions{BaseURL: srv.URL}))
+	t.Cleanup(func() { SetScraper(nil) })
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice?stats=false", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response UserResponse
+	decode(t, w, &response)
+	if response.Meta.UpstreamRequestID != "rk-123" {
+		t.Errorf("upstream request id = %q, want %q", response.Meta.UpstreamRequestID, "rk-123")
+	}
+
+	// A stored user wasn't fetched upstream, so has no request id
+	w = serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice?stats=false", nil)
+	var stored UserResponse
+	decode(t, w, &stored)
+	if stored.Meta.Source != "database" || stored.Meta.UpstreamRequestID != "" {
+		t.Errorf("stored user meta = %+v, want a database source without request id", stored.Meta)
+	}
+}
+
+func TestBatchOfHundredCompletesWithinConcurrency(t *testing.T) {
+	newTestStore(t)
+
+	var running, peak int32
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return scrapeAs(ctx, username)
+	})
+
+	// 100 users overflow the pool's buffer, so enqueues must wait
+	// rather than drop users
+	usernames := make([]string, 100)
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("user%d", i)
+	}
+	results := fetchDataForUsers(context.Background(), usernameTargets(usernames...), 10, nil)
+
+	for i, result := range results {
+		if result.Identifier != usernames[i] || result.Status != "success" {
+			t.Errorf("result %d = %s %q %q, want success for %s", i, result.Identifier, result.Status, result.Error, usernames[i])
+		}
+	}
+	if p := atomic.LoadInt32(&peak); p > 10 {
+		t.Errorf("%d users scraped at once, want at most 10", p)
+	}
+}
+
+// statsColumnNames are the columns of the full stats query
+var statsColumnNames = []string{
+	"user", "tagged_usernames", "coauthored_usernames", "total_posted_count",
+	"total_tagged_in_count", "total_coauthored_count", "engagement_rate", "average_posts_per_week",
+}
+
+func TestGetUserFallsBackToPartialStatsOnTimeout(t *testing.T) {
+	for name, timeoutErr := range map[string]error{
+		"statement cancelled": &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"},
+		"deadline exceeded":   context.DeadlineExceeded,
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newTestStore(t, testUser("1", "alice"))
+			store.OnError("json_agg", timeoutErr)
+			store.OnRows("COUNT(*) FROM instagram_posts p WHERE p.user_id = u.id", []string{"user", "total_posted_count"},
+				[]driver.Value{[]byte(`{"id":"1","username":"alice"}`), int64(12000)})
+
+			w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			var response UserResponse
+			decode(t, w, &response)
+
+			stats := response.Stats
+			if stats == nil || !stats.Partial || stats.TotalPostedCount != 12000 {
+				t.Fatalf("stats = %+v, want partial stats with 12000 posts", stats)
+			}
+			if string(stats.TaggedUsernames) != "[]" || string(stats.CoauthoredUsernames) != "[]" {
+				t.Errorf("partial stats lists = %s %s, want empty", stats.TaggedUsernames, stats.CoauthoredUsernames)
+			}
+			if response.Meta.StatsError != "" {
+				t.Errorf("stats error = %q for partial stats", response.Meta.StatsError)
+			}
+		})
+	}
+}
+
+func TestSlowStatsQueryTimesOutAndUserStillReturns(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      int
+		partialErr   error
+		wantPartial  bool
+		wantStatsErr string
+	}{
+		{"within the timeout", 5, nil, false, ""},
+		{"falls back to partial stats", 1, nil, true, ""},
+		{"partial stats fail too", 1, errors.New("connection reset"), false, "stats unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(cfg *utils.Config) { cfg.StatsQueryTimeout = tt.timeout })
+			store := newTestStore(t, testUser("1", "alice"))
+			// The query answers only after the stats timeout has passed
+			store.On("json_agg", func([]driver.Value) dbtest.Result {
+				time.Sleep(1100 * time.Millisecond)
+				return dbtest.Result{Columns: statsColumnNames, Rows: [][]driver.Value{{
+					[]byte(`{"id":"1"}`), []byte(`[]`), []byte(`[]`), int64(3), int64(0), int64(0), 0.0, 0.0,
+				}}}
+			})
+			if tt.partialErr != nil {
+				store.OnError("COUNT(*) FROM instagram_posts p WHERE p.user_id = u.id", tt.partialErr)
+			} else {
+				store.OnRows("COUNT(*) FROM instagram_posts p WHERE p.user_id = u.id", []string{"user", "total_posted_count"},
+					[]driver.Value{[]byte(`{"id":"1","username":"alice"}`), int64(3)})
+			}
+
+			start := time.Now()
+			w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice", nil)
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("response took %v, want about the slow query's 1.1s", elapsed)
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			var response UserResponse
+			decode(t, w, &response)
+			if response.User.ID != "1" {
+				t.Errorf("user = %q, want the stored user", response.User.ID)
+			}
+			if tt.wantStatsErr == "" && response.Stats == nil {
+				t.Fatal("no stats")
+			}
+			if got := response.Stats != nil && response.Stats.Partial; got != tt.wantPartial {
+				t.Errorf("stats = %+v, want partial %v", response.Stats, tt.wantPartial)
+			}
+			if response.Meta.StatsError != tt.wantStatsErr {
+				t.Errorf("stats error = %q, want %q", response.Meta.StatsError, tt.wantStatsErr)
+			}
+		})
+	}
+}
+
+func TestStatsTimeoutIsDerivedFromRequestContext(t *testing.T) {
+	useConfig(t, func(cfg *utils.Config) { cfg.StatsQueryTimeout = 60 })
+	store := newTestStore(t, testUser("1", "alice"))
+	store.OnError("json_agg", context.DeadlineExceeded)
+
+	// A request that has already run out of time gets no partial stats
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := getUserStats(ctx, "1", database.DefaultStatsOptions); err == nil {
+		t.Error("getUserStats succeeded for an ended request")
+	}
+	if n := len(store.Calls("COUNT(*) FROM instagram_posts p WHERE p.user_id = u.id")); n != 0 {
+		t.Errorf("ran the partial stats query %d times after the request ended", n)
+	}
+}
+
+func TestGetUserReportsNonTimeoutStatsFailure(t *testing.T) {
+	store := newTestStore(t, testUser("1", "alice"))
+	store.OnError("json_agg", errors.New("relation does not exist"))
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response UserResponse
+	decode(t, w, &response)
+	if response.Stats != nil || response.Meta.StatsError == "" {
+		t.Errorf("stats = %+v, error %q, want no stats and a stats error", response.Stats, response.Meta.StatsError)
+	}
+	if n := len(store.Calls("COUNT(*) FROM instagram_posts p WHERE p.user_id = u.id")); n != 0 {
+		t.Errorf("ran the partial stats query %d times for a non-timeout failure", n)
+	}
+}
+
+func TestStatsFailureIsToldApartFromNoActivity(t *testing.T) {
+	tests := []struct {
+		name          string
+		failStats     bool
+		wantStats     bool
+		wantStatsErr  string
+		wantErrInJSON bool
+	}{
+		{"user without activity", false, true, "", false},
+		{"stats query fails", true, false, "stats unavailable", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t, testUser("1", "quiet"))
+			if tt.failStats {
+				store.OnError("json_agg", errors.New("pq: could not serialize access"))
+			} else {
+				store.OnRows("json_agg", statsColumnNames, []driver.Value{
+					[]byte(`{"id":"1"}`), []byte(`[]`), []byte(`[]`), int64(0), int64(0), int64(0), 0.0, 0.0,
+				})
+			}
+
+			w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/quiet", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			var response UserResponse
+			decode(t, w, &response)
+			if response.User.ID != "1" || response.User.Username != "quiet" {
+				t.Errorf("user = %s %q, want the stored user", response.User.ID, response.User.Username)
+			}
+			if (response.Stats != nil) != tt.wantStats {
+				t.Errorf("stats = %+v, want present %v", response.Stats, tt.wantStats)
+			}
+			if response.Meta.StatsError != tt.wantStatsErr {
+				t.Errorf("stats error = %q, want %q", response.Meta.StatsError, tt.wantStatsErr)
+			}
+			if got := strings.Contains(w.Body.String(), `"stats_error"`); got != tt.wantErrInJSON {
+				t.Errorf("stats_error in body = %v, want %v: %s", got, tt.wantErrInJSON, w.Body.String())
+			}
+			if strings.Contains(w.Body.String(), "serialize") {
+				t.Errorf("response leaks the database error: %s", w.Body.String())
+			}
+		})
+	}
+}
+
+// serveUserList routes ListUsers queries to store.users ordered by
+// followers, most first, and ids
+func serveUserList(store *testStore) {
+	store.On("SELECT COUNT(*) FROM instagram_users", func([]driver.Value) dbtest.Result {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return dbtest.Result{Columns: []string{"count"}, Rows: [][]driver.Value{{int64(len(store.users))}}}
+	})
+	store.On("LIMIT $1 OFFSET $2", func(args []driver.Value) dbtest.Result {
+		store.mu.Lock()
+		users := make([]*database.User, 0, len(store.users))
+		for _, u := range store.users {
+			users = append(users, u)
+		}
+		store.mu.Unlock()
+		sort.Slice(users, func(i, j int) bool {
+			if users[i].Followers != users[j].Followers {
+				return users[i].Followers > users[j].Followers
+			}
+			return users[i].ID < users[j].ID
+		})
+
+		limit, offset := int(args[0].(int64)), int(args[1].(int64))
+		result := dbtest.Result{Columns: userColumnNames}
+		for i := offset; i < offset+limit && i < len(users); i++ {
+			id := users[i].ID
+			result.Rows = append(result.Rows, store.userResult(func(u *database.User) bool { return u.ID == id }).Rows...)
+		}
+		return result
+	})
+}
+
+func TestListUsersPagination(t *testing.T) {
+	var users []*database.User
+	for i := 1; i <= 5; i++ {
+		user := testUser(fmt.Sprint(i), fmt.Sprintf("user%d", i))
+		user.Followers = int64(i * 100)
+		users = append(users, user)
+	}
+	store := newTestStore(t, users...)
+	serveUserList(store)
+
+	// Pages of two walk the users most followed first with a stable total
+	var ids []string
+	for offset := 0; offset < 6; offset += 2 {
+		w := serve(ListUsersHandler, http.MethodGet, "/users", fmt.Sprintf("/users?limit=2&offset=%d", offset), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("offset %d status = %d, body %s", offset, w.Code, w.Body.String())
+		}
+		var page UserListResponse
+		decode(t, w, &page)
+		want := Pagination{Total: 5, Limit: 2, Offset: offset, HasMore: offset+2 < 5}
+		if page.Pagination != want {
+			t.Errorf("offset %d pagination = %+v, want %+v", offset, page.Pagination, want)
+		}
+		for _, user := range page.Users {
+			ids = append(ids, user.ID)
+		}
+	}
+	if got := strings.Join(ids, ","); got != "5,4,3,2,1" {
+		t.Errorf("listed %s, want 5,4,3,2,1", got)
+	}
+}
+
+func TestListUsersParameters(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantLimit  int64 // bound to the query
+	}{
+		{"", http.StatusOK, 20},
+		{"?limit=100", http.StatusOK, 100},
+		{"?limit=1000", http.StatusOK, 100},
+		{"?sort=username", http.StatusOK, 20},
+		{"?limit=0", http.StatusBadRequest, 0},
+		{"?limit=ten", http.StatusBadRequest, 0},
+		{"?offset=-1", http.StatusBadRequest, 0},
+		{"?sort=id", http.StatusBadRequest, 0},
+		{"?sort=followers%3BDROP%20TABLE%20instagram_users", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			store := newTestStore(t)
+			serveUserList(store)
+
+			w := serve(ListUsersHandler, http.MethodGet, "/users", "/users"+tt.query, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			calls := store.Calls("LIMIT $1 OFFSET $2")
+			if tt.wantStatus != http.StatusOK {
+				if len(calls) != 0 {
+					t.Errorf("listed users for a rejected request")
+				}
+				return
+			}
+			if len(calls) != 1 || calls[0].Args[0] != tt.wantLimit {
+				t.Errorf("list queries = %v, want one with limit %d", calls, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestFetchUserCache(t *testing.T) {
+	store := newTestStore(t)
+	userCache = cache.NewTTLCache[string, *database.User](time.Minute, 10)
+	var scrapes int32
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		atomic.AddInt32(&scrapes, 1)
+		return scrapeAs(ctx, username)
+	})
+
+	// A miss scrapes and caches the result
+	_, source, _, err := fetchUser(context.Background(), "alice", fetchOptions{})
+	if err != nil || source != "rocketapi" {
+		t.Fatalf("first fetch source = %q, err %v, want rocketapi", source, err)
+	}
+	if cached, ok := userCache.Get("alice"); !ok || cached.ID != "id-alice" {
+		t.Fatalf("scraped user not cached")
+	}
+
+	// A hit skips the database and the scraper
+	lookups := len(store.Calls("FROM instagram_users WHERE username = $1"))
+	user, source, _, err := fetchUser(context.Background(), "alice", fetchOptions{})
+	if err != nil || source != "cache" || user.ID != "id-alice" {
+		t.Fatalf("second fetch = %+v from %q, err %v, want the cached user", user, source, err)
+	}
+	if n := len(store.Calls("FROM instagram_users WHERE username = $1")); n != lookups {
+		t.Errorf("cache hit read the database")
+	}
+	if n := atomic.LoadInt32(&scrapes); n != 1 {
+		t.Errorf("scraped %d times, want 1", n)
+	}
+
+	// A refresh bypasses the cache
+	if _, source, _, _ = fetchUser(context.Background(), "alice", fetchOptions{Refresh: true}); source != "rocketapi" {
+		t.Errorf("refresh served from %q, want rocketapi", source)
+	}
+}
+
+func TestFetchUserCachesDatabaseReads(t *testing.T) {
+	store := newTestStore(t, testUser("1", "alice"))
+	userCache = cache.NewTTLCache[string, *database.User](time.Minute, 10)
+
+	for i, want := range []string{"database", "cache"} {
+		if _, source, _, err := fetchUser(context.Background(), "alice", fetchOptions{}); err != nil || source != want {
+			t.Errorf("fetch %d source = %q, err %v, want %s", i, source, err, want)
+		}
+	}
+	if n := len(store.Calls("FROM instagram_users WHERE username = $1")); n != 1 {
+		t.Errorf("read the database %d times, want 1", n)
+	}
+}
+
+func TestUserExistsHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		stored     []*database.User
+		cached     *database.User
+		username   string
+		wantStatus int
+		wantSource string
+		wantScrape bool
+	}{
+		{"cached", nil, testUser("1", "alice"), "alice", http.StatusOK, "cache", false},
+		{"stored", []*database.User{testUser("1", "alice")}, nil, "alice", http.StatusOK, "database", false},
+		{"scrapable", nil, nil, "pic_uploader", http.StatusOK, "rocketapi", true},
+		{"not found", nil, nil, "ghost", http.StatusNotFound, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t, tt.stored...)
+			userCache = cache.NewTTLCache[string, *database.User](time.Minute, 10)
+			if tt.cached != nil {
+				userCache.Set(tt.cached.Username, tt.cached)
+			}
+			scraped := false
+			stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+				scraped = true
+				if username == "ghost" {
+					return nil, external.UserNotFoundError{Username: username, Message: "HTTP 404"}
+				}
+				return scrapeWithPicture(ctx, username)
+			})
+			storage := external.GetStorageClient().(*external.MockStorageClient)
+			uploads := storage.GetUploadCount()
+
+			w := serve(UserExistsHandler, http.MethodGet, "/user/:username/exists", "/user/"+tt.username+"/exists", nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if scraped != tt.wantScrape {
+				t.Errorf("scraped = %v, want %v", scraped, tt.wantScrape)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var response UserExistsResponse
+				decode(t, w, &response)
+				if !response.Exists || response.Username != tt.username || response.Source != tt.wantSource {
+					t.Errorf("response = %+v, want %s to exist from %s", response, tt.username, tt.wantSource)
+				}
+			} else {
+				var body struct {
+					Code string `json:"code"`
+				}
+				decode(t, w, &body)
+				if body.Code != apierror.CodeUserNotFound {
+					t.Errorf("code = %q, want %q", body.Code, apierror.CodeUserNotFound)
+				}
+			}
+
+			if n := len(store.Calls("json_agg")); n != 0 {
+				t.Errorf("ran the stats query %d times, want none", n)
+			}
+			if storage.GetUploadCount() != uploads || len(store.Calls("SET profile_pic_storage_url")) != 0 {
+				t.Error("uploaded a profile picture for an exists check")
+			}
+		})
+	}
+}
+
+func TestUserExistsHandlerHead(t *testing.T) {
+	newTestStore(t, testUser("1", "alice"))
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		return nil, external.UserNotFoundError{Username: username, Message: "HTTP 404"}
+	})
+
+	for target, want := range map[string]int{
+		"/user/alice/exists": http.StatusOK,
+		"/user/ghost/exists": http.StatusNotFound,
+	} {
+		if w := serve(UserExistsHandler, http.MethodHead, "/user/:username/exists", target, nil); w.Code != want {
+			t.Errorf("HEAD %s status = %d, want %d", target, w.Code, want)
+		}
+	}
+}
+
+func TestUserStatsListLimits(t *testing.T) {
+	tests := []struct {
+		query                      string
+		wantStatus                 int
+		wantTagged, wantCoauthored int64
+	}{
+		{"", http.StatusOK, 10, 10},
+		{"?tagged_limit=3", http.StatusOK, 3, 10},
+		{"?coauthored_limit=7", http.StatusOK, 10, 7},
+		{"?tagged_limit=50&coauthored_limit=1", http.StatusOK, 50, 1},
+		{"?tagged_limit=0", http.StatusBadRequest, 0, 0},
+		{"?coauthored_limit=51", http.StatusBadRequest, 0, 0},
+		{"?tagged_limit=five", http.StatusBadRequest, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			store := newTestStore(t, testUser("1", "alice"))
+			store.OnRows("json_agg", statsColumnNames, []driver.Value{
+				[]byte(`{"id":"1"}`), []byte(`[]`), []byte(`[]`), int64(0), int64(0), int64(0), 0.0, 0.0,
+			})
+
+			w := serve(GetUserStatsHandler, http.MethodGet, "/users/:id/stats", "/users/1/stats"+tt.query, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			calls := store.Calls("json_agg")
+			if tt.wantStatus != http.StatusOK {
+				if len(calls) != 0 {
+					t.Error("ran the stats query for a rejected request")
+				}
+				return
+			}
+			if len(calls) != 1 {
+				t.Fatalf("ran %d stats queries, want 1", len(calls))
+			}
+			if args := calls[0].Args; args[1] != tt.wantTagged || args[2] != tt.wantCoauthored {
+				t.Errorf("limits bound as %v/%v, want %d/%d", args[1], args[2], tt.wantTagged, tt.wantCoauthored)
+			}
+		})
+	}
+}
+
+func TestSyncBatchReturnsPartialResultsAtTimeout(t *testing.T) {
+	newTestStore(t)
+
+	// Slow users hold their worker until the batch deadline
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		if strings.HasPrefix(username, "slow") {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return scrapeAs(ctx, username)
+	})
+
+	started := time.Now()
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames":       []string{"fast1", "fast2", "slow1", "slow2", "slow3", "slow4"},
+		"max_concurrency": 2,
+		"timeout_seconds": 1,
+	})
+	elapsed := time.Since(started)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if elapsed < time.Second || elapsed > 2*time.Second {
+		t.Errorf("batch returned after %v, want near the 1s deadline", elapsed)
+	}
+
+	var response BatchResponse
+	decode(t, w, &response)
+	if len(response.Results) != 6 {
+		t.Fatalf("got %d results, want 6", len(response.Results))
+	}
+	for _, result := range response.Results {
+		slow := strings.HasPrefix(result.Identifier, "slow")
+		switch {
+		case slow && (result.Status != "error" || result.Error != "timeout"):
+			t.Errorf("%s = %s %q, want an error with timeout", result.Identifier, result.Status, result.Error)
+		case !slow && result.Status != "success":
+			t.Errorf("%s = %s %q, want success", result.Identifier, result.Status, result.Error)
+		}
+	}
+	if s := response.Summary; s.Successful != 2 || s.Failed != 4 {
+		t.Errorf("summary = %+v, want 2 successful and 4 failed", s)
+	}
+}
+
+func TestBatchSeparatesPrivateAccounts(t *testing.T) {
+	tests := []struct {
+		name            string
+		separatePrivate bool
+		wantStatus      string
+		wantSuccessful  int
+		wantPrivate     int
+	}{
+		{"counted as success by default", false, "success", 2, 0},
+		{"counted separately when asked", true, "private", 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// hidden is a private account, public is not, and ghost doesn't exist
+			newTestStore(t)
+			stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+				if username == "ghost" {
+					return nil, external.UserNotFoundError{Username: username, Message: "user not found"}
+				}
+				user, _ := scrapeAs(ctx, username)
+				user.IsPrivate = username == "hidden"
+				return user, nil
+			})
+
+			w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+				"usernames":        []string{"hidden", "public", "ghost"},
+				"separate_private": tt.separatePrivate,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			var response BatchResponse
+			decode(t, w, &response)
+
+			for _, result := range response.Results {
+				if result.Identifier == "hidden" && result.Status != tt.wantStatus {
+					t.Errorf("private account status = %q, want %q", result.Status, tt.wantStatus)
+				}
+			}
+			s := response.Summary
+			if s.Successful != tt.wantSuccessful || s.Private != tt.wantPrivate || s.Failed != 1 {
+				t.Errorf("summary successful=%d private=%d failed=%d, want %d/%d/1",
+					s.Successful, s.Private, s.Failed, tt.wantSuccessful, tt.wantPrivate)
+			}
+		})
+	}
+}
+
+func TestBuildUserResponseWithoutStats(t *testing.T) {
+	store := newTestStore(t)
+	store.OnError("json_agg", errors.New("stats query ran"))
+	useConfig(t, func(cfg *utils.Config) { cfg.Provenance = true })
+	user := testUser("1", "alice")
+
+	response := buildUserResponse(context.Background(), user, "database", false, database.StatsOptions{})
+	if response.Stats != nil || response.Meta.StatsError != "" {
+		t.Errorf("stats = %+v, error %q, want neither", response.Stats, response.Meta.StatsError)
+	}
+	if _, ok := response.Meta.Provenance["stats"]; ok {
+		t.Errorf("provenance %v names a stats source", response.Meta.Provenance)
+	}
+	if response.User.Username != "alice" || response.Meta.Source != "database" {
+		t.Errorf("user %q from %q, want alice from database", response.User.Username, response.Meta.Source)
+	}
+	if n := len(store.Calls("json_agg")) + len(store.Calls("FROM user_stats_cache")); n != 0 {
+		t.Errorf("ran %d stats queries for a response without stats", n)
+	}
+
+	// The same user with stats does query them
+	response = buildUserResponse(context.Background(), user, "database", true, database.StatsOptions{})
+	if response.Meta.StatsError == "" {
+		t.Error("no stats error when the stats query fails")
+	}
+	if n := len(store.Calls("json_agg")); n == 0 {
+		t.Error("stats query didn't run for a response with stats")
+	}
+}
+
+func TestGetUserFindsRenamedUserByOldUsername(t *testing.T) {
+	for _, fallback := range []bool{true, false} {
+		t.Run(fmt.Sprintf("fallback=%v", fallback), func(t *testing.T) {
+			store := newTestStore(t, testUser("1", "alice_new"))
+			store.On("FROM username_history", func(args []driver.Value) dbtest.Result {
+				result := dbtest.Result{Columns: []string{"user_id"}}
+				if args[0] == "alice" {
+					result.Rows = append(result.Rows, []driver.Value{"1"})
+				}
+				return result
+			})
+			useConfig(t, func(cfg *utils.Config) { cfg.UsernameFallback = fallback })
+			mock := &MockScraper{}
+			useMockScraper(t, mock)
+
+			w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice?stats=false", nil)
+			if !fallback {
+				if w.Code != http.StatusNotFound || len(store.Calls("FROM username_history")) != 0 {
+					t.Errorf("status = %d after %d history lookups, want 404 without any", w.Code, len(store.Calls("FROM username_history")))
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			var response UserResponse
+			decode(t, w, &response)
+			if response.User.ID != "1" || response.User.Username != "alice_new" || response.Meta.Source != "database" {
+				t.Errorf("got %s (%s) from %q, want the stored alice_new", response.User.ID, response.User.Username, response.Meta.Source)
+			}
+			if len(mock.Calls) != 0 {
+				t.Errorf("scraped %v for a user resolved by id", mock.Calls)
+			}
+		})
+	}
+}
+
+func TestGetUserRefresh(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		scrapeErr     error
+		wantSource    string
+		wantFollowers int64
+		wantFailed    bool
+	}{
+		{"stored copy by default", "", nil, "database", 100, false},
+		{"forced refresh", "refresh=true", nil, "rocketapi", 500, false},
+		{"fresh enough for max_age", "max_age=2h", nil, "database", 100, false},
+		{"stale past max_age", "max_age=30m", nil, "rocketapi", 500, false},
+		{"failed refresh falls back", "refresh=true", errors.New("failed to parse user data"), "database", 100, true},
+		{"failed stale refresh falls back", "max_age=30m", errors.New("failed to parse user data"), "database", 100, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := testUser("1", "alice")
+			stored.ScrapedAt = time.Now().Add(-time.Hour)
+			store := newTestStore(t, stored)
+			mock := &MockScraper{Users: map[string]*database.User{"alice": {ID: "1", Username: "alice", Followers: 500, ScrapedAt: time.Now()}}, Err: tt.scrapeErr}
+			useMockScraper(t, mock)
+
+			w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice?stats=false&"+tt.query, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			var response UserResponse
+			decode(t, w, &response)
+			if response.Meta.Source != tt.wantSource || response.User.Followers != tt.wantFollowers || response.Meta.RefreshFailed != tt.wantFailed {
+				t.Errorf("got %d followers from %q, refresh failed %v; want %d from %q, %v",
+					response.User.Followers, response.Meta.Source, response.Meta.RefreshFailed,
+					tt.wantFollowers, tt.wantSource, tt.wantFailed)
+			}
+
+			upserts := len(store.Calls("INSERT INTO instagram_users"))
+			if wantUpsert := tt.wantSource == "rocketapi"; (upserts > 0) != wantUpsert {
+				t.Errorf("%d upserts, want an upsert only for a successful refresh", upserts)
+			}
+			if wantScrape := tt.query != "" && tt.query != "max_age=2h"; (len(mock.Calls) > 0) != wantScrape {
+				t.Errorf("scraped %v", mock.Calls)
+			}
+		})
+	}
+}
+
+func TestGetUserRejectsInvalidRefreshOptions(t *testing.T) {
+	for _, query := range []string{"refresh=maybe", "max_age=soon", "max_age=-1h"} {
+		newTestStore(t, testUser("1", "alice"))
+		w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice?"+query, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("?%s status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestGetUserPosts(t *testing.T) {
+	store := newTestStore(t, testUser("1", "alice"), testUser("2", "bob"))
+	now := time.Now()
+	posts := [][]driver.Value{
+		{"p3", "1", "alice", "reel", int64(30), int64(3), int64(900), false, now, now, now},
+		{"p2", "1", "alice", nil, int64(20), int64(2), nil, false, now.Add(-time.Hour), now, now},
+		{"p1", "1", "alice", nil, int64(10), int64(1), nil, false, now.Add(-2 * time.Hour), now, now},
+	}
+	store.On("COUNT(*) FROM instagram_posts WHERE user_id", func(args []driver.Value) dbtest.Result {
+		count := int64(0)
+		if args[0] == "1" {
+			count = int64(len(posts))
+		}
+		return dbtest.Result{Columns: []string{"count"}, Rows: [][]driver.Value{{count}}}
+	})
+	store.On("ORDER BY posted_at DESC", func(args []driver.Value) dbtest.Result {
+		result := dbtest.Result{Columns: []string{
+			"id", "user_id", "username", "caption", "like_count", "comment_count",
+			"play_count", "is_ad", "posted_at", "created_at", "updated_at",
+		}}
+		if args[0] != "1" {
+			return result
+		}
+		limit, offset := int(args[1].(int64)), int(args[2].(int64))
+		for i := offset; i < offset+limit && i < len(posts); i++ {
+			result.Rows = append(result.Rows, posts[i])
+		}
+		return result
+	})
+
+	get := func(target string) *httptest.ResponseRecorder {
+		return serve(GetUserPostsHandler, http.MethodGet, "/users/:id/posts", target, nil)
+	}
+
+	w := get("/users/1/posts?limit=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	// Post only marshals its nullable caption, so decode the fields checked
+	type postPage struct {
+		Posts []struct {
+			ID        string  `json:"id"`
+			PlayCount *int64  `json:"play_count"`
+			Caption   *string `json:"caption"`
+		} `json:"posts"`
+		Pagination Pagination `json:"pagination"`
+	}
+	var page postPage
+	decode(t, w, &page)
+	if len(page.Posts) != 2 || page.Posts[0].ID != "p3" || !page.Pagination.HasMore || page.Pagination.Total != 3 {
+		t.Fatalf("first page = %d posts, pagination %+v, want p3 first of 3 with more", len(page.Posts), page.Pagination)
+	}
+	if page.Posts[0].PlayCount == nil || *page.Posts[0].PlayCount != 900 || page.Posts[1].PlayCount != nil {
+		t.Errorf("play counts = %v, %v, want 900 and null", page.Posts[0].PlayCount, page.Posts[1].PlayCount)
+	}
+	if page.Posts[1].Caption != nil {
+		t.Errorf("null caption = %q, want null", *page.Posts[1].Caption)
+	}
+
+	page = postPage{}
+	decode(t, get("/users/1/posts?limit=2&offset=2"), &page)
+	if len(page.Posts) != 1 || page.Posts[0].ID != "p1" || page.Pagination.HasMore {
+		t.Errorf("last page = %d posts, pagination %+v, want p1 only", len(page.Posts), page.Pagination)
+	}
+
+	// No posts is an empty array, not null
+	if w := get("/users/2/posts"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"posts":[]`) {
+		t.Errorf("user without posts: status %d, body %s", w.Code, w.Body.String())
+	}
+	if w := get("/users/404/posts"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown user status = %d, want 404", w.Code)
+	}
+	for _, query := range []string{"limit=0", "limit=x", "offset=-1"} {
+		if w := get("/users/1/posts?" + query); w.Code != http.StatusBadRequest {
+			t.Errorf("?%s status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestGetUserTaggedAndCoauthoredPages(t *testing.T) {
+	store := newTestStore(t, testUser("1", "alice"))
+	tagged := [][]driver.Value{
+		{"zed", int64(3), int64(30), int64(3), int64(0)},
+		{"amy", int64(2), int64(20), int64(2), int64(0)},
+		{"bea", int64(2), int64(20), int64(2), int64(0)},
+	}
+	coauthored := [][]driver.Value{
+		{"alice", int64(3), int64(30), int64(3)},
+		{"bob", int64(1), int64(5), int64(0)},
+	}
+	// page answers a list query with the rows in [offset, offset+limit)
+	page := func(columns []string, rows [][]driver.Value) dbtest.Handler {
+		return func(args []driver.Value) dbtest.Result {
+			result := dbtest.Result{Columns: columns}
+			limit, offset := int(args[1].(int64)), int(args[2].(int64))
+			for i := offset; i < offset+limit && i < len(rows); i++ {
+				result.Rows = append(result.Rows, rows[i])
+			}
+			return result
+		}
+	}
+	store.OnRows("COUNT(DISTINCT t.username)", []string{"count"}, []driver.Value{int64(len(tagged))})
+	store.OnRows("COUNT(DISTINCT username)", []string{"count"}, []driver.Value{int64(len(coauthored))})
+	store.On("GROUP BY t.username", page([]string{"username", "count", "total_likes", "total_comments", "total_plays"}, tagged))
+	store.On("GROUP BY p.username", page([]string{"username", "collaboration_count", "total_likes", "total_comments"}, coauthored))
+
+	w := serve(GetUserTaggedHandler, http.MethodGet, "/users/:id/tagged", "/users/1/tagged?limit=2", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var taggedPage TaggedUsernameListResponse
+	decode(t, w, &taggedPage)
+	if len(taggedPage.TaggedUsernames) != 2 || taggedPage.TaggedUsernames[0].Username != "zed" || taggedPage.TaggedUsernames[1].Username != "amy" {
+		t.Errorf("first tagged page = %+v, want zed and amy", taggedPage.TaggedUsernames)
+	}
+	if p := taggedPage.Pagination; p.Total != 3 || p.Limit != 2 || p.Offset != 0 || !p.HasMore {
+		t.Errorf("first tagged page pagination = %+v, want 2 of 3 with more", p)
+	}
+
+	w = serve(GetUserTaggedHandler, http.MethodGet, "/users/:id/tagged", "/users/1/tagged?limit=2&offset=2", nil)
+	decode(t, w, &taggedPage)
+	if len(taggedPage.TaggedUsernames) != 1 || taggedPage.TaggedUsernames[0].Username != "bea" || taggedPage.Pagination.HasMore {
+		t.Errorf("last tagged page = %+v, pagination %+v, want bea without more", taggedPage.TaggedUsernames, taggedPage.Pagination)
+	}
+
+	w = serve(GetUserCoauthoredHandler, http.MethodGet, "/users/:id/coauthored", "/users/1/coauthored?limit=500", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var coauthoredPage CoauthoredUsernameListResponse
+	decode(t, w, &coauthoredPage)
+	if len(coauthoredPage.CoauthoredUsernames) != 2 || coauthoredPage.CoauthoredUsernames[0].Collaborator != "alice" {
+		t.Errorf("coauthored page = %+v, want alice then bob", coauthoredPage.CoauthoredUsernames)
+	}
+	if p := coauthoredPage.Pagination; p.Limit != 100 || p.Total != 2 || p.HasMore {
+		t.Errorf("coauthored pagination = %+v, want the limit capped at 100 and no more", p)
+	}
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/users/9/tagged", http.StatusNotFound},
+		{"/users/1/tagged?limit=0", http.StatusBadRequest},
+		{"/users/1/tagged?offset=-1", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := serve(GetUserTaggedHandler, http.MethodGet, "/users/:id/tagged", tt.target, nil); w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+// serveStoredLookup routes GetUsersByUsernames queries to store.users
+func serveStoredLookup(t *testing.T, store *testStore) {
+	store.On("WHERE username = ANY($1)", func(args []driver.Value) dbtest.Result {
+		var usernames pq.StringArray
+		if err := usernames.Scan(args[0]); err != nil {
+			t.Errorf("usernames argument %v: %v", args[0], err)
+		}
+		return store.userResult(func(u *database.User) bool {
+			for _, username := range usernames {
+				if u.Username == username {
+					return true
+				}
+			}
+			return false
+		})
+	})
+}
+
+func TestListUsersByUsernamesReturnsOnlyStoredUsers(t *testing.T) {
+	store := newTestStore(t, testUser("1", "alice"), testUser("2", "bob"))
+	serveStoredLookup(t, store)
+	mock := &MockScraper{Users: map[string]*database.User{"carol": {ID: "3", Username: "carol"}}}
+	useMockScraper(t, mock)
+
+	w := serve(ListUsersHandler, http.MethodGet, "/users", "/users?usernames=alice,carol,Alice,bob,bad..name", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response StoredUsersResponse
+	decode(t, w, &response)
+
+	var found []string
+	for _, user := range response.Users {
+		found = append(found, user.Username)
+	}
+	if strings.Join(found, ",") != "alice,bob" || strings.Join(response.NotFound, ",") != "carol" {
+		t.Errorf("found %v, not found %v, want alice,bob and carol", found, response.NotFound)
+	}
+	if len(response.InvalidUsers) != 1 {
+		t.Errorf("invalid users = %+v, want bad..name", response.InvalidUsers)
+	}
+	if len(mock.Calls) != 0 {
+		t.Errorf("scraped %v for a stored-only lookup", mock.Calls)
+	}
+
+	// Duplicates are looked up once, in a single query
+	calls := store.Calls("WHERE username = ANY($1)")
+	if len(calls) != 1 {
+		t.Fatalf("ran %d lookups, want 1", len(calls))
+	}
+	var queried pq.StringArray
+	queried.Scan(calls[0].Args[0])
+	if strings.Join(queried, ",") != "alice,carol,bob" {
+		t.Errorf("queried usernames %v, want alice,carol,bob", queried)
+	}
+}
+
+func TestListUsersByUsernamesLimits(t *testing.T) {
+	newTestStore(t)
+
+	usernames := make([]string, maxStoredUsersLookup+1)
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("user_%d", i)
+	}
+	for name, target := range map[string]string{
+		"too many":   "/users?usernames=" + strings.Join(usernames, ","),
+		"none valid": "/users?usernames=bad..name,",
+	} {
+		if w := serve(ListUsersHandler, http.MethodGet, "/users", target, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, w.Code)
+		}
+	}
+
+	// The cap counts distinct usernames
+	store := newTestStore(t)
+	serveStoredLookup(t, store)
+	repeated := strings.Repeat("alice,", maxStoredUsersLookup+1)
+	if w := serve(ListUsersHandler, http.MethodGet, "/users", "/users?usernames="+repeated, nil); w.Code != http.StatusOK {
+		t.Errorf("repeated username status = %d, want 200", w.Code)
+	}
+}
+
+// fastTransientRetry shortens the pause before retrying a transient scrape
+// failure for the duration of the test
+func fastTransientRetry(t *testing.T) {
+	prev := transientRetryDelay
+	transientRetryDelay = time.Millisecond
+	t.Cleanup(func() { transientRetryDelay = prev })
+}
+
+// flakyScraper fails each username's first failures scrapes with err, then
+// scrapes it as scrapeAs would
+func flakyScraper(t *testing.T, failures int, err error) *int32 {
+	t.Helper()
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	var calls int32
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		atomic.AddInt32(&calls, 1)
+		mu.Lock()
+		attempts[username]++
+		n := attempts[username]
+		mu.Unlock()
+		if n <= failures {
+			return nil, err
+		}
+		return scrapeAs(ctx, username)
+	})
+	return &calls
+}
+
+func TestScrapeWithRetry(t *testing.T) {
+	fastTransientRetry(t)
+
+	transient := external.UpstreamError{StatusCode: 503}
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		timeout   time.Duration
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"transient then success", 1, transient, 0, false, 2},
+		{"retried only once", 2, transient, 0, true, 2},
+		{"not transient", 1, external.UserNotFoundError{Username: "alice"}, 0, true, 1},
+		{"deadline too close", 1, transient, minRetryBudget / 2, true, 1},
+		{"enough budget left", 1, transient, 2 * minRetryBudget, false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := flakyScraper(t, tt.failures, tt.err)
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			user, err := scrapeWithRetry(ctx, "alice")
+			if (err != nil) != tt.wantErr || (err == nil && user.Username != "alice") {
+				t.Errorf("scrapeWithRetry = %v, %v, want error %v", user, err, tt.wantErr)
+			}
+			if *calls != tt.wantCalls {
+				t.Errorf("scraped %d times, want %d", *calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestScrapeWithRetryStaysWithinUpstreamBudget(t *testing.T) {
+	fastTransientRetry(t)
+
+	// Each scrape stands in for the RocketAPI client spending all its
+	// attempts on a 503 before giving up
+	const clientAttempts = 5
+	var upstreamCalls int32
+	stubScraper(t, func(context.Context, string) (*database.User, error) {
+		attempts := make([]external.RetryAttempt, clientAttempts)
+		for i := range attempts {
+			atomic.AddInt32(&upstreamCalls, 1)
+			attempts[i] = external.RetryAttempt{Attempt: i + 1, Err: external.UpstreamError{StatusCode: 503}}
+		}
+		return nil, external.RetryError{Operation: "ScrapeInstagramUser", Attempts: attempts}
+	})
+
+	_, err := scrapeWithRetry(context.Background(), "alice")
+	if !external.IsTransient(err) {
+		t.Fatalf("scrapeWithRetry error = %v, want the client's transient failure", err)
+	}
+	if upstreamCalls != clientAttempts {
+		t.Errorf("made %d upstream calls, want the client's %d", upstreamCalls, clientAttempts)
+	}
+}
+
+func TestBatchRecoversFromTransientScrapeFailure(t *testing.T) {
+	newTestStore(t)
+	fastTransientRetry(t)
+	calls := flakyScraper(t, 1, external.RateLimitedError{RetryAfter: time.Second})
+
+	results := fetchDataForUsers(context.Background(), usernameTargets("alice", "bob"), 2, nil)
+	for _, result := range results {
+		if result.Status != "success" {
+			t.Errorf("%s: status %q, error %q, want recovery on retry", result.Identifier, result.Status, result.Error)
+		}
+	}
+	if *calls != 4 {
+		t.Errorf("scraped %d times, want two attempts per user", *calls)
+	}
+}
+
+func TestProvenanceOfCachedUserWithFreshStats(t *testing.T) {
+	store := newTestStore(t)
+	useConfig(t, func(cfg *utils.Config) { cfg.Provenance = true })
+	userCache = cache.NewTTLCache[string, *database.User](time.Minute, 10)
+	cached := testUser("1", "alice")
+	cached.ProfilePicURL = sql.NullString{String: "https://cdn.instagram.com/alice.jpg", Valid: true}
+	cached.ProfilePicStorageURL = sql.NullString{String: "https://bucket.s3.amazonaws.com/alice.jpg", Valid: true}
+	userCache.Set("alice", cached)
+	store.OnRows("json_agg", statsColumnNames, []driver.Value{
+		[]byte(`{"id":"1"}`), []byte(`[]`), []byte(`[]`), int64(3), int64(0), int64(0), 1.5, 0.5,
+	})
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	// Only the meta is decoded, as User doesn't unmarshal its nullable fields
+	var response struct {
+		Meta ResponseMeta `json:"meta"`
+	}
+	decode(t, w, &response)
+
+	want := map[string]string{"user": "cache", "stats": "database", "profile_pic": "s3"}
+	if !maps.Equal(response.Meta.Provenance, want) {
+		t.Errorf("provenance = %v, want %v", response.Meta.Provenance, want)
+	}
+	if len(store.Calls("FROM instagram_users WHERE username = $1")) != 0 {
+		t.Error("read the user from the database on a cache hit")
+	}
+
+	// Provenance is only reported when enabled
+	useConfig(t, func(cfg *utils.Config) { cfg.Provenance = false })
+	response.Meta = ResponseMeta{}
+	decode(t, serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/alice", nil), &response)
+	if response.Meta.Provenance != nil {
+		t.Errorf("provenance = %v with provenance disabled", response.Meta.Provenance)
+	}
+}
+
+func TestProvenanceSections(t *testing.T) {
+	now := time.Now()
+	withPic := testUser("1", "alice")
+	withPic.ProfilePicURL = sql.NullString{String: "https://cdn.instagram.com/alice.jpg", Valid: true}
+
+	tests := []struct {
+		name   string
+		user   *database.User
+		source string
+		stats  *database.UserStats
+		want   map[string]string
+	}{
+		{"scraped without stats", withPic, "rocketapi", nil, map[string]string{"user": "rocketapi", "profile_pic": "instagram"}},
+		{"cached stats", testUser("1", "alice"), "database", &database.UserStats{CachedAt: &now}, map[string]string{"user": "database", "stats": "stats_cache"}},
+		{"partial stats", testUser("1", "alice"), "database", &database.UserStats{Partial: true}, map[string]string{"user": "database", "stats": "partial"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := provenance(tt.user, tt.source, tt.stats); !maps.Equal(got, tt.want) {
+				t.Errorf("provenance = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchUsersHandler(t *testing.T) {
+	store := newTestStore(t)
+	store.OnRows("ILIKE $1", userColumnNames)
+
+	for _, tt := range []struct {
+		query      string
+		wantStatus int
+		wantLimit  int64
+	}{
+		{"q=al", http.StatusOK, 10},
+		{"q=%20%20al%20", http.StatusOK, 10},
+		{"q=al&limit=500", http.StatusOK, 100},
+		{"q=a", http.StatusBadRequest, 0},
+		{"q=%20a%20", http.StatusBadRequest, 0},
+		{"", http.StatusBadRequest, 0},
+		{"q=al&limit=0", http.StatusBadRequest, 0},
+	} {
+		before := len(store.Calls("ILIKE $1"))
+		w := serve(SearchUsersHandler, http.MethodGet, "/users/search", "/users/search?"+tt.query, nil)
+		if w.Code != tt.wantStatus {
+			t.Errorf("?%s status = %d, want %d", tt.query, w.Code, tt.wantStatus)
+			continue
+		}
+		calls := store.Calls("ILIKE $1")[before:]
+		if tt.wantStatus != http.StatusOK {
+			if len(calls) != 0 {
+				t.Errorf("?%s searched the database for a rejected query", tt.query)
+			}
+			continue
+		}
+		if len(calls) != 1 || calls[0].Args[0] != "%al%" || calls[0].Args[1] != tt.wantLimit {
+			t.Errorf("?%s searched with %v, want %%al%% and limit %d", tt.query, calls, tt.wantLimit)
+		}
+		if !strings.Contains(w.Body.String(), `"users":[]`) {
+			t.Errorf("?%s body %s, want an empty users array", tt.query, w.Body.String())
+		}
+	}
+}
+
+// scrapeWithPicture is a scraper returning users with a profile picture
+// named after them
+func scrapeWithPicture(ctx context.Context, username string) (*database.User, error) {
+	user, _ := scrapeAs(ctx, username)
+	user.ProfilePicURL = sql.NullString{String: "https://cdn.example.com/" + username + ".jpg", Valid: true}
+	return user, nil
+}
+
+func TestScrapeUploadsProfilePicture(t *testing.T) {
+	store := newTestStore(t)
+	stubScraper(t, scrapeWithPicture)
+	storage := external.GetStorageClient().(*external.MockStorageClient)
+	before := storage.GetUploadCount()
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/pic_uploader?stats=false", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if got := storage.GetUploadCount() - before; got != 1 {
+		t.Fatalf("upload count grew by %d, want 1", got)
+	}
+	if got := mockUploads(t)["id-pic_uploader"]; got != "https://cdn.example.com/pic_uploader.jpg" {
+		t.Errorf("storage received %q, want the scraped picture", got)
+	}
+
+	wantURL := storage.GetUploadURL("id-pic_uploader")
+	if got := store.user("id-pic_uploader").ProfilePicStorageURL.String; got != wantURL {
+		t.Errorf("stored upload URL = %q, want %q", got, wantURL)
+	}
+	if !strings.Contains(w.Body.String(), `"profile_pic_storage_url":"`+wantURL+`"`) {
+		t.Errorf("response %s doesn't carry the upload URL", w.Body.String())
+	}
+}
+
+func TestScrapeWithoutPictureSkipsUpload(t *testing.T) {
+	store := newTestStore(t)
+	stubScraper(t, scrapeAs)
+	storage := external.GetStorageClient().(*external.MockStorageClient)
+	before := storage.GetUploadCount()
+
+	if w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/no_picture?stats=false", nil); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if storage.GetUploadCount() != before || len(store.Calls("SET profile_pic_storage_url")) != 0 {
+		t.Error("uploaded a picture for a user without one")
+	}
+}
+
+func TestFailedUploadRecordDoesntFailScrape(t *testing.T) {
+	store := newTestStore(t)
+	store.OnError("SET profile_pic_storage_url", errors.New("connection reset"))
+	stubScraper(t, scrapeWithPicture)
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/pic_unrecorded?stats=false", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), `"profile_pic_storage_url":"`) {
+		t.Errorf("response %s has an upload URL that wasn't recorded", w.Body.String())
+	}
+}
+
+func TestRefreshWithUnchangedPictureSkipsUpload(t *testing.T) {
+	stored := testUser("id-pic_unchanged", "pic_unchanged")
+	stored.ProfilePicURL = sql.NullString{String: "https://cdn.example.com/pic_unchanged.jpg", Valid: true}
+	stored.ProfilePicStorageURL = sql.NullString{String: "https://bucket.example.com/pic_unchanged.jpg", Valid: true}
+	store := newTestStore(t, stored)
+	stubScraper(t, scrapeWithPicture)
+
+	w := serve(GetUserHandler, http.MethodGet, "/user/:username", "/user/pic_unchanged?stats=false&refresh=true", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if _, ok := mockUploads(t)["id-pic_unchanged"]; ok {
+		t.Error("re-uploaded an unchanged profile picture")
+	}
+	if !strings.Contains(w.Body.String(), `"profile_pic_storage_url":"https://bucket.example.com/pic_unchanged.jpg"`) {
+		t.Errorf("response %s lost the stored upload URL", w.Body.String())
+	}
+	if len(store.Calls("SET profile_pic_storage_url")) != 0 {
+		t.Error("rewrote the upload URL of an unchanged picture")
+	}
+}
+
+func TestBatchCollapsesDuplicateUsernames(t *testing.T) {
+	newTestStore(t)
+	mock := &MockScraper{Users: map[string]*database.User{
+		"abc": {ID: "1", Username: "abc"},
+		"def": {ID: "2", Username: "def"},
+	}}
+	useMockScraper(t, mock)
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames":       []string{"abc", "ABC", "abc", "def"},
+		"max_concurrency": 1,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if !slices.Equal(mock.Calls, []string{"abc", "def"}) {
+		t.Errorf("scraped %v, want abc and def once each", mock.Calls)
+	}
+
+	var response BatchResponse
+	decode(t, w, &response)
+	if len(response.Results) != 2 {
+		t.Fatalf("got %d results, want 2", len(response.Results))
+	}
+	s := response.Summary
+	if s.Total != 4 || s.Duplicates != 2 || s.Successful != 2 || s.Failed != 0 {
+		t.Errorf("summary total=%d duplicates=%d successful=%d failed=%d, want 4/2/2/0", s.Total, s.Duplicates, s.Successful, s.Failed)
+	}
+}
+
+func TestValidateTargetsKeepsFirstOccurrence(t *testing.T) {
+	targets, invalid := validateTargets([]string{"def", "ABC", "abc", "@Def", "bad name!", "abc"}, []string{"42", "42", "7"})
+	var got []string
+	for _, target := range targets {
+		got = append(got, target.Type+":"+target.Identifier)
+	}
+	want := []string{"username:def", "username:abc", "id:42", "id:7"}
+	if !slices.Equal(got, want) {
+		t.Errorf("targets = %v, want %v", got, want)
+	}
+	if len(invalid) != 1 || invalid[0].Index != 4 {
+		t.Errorf("invalid = %+v, want only index 4", invalid)
+	}
+}
+
+func TestStatsOverviewHandler(t *testing.T) {
+	store := newTestStore(t)
+	store.OnRows("COUNT(*) FILTER (WHERE is_verified)", []string{"count", "verified", "business", "private", "sum", "max", "avg"},
+		[]driver.Value{int64(3), int64(1), int64(0), int64(2), int64(600), int64(500), 200.0})
+
+	w := serve(StatsOverviewHandler, http.MethodGet, "/stats/overview", "/stats/overview", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var stats database.AggregateStats
+	decode(t, w, &stats)
+	want := database.AggregateStats{TotalUsers: 3, VerifiedUsers: 1, PrivateUsers: 2, TotalFollowers: 600, MaxFollowers: 500, AvgFollowers: 200}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	store.OnError("COUNT(*) FILTER (WHERE is_verified)", errors.New("syntax error"))
+	if w := serve(StatsOverviewHandler, http.MethodGet, "/stats/overview", "/stats/overview", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("status on a query error = %d, want 500", w.Code)
+	}
+}
+
+func TestStaleScrapeIsReportedSkippedAndNotCached(t *testing.T) {
+	store := newTestStore(t)
+	userCache = cache.NewTTLCache[string, *database.User](time.Minute, 10)
+	useMockScraper(t, &MockScraper{Users: map[string]*database.User{
+		"alice": {ID: "1", Username: "alice"},
+	}})
+	// A newer scrape is already stored, so the guarded upsert writes nothing
+	store.OnRows("INSERT INTO instagram_users", []string{"inserted"})
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchResponse
+	decode(t, w, &response)
+
+	if len(response.Results) != 1 || response.Results[0].Status != "success" || response.Results[0].Stored != storeSkipped {
+		t.Errorf("results = %+v, want alice succeeding with stored skipped", response.Results)
+	}
+	if s := response.Summary; s.Inserted != 0 || s.Updated != 0 {
+		t.Errorf("summary inserted=%d updated=%d, want neither", s.Inserted, s.Updated)
+	}
+	if _, ok := userCache.Get("alice"); ok {
+		t.Error("stale scrape was cached")
+	}
+}
+
+func TestBatchSizeLimitFollowsConfig(t *testing.T) {
+	useConfig(t, func(cfg *utils.Config) { cfg.MaxBatchSize = 3 })
+
+	tests := []struct {
+		name       string
+		body       map[string]interface{}
+		wantStatus int
+	}{
+		{"at the limit", map[string]interface{}{"usernames": []string{"a1", "b2", "c3"}}, http.StatusOK},
+		{"usernames and ids at the limit", map[string]interface{}{"usernames": []string{"a1", "b2"}, "ids": []string{"7"}}, http.StatusOK},
+		{"above the limit", map[string]interface{}{"usernames": []string{"a1", "b2", "c3", "d4"}}, http.StatusBadRequest},
+		{"usernames and ids above the limit", map[string]interface{}{"usernames": []string{"a1", "b2"}, "ids": []string{"7", "8"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			SetScraper(idScraper{ScraperFunc: scrapeAs, byID: scrapeIDAs})
+
+			w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus == http.StatusBadRequest && !strings.Contains(w.Body.String(), "maximum 3 users per batch") {
+				t.Errorf("body %s doesn't name the configured limit", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestBatchConcurrencyClampedToConfig(t *testing.T) {
+	useConfig(t, func(cfg *utils.Config) { cfg.MaxConcurrency = 3 })
+
+	tests := []struct {
+		name      string
+		requested int
+		wantPeak  int32
+	}{
+		{"default", 0, 3},
+		{"below the limit", 2, 2},
+		{"at the limit", 3, 3},
+		{"above the limit", 20, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			var inFlight, peak int32
+			stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+				n := atomic.AddInt32(&inFlight, 1)
+				defer atomic.AddInt32(&inFlight, -1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				return scrapeAs(ctx, username)
+			})
+
+			w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+				"usernames":       []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8"},
+				"max_concurrency": tt.requested,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			if peak != tt.wantPeak {
+				t.Errorf("peak concurrent scrapes = %d, want %d", peak, tt.wantPeak)
+			}
+		})
+	}
+}
+
+// failureScraper fails ghost_* users as not found, flaky_* with a 503
+// and busy_* as rate limited, scraping everyone else
+func failureScraper(t *testing.T) {
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		switch {
+		case strings.HasPrefix(username, "ghost"):
+			return nil, external.UserNotFoundError{Username: username, Message: "HTTP 404"}
+		case strings.HasPrefix(username, "flaky"):
+			return nil, external.UpstreamError{StatusCode: http.StatusServiceUnavailable, Body: "service unavailable"}
+		case strings.HasPrefix(username, "busy"):
+			return nil, external.RateLimitedError{Body: "quota exceeded"}
+		}
+		return scrapeAs(ctx, username)
+	})
+}
+
+func TestBatchSummaryListsFailures(t *testing.T) {
+	newTestStore(t)
+	fastTransientRetry(t)
+	failureScraper(t)
+
+	w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+		"usernames": []string{"alice", "ghost_one", "flaky_one", "ghost_two", "busy_one", "bob"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchResponse
+	decode(t, w, &response)
+
+	summary := response.Summary
+	if summary.Failed != 4 || summary.FailuresTruncated {
+		t.Errorf("summary failed=%d truncated=%v, want 4 listed in full", summary.Failed, summary.FailuresTruncated)
+	}
+	want := map[string]string{
+		"ghost_one": "user ghost_one not found",
+		"ghost_two": "user ghost_two not found",
+		"flaky_one": "upstream error 503",
+		"busy_one":  "rate limited",
+	}
+	if len(summary.Failures) != len(want) {
+		t.Errorf("failures = %v, want exactly %d entries", summary.Failures, len(want))
+	}
+	for username, message := range want {
+		if got, ok := summary.Failures[username]; !ok || !strings.Contains(got, message) {
+			t.Errorf("failure for %s = %q, want it to mention %q", username, got, message)
+		}
+	}
+}
+
+func TestBatchSummaryFailuresAreCapped(t *testing.T) {
+	tests := []struct {
+		name          string
+		max           int
+		usernames     []string
+		wantListed    int
+		wantTruncated bool
+	}{
+		{"under the cap", 5, []string{"ghost_a", "ghost_b", "alice"}, 2, false},
+		{"at the cap", 2, []string{"ghost_a", "ghost_b", "alice"}, 2, false},
+		{"over the cap", 2, []string{"ghost_a", "ghost_b", "ghost_c", "ghost_d"}, 2, true},
+		{"listing disabled", 0, []string{"ghost_a", "alice"}, 0, true},
+		{"no failures", 0, []string{"alice", "bob"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			failureScraper(t)
+			useConfig(t, func(cfg *utils.Config) { cfg.MaxSummaryFailures = tt.max })
+
+			w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+				"usernames": tt.usernames,
+			})
+			var response BatchResponse
+			decode(t, w, &response)
+			summary := response.Summary
+			if len(summary.Failures) != tt.wantListed || summary.FailuresTruncated != tt.wantTruncated {
+				t.Errorf("listed %d failures, truncated %v, want %d and %v",
+					len(summary.Failures), summary.FailuresTruncated, tt.wantListed, tt.wantTruncated)
+			}
+			for username := range summary.Failures {
+				if !strings.HasPrefix(username, "ghost") {
+					t.Errorf("listed %s, which didn't fail", username)
+				}
+			}
+		})
+	}
+}
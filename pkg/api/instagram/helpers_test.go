@@ -0,0 +1,391 @@
+package instagram
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/database/dbtest"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// testStore is an in-memory users and processing_jobs store served to the
+// handlers through a fake database.DB
+type testStore struct {
+	*dbtest.DB
+
+	mu     sync.Mutex
+	users  map[string]*database.User // by id
+	jobs   map[string]*database.ProcessingJob
+	nextID int
+}
+
+var userColumnNames = []string{
+	"id", "username", "full_name", "biography", "is_verified",
+	"is_business_account", "is_professional_account", "is_private",
+	"category_name", "followers", "following", "posts", "profile_pic_url",
+	"profile_pic_storage_url", "scraped_at", "created_at", "updated_at",
+}
+
+var jobColumnNames = []string{
+	"id", "status", "total_users", "processed_users", "successful_users",
+	"failed_users", "max_concurrency", "started_at", "completed_at",
+	"errors", "failed_targets", "parent_job_id", "created_at", "updated_at",
+}
+
+// newTestStore installs a fake database holding users as database.DB, and
+// resets the user cache and scraper, for the duration of the test. Writes
+// to tables the store doesn't model succeed without effect.
+func newTestStore(t *testing.T, users ...*database.User) *testStore {
+	t.Helper()
+
+	s := &testStore{
+		DB:    dbtest.New(),
+		users: make(map[string]*database.User),
+		jobs:  make(map[string]*database.ProcessingJob),
+	}
+	for _, user := range users {
+		s.users[user.ID] = user
+	}
+
+	s.On("FROM instagram_users WHERE username = $1", func(args []driver.Value) dbtest.Result {
+		return s.userResult(func(u *database.User) bool { return u.Username == args[0] })
+	})
+	s.On("FROM instagram_users WHERE id = $1", func(args []driver.Value) dbtest.Result {
+		return s.userResult(func(u *database.User) bool { return u.ID == args[0] })
+	})
+	s.OnRows("FROM username_history", []string{"user_id"})
+	s.OnRows("FROM user_stats_cache", []string{"user_json"})
+	s.OnRows("SET username = $1 || '#' || id", []string{"id"})
+	s.On("INSERT INTO instagram_users", s.upsertUser)
+	s.On("SET profile_pic_storage_url", s.setStorageURL)
+	s.OnExec("INSERT INTO username_history", 1)
+	s.OnExec("INSERT INTO audit_log", 1)
+	s.OnExec("UPDATE audit_log", 0)
+	s.OnExec("DELETE FROM instagram_assets", 0)
+	s.OnExec("DELETE FROM instagram_posts", 0)
+	s.On("DELETE FROM instagram_users", s.deleteUser)
+	s.On("INSERT INTO processing_jobs", s.createJob)
+	s.On("UPDATE processing_jobs", s.updateJob)
+	s.On("FROM processing_jobs", func(args []driver.Value) dbtest.Result {
+		return s.jobResult(args[0].(string))
+	})
+
+	prevDB, prevCache, prevScraper := database.DB, userCache, scraper
+	database.DB = s.Open()
+	userCache = nil
+	t.Cleanup(func() {
+		database.DB.Close()
+		database.DB, userCache, scraper = prevDB, prevCache, prevScraper
+	})
+	return s
+}
+
+func (s *testStore) userResult(match func(*database.User) bool) dbtest.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := dbtest.Result{Columns: userColumnNames}
+	for _, u := range s.users {
+		if match(u) {
+			result.Rows = append(result.Rows, []driver.Value{
+				u.ID, u.Username, nullString(u.FullName), nullString(u.Biography), u.IsVerified,
+				u.IsBusinessAccount, u.IsProfessionalAccount, u.IsPrivate,
+				nullString(u.CategoryName), u.Followers, u.Following, u.Posts, nullString(u.ProfilePicURL),
+				nullString(u.ProfilePicStorageURL), u.ScrapedAt, u.CreatedAt, u.UpdatedAt,
+			})
+		}
+	}
+	return result
+}
+
+func (s *testStore) upsertUser(args []driver.Value) dbtest.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := args[0].(string)
+	_, exists := s.users[id]
+	s.users[id] = &database.User{ID: id, Username: args[1].(string), ScrapedAt: time.Now()}
+	return dbtest.Result{Columns: []string{"inserted"}, Rows: [][]driver.Value{{!exists}}}
+}
+
+func (s *testStore) setStorageURL(args []driver.Value) dbtest.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[args[0].(string)]
+	if !ok {
+		return dbtest.Result{}
+	}
+	url, _ := args[1].(string)
+	user.ProfilePicStorageURL = sql.NullString{String: url, Valid: url != ""}
+	return dbtest.Result{RowsAffected: 1}
+}
+
+func (s *testStore) deleteUser(args []driver.Value) dbtest.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := args[0].(string)
+	if _, ok := s.users[id]; !ok {
+		return dbtest.Result{}
+	}
+	delete(s.users, id)
+	return dbtest.Result{RowsAffected: 1}
+}
+
+func (s *testStore) createJob(args []driver.Value) dbtest.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	now := time.Now()
+	job := &database.ProcessingJob{
+		ID:             fmt.Sprintf("00000000-0000-0000-0000-%012d", s.nextID),
+		Status:         args[0].(string),
+		TotalUsers:     int(args[1].(int64)),
+		MaxConcurrency: int(args[2].(int64)),
+		Errors:         make(map[string]string),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if parentID, ok := args[3].(string); ok {
+		job.ParentJobID = &parentID
+	}
+	s.jobs[job.ID] = job
+	return dbtest.Result{
+		Columns: []string{"id", "status", "total_users", "processed_users", "successful_users",
+			"failed_users", "max_concurrency", "parent_job_id", "created_at", "updated_at"},
+		Rows: [][]driver.Value{{job.ID, job.Status, int64(job.TotalUsers), int64(0), int64(0),
+			int64(0), int64(job.MaxConcurrency), args[3], now, now}},
+	}
+}
+
+func (s *testStore) updateJob(args []driver.Value) dbtest.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[args[0].(string)]
+	if !ok {
+		return dbtest.Result{}
+	}
+	job.Status = args[1].(string)
+	job.ProcessedUsers = int(args[2].(int64))
+	job.SuccessfulUsers = int(args[3].(int64))
+	job.FailedUsers = int(args[4].(int64))
+	if t, ok := args[5].(time.Time); ok {
+		job.StartedAt = &t
+	}
+	if t, ok := args[6].(time.Time); ok {
+		job.CompletedAt = &t
+	}
+	job.Errors = make(map[string]string)
+	if b, ok := args[7].([]byte); ok {
+		json.Unmarshal(b, &job.Errors)
+	}
+	job.FailedTargets = nil
+	if b, ok := args[8].([]byte); ok {
+		json.Unmarshal(b, &job.FailedTargets)
+	}
+	return dbtest.Result{RowsAffected: 1}
+}
+
+func (s *testStore) jobResult(id string) dbtest.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := dbtest.Result{Columns: jobColumnNames}
+	if job, ok := s.jobs[id]; ok {
+		errorsJSON, _ := json.Marshal(job.Errors)
+		failedTargetsJSON, _ := json.Marshal(job.FailedTargets)
+		var parentID driver.Value
+		if job.ParentJobID != nil {
+			parentID = *job.ParentJobID
+		}
+		result.Rows = [][]driver.Value{{job.ID, job.Status, int64(job.TotalUsers), int64(job.ProcessedUsers),
+			int64(job.SuccessfulUsers), int64(job.FailedUsers), int64(job.MaxConcurrency),
+			timeValue(job.StartedAt), timeValue(job.CompletedAt), errorsJSON, failedTargetsJSON, parentID, job.CreatedAt, job.UpdatedAt}}
+	}
+	return result
+}
+
+// job returns a copy of a stored job
+func (s *testStore) job(id string) database.ProcessingJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.jobs[id]
+}
+
+// user returns the stored user with id, or nil
+func (s *testStore) user(id string) *database.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[id]
+}
+
+func nullString(ns sql.NullString) driver.Value {
+	if !ns.Valid {
+		return nil
+	}
+	return ns.String
+}
+
+func timeValue(t *time.Time) driver.Value {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+// testUser returns a stored user for tests
+func testUser(id, username string) *database.User {
+	now := time.Now()
+	return &database.User{ID: id, Username: username, Followers: 100, ScrapedAt: now, CreatedAt: now, UpdatedAt: now}
+}
+
+// stubScraper replaces the scraper for the duration of the test
+func stubScraper(t *testing.T, fn func(ctx context.Context, username string) (*database.User, error)) {
+	t.Helper()
+	prev := scraper
+	SetScraper(external.ScraperFunc(fn))
+	t.Cleanup(func() { scraper = prev })
+}
+
+// MockScraper is a scraper returning canned users by username, Err for
+// every lookup when set, or UserNotFoundError for unknown usernames
+type MockScraper struct {
+	Users map[string]*database.User
+	Err   error
+
+	mu    sync.Mutex
+	Calls []string
+}
+
+func (m *MockScraper) ScrapeInstagramUser(_ context.Context, username string) (*database.User, error) {
+	m.mu.Lock()
+	m.Calls = append(m.Calls, username)
+	m.mu.Unlock()
+
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	user, ok := m.Users[username]
+	if !ok {
+		return nil, external.UserNotFoundError{Username: username, Message: "user not found"}
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// useMockScraper installs m as the scraper for the duration of the test
+func useMockScraper(t *testing.T, m *MockScraper) {
+	t.Helper()
+	prev := scraper
+	SetScraper(m)
+	t.Cleanup(func() { scraper = prev })
+}
+
+// useConfig runs the test against a copy of the handler config changed by
+// set
+func useConfig(t *testing.T, set func(cfg *utils.Config)) {
+	t.Helper()
+	prev := config
+	cfg := *config
+	set(&cfg)
+	config = &cfg
+	t.Cleanup(func() { config = prev })
+}
+
+// scrapeAs is a scraper that returns a user with a deterministic id
+func scrapeAs(_ context.Context, username string) (*database.User, error) {
+	return &database.User{ID: "id-" + username, Username: username, ScrapedAt: time.Now()}, nil
+}
+
+// rocketAPIServer starts a fake RocketAPI answering get_info and
+// get_info_by_id with a user whose id is a checksum of the username, or
+// whose username is "user<id>" for id lookups.
+// record, if set, is called with each request before it's answered.
+func rocketAPIServer(t *testing.T, record func(r *http.Request)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if record != nil {
+			record(r)
+		}
+		var req struct {
+			Username string `json:"username"`
+			ID       int64  `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		id, username := fmt.Sprint(crc32.ChecksumIEEE([]byte(req.Username))), req.Username
+		if req.ID != 0 {
+			id, username = fmt.Sprint(req.ID), fmt.Sprintf("user%d", req.ID)
+		}
+		fmt.Fprintf(w, `{"status":"done","response":{"status_code":200,"body":{"user":{"id":%q,"username":%q}}}}`, id, username)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// waitForJobs waits until no async jobs are running
+func waitForJobs(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runningJobsMu.Lock()
+		n := len(runningJobs)
+		runningJobsMu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("async jobs still running")
+}
+
+// serve sends a request to handler registered on method and route, with a
+// JSON body when body is non-nil
+func serve(handler gin.HandlerFunc, method, route, target string, body interface{}) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Handle(method, route, handler)
+
+	var req *http.Request
+	if body != nil {
+		b, _ := json.Marshal(body)
+		req = httptest.NewRequest(method, target, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// decode unmarshals a response body into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+	}
+}
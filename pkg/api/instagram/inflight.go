@@ -0,0 +1,33 @@
+package instagram
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	inflightMu   sync.Mutex
+	inflightJobs = make(map[string]string) // target set hash -> async job id
+)
+
+// targetSetHash returns a stable hash of a batch target set, independent
+// of order and duplicates
+func targetSetHash(targets []batchTarget) string {
+	keys := targetKeys(targets)
+	set := make([]string, 0, len(keys))
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		set = append(set, key)
+	}
+	sort.Strings(set)
+
+	sum := sha256.Sum256([]byte(strings.Join(set, ",")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package instagram
+
+import (
+	"context"
+	"instagram-user-processor/pkg/database"
+	"net/http"
+	"testing"
+)
+
+func TestTargetSetHashIgnoresOrderAndDuplicates(t *testing.T) {
+	a := []batchTarget{{Identifier: "alice", Type: targetTypeUsername}, {Identifier: "bob", Type: targetTypeUsername}}
+	b := []batchTarget{{Identifier: "bob", Type: targetTypeUsername}, {Identifier: "alice", Type: targetTypeUsername}, {Identifier: "bob", Type: targetTypeUsername}}
+	if targetSetHash(a) != targetSetHash(b) {
+		t.Error("hash differs for the same set in another order")
+	}
+
+	c := []batchTarget{{Identifier: "alice", Type: targetTypeUsername}}
+	if targetSetHash(a) == targetSetHash(c) {
+		t.Error("hash equal for different sets")
+	}
+}
+
+func TestAsyncBatchSameSetTwiceStartsOneJob(t *testing.T) {
+	store := newTestStore(t)
+
+	release := make(chan struct{})
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		<-release
+		return scrapeAs(ctx, username)
+	})
+
+	submit := func(usernames ...string) BatchJobResponse {
+		w := serve(BatchProcessUsersHandler, http.MethodPost, "/batch", "/batch", map[string]interface{}{
+			"usernames": usernames,
+			"async":     true,
+		})
+		var response BatchJobResponse
+		decode(t, w, &response)
+		return response
+	}
+
+	first := submit("alice", "bob")
+	second := submit("bob", "alice")
+	close(release)
+	waitForJobs(t)
+
+	if first.Duplicate {
+		t.Error("first submission marked duplicate")
+	}
+	if !second.Duplicate {
+		t.Error("second submission not marked duplicate")
+	}
+	if second.JobID != first.JobID {
+		t.Errorf("second submission got job %q, want %q", second.JobID, first.JobID)
+	}
+	if n := len(store.Calls("INSERT INTO processing_jobs")); n != 1 {
+		t.Errorf("created %d jobs, want 1", n)
+	}
+
+	// Once the job has finished the same set starts a new one
+	stubScraper(t, scrapeAs)
+	third := submit("alice", "bob")
+	waitForJobs(t)
+	if third.Duplicate || third.JobID == first.JobID {
+		t.Errorf("submission after completion reused job %q", third.JobID)
+	}
+}
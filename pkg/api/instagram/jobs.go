@@ -0,0 +1,553 @@
+package instagram
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"instagram-user-processor/pkg/api/apierror"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/metrics"
+	"instagram-user-processor/pkg/utils"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Async jobs run under jobsCtx so Shutdown can cancel them
+var (
+	jobsCtx, cancelJobs = context.WithCancel(context.Background())
+	jobsWG              sync.WaitGroup
+
+	// jobsDone is closed once jobsWG is done after Shutdown. A single
+	// goroutine waits for it however often Shutdown is called.
+	jobsDone     = make(chan struct{})
+	jobsDoneOnce sync.Once
+)
+
+// runningJob is an async job running on this instance
+type runningJob struct {
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the job has recorded its final state
+}
+
+var (
+	runningJobsMu sync.Mutex
+	runningJobs   = make(map[string]*runningJob) // job id -> running job
+)
+
+// Shutdown cancels running async batch jobs and waits until they have
+// recorded their final state or ctx is done
+func Shutdown(ctx context.Context) error {
+	cancelJobs()
+
+	jobsDoneOnce.Do(func() {
+		go func() {
+			jobsWG.Wait()
+			close(jobsDone)
+		}()
+	})
+
+	select {
+	case <-jobsDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var jobIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// GetJobHandler returns the persisted status of a processing job
+// GET /api/v1/instagram/jobs/:id
+func GetJobHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	jobID := c.Param("id")
+	if !jobIDPattern.MatchString(jobID) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeJobNotFound, "job not found")
+		return
+	}
+
+	job, err := database.GetProcessingJobStatus(c.Request.Context(), jobID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeJobNotFound, "job not found")
+			return
+		}
+		logger.Error().Err(err).Str("job_id", jobID).Msg("failed to get job status")
+		respondError(c, http.StatusInternalServerError, "failed to get job status", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// cancelWaitTimeout bounds how long CancelJobHandler waits for a cancelled
+// job to record its final state
+const cancelWaitTimeout = 10 * time.Second
+
+// CancelJobHandler stops a running async job. Users already processed keep
+// their results and the job is marked cancelled with its counts at that
+// point. Cancelling a cancelled job returns it again; a job that completed
+// or failed gets a 409.
+// POST /api/v1/instagram/jobs/:id/cancel
+func CancelJobHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	jobID := c.Param("id")
+	if !jobIDPattern.MatchString(jobID) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeJobNotFound, "job not found")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	runningJobsMu.Lock()
+	running, ok := runningJobs[jobID]
+	runningJobsMu.Unlock()
+
+	if ok {
+		logger.Info().Str("job_id", jobID).Msg("cancelling async batch job")
+		running.cancel()
+
+		// Wait for the workers to stop so the response carries final counts
+		select {
+		case <-running.done:
+		case <-time.After(cancelWaitTimeout):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	job, err := database.GetProcessingJobStatus(ctx, jobID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeJobNotFound, "job not found")
+			return
+		}
+		logger.Error().Err(err).Str("job_id", jobID).Msg("failed to get job status")
+		respondError(c, http.StatusInternalServerError, "failed to get job status", err)
+		return
+	}
+
+	switch {
+	case job.Status == database.JobStatusCancelled:
+		c.JSON(http.StatusOK, newBatchJobResponse(job))
+	case isTerminalJobStatus(job.Status):
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "job has already finished", gin.H{
+			"status": job.Status,
+		})
+	case ok:
+		// Still stopping after cancelWaitTimeout
+		c.JSON(http.StatusAccepted, newBatchJobResponse(job))
+	default:
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "job is not running on this instance", gin.H{
+			"status": job.Status,
+		})
+	}
+}
+
+// RetryJobHandler starts a new async job re-running only the users that
+// failed in a finished job. The new job links back through parent_job_id.
+// POST /api/v1/instagram/jobs/:id/retry
+func RetryJobHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	jobID := c.Param("id")
+	if !jobIDPattern.MatchString(jobID) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeJobNotFound, "job not found")
+		return
+	}
+
+	job, err := database.GetProcessingJobStatus(c.Request.Context(), jobID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeJobNotFound, "job not found")
+			return
+		}
+		logger.Error().Err(err).Str("job_id", jobID).Msg("failed to get job status")
+		respondError(c, http.StatusInternalServerError, "failed to get job status", err)
+		return
+	}
+
+	if !isTerminalJobStatus(job.Status) {
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "job is still running", gin.H{
+			"status": job.Status,
+		})
+		return
+	}
+
+	targets := failedTargets(job)
+	if len(targets) == 0 {
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "job has no failed users to retry")
+		return
+	}
+
+	response, err := launchBatchJob(c.Request.Context(), targets, job.MaxConcurrency,
+		defaultBatchTimeoutSeconds*time.Second, "", &job.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to create processing job", err)
+		return
+	}
+
+	logger.Info().
+		Str("job_id", response.JobID).
+		Str("parent_job_id", job.ID).
+		Int("user_count", len(targets)).
+		Msg("retrying failed users of batch job")
+
+	status := http.StatusAccepted
+	if response.Duplicate {
+		status = http.StatusOK
+	}
+	c.JSON(status, response)
+}
+
+// failedTargets rebuilds the batch targets of a job's failed users, in a
+// stable order, as they were recorded when the job ran. Jobs finished
+// before targets were recorded only have their errors, keyed by
+// identifier, so all-digit identifiers are retried as ids and everything
+// else as usernames.
+func failedTargets(job *database.ProcessingJob) []batchTarget {
+	var targets []batchTarget
+	if len(job.FailedTargets) > 0 {
+		targets = make([]batchTarget, 0, len(job.FailedTargets))
+		for _, target := range job.FailedTargets {
+			targets = append(targets, batchTarget{Identifier: target.Identifier, Type: target.Type, Refresh: target.Refresh})
+		}
+	} else {
+		targets = make([]batchTarget, 0, len(job.Errors))
+		for identifier := range job.Errors {
+			target := batchTarget{Identifier: identifier, Type: targetTypeUsername}
+			if validateUserID(identifier) == nil {
+				target.Type = targetTypeID
+			}
+			targets = append(targets, target)
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].key() < targets[j].key() })
+	return targets
+}
+
+// progressInterval is how often job progress is emitted over SSE
+var progressInterval = time.Second
+
+// JobProgressHandler streams job progress as Server-Sent Events until the
+// job reaches a terminal state or the client disconnects
+// GET /api/v1/instagram/jobs/:id/progress
+func JobProgressHandler(c *gin.Context) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	jobID := c.Param("id")
+	if !jobIDPattern.MatchString(jobID) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeJobNotFound, "job not found")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	job, err := database.GetProcessingJobStatus(ctx, jobID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Respond(c, http.StatusNotFound, apierror.CodeJobNotFound, "job not found")
+			return
+		}
+		logger.Error().Err(err).Str("job_id", jobID).Msg("failed to get job status")
+		respondError(c, http.StatusInternalServerError, "failed to get job status", err)
+		return
+	}
+
+	// Streams outlive the server write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		logger.Warn().Err(err).Str("job_id", jobID).Msg("failed to clear write deadline for progress stream")
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		c.SSEvent("progress", newProgressUpdate(job))
+		c.Writer.Flush()
+
+		if isTerminalJobStatus(job.Status) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Debug().Str("job_id", jobID).Msg("progress stream client disconnected")
+			return
+		case <-ticker.C:
+		}
+
+		job, err = database.GetProcessingJobStatus(ctx, jobID)
+		if err != nil {
+			logger.Error().Err(err).Str("job_id", jobID).Msg("failed to get job status")
+			c.SSEvent("error", apierror.Body(http.StatusInternalServerError, apierror.CodeInternalError, "failed to get job status"))
+			c.Writer.Flush()
+			return
+		}
+	}
+}
+
+// newProgressUpdate builds a progress update from a job's counters
+func newProgressUpdate(job *database.ProcessingJob) ProgressUpdate {
+	progress := 100.0
+	if job.TotalUsers > 0 {
+		progress = float64(job.ProcessedUsers) / float64(job.TotalUsers) * 100
+	}
+
+	return ProgressUpdate{
+		Completed: job.ProcessedUsers,
+		Total:     job.TotalUsers,
+		Progress:  progress,
+		Status:    job.Status,
+	}
+}
+
+// isTerminalJobStatus reports whether a job can no longer make progress
+func isTerminalJobStatus(status string) bool {
+	switch status {
+	case database.JobStatusCompleted, database.JobStatusFailed, database.JobStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// startBatchJob creates a processing job for the batch, runs it in the
+// background and responds 202 with the job id. If an identical batch job
+// is already in flight its id is returned instead of starting a new one.
+// A non-empty callbackURL receives a JobCallback when the job finishes.
+func startBatchJob(c *gin.Context, targets []batchTarget, invalid []ValidationError, maxConcurrency int, timeout time.Duration, callbackURL string) {
+	response, err := launchBatchJob(c.Request.Context(), targets, maxConcurrency, timeout, callbackURL, nil)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to create processing job", err)
+		return
+	}
+	response.InvalidUsers = invalid
+
+	status := http.StatusAccepted
+	if response.Duplicate {
+		status = http.StatusOK
+	}
+	c.JSON(status, response)
+}
+
+// launchBatchJob creates a processing job for targets and runs it in the
+// background, or returns the in-flight job for an identical target set
+// and callback URL with Duplicate set. The job keeps the actor and request
+// id of ctx but not its cancellation. parentJobID is set for retries.
+func launchBatchJob(ctx context.Context, targets []batchTarget, maxConcurrency int, timeout time.Duration, callbackURL string, parentJobID *string) (BatchJobResponse, error) {
+	logger := utils.LoggerFromContext(ctx)
+
+	// Submissions with different callbacks each get their own job so every
+	// callback is delivered
+	key := targetSetHash(targets)
+	if callbackURL != "" {
+		key += " " + callbackURL
+	}
+
+	// Hold the lock across creation so concurrent identical submissions
+	// can't both start a job
+	inflightMu.Lock()
+	if jobID, ok := inflightJobs[key]; ok {
+		inflightMu.Unlock()
+
+		response := BatchJobResponse{JobID: jobID, Status: database.JobStatusRunning}
+		if job, err := database.GetProcessingJobStatus(ctx, jobID); err == nil {
+			response = newBatchJobResponse(job)
+		}
+		response.Duplicate = true
+		return response, nil
+	}
+
+	job, err := database.CreateProcessingJob(ctx, len(targets), maxConcurrency, parentJobID)
+	if err != nil {
+		inflightMu.Unlock()
+		return BatchJobResponse{}, err
+	}
+	inflightJobs[key] = job.ID
+	inflightMu.Unlock()
+
+	logger.Info().
+		Str("job_id", job.ID).
+		Int("user_count", len(targets)).
+		Int("max_concurrency", maxConcurrency).
+		Msg("starting async batch job")
+
+	response := newBatchJobResponse(job)
+
+	jobCtx := database.WithActor(jobsCtx, database.ActorFromContext(ctx))
+	jobCtx = utils.WithRequestID(jobCtx, utils.RequestIDFromContext(ctx))
+	runCtx, cancel := context.WithTimeout(jobCtx, timeout)
+	running := &runningJob{cancel: cancel, done: make(chan struct{})}
+	runningJobsMu.Lock()
+	runningJobs[job.ID] = running
+	runningJobsMu.Unlock()
+
+	jobsWG.Add(1)
+	go func() {
+		defer jobsWG.Done()
+		defer cancel()
+
+		runBatchJob(runCtx, job, targets, key)
+
+		runningJobsMu.Lock()
+		delete(runningJobs, job.ID)
+		runningJobsMu.Unlock()
+		close(running.done)
+
+		if callbackURL != "" {
+			deliverJobCallback(jobCtx, job, callbackURL)
+		}
+	}()
+
+	return response, nil
+}
+
+// runBatchJob processes a batch job, persisting progress as each user
+// completes. ctx must outlive the submitting request; cancelling it stops
+// the job and marks it cancelled, leaving users never dispatched
+// unprocessed. A deadline completes it with every unfinished user failed
+// as a timeout. A job that ends without accounting for every user is
+// marked failed.
+func runBatchJob(ctx context.Context, job *database.ProcessingJob, targets []batchTarget, key string) {
+	logger := utils.LoggerFromContext(ctx)
+
+	defer func() {
+		inflightMu.Lock()
+		delete(inflightJobs, key)
+		inflightMu.Unlock()
+	}()
+
+	// Job state is persisted even after ctx is cancelled
+	persistCtx := context.WithoutCancel(ctx)
+
+	startedAt := time.Now()
+	job.Status = database.JobStatusRunning
+	job.StartedAt = &startedAt
+	if err := database.UpdateProcessingJob(persistCtx, job); err != nil {
+		logger.Error().Err(err).Str("job_id", job.ID).Msg("failed to mark job running")
+	}
+
+	record := func(target batchTarget, result UserResult) {
+		job.ProcessedUsers++
+		if result.Status == "success" {
+			job.SuccessfulUsers++
+		} else {
+			job.FailedUsers++
+			job.Errors[result.Identifier] = result.Error
+			job.FailedTargets = append(job.FailedTargets, target.jobTarget())
+		}
+	}
+
+	// Updates are serialized so progress is never written out of order.
+	// Workers are done once fetchDataForUsers returns, so reported is safe
+	// to read afterwards.
+	var mu sync.Mutex
+	reported := make([]bool, len(targets))
+	results := fetchDataForUsers(ctx, targets, job.MaxConcurrency, func(i int, result UserResult) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		reported[i] = true
+		record(targets[i], result)
+		if err := database.UpdateProcessingJob(persistCtx, job); err != nil {
+			logger.Error().Err(err).Str("job_id", job.ID).Msg("failed to update job progress")
+		}
+	})
+
+	// Users never dispatched before the deadline count as timeouts, as in
+	// the sync response. A cancelled job leaves them unprocessed.
+	cancelled := errors.Is(ctx.Err(), context.Canceled)
+	if !cancelled {
+		for i, result := range results {
+			if !reported[i] {
+				record(targets[i], result)
+			}
+		}
+	}
+
+	completedAt := time.Now()
+	switch {
+	case cancelled:
+		job.Status = database.JobStatusCancelled
+	case job.ProcessedUsers < job.TotalUsers:
+		logger.Error().
+			Str("job_id", job.ID).
+			Int("processed", job.ProcessedUsers).
+			Int("total", job.TotalUsers).
+			Msg("batch job finished without processing every user")
+		job.Status = database.JobStatusFailed
+	default:
+		job.Status = database.JobStatusCompleted
+	}
+	job.CompletedAt = &completedAt
+	metrics.ObserveBatch("async", completedAt.Sub(startedAt))
+	if err := database.UpdateProcessingJob(persistCtx, job); err != nil {
+		logger.Error().Err(err).Str("job_id", job.ID).Msg("failed to mark job completed")
+	}
+
+	logger.Info().
+		Str("job_id", job.ID).
+		Int("successful", job.SuccessfulUsers).
+		Int("failed", job.FailedUsers).
+		Dur("duration", completedAt.Sub(startedAt)).
+		Str("status", job.Status).
+		Msg("async batch job finished")
+}
+
+// callbackDeliveryTimeout bounds all attempts to deliver a job callback
+const callbackDeliveryTimeout = 2 * time.Minute
+
+// deliverJobCallback POSTs the finished job's summary to callbackURL.
+// Delivery is attempted even for cancelled jobs, and failures are logged
+// rather than changing the job's status.
+func deliverJobCallback(ctx context.Context, job *database.ProcessingJob, callbackURL string) {
+	logger := utils.LoggerFromContext(ctx)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), callbackDeliveryTimeout)
+	defer cancel()
+
+	payload := JobCallback{
+		JobID:           job.ID,
+		Status:          job.Status,
+		TotalUsers:      job.TotalUsers,
+		ProcessedUsers:  job.ProcessedUsers,
+		SuccessfulUsers: job.SuccessfulUsers,
+		FailedUsers:     job.FailedUsers,
+		Errors:          job.Errors,
+		StartedAt:       job.StartedAt,
+		CompletedAt:     job.CompletedAt,
+	}
+
+	if err := external.DeliverWebhook(ctx, callbackURL, payload); err != nil {
+		logger.Error().Err(err).Str("job_id", job.ID).Msg("failed to deliver job callback")
+		return
+	}
+	logger.Info().Str("job_id", job.ID).Msg("job callback delivered")
+}
+
+// newBatchJobResponse builds the job tracking response for a job
+func newBatchJobResponse(job *database.ProcessingJob) BatchJobResponse {
+	return BatchJobResponse{
+		JobID:           job.ID,
+		Status:          job.Status,
+		TotalUsers:      job.TotalUsers,
+		ProcessedUsers:  job.ProcessedUsers,
+		SuccessfulUsers: job.SuccessfulUsers,
+		FailedUsers:     job.FailedUsers,
+		ParentJobID:     job.ParentJobID,
+	}
+}
@@ -0,0 +1,634 @@
+package instagram
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/database/dbtest"
+	"instagram-user-processor/pkg/external"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func usernameTargets(usernames ...string) []batchTarget {
+	targets := make([]batchTarget, len(usernames))
+	for i, username := range usernames {
+		targets[i] = batchTarget{Identifier: username, Type: targetTypeUsername}
+	}
+	return targets
+}
+
+// jobStatuses returns the statuses a job was created and updated with, in
+// order
+func jobStatuses(store *testStore) []string {
+	var statuses []string
+	for _, call := range store.Calls("INSERT INTO processing_jobs") {
+		statuses = append(statuses, call.Args[0].(string))
+	}
+	for _, call := range store.Calls("UPDATE processing_jobs") {
+		statuses = append(statuses, call.Args[1].(string))
+	}
+	return statuses
+}
+
+func TestBatchJobTransitionsPendingRunningCompleted(t *testing.T) {
+	store := newTestStore(t)
+	stubScraper(t, scrapeAs)
+
+	response, err := launchBatchJob(context.Background(), usernameTargets("alice", "bob", "carol"), 2, time.Minute, "", nil)
+	if err != nil {
+		t.Fatalf("launchBatchJob: %v", err)
+	}
+	if response.Status != database.JobStatusPending {
+		t.Errorf("launched job status = %q, want %q", response.Status, database.JobStatusPending)
+	}
+	waitForJobs(t)
+
+	statuses := jobStatuses(store)
+	if statuses[0] != database.JobStatusPending || statuses[1] != database.JobStatusRunning {
+		t.Errorf("job started with statuses %v, want pending then running", statuses)
+	}
+	if last := statuses[len(statuses)-1]; last != database.JobStatusCompleted {
+		t.Errorf("final job status = %q, want %q", last, database.JobStatusCompleted)
+	}
+
+	job := store.job(response.JobID)
+	if job.ProcessedUsers != 3 || job.SuccessfulUsers != 3 || job.FailedUsers != 0 {
+		t.Errorf("job counts processed=%d successful=%d failed=%d, want 3/3/0",
+			job.ProcessedUsers, job.SuccessfulUsers, job.FailedUsers)
+	}
+	if job.StartedAt == nil || job.CompletedAt == nil {
+		t.Error("job timestamps not recorded")
+	}
+}
+
+// blockingScraper stubs a scraper that signals entered and then waits for
+// ctx to end
+func blockingScraper(t *testing.T) <-chan struct{} {
+	entered := make(chan struct{}, 100)
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		entered <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	return entered
+}
+
+func TestCancelledBatchJobSkipsUndispatchedUsers(t *testing.T) {
+	store := newTestStore(t)
+	entered := blockingScraper(t)
+
+	// One worker holds the first user and the pool buffers two more. The
+	// fourth is waiting to be enqueued when the job is cancelled and may
+	// still win a freed slot, but the last two are never dispatched.
+	targets := usernameTargets("u1", "u2", "u3", "u4", "u5", "u6")
+	response, err := launchBatchJob(context.Background(), targets, 1, time.Minute, "", nil)
+	if err != nil {
+		t.Fatalf("launchBatchJob: %v", err)
+	}
+	<-entered
+	time.Sleep(20 * time.Millisecond)
+
+	runningJobsMu.Lock()
+	runningJobs[response.JobID].cancel()
+	runningJobsMu.Unlock()
+	waitForJobs(t)
+
+	job := store.job(response.JobID)
+	if job.Status != database.JobStatusCancelled {
+		t.Errorf("job status = %q, want %q", job.Status, database.JobStatusCancelled)
+	}
+	assertUndispatchedSkipped(t, job)
+}
+
+// assertUndispatchedSkipped checks a job of u1..u6 stopped while u1 was
+// running on a single worker counted only its dispatched users
+func assertUndispatchedSkipped(t *testing.T, job database.ProcessingJob) {
+	t.Helper()
+	if job.TotalUsers != 6 {
+		t.Errorf("job total = %d, want 6", job.TotalUsers)
+	}
+	if job.ProcessedUsers < 3 || job.ProcessedUsers > 4 {
+		t.Errorf("job processed = %d, want 3 or 4", job.ProcessedUsers)
+	}
+	if job.FailedUsers != job.ProcessedUsers || len(job.Errors) != job.ProcessedUsers {
+		t.Errorf("job failed = %d with %d errors, want %d", job.FailedUsers, len(job.Errors), job.ProcessedUsers)
+	}
+	for _, username := range []string{"u5", "u6"} {
+		if _, ok := job.Errors[username]; ok {
+			t.Errorf("undispatched user %s recorded as failed", username)
+		}
+	}
+}
+
+func TestCancelJobHandlerStopsInFlightJob(t *testing.T) {
+	store := newTestStore(t)
+	entered := blockingScraper(t)
+
+	targets := usernameTargets("u1", "u2", "u3", "u4", "u5", "u6")
+	launched, err := launchBatchJob(context.Background(), targets, 1, time.Minute, "", nil)
+	if err != nil {
+		t.Fatalf("launchBatchJob: %v", err)
+	}
+	<-entered
+	time.Sleep(20 * time.Millisecond)
+
+	cancelJob := func() (int, BatchJobResponse) {
+		w := serve(CancelJobHandler, http.MethodPost, "/jobs/:id/cancel", "/jobs/"+launched.JobID+"/cancel", nil)
+		var response BatchJobResponse
+		decode(t, w, &response)
+		return w.Code, response
+	}
+
+	status, response := cancelJob()
+	if status != http.StatusOK || response.Status != database.JobStatusCancelled {
+		t.Fatalf("cancel = %d with status %q, want 200 and %q", status, response.Status, database.JobStatusCancelled)
+	}
+	// The response carries the final counts, so the job has stopped
+	runningJobsMu.Lock()
+	_, running := runningJobs[launched.JobID]
+	runningJobsMu.Unlock()
+	if running {
+		t.Error("job still running after cancel returned")
+	}
+	job := store.job(launched.JobID)
+	if response.ProcessedUsers != job.ProcessedUsers || response.FailedUsers != job.FailedUsers {
+		t.Errorf("response counts processed=%d failed=%d, stored %d/%d",
+			response.ProcessedUsers, response.FailedUsers, job.ProcessedUsers, job.FailedUsers)
+	}
+	assertUndispatchedSkipped(t, job)
+
+	// Cancelling again returns the same cancelled job
+	status, again := cancelJob()
+	if status != http.StatusOK || again.Status != database.JobStatusCancelled || again.ProcessedUsers != response.ProcessedUsers {
+		t.Errorf("second cancel = %d %+v, want the same cancelled job", status, again)
+	}
+}
+
+func TestCancelJobHandlerRejectsFinishedJobs(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		jobID  string
+		want   int
+	}{
+		{"completed", database.JobStatusCompleted, "", http.StatusConflict},
+		{"failed", database.JobStatusFailed, "", http.StatusConflict},
+		{"running elsewhere", database.JobStatusRunning, "", http.StatusConflict},
+		{"unknown job", "", "00000000-0000-0000-0000-000000000099", http.StatusNotFound},
+		{"malformed id", "", "not-a-job", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			jobID := tt.jobID
+			if jobID == "" {
+				var err error
+				if jobID, err = createTestJob(store, 2); err != nil {
+					t.Fatalf("createTestJob: %v", err)
+				}
+				store.mu.Lock()
+				store.jobs[jobID].Status = tt.status
+				store.mu.Unlock()
+			}
+
+			w := serve(CancelJobHandler, http.MethodPost, "/jobs/:id/cancel", "/jobs/"+jobID+"/cancel", nil)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.status != "" && store.job(jobID).Status != tt.status {
+				t.Errorf("job status changed to %q", store.job(jobID).Status)
+			}
+		})
+	}
+}
+
+func TestTimedOutBatchJobCompletesWithTimeouts(t *testing.T) {
+	store := newTestStore(t)
+	blockingScraper(t)
+
+	usernames := []string{"u1", "u2", "u3", "u4", "u5", "u6"}
+	response, err := launchBatchJob(context.Background(), usernameTargets(usernames...), 1, 100*time.Millisecond, "", nil)
+	if err != nil {
+		t.Fatalf("launchBatchJob: %v", err)
+	}
+	waitForJobs(t)
+
+	// Users never dispatched before the deadline count as timeouts too
+	job := store.job(response.JobID)
+	if job.Status != database.JobStatusCompleted {
+		t.Errorf("job status = %q, want %q", job.Status, database.JobStatusCompleted)
+	}
+	if job.ProcessedUsers != job.TotalUsers || job.FailedUsers != job.TotalUsers || job.SuccessfulUsers != 0 {
+		t.Errorf("job processed %d, failed %d, succeeded %d of %d, want every user failed",
+			job.ProcessedUsers, job.FailedUsers, job.SuccessfulUsers, job.TotalUsers)
+	}
+	for _, username := range usernames {
+		if got := job.Errors[username]; got != errBatchTimeout.Error() {
+			t.Errorf("%s error = %q, want %q", username, got, errBatchTimeout.Error())
+		}
+	}
+}
+
+func TestBatchJobMissingUsersIsFailed(t *testing.T) {
+	store := newTestStore(t)
+	stubScraper(t, scrapeAs)
+
+	// The job expects one more user than it is given
+	job, err := database.CreateProcessingJob(context.Background(), 3, 1, nil)
+	if err != nil {
+		t.Fatalf("CreateProcessingJob: %v", err)
+	}
+	runBatchJob(context.Background(), job, usernameTargets("alice", "bob"), "missing-users")
+
+	stored := store.job(job.ID)
+	if stored.Status != database.JobStatusFailed || stored.ProcessedUsers != 2 {
+		t.Errorf("job status = %q with %d processed, want %q with 2", stored.Status, stored.ProcessedUsers, database.JobStatusFailed)
+	}
+}
+
+// progressEvents reads Server-Sent Events from body until it ends
+func progressEvents(t *testing.T, body io.Reader) (names []string, updates []ProgressUpdate) {
+	t.Helper()
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			names = append(names, strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			var update ProgressUpdate
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &update); err != nil {
+				t.Fatalf("bad progress event %q: %v", line, err)
+			}
+			updates = append(updates, update)
+		}
+	}
+	return names, updates
+}
+
+// fastProgress shortens the progress interval for the duration of the test
+func fastProgress(t *testing.T) {
+	prev := progressInterval
+	progressInterval = 10 * time.Millisecond
+	t.Cleanup(func() { progressInterval = prev })
+}
+
+func TestJobProgressStreamsUntilCompleted(t *testing.T) {
+	store := newTestStore(t)
+	fastProgress(t)
+	jobID, err := createTestJob(store, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each poll of the job sees one more user processed
+	store.On("FROM processing_jobs", func(args []driver.Value) dbtest.Result {
+		store.mu.Lock()
+		job := store.jobs[args[0].(string)]
+		job.ProcessedUsers++
+		if job.ProcessedUsers == job.TotalUsers {
+			job.Status = database.JobStatusCompleted
+		}
+		store.mu.Unlock()
+		return store.jobResult(args[0].(string))
+	})
+
+	r := gin.New()
+	r.GET("/jobs/:id/progress", JobProgressHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/jobs/" + jobID + "/progress")
+	if err != nil {
+		t.Fatalf("GET progress: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	names, updates := progressEvents(t, resp.Body)
+	if len(updates) != 3 {
+		t.Fatalf("got %d progress events %+v, want 3", len(updates), updates)
+	}
+	for i, update := range updates {
+		if names[i] != "progress" || update.Completed != i+1 || update.Total != 3 {
+			t.Errorf("event %d = %s %+v, want %d of 3", i, names[i], update, i+1)
+		}
+	}
+	if updates[0].Status != database.JobStatusRunning {
+		t.Errorf("first event status = %q, want %q", updates[0].Status, database.JobStatusRunning)
+	}
+	if last := updates[2]; last.Status != database.JobStatusCompleted || last.Progress != 100 {
+		t.Errorf("final event = %+v, want completed at 100%%", last)
+	}
+}
+
+func TestJobProgressStopsWhenClientDisconnects(t *testing.T) {
+	store := newTestStore(t)
+	fastProgress(t)
+	jobID, err := createTestJob(store, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.GET("/jobs/:id/progress", JobProgressHandler)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/jobs/"+jobID+"/progress", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	// Let a few polls of the still running job happen, then disconnect
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("progress stream still running after the client disconnected")
+	}
+	if n := len(store.Calls("FROM processing_jobs")); n < 2 {
+		t.Errorf("job polled %d times, want at least 2", n)
+	}
+}
+
+func TestJobProgressUnknownJob(t *testing.T) {
+	newTestStore(t)
+	w := serve(JobProgressHandler, http.MethodGet, "/jobs/:id/progress", "/jobs/00000000-0000-0000-0000-000000000009/progress", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// createTestJob stores a running job of total users and returns its id
+func createTestJob(store *testStore, total int) (string, error) {
+	job, err := database.CreateProcessingJob(context.Background(), total, 1, nil)
+	if err != nil {
+		return "", err
+	}
+	store.mu.Lock()
+	store.jobs[job.ID].Status = database.JobStatusRunning
+	store.mu.Unlock()
+	return job.ID, nil
+}
+
+// restartJobsAfterShutdown gives async jobs a live context again once the
+// test's jobs have exited, as Shutdown cancels it for good. Waiting on
+// jobsDone rather than jobsWG means Shutdown's waiter has returned before
+// later tests reuse jobsWG.
+func restartJobsAfterShutdown(t *testing.T) {
+	t.Cleanup(func() {
+		Shutdown(context.Background())
+		jobsCtx, cancelJobs = context.WithCancel(context.Background())
+		jobsDone, jobsDoneOnce = make(chan struct{}), sync.Once{}
+	})
+}
+
+func TestShutdownCancelsRunningJobs(t *testing.T) {
+	store := newTestStore(t)
+	entered := blockingScraper(t)
+	restartJobsAfterShutdown(t)
+
+	response, err := launchBatchJob(context.Background(), usernameTargets("u1", "u2", "u3"), 1, time.Minute, "", nil)
+	if err != nil {
+		t.Fatalf("launchBatchJob: %v", err)
+	}
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// The job recorded its final state before Shutdown returned
+	if job := store.job(response.JobID); job.Status != database.JobStatusCancelled || job.CompletedAt == nil {
+		t.Errorf("job status = %q, completed at %v, want cancelled", job.Status, job.CompletedAt)
+	}
+	runningJobsMu.Lock()
+	defer runningJobsMu.Unlock()
+	if len(runningJobs) != 0 {
+		t.Errorf("%d jobs still running after Shutdown", len(runningJobs))
+	}
+}
+
+func TestShutdownGivesUpAtDeadline(t *testing.T) {
+	newTestStore(t)
+	restartJobsAfterShutdown(t)
+
+	// A scrape that ignores cancellation holds the job past the deadline
+	entered, release := make(chan struct{}), make(chan struct{})
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		close(entered)
+		<-release
+		return nil, ctx.Err()
+	})
+	if _, err := launchBatchJob(context.Background(), usernameTargets("u1"), 1, time.Minute, "", nil); err != nil {
+		t.Fatalf("launchBatchJob: %v", err)
+	}
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown error = %v, want context.DeadlineExceeded", err)
+	}
+
+	close(release)
+}
+
+// finishTestJob marks a stored job finished with status and the given
+// per-identifier errors
+func finishTestJob(store *testStore, id, status string, failures map[string]string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	job := store.jobs[id]
+	job.Status = status
+	job.ProcessedUsers = job.TotalUsers
+	job.FailedUsers = len(failures)
+	job.SuccessfulUsers = job.TotalUsers - len(failures)
+	job.Errors = failures
+}
+
+func TestRetryJobRequeuesExactlyTheFailedUsers(t *testing.T) {
+	store := newTestStore(t)
+	var mu sync.Mutex
+	var scraped []string
+	SetScraper(idScraper{
+		ScraperFunc: func(ctx context.Context, username string) (*database.User, error) {
+			mu.Lock()
+			scraped = append(scraped, username)
+			mu.Unlock()
+			return scrapeAs(ctx, username)
+		},
+		byID: func(ctx context.Context, userID string) (*database.User, error) {
+			mu.Lock()
+			scraped = append(scraped, "id:"+userID)
+			mu.Unlock()
+			return scrapeIDAs(ctx, userID)
+		},
+	})
+
+	// The parent has only its errors, as jobs finished before failed
+	// targets were recorded do
+	parentID, err := createTestJob(store, 5)
+	if err != nil {
+		t.Fatalf("createTestJob: %v", err)
+	}
+	finishTestJob(store, parentID, database.JobStatusCompleted, map[string]string{
+		"bob":   "upstream error",
+		"carol": "timeout",
+		"12345": "user not found",
+	})
+
+	w := serve(RetryJobHandler, http.MethodPost, "/jobs/:id/retry", "/jobs/"+parentID+"/retry", nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response BatchJobResponse
+	decode(t, w, &response)
+	if response.JobID == "" || response.JobID == parentID {
+		t.Fatalf("retry job id = %q, want a new job", response.JobID)
+	}
+	if response.ParentJobID == nil || *response.ParentJobID != parentID || response.TotalUsers != 3 {
+		t.Errorf("retry job = %+v, want 3 users linked to %s", response, parentID)
+	}
+	waitForJobs(t)
+
+	mu.Lock()
+	got := append([]string(nil), scraped...)
+	mu.Unlock()
+	sort.Strings(got)
+	if want := []string{"bob", "carol", "id:12345"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("retry scraped %v, want exactly the failed users %v", got, want)
+	}
+
+	retry := store.job(response.JobID)
+	if retry.ParentJobID == nil || *retry.ParentJobID != parentID {
+		t.Errorf("stored retry job parent = %v, want %s", retry.ParentJobID, parentID)
+	}
+	if retry.Status != database.JobStatusCompleted || retry.SuccessfulUsers != 3 {
+		t.Errorf("retry job %s with %d successes, want completed with 3", retry.Status, retry.SuccessfulUsers)
+	}
+	if parent := store.job(parentID); parent.FailedUsers != 3 || len(parent.Errors) != 3 {
+		t.Errorf("parent job changed: %+v", parent)
+	}
+}
+
+func TestRetryJobRerunsRecordedTargets(t *testing.T) {
+	bob := testUser("2", "bob")
+	bob.ScrapedAt = time.Now().Add(-48 * time.Hour)
+	store := newTestStore(t, bob)
+	var mu sync.Mutex
+	var scraped []string
+	failing := true
+	SetScraper(idScraper{
+		ScraperFunc: func(ctx context.Context, username string) (*database.User, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			scraped = append(scraped, username)
+			if failing {
+				return nil, external.UserNotFoundError{Username: username, Message: "user not found"}
+			}
+			return scrapeAs(ctx, username)
+		},
+		byID: func(ctx context.Context, userID string) (*database.User, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			scraped = append(scraped, "id:"+userID)
+			return nil, external.UserNotFoundError{Username: userID, Message: "user not found"}
+		},
+	})
+
+	// A refresh of stored bob, an all-digit username and an id all fail
+	parent, err := launchBatchJob(context.Background(), []batchTarget{
+		{Identifier: "bob", Type: targetTypeUsername, Refresh: true},
+		{Identifier: "12345", Type: targetTypeUsername},
+		{Identifier: "67890", Type: targetTypeID},
+	}, 1, time.Minute, "", nil)
+	if err != nil {
+		t.Fatalf("launchBatchJob: %v", err)
+	}
+	waitForJobs(t)
+	if job := store.job(parent.JobID); job.FailedUsers != 3 || len(job.FailedTargets) != 3 {
+		t.Fatalf("parent job failed %d with targets %v, want all 3 recorded", job.FailedUsers, job.FailedTargets)
+	}
+
+	mu.Lock()
+	failing = false
+	scraped = nil
+	mu.Unlock()
+
+	w := serve(RetryJobHandler, http.MethodPost, "/jobs/:id/retry", "/jobs/"+parent.JobID+"/retry", nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	waitForJobs(t)
+
+	// bob is re-scraped rather than served stale, and 12345 stays a username
+	mu.Lock()
+	got := append([]string(nil), scraped...)
+	mu.Unlock()
+	sort.Strings(got)
+	if want := []string{"12345", "bob", "id:67890"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("retry scraped %v, want %v", got, want)
+	}
+}
+
+func TestRetryJobRejections(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		failures map[string]string
+		jobID    string
+		want     int
+	}{
+		{"unknown job", "", nil, "00000000-0000-0000-0000-000000000099", http.StatusNotFound},
+		{"malformed id", "", nil, "not-a-job", http.StatusNotFound},
+		{"still running", database.JobStatusRunning, map[string]string{"bob": "timeout"}, "", http.StatusConflict},
+		{"no failures", database.JobStatusCompleted, map[string]string{}, "", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			calls := countingScraper(t)
+			jobID := tt.jobID
+			if jobID == "" {
+				var err error
+				if jobID, err = createTestJob(store, 2); err != nil {
+					t.Fatalf("createTestJob: %v", err)
+				}
+				finishTestJob(store, jobID, tt.status, tt.failures)
+			}
+
+			w := serve(RetryJobHandler, http.MethodPost, "/jobs/:id/retry", "/jobs/"+jobID+"/retry", nil)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.want, w.Body.String())
+			}
+			waitForJobs(t)
+			if n := len(store.Calls("INSERT INTO processing_jobs")); n > 1 {
+				t.Errorf("created %d jobs, want no retry job", n-1)
+			}
+			if n := atomic.LoadInt32(calls); n != 0 {
+				t.Errorf("scraped %d users", n)
+			}
+		})
+	}
+}
@@ -7,9 +7,18 @@ import (
 
 // BatchRequest represents a batch processing request
 type BatchRequest struct {
-	Usernames      []string `json:"usernames" binding:"required"`
+	Usernames      []string `json:"usernames,omitempty"`
+	IDs            []string `json:"ids,omitempty"` // stored user ids, resolved alongside usernames
 	MaxConcurrency int      `json:"max_concurrency,omitempty"`
 	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+	Async          bool     `json:"async,omitempty"` // run as a background job and return its id
+
+	// CallbackURL receives a signed JobCallback when an async job finishes
+	CallbackURL string `json:"callback_url,omitempty"`
+
+	// SeparatePrivate reports private accounts with status "private" and
+	// counts them in summary.private instead of summary.successful
+	SeparatePrivate bool `json:"separate_private,omitempty"`
 }
 
 // BatchResponse represents a batch processing response
@@ -18,12 +27,51 @@ type BatchResponse struct {
 	Summary Summary      `json:"summary"`
 }
 
-// UserResult represents the result for a single user
+// BatchStreamLine is one NDJSON line of a streamed batch: a "result" line
+// per user as it completes, then a final "summary" line
+type BatchStreamLine struct {
+	Type    string      `json:"type"` // "result", "summary"
+	Result  *UserResult `json:"result,omitempty"`
+	Summary *Summary    `json:"summary,omitempty"`
+}
+
+// BatchJobResponse represents an async batch job tracking response
+type BatchJobResponse struct {
+	JobID           string            `json:"job_id"`
+	Status          string            `json:"status"`
+	TotalUsers      int               `json:"total_users"`
+	ProcessedUsers  int               `json:"processed_users"`
+	SuccessfulUsers int               `json:"successful_users"`
+	FailedUsers     int               `json:"failed_users"`
+	InvalidUsers    []ValidationError `json:"invalid_users,omitempty"`
+	Duplicate       bool              `json:"duplicate,omitempty"`     // an identical job was already running
+	ParentJobID     *string           `json:"parent_job_id,omitempty"` // job whose failed users this one retries
+}
+
+// JobCallback is the signed payload POSTed to an async batch's
+// callback_url once the job finishes. Errors is keyed by identifier.
+type JobCallback struct {
+	JobID           string            `json:"job_id"`
+	Status          string            `json:"status"`
+	TotalUsers      int               `json:"total_users"`
+	ProcessedUsers  int               `json:"processed_users"`
+	SuccessfulUsers int               `json:"successful_users"`
+	FailedUsers     int               `json:"failed_users"`
+	Errors          map[string]string `json:"errors,omitempty"`
+	StartedAt       *time.Time        `json:"started_at,omitempty"`
+	CompletedAt     *time.Time        `json:"completed_at,omitempty"`
+}
+
+// UserResult represents the result for a single user. Identifier and Type
+// echo the submitted entry; Username is the resolved username when known.
 type UserResult struct {
+	Identifier  string               `json:"identifier"`
+	Type        string               `json:"type"` // "username", "id"
 	Username    string               `json:"username"`
-	Status      string               `json:"status"` // "success", "error"
+	Status      string               `json:"status"` // "success", "private", "rate_limited", "error"
 	User        *database.User       `json:"user,omitempty"`
 	Error       string               `json:"error,omitempty"`
+	Stored      string               `json:"stored,omitempty"` // "inserted", "updated", "skipped" for a fresh scrape
 	ProcessedAt time.Time           `json:"processed_at"`
 }
 
@@ -32,11 +80,34 @@ type Summary struct {
 	Total           int     `json:"total"`
 	Successful      int     `json:"successful"`
 	Failed          int     `json:"failed"`
+	Private         int     `json:"private"`
+	Invalid         int     `json:"invalid"`
+	Duplicates      int     `json:"duplicates"`   // repeated entries collapsed into their first occurrence
+	Inserted        int     `json:"inserted"`     // newly discovered users written
+	Updated         int     `json:"updated"`      // stored users refreshed by a scrape
+	RateLimited     int     `json:"rate_limited"` // failures caused by RocketAPI rate limits, also counted in failed
+	InvalidUsers    []ValidationError `json:"invalid_users,omitempty"`
+
+	// Failures maps failed identifiers to their error, listing at most
+	// MAX_SUMMARY_FAILURES; FailuresTruncated is set when some were left out
+	Failures          map[string]string `json:"failures,omitempty"`
+	FailuresTruncated bool              `json:"failures_truncated,omitempty"`
+
 	DurationSeconds float64 `json:"duration_seconds"`
 	StartedAt       time.Time `json:"started_at"`
 	CompletedAt     time.Time `json:"completed_at"`
 }
 
+// ValidationError describes a username or id rejected before processing.
+// Index is the position within the list named by Type.
+type ValidationError struct {
+	Index    int    `json:"index"`
+	Type     string `json:"type"` // "username", "id"
+	Username string `json:"username,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Error    string `json:"error"`
+}
+
 // UserResponse represents a single user response
 type UserResponse struct {
 	User  database.User    `json:"user"`
@@ -44,10 +115,99 @@ type UserResponse struct {
 	Meta  ResponseMeta     `json:"meta"`
 }
 
+// UserExistsResponse reports that a username resolves to a user. Source is
+// "cache", "database" or "rocketapi".
+type UserExistsResponse struct {
+	Username string `json:"username"`
+	ID       string `json:"id"`
+	Exists   bool   `json:"exists"`
+	Source   string `json:"source"`
+}
+
+// UserListResponse represents a page of stored users
+type UserListResponse struct {
+	Users      []*database.User `json:"users"`
+	Pagination Pagination       `json:"pagination"`
+}
+
+// RefreshIfStaleRequest represents a watchlist to refresh where stale
+type RefreshIfStaleRequest struct {
+	Usernames     []string `json:"usernames"`
+	MaxAgeSeconds int      `json:"max_age_seconds,omitempty"` // overrides STALE_AFTER_SECONDS
+}
+
+// RefreshIfStaleResponse reports which watchlist users were fresh and which
+// were queued for refresh. Job is set when any user was queued.
+type RefreshIfStaleResponse struct {
+	Fresh        []string          `json:"fresh"`
+	Queued       []string          `json:"queued"`
+	InvalidUsers []ValidationError `json:"invalid_users,omitempty"`
+	Job          *BatchJobResponse `json:"job,omitempty"`
+}
+
+// StoredUsersResponse represents the stored users among a list of
+// usernames, looked up without scraping
+type StoredUsersResponse struct {
+	Users        []*database.User  `json:"users"`
+	NotFound     []string          `json:"not_found"`
+	InvalidUsers []ValidationError `json:"invalid_users,omitempty"`
+}
+
+// UserSearchResponse represents stored users matching a search query
+type UserSearchResponse struct {
+	Users []*database.User `json:"users"`
+	Query string           `json:"query"`
+	Limit int              `json:"limit"`
+}
+
+// PostListResponse represents a page of a user's posts
+type PostListResponse struct {
+	Posts      []*database.Post `json:"posts"`
+	Pagination Pagination       `json:"pagination"`
+}
+
+// TaggedUsernameListResponse represents a page of the accounts tagged in
+// a user's posts
+type TaggedUsernameListResponse struct {
+	TaggedUsernames []*database.TaggedUsername `json:"tagged_usernames"`
+	Pagination      Pagination                 `json:"pagination"`
+}
+
+// CoauthoredUsernameListResponse represents a page of the authors of a
+// user's posts
+type CoauthoredUsernameListResponse struct {
+	CoauthoredUsernames []*database.CoauthoredUsername `json:"coauthored_usernames"`
+	Pagination          Pagination                     `json:"pagination"`
+}
+
+// TopEngagementResponse represents users ranked by engagement rate
+type TopEngagementResponse struct {
+	Users                []*database.UserEngagement `json:"users"`
+	Limit                int                        `json:"limit"`
+	MinFollowers         int64                      `json:"min_followers"`
+	EngagementWindowDays int                        `json:"engagement_window_days"`
+}
+
+// Pagination describes the position of a page within a result set
+type Pagination struct {
+	Total   int  `json:"total"`
+	Limit   int  `json:"limit"`
+	Offset  int  `json:"offset"`
+	HasMore bool `json:"has_more"`
+}
+
 // ResponseMeta provides metadata about the response
 type ResponseMeta struct {
-	ProcessedAt time.Time `json:"processed_at"`
-	Source      string    `json:"source"` // "database", "api"
+	ProcessedAt       time.Time `json:"processed_at"`
+	Source            string    `json:"source"`                        // "cache", "database", "rocketapi"
+	UpstreamRequestID string    `json:"upstream_request_id,omitempty"` // RocketAPI request id, for support escalation
+	RefreshFailed     bool      `json:"refresh_failed,omitempty"`      // a requested re-scrape failed, the stored copy was returned
+	PreviousUsername  string    `json:"previous_username,omitempty"`   // stored username before a refresh by id picked up a rename
+	StatsError        string    `json:"stats_error,omitempty"`         // stats were requested but could not be computed
+
+	// Provenance maps each response section ("user", "stats",
+	// "profile_pic") to where its data came from, for mixed freshness
+	Provenance map[string]string `json:"provenance,omitempty"`
 }
 
 // ProgressUpdate represents real-time progress updates
@@ -0,0 +1,166 @@
+package instagram
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/api/apierror"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxRefreshUsernames caps the usernames accepted by RefreshIfStaleHandler
+const maxRefreshUsernames = 100
+
+// RefreshIfStaleHandler checks a watchlist against the stored users and
+// queues an async refresh job for the missing and stale ones only, so
+// syncing a watchlist doesn't spend quota on fresh users
+// POST /api/v1/instagram/users/refresh-if-stale
+func RefreshIfStaleHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	logger := utils.LoggerFromContext(ctx)
+
+	var req RefreshIfStaleRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		respondDecodeError(c, err)
+		return
+	}
+
+	if req.MaxAgeSeconds < 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "max_age_seconds must be a non-negative integer")
+		return
+	}
+
+	targets, invalid := validateTargets(req.Usernames, nil)
+	usernames := uniqueIdentifiers(targets)
+
+	if len(usernames) == 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "no valid usernames provided", gin.H{
+			"validation_errors": invalid,
+		})
+		return
+	}
+
+	if len(usernames) > maxRefreshUsernames {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("maximum %d usernames per refresh", maxRefreshUsernames))
+		return
+	}
+
+	maxAge := time.Duration(config.StaleAfterSeconds) * time.Second
+	if req.MaxAgeSeconds > 0 {
+		maxAge = time.Duration(req.MaxAgeSeconds) * time.Second
+	}
+
+	stored, err := database.GetUsersByUsernames(ctx, usernames)
+	if err != nil {
+		logger.Error().Err(err).Int("count", len(usernames)).Msg("failed to look up stored users")
+		respondError(c, http.StatusInternalServerError, "failed to look up users", err)
+		return
+	}
+
+	scrapedAt := make(map[string]time.Time, len(stored))
+	for _, user := range stored {
+		scrapedAt[user.Username] = user.ScrapedAt
+	}
+
+	response := RefreshIfStaleResponse{
+		Fresh:        make([]string, 0, len(usernames)),
+		Queued:       make([]string, 0, len(usernames)),
+		InvalidUsers: invalid,
+	}
+	var stale []batchTarget
+	for _, username := range usernames {
+		if at, ok := scrapedAt[username]; ok && time.Since(at) <= maxAge {
+			response.Fresh = append(response.Fresh, username)
+			continue
+		}
+		response.Queued = append(response.Queued, username)
+		stale = append(stale, batchTarget{Identifier: username, Type: targetTypeUsername, Refresh: true})
+	}
+
+	logger.Info().
+		Int("fresh", len(response.Fresh)).
+		Int("queued", len(response.Queued)).
+		Dur("max_age", maxAge).
+		Msg("checked watchlist staleness")
+
+	if len(stale) == 0 {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	job, err := launchBatchJob(ctx, stale, defaultBatchConcurrency, defaultBatchTimeoutSeconds*time.Second, "", nil)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to create processing job", err)
+		return
+	}
+	response.Job = &job
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+// RefreshUserByIDHandler re-scrapes a user by id and stores the result.
+// Lookup by id still finds an account renamed since it was stored, in which
+// case the stored username is replaced by the current one.
+// GET /api/v1/instagram/users/:id/refresh
+func RefreshUserByIDHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	logger := utils.LoggerFromContext(ctx)
+
+	userID := c.Param("id")
+	if err := validateUserID(userID); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	idScraper, ok := scraper.(external.IDScraper)
+	if !ok {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeNotImplemented, "the configured scraper cannot look up users by id")
+		return
+	}
+
+	stored, err := database.GetUserByID(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Error().Err(err).Str("user_id", userID).Msg("database error")
+		respondError(c, http.StatusInternalServerError, "database error", err)
+		return
+	}
+
+	user, err := idScraper.ScrapeInstagramUserByID(ctx, userID)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to scrape user by id")
+		respondScrapeError(c, err, userID)
+		return
+	}
+
+	outcome, err := storeUser(ctx, user)
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", userID).Msg("failed to store user")
+		respondError(c, http.StatusInternalServerError, "failed to store user", err)
+		return
+	}
+	if outcome != storeSkipped {
+		uploadProfilePicture(ctx, user, stored)
+	}
+
+	response := buildUserResponse(ctx, user, "rocketapi", false, database.StatsOptions{})
+	if stored != nil && stored.Username != user.Username {
+		// The cache is keyed by username, so the old entry must go too
+		if userCache != nil {
+			userCache.Delete(stored.Username)
+		}
+		response.Meta.PreviousUsername = stored.Username
+		logger.Info().
+			Str("user_id", userID).
+			Str("previous_username", stored.Username).
+			Str("username", user.Username).
+			Msg("refreshed renamed user")
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,224 @@
+package instagram
+
+import (
+	"context"
+	"fmt"
+	"instagram-user-processor/pkg/cache"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/utils"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watchlistStore returns a store holding a freshly scraped alice and a bob
+// scraped two days ago, with stale users after an hour
+func watchlistStore(t *testing.T) (*testStore, *MockScraper) {
+	t.Helper()
+	alice, bob := testUser("1", "alice"), testUser("2", "bob")
+	bob.ScrapedAt = time.Now().Add(-48 * time.Hour)
+	store := newTestStore(t, alice, bob)
+	serveStoredLookup(t, store)
+	useConfig(t, func(cfg *utils.Config) { cfg.StaleAfterSeconds = 3600 })
+
+	mock := &MockScraper{Users: map[string]*database.User{
+		"alice": {ID: "1", Username: "alice", ScrapedAt: time.Now()},
+		"bob":   {ID: "2", Username: "bob", ScrapedAt: time.Now()},
+		"carol": {ID: "3", Username: "carol", ScrapedAt: time.Now()},
+	}}
+	useMockScraper(t, mock)
+	return store, mock
+}
+
+func TestRefreshIfStaleQueuesOnlyStaleAndMissingUsers(t *testing.T) {
+	_, mock := watchlistStore(t)
+
+	w := serve(RefreshIfStaleHandler, http.MethodPost, "/users/refresh-if-stale", "/users/refresh-if-stale", map[string]interface{}{
+		"usernames": []string{"alice", "bob", "carol", "bob"},
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response RefreshIfStaleResponse
+	decode(t, w, &response)
+	if strings.Join(response.Fresh, ",") != "alice" || strings.Join(response.Queued, ",") != "bob,carol" {
+		t.Errorf("fresh %v, queued %v, want alice and bob,carol", response.Fresh, response.Queued)
+	}
+	if response.Job == nil || response.Job.JobID == "" {
+		t.Fatalf("response %+v has no job for the queued users", response)
+	}
+
+	waitForJobs(t)
+	scraped := append([]string(nil), mock.Calls...)
+	sort.Strings(scraped)
+	if strings.Join(scraped, ",") != "bob,carol" {
+		t.Errorf("scraped %v, want only bob and carol", scraped)
+	}
+}
+
+func TestRefreshIfStaleCountsFailedRefreshAsFailure(t *testing.T) {
+	store, mock := watchlistStore(t)
+	// bob's account is gone, so his re-scrape fails
+	delete(mock.Users, "bob")
+
+	w := serve(RefreshIfStaleHandler, http.MethodPost, "/users/refresh-if-stale", "/users/refresh-if-stale", map[string]interface{}{
+		"usernames": []string{"alice", "bob", "carol"},
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response RefreshIfStaleResponse
+	decode(t, w, &response)
+	if response.Job == nil {
+		t.Fatalf("response %+v has no job", response)
+	}
+
+	waitForJobs(t)
+	job := store.job(response.Job.JobID)
+	if job.SuccessfulUsers != 1 || job.FailedUsers != 1 {
+		t.Errorf("job counted %d successful and %d failed, want carol and bob", job.SuccessfulUsers, job.FailedUsers)
+	}
+	if msg, ok := job.Errors["bob"]; !ok || !strings.Contains(msg, "not found") {
+		t.Errorf("job errors = %v, want bob's failed refresh", job.Errors)
+	}
+}
+
+func TestFetchUserStrictRefresh(t *testing.T) {
+	stale := testUser("1", "alice")
+	stale.ScrapedAt = time.Now().Add(-48 * time.Hour)
+	newTestStore(t, stale)
+	useMockScraper(t, &MockScraper{Err: external.UserNotFoundError{Username: "alice", Message: "user not found"}})
+
+	// The single user endpoint falls back to the stored user
+	user, source, _, err := fetchUser(context.Background(), "alice", fetchOptions{Refresh: true})
+	if err != nil || source != "database" || user.ID != "1" {
+		t.Errorf("lenient refresh = %+v from %q, err %v, want the stored user", user, source, err)
+	}
+
+	user, _, _, err = fetchUser(context.Background(), "alice", fetchOptions{Refresh: true, Strict: true})
+	if err == nil || user != nil {
+		t.Errorf("strict refresh = %+v, err %v, want the scrape error", user, err)
+	}
+}
+
+func TestRefreshIfStaleAllFreshQueuesNothing(t *testing.T) {
+	store, mock := watchlistStore(t)
+
+	// A week's max age makes bob fresh too
+	w := serve(RefreshIfStaleHandler, http.MethodPost, "/users/refresh-if-stale", "/users/refresh-if-stale", map[string]interface{}{
+		"usernames":       []string{"alice", "bob"},
+		"max_age_seconds": 7 * 24 * 3600,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	var response RefreshIfStaleResponse
+	decode(t, w, &response)
+	if len(response.Fresh) != 2 || len(response.Queued) != 0 || response.Job != nil {
+		t.Errorf("response %+v, want both fresh and no job", response)
+	}
+	if len(store.Calls("INSERT INTO processing_jobs")) != 0 || len(mock.Calls) != 0 {
+		t.Error("created a job for a fresh watchlist")
+	}
+}
+
+func TestRefreshIfStaleRejectsInvalidRequests(t *testing.T) {
+	watchlistStore(t)
+
+	for name, body := range map[string]map[string]interface{}{
+		"no usernames":     {"usernames": []string{}},
+		"only invalid":     {"usernames": []string{"bad..name"}},
+		"negative max age": {"usernames": []string{"alice"}, "max_age_seconds": -1},
+	} {
+		w := serve(RefreshIfStaleHandler, http.MethodPost, "/users/refresh-if-stale", "/users/refresh-if-stale", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, w.Code)
+		}
+	}
+}
+
+// refreshByIDResponse is the part of a by-id refresh response the tests
+// check
+type refreshByIDResponse struct {
+	User struct {
+		ID        string `json:"id"`
+		Username  string `json:"username"`
+		Followers int64  `json:"followers"`
+	} `json:"user"`
+	Meta ResponseMeta `json:"meta"`
+}
+
+func TestRefreshByIDPicksUpRename(t *testing.T) {
+	store := newTestStore(t, testUser("123456", "alice"))
+	userCache = cache.NewTTLCache[string, *database.User](time.Minute, 10)
+	userCache.Set("alice", testUser("123456", "alice"))
+
+	// RocketAPI now knows the account under a new username
+	var requested string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		fmt.Fprint(w, `{"status":"done","response":{"status_code":200,"body":{"user":{"pk":123456,"username":"alice_renamed","follower_count":900}}}}`)
+	}))
+	t.Cleanup(srv.Close)
+	SetScraper(external.NewRocketAPIClient(external.RocketAPIOptions{BaseURL: srv.URL, RateLimit: 1000}))
+
+	w := serve(RefreshUserByIDHandler, http.MethodGet, "/users/:id/refresh", "/users/123456/refresh", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if requested != "/instagram/user/get_info_by_id" {
+		t.Errorf("RocketAPI path = %q, want get_info_by_id", requested)
+	}
+
+	var response refreshByIDResponse
+	decode(t, w, &response)
+	if response.User.ID != "123456" || response.User.Username != "alice_renamed" || response.User.Followers != 900 {
+		t.Errorf("user = %+v, want 123456 renamed to alice_renamed with 900 followers", response.User)
+	}
+	if response.Meta.PreviousUsername != "alice" {
+		t.Errorf("previous_username = %q, want alice", response.Meta.PreviousUsername)
+	}
+	if got := store.user("123456").Username; got != "alice_renamed" {
+		t.Errorf("stored username = %q, want alice_renamed", got)
+	}
+	if _, ok := userCache.Get("alice"); ok {
+		t.Error("old username still cached")
+	}
+}
+
+func TestRefreshByIDErrors(t *testing.T) {
+	notFound := idScraper{
+		ScraperFunc: scrapeAs,
+		byID: func(_ context.Context, userID string) (*database.User, error) {
+			return nil, external.UserNotFoundError{Username: userID, Message: "HTTP 404"}
+		},
+	}
+	tests := []struct {
+		name    string
+		scraper external.Scraper
+		id      string
+		want    int
+	}{
+		{"invalid id", notFound, "not-an-id", http.StatusBadRequest},
+		{"unknown account", notFound, "42", http.StatusNotFound},
+		{"scraper without id lookups", external.ScraperFunc(scrapeAs), "42", http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			SetScraper(tt.scraper)
+
+			w := serve(RefreshUserByIDHandler, http.MethodGet, "/users/:id/refresh", "/users/"+tt.id+"/refresh", nil)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.want, w.Body.String())
+			}
+			if n := len(store.Calls("INSERT INTO instagram_users")); n != 0 {
+				t.Errorf("stored %d users, want none", n)
+			}
+		})
+	}
+}
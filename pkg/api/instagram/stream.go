@@ -0,0 +1,98 @@
+package instagram
+
+import (
+	"context"
+	"encoding/json"
+	"instagram-user-processor/pkg/metrics"
+	"instagram-user-processor/pkg/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ndjsonContentType is the media type of streamed batch results
+const ndjsonContentType = "application/x-ndjson"
+
+// StreamBatchUsersHandler processes a batch and streams each result as
+// NDJSON as soon as it completes, followed by a summary line
+// POST /api/v1/instagram/users/batch/stream
+func StreamBatchUsersHandler(c *gin.Context) {
+	req, targets, invalid, ok := bindBatchRequest(c)
+	if !ok {
+		return
+	}
+
+	streamBatch(c, req, targets, invalid)
+}
+
+// wantsNDJSON reports whether the client's Accept header prefers streamed
+// NDJSON results
+func wantsNDJSON(c *gin.Context) bool {
+	return c.NegotiateFormat(gin.MIMEJSON, ndjsonContentType) == ndjsonContentType
+}
+
+// streamBatch processes a bound batch request, writing each result as an
+// NDJSON line as soon as it completes and a summary line last. A failed
+// user is written as an error result; it doesn't end the stream.
+func streamBatch(c *gin.Context, req *BatchRequest, targets []batchTarget, invalid []ValidationError) {
+	logger := utils.LoggerFromContext(c.Request.Context())
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(req.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	// Streams outlive the server write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		logger.Warn().Err(err).Msg("failed to clear write deadline for batch stream")
+	}
+
+	c.Header("Content-Type", ndjsonContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+
+	// Buffered for the whole batch so workers never block on a slow client
+	resultsCh := make(chan UserResult, len(targets))
+	startedAt := time.Now()
+	go func() {
+		defer close(resultsCh)
+
+		// Workers are done once fetchDataForUsers returns, so reported is
+		// safe to read afterwards
+		reported := make([]bool, len(targets))
+		results := fetchDataForUsers(ctx, targets, req.MaxConcurrency, func(i int, result UserResult) {
+			reported[i] = true
+			resultsCh <- result
+		})
+
+		// Users never dispatched before the deadline are streamed last
+		for i, result := range results {
+			if !reported[i] {
+				resultsCh <- result
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(c.Writer)
+	results := make([]UserResult, 0, len(targets))
+	for result := range resultsCh {
+		if req.SeparatePrivate {
+			result = markPrivate([]UserResult{result})[0]
+		}
+		results = append(results, result)
+		if err := enc.Encode(BatchStreamLine{Type: "result", Result: &result}); err != nil {
+			logger.Debug().Err(err).Msg("failed to write batch stream result")
+			continue
+		}
+		c.Writer.Flush()
+	}
+
+	completedAt := time.Now()
+	metrics.ObserveBatch("stream", completedAt.Sub(startedAt))
+
+	summary := newSummary(req.total(), invalid, results, startedAt, completedAt)
+	if err := enc.Encode(BatchStreamLine{Type: "summary", Summary: &summary}); err != nil {
+		logger.Debug().Err(err).Msg("failed to write batch stream summary")
+		return
+	}
+	c.Writer.Flush()
+}
@@ -0,0 +1,199 @@
+package instagram
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"instagram-user-processor/pkg/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamLines decodes an NDJSON batch stream
+func streamLines(t *testing.T, body string) (results []UserResult, summary *Summary) {
+	t.Helper()
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		var line BatchStreamLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("bad stream line %q: %v", scanner.Text(), err)
+		}
+		switch line.Type {
+		case "result":
+			results = append(results, *line.Result)
+		case "summary":
+			summary = line.Summary
+		}
+	}
+	return results, summary
+}
+
+func TestStreamBatchWritesEveryUserAndSummary(t *testing.T) {
+	newTestStore(t)
+	stubScraper(t, scrapeAs)
+
+	w := serve(StreamBatchUsersHandler, http.MethodPost, "/stream", "/stream", map[string]interface{}{
+		"usernames": []string{"alice", "bob", "carol"},
+	})
+	if ct := w.Header().Get("Content-Type"); ct != ndjsonContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, ndjsonContentType)
+	}
+
+	results, summary := streamLines(t, w.Body.String())
+	if len(results) != 3 {
+		t.Fatalf("streamed %d results, want 3", len(results))
+	}
+	if summary == nil || summary.Total != 3 || summary.Successful != 3 {
+		t.Errorf("summary = %+v, want 3 successful of 3", summary)
+	}
+}
+
+func TestStreamBatchReportsUndispatchedUsersAtDeadline(t *testing.T) {
+	newTestStore(t)
+	blockingScraper(t)
+
+	w := serve(StreamBatchUsersHandler, http.MethodPost, "/stream", "/stream", map[string]interface{}{
+		"usernames":       []string{"u1", "u2", "u3", "u4", "u5", "u6"},
+		"max_concurrency": 1,
+		"timeout_seconds": 1,
+	})
+
+	results, summary := streamLines(t, w.Body.String())
+	if len(results) != 6 {
+		t.Fatalf("streamed %d results, want 6", len(results))
+	}
+	for _, result := range results {
+		if result.Error != errBatchTimeout.Error() {
+			t.Errorf("%s error = %q, want %q", result.Identifier, result.Error, errBatchTimeout.Error())
+		}
+	}
+	if summary == nil || summary.Failed != 6 {
+		t.Errorf("summary = %+v, want 6 failed", summary)
+	}
+}
+
+func TestStreamBatchWritesResultsAsTheyComplete(t *testing.T) {
+	newTestStore(t)
+
+	// Each user's scrape waits for its own release, or for the test to end
+	release := map[string]chan struct{}{"alice": make(chan struct{}), "bob": make(chan struct{})}
+	stop := make(chan struct{})
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		select {
+		case <-release[username]:
+		case <-stop:
+			return nil, errors.New("test ended")
+		}
+		return scrapeAs(ctx, username)
+	})
+
+	r := gin.New()
+	r.POST("/stream", StreamBatchUsersHandler)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(stop) })
+
+	// Only bob can finish; the response starts with his result while alice
+	// is still being scraped
+	close(release["bob"])
+	resp, err := http.Post(srv.URL+"/stream", "application/json", strings.NewReader(`{"usernames":["alice","bob"]}`))
+	if err != nil {
+		t.Fatalf("POST stream: %v", err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	next := func() BatchStreamLine {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("stream ended early: %v", lines.Err())
+		}
+		var line BatchStreamLine
+		if err := json.Unmarshal(lines.Bytes(), &line); err != nil {
+			t.Fatalf("bad stream line %q: %v", lines.Text(), err)
+		}
+		return line
+	}
+
+	if line := next(); line.Type != "result" || line.Result.Identifier != "bob" {
+		t.Fatalf("first line = %+v, want bob's result", line)
+	}
+	close(release["alice"])
+	if line := next(); line.Type != "result" || line.Result.Identifier != "alice" {
+		t.Fatalf("second line = %+v, want alice's result", line)
+	}
+	if line := next(); line.Type != "summary" || line.Summary.Successful != 2 {
+		t.Fatalf("last line = %+v, want a summary of 2 successful", line)
+	}
+	if lines.Scan() {
+		t.Errorf("unexpected line after the summary: %s", lines.Text())
+	}
+}
+
+func TestStreamBatchSeparatesPrivateAccounts(t *testing.T) {
+	newTestStore(t)
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		user, _ := scrapeAs(ctx, username)
+		user.IsPrivate = username == "hidden"
+		return user, nil
+	})
+
+	w := serve(StreamBatchUsersHandler, http.MethodPost, "/stream", "/stream", map[string]interface{}{
+		"usernames":        []string{"hidden", "public"},
+		"separate_private": true,
+	})
+
+	results, summary := streamLines(t, w.Body.String())
+	for _, result := range results {
+		if want := map[string]string{"hidden": "private", "public": "success"}[result.Identifier]; result.Status != want {
+			t.Errorf("%s status = %q, want %q", result.Identifier, result.Status, want)
+		}
+	}
+	if summary == nil || summary.Private != 1 || summary.Successful != 1 || summary.Failed != 0 {
+		t.Errorf("summary = %+v, want 1 private and 1 successful", summary)
+	}
+}
+
+func TestBatchStreamsNDJSONOnAccept(t *testing.T) {
+	newTestStore(t)
+	stubScraper(t, func(ctx context.Context, username string) (*database.User, error) {
+		if username == "broken" {
+			return nil, errors.New("parse failure")
+		}
+		return scrapeAs(ctx, username)
+	})
+
+	r := gin.New()
+	r.POST("/batch", BatchProcessUsersHandler)
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`{"usernames":["alice","broken","bob","carol"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", ndjsonContentType)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if ct := w.Header().Get("Content-Type"); ct != ndjsonContentType {
+		t.Fatalf("Content-Type = %q, want %q", ct, ndjsonContentType)
+	}
+
+	// One failing user is reported on its own line and the rest still stream
+	results, summary := streamLines(t, w.Body.String())
+	completed := 0
+	for _, result := range results {
+		switch {
+		case result.Identifier == "broken" && result.Status != "error":
+			t.Errorf("broken status = %q, want error", result.Status)
+		case result.Status == "success":
+			completed++
+		}
+	}
+	if len(results) != 4 || completed != 3 {
+		t.Errorf("streamed %d results with %d completed, want 4 with 3", len(results), completed)
+	}
+	if summary == nil || summary.Successful != 3 || summary.Failed != 1 {
+		t.Errorf("summary = %+v, want 3 successful and 1 failed", summary)
+	}
+}
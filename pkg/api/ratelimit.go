@@ -0,0 +1,136 @@
+package api
+
+import (
+	"instagram-user-processor/pkg/api/apierror"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// clientIdleTTL is how long an idle client's limiter is kept
+	clientIdleTTL = 10 * time.Minute
+	// clientSweepInterval is how often idle limiters are evicted
+	clientSweepInterval = time.Minute
+	// maxClientLimiters bounds the tracked clients, e.g. under a spoofed
+	// address flood
+	maxClientLimiters = 100000
+)
+
+// clientLimiter is the token bucket of a single client
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientLimiters holds a token bucket per client
+type clientLimiters struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+func newClientLimiters(limit rate.Limit, burst int) *clientLimiters {
+	return &clientLimiters{
+		limit:     limit,
+		burst:     burst,
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns the limiter for key, creating it on first use and evicting
+// limiters of clients that have been idle for clientIdleTTL. When
+// maxClientLimiters clients are tracked, an arbitrary one is evicted to
+// make room.
+func (l *clientLimiters) get(key string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > clientSweepInterval || len(l.clients) >= maxClientLimiters {
+		for k, client := range l.clients {
+			if now.Sub(client.lastSeen) > clientIdleTTL {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	client, ok := l.clients[key]
+	if !ok {
+		if len(l.clients) >= maxClientLimiters {
+			for k := range l.clients {
+				delete(l.clients, k)
+				break
+			}
+		}
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = now
+	return client.limiter
+}
+
+// rateLimitExemptPaths are the health check routes, which load balancers
+// poll and must never see a 429.
+var rateLimitExemptPaths = map[string]bool{
+	"/health":       true,
+	"/health/ready": true,
+}
+
+// RateLimitMiddleware limits each client IP to requestsPerSecond with the
+// given burst. Every response carries X-RateLimit-Limit (the burst),
+// X-RateLimit-Remaining and X-RateLimit-Reset (Unix time at which the
+// bucket is full again) so clients can throttle themselves before being
+// rejected with 429. Preflight requests and health checks are exempt. A
+// non-positive requestsPerSecond disables limiting.
+func RateLimitMiddleware(requestsPerSecond, burst int) gin.HandlerFunc {
+	if requestsPerSecond <= 0 {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	if burst <= 0 {
+		burst = requestsPerSecond
+	}
+
+	limiters := newClientLimiters(rate.Limit(requestsPerSecond), burst)
+
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions || rateLimitExemptPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		limiter := limiters.get(c.ClientIP(), now)
+		allowed := limiter.AllowN(now, 1)
+
+		tokens := limiter.TokensAt(now)
+		remaining := int(tokens)
+		if remaining < 0 {
+			remaining = 0
+		}
+		untilFull := time.Duration((float64(burst) - tokens) / float64(requestsPerSecond) * float64(time.Second))
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(now.Add(untilFull).Unix(), 10))
+
+		if !allowed {
+			// Time until a single token is available
+			retryAfter := time.Duration((1 - tokens) / float64(requestsPerSecond) * float64(time.Second))
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			apierror.Abort(c, http.StatusTooManyRequests, apierror.CodeRateLimited, "rate limit exceeded")
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimitHeadersDecrement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RateLimitMiddleware(1, 3))
+	r.Any("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	get := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, want := range []string{"2", "1", "0"} {
+		w := get("/api/v1/instagram/user/alice", "10.0.0.1:1234")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d status = %d", i+1, w.Code)
+		}
+		if got := w.Header().Get("X-RateLimit-Limit"); got != "3" {
+			t.Errorf("request %d X-RateLimit-Limit = %q, want 3", i+1, got)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != want {
+			t.Errorf("request %d X-RateLimit-Remaining = %q, want %s", i+1, got, want)
+		}
+		reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil || reset < time.Now().Unix() {
+			t.Errorf("request %d X-RateLimit-Reset = %q, want a time not in the past", i+1, w.Header().Get("X-RateLimit-Reset"))
+		}
+	}
+
+	w := get("/api/v1/instagram/user/alice", "10.0.0.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst status = %d, want 429", w.Code)
+	}
+	if w.Header().Get("X-RateLimit-Remaining") != "0" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("rejected request headers = %v, want no remaining and a Retry-After", w.Header())
+	}
+
+	// Other clients have their own bucket, and health checks aren't counted
+	if got := get("/api/v1/instagram/user/alice", "10.0.0.2:1234").Header().Get("X-RateLimit-Remaining"); got != "2" {
+		t.Errorf("another client's X-RateLimit-Remaining = %q, want 2", got)
+	}
+	if w := get("/health", "10.0.0.1:1234"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "" {
+		t.Errorf("health check status = %d with headers %v, want 200 without rate limit headers", w.Code, w.Header())
+	}
+}
+
+func TestRateLimitExemptsOnlyHealthPaths(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RateLimitMiddleware(1, 1))
+	r.Any("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	get := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := get("/healthz-admin"); code != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", code)
+	}
+	for _, path := range []string{"/health", "/health/ready", "/health", "/health/ready"} {
+		if code := get(path); code != http.StatusOK {
+			t.Errorf("%s status = %d, want 200 (exempt)", path, code)
+		}
+	}
+	if code := get("/healthz-admin"); code != http.StatusTooManyRequests {
+		t.Errorf("/healthz-admin past the burst status = %d, want 429", code)
+	}
+}
+
+func TestRateLimitRejectsRequestsAboveLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RateLimitMiddleware(1, 5))
+	r.Any("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	send := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/instagram/user/alice", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	var ok, limited int
+	var last *httptest.ResponseRecorder
+	for i := 0; i < 20; i++ {
+		w := send(http.MethodGet)
+		switch w.Code {
+		case http.StatusOK:
+			ok++
+		case http.StatusTooManyRequests:
+			limited++
+			last = w
+		default:
+			t.Fatalf("request %d status = %d", i+1, w.Code)
+		}
+	}
+	if ok != 5 || limited != 15 {
+		t.Fatalf("got %d allowed and %d rejected, want 5 and 15", ok, limited)
+	}
+
+	if ct := last.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q, want JSON", ct)
+	}
+	var body struct {
+		Code       string `json:"code"`
+		HTTPStatus int    `json:"http_status"`
+		Error      string `json:"error"`
+	}
+	if err := json.Unmarshal(last.Body.Bytes(), &body); err != nil {
+		t.Fatalf("429 body isn't JSON: %v: %s", err, last.Body)
+	}
+	if body.Code != "RATE_LIMITED" || body.HTTPStatus != http.StatusTooManyRequests || body.Error == "" {
+		t.Errorf("429 body = %+v, want code RATE_LIMITED", body)
+	}
+	if secs, err := strconv.Atoi(last.Header().Get("Retry-After")); err != nil || secs < 1 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", last.Header().Get("Retry-After"))
+	}
+
+	// Preflight requests go through even when the client is limited
+	if w := send(http.MethodOptions); w.Code != http.StatusOK {
+		t.Errorf("OPTIONS status = %d, want 200", w.Code)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RateLimitMiddleware(0, 0))
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+			t.Fatalf("request %d status = %d with headers %v, want 200 without limiting", i+1, w.Code, w.Header())
+		}
+	}
+}
+
+func TestClientLimitersEvictIdleClients(t *testing.T) {
+	l := newClientLimiters(1, 1)
+	start := time.Now()
+	l.get("10.0.0.1", start)
+	l.get("10.0.0.2", start.Add(clientIdleTTL))
+
+	// After the next sweep only the client seen within clientIdleTTL remains
+	l.get("10.0.0.2", start.Add(clientIdleTTL+clientSweepInterval+time.Second))
+	if _, ok := l.clients["10.0.0.1"]; ok {
+		t.Error("idle client limiter wasn't evicted")
+	}
+	if len(l.clients) != 1 {
+		t.Errorf("tracking %d clients, want 1", len(l.clients))
+	}
+}
@@ -1,10 +1,18 @@
 package api
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"instagram-user-processor/pkg/api/apierror"
 	"instagram-user-processor/pkg/api/instagram"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/metrics"
 	"instagram-user-processor/pkg/utils"
 	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -12,18 +20,26 @@ import (
 func InitRouter(config *utils.Config) *gin.Engine {
 	r := gin.Default()
 
+	instagram.Init(config)
+
 	// Add middleware
+	r.Use(RequestIDMiddleware())
+	r.Use(TracingMiddleware())
+	r.Use(InFlightMiddleware())
+	r.Use(MetricsMiddleware())
 	r.Use(LoggingMiddleware())
-	r.Use(CORSMiddleware())
+	r.Use(CORSMiddleware(config.CORSAllowedOrigins))
+	r.Use(GzipMiddleware(config.GzipMinBytes))
+	r.Use(PathLengthMiddleware(config.MaxPathSegmentLength))
+	r.Use(RateLimitMiddleware(config.ClientRateLimit, config.ClientRateBurst))
+	r.Use(AuditActorMiddleware())
 
 	// Health check endpoint
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":    "ok",
-			"service":   "instagram-user-processor",
-			"timestamp": gin.H{"unix": gin.H{}},
-		})
-	})
+	r.GET("/health", HealthHandler)
+	r.GET("/health/ready", ReadyHandler)
+
+	// Prometheus metrics
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	// API v1 group
 	v1 := r.Group("/api/v1")
@@ -33,26 +49,76 @@ func InitRouter(config *utils.Config) *gin.Engine {
 	{
 		// Existing single user endpoint (working implementation)
 		instagramGroup.GET("/user/:username", instagram.GetUserHandler)
+		instagramGroup.GET("/user/:username/exists", instagram.UserExistsHandler)
+		instagramGroup.HEAD("/user/:username/exists", instagram.UserExistsHandler)
 
 		// New batch endpoint (to be implemented by candidate)
 		instagramGroup.POST("/users/batch", instagram.BatchProcessUsersHandler)
+		instagramGroup.POST("/users/batch/stream", instagram.StreamBatchUsersHandler)
+		instagramGroup.POST("/users/refresh-if-stale", instagram.RefreshIfStaleHandler)
+
+		// Stored users listing
+		instagramGroup.GET("/users", instagram.ListUsersHandler)
+		instagramGroup.GET("/users/search", instagram.SearchUsersHandler)
 
 		// Helper endpoint for testing
 		instagramGroup.GET("/users/:id/stats", instagram.GetUserStatsHandler)
+		instagramGroup.GET("/users/:id/posts", instagram.GetUserPostsHandler)
+		instagramGroup.GET("/users/:id/tagged", instagram.GetUserTaggedHandler)
+		instagramGroup.GET("/users/:id/coauthored", instagram.GetUserCoauthoredHandler)
+		instagramGroup.GET("/users/:id/refresh", instagram.RefreshUserByIDHandler)
+
+		// Engagement ranking
+		instagramGroup.GET("/stats/top-engagement", instagram.TopEngagementHandler)
+		instagramGroup.GET("/stats/overview", instagram.StatsOverviewHandler)
+
+		// Async batch job status
+		instagramGroup.GET("/jobs/:id", instagram.GetJobHandler)
+		instagramGroup.GET("/jobs/:id/progress", instagram.JobProgressHandler)
+		instagramGroup.POST("/jobs/:id/cancel", instagram.CancelJobHandler)
+	}
+
+	// Admin endpoints (require API key)
+	adminGroup := instagramGroup.Group("", AuthMiddleware(config.AdminAPIKey))
+	{
+		adminGroup.POST("/users/:id/profile-pic/reupload", instagram.ReuploadProfilePictureHandler)
+		adminGroup.GET("/admin/audit", instagram.GetAuditLogHandler)
+		adminGroup.DELETE("/users/:id", instagram.DeleteUserHandler)
+		adminGroup.POST("/jobs/:id/retry", instagram.RetryJobHandler)
+	}
+
+	// Profiling endpoints, off by default
+	if config.EnablePprof {
+		registerPprof(r)
 	}
 
 	// 404 handler
 	r.NoRoute(func(c *gin.Context) {
-		c.JSON(404, gin.H{
-			"error":   "route not found",
-			"path":    c.Request.URL.Path,
-			"method":  c.Request.Method,
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeRouteNotFound, "route not found", gin.H{
+			"path":   c.Request.URL.Path,
+			"method": c.Request.Method,
 		})
 	})
 
 	return r
 }
 
+// registerPprof mounts the net/http/pprof handlers under /debug/pprof.
+// Profiles longer than the server write timeout need ?seconds= set lower.
+func registerPprof(r *gin.Engine) {
+	debug := r.Group("/debug/pprof")
+	{
+		debug.GET("/", gin.WrapF(pprof.Index))
+		debug.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+		debug.GET("/profile", gin.WrapF(pprof.Profile))
+		debug.GET("/symbol", gin.WrapF(pprof.Symbol))
+		debug.POST("/symbol", gin.WrapF(pprof.Symbol))
+		debug.GET("/trace", gin.WrapF(pprof.Trace))
+		// Named profiles (heap, goroutine, allocs, block, mutex, ...)
+		debug.GET("/:name", gin.WrapF(pprof.Index))
+	}
+}
+
 // LoggingMiddleware provides request logging
 func LoggingMiddleware() gin.HandlerFunc {
 	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
@@ -69,12 +135,39 @@ func LoggingMiddleware() gin.HandlerFunc {
 	})
 }
 
-// CORSMiddleware handles CORS
-func CORSMiddleware() gin.HandlerFunc {
+// CORSMiddleware handles CORS for allowedOrigins. "*" allows any origin
+// without credentials; otherwise a listed request Origin is echoed back with
+// credentials allowed, and requests from other origins are rejected with 403.
+// Requests without an Origin header (non-browser clients) pass through.
+func CORSMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	wildcard := false
+	allowed := make(map[string]struct{}, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			wildcard = true
+		}
+		allowed[origin] = struct{}{}
+	}
+
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		origin := c.GetHeader("Origin")
+
+		switch {
+		case wildcard:
+			c.Header("Access-Control-Allow-Origin", "*")
+		case origin == "":
+		default:
+			c.Header("Vary", "Origin")
+			if _, ok := allowed[origin]; !ok {
+				apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "origin not allowed")
+				return
+			}
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		c.Header("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Request-ID, traceparent, tracestate")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -83,4 +176,120 @@ func CORSMiddleware() gin.HandlerFunc {
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// AuthMiddleware requires a matching API key in the X-API-Key header
+// or an "Authorization: Bearer <key>" header. If no key is configured,
+// all requests are rejected.
+func AuthMiddleware(apiKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiKey == "" {
+			apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "admin endpoints are disabled")
+			return
+		}
+
+		provided := c.GetHeader("X-API-Key")
+		if provided == "" {
+			provided = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) != 1 {
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid or missing API key")
+			return
+		}
+
+		// Attribute audited operations to the admin key holder
+		c.Request = c.Request.WithContext(database.WithActor(c.Request.Context(), "admin"))
+
+		c.Next()
+	}
+}
+
+// PathLengthMiddleware rejects requests whose path contains a segment longer
+// than maxLen before they reach handlers or the database
+func PathLengthMiddleware(maxLen int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, segment := range strings.Split(c.Request.URL.Path, "/") {
+			if len(segment) > maxLen {
+				apierror.Abort(c, http.StatusRequestURITooLong, apierror.CodeURITooLong, fmt.Sprintf("path segment exceeds %d characters", maxLen))
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// maxRequestIDLength bounds client-supplied request IDs
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware reuses the client's X-Request-ID or generates one,
+// stores it on the request context for LoggerFromContext and echoes it in
+// the response header
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(utils.RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = utils.NewRequestID()
+		}
+
+		c.Request = c.Request.WithContext(utils.WithRequestID(c.Request.Context(), requestID))
+		c.Header(utils.RequestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// validRequestID accepts non-empty printable ASCII IDs of bounded length so
+// client input can't inject into logs
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < 0x21 || requestID[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// AuditActorMiddleware attributes audited operations to the client IP
+func AuditActorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(database.WithActor(c.Request.Context(), c.ClientIP()))
+		c.Next()
+	}
+}
+
+// inFlightRequests counts requests currently being served
+var inFlightRequests int64
+
+// InFlightMiddleware tracks the number of requests currently being served
+func InFlightMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		atomic.AddInt64(&inFlightRequests, 1)
+		defer atomic.AddInt64(&inFlightRequests, -1)
+
+		c.Next()
+	}
+}
+
+// MetricsMiddleware records request counts and latency by route
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Use the route pattern so path parameters don't explode cardinality
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.ObserveHTTPRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// InFlightRequests returns the number of requests currently being served
+func InFlightRequests() int64 {
+	return atomic.LoadInt64(&inFlightRequests)
+}
@@ -0,0 +1,363 @@
+package api
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/utils"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// serveThrough sends req to a handler answering 200 behind middleware
+func serveThrough(middleware gin.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware)
+	r.Any("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	allowlist := []string{"https://app.example.com", "https://admin.example.com"}
+	tests := []struct {
+		name            string
+		origins         []string
+		method          string
+		origin          string
+		wantStatus      int
+		wantOrigin      string
+		wantCredentials string
+	}{
+		{"wildcard allows any origin", []string{"*"}, http.MethodGet, "https://evil.example", http.StatusOK, "*", ""},
+		{"allowed origin is echoed", allowlist, http.MethodGet, "https://admin.example.com", http.StatusOK, "https://admin.example.com", "true"},
+		{"disallowed origin is rejected", allowlist, http.MethodGet, "https://evil.example", http.StatusForbidden, "", ""},
+		{"no origin passes through", allowlist, http.MethodGet, "", http.StatusOK, "", ""},
+		{"preflight from allowed origin", allowlist, http.MethodOptions, "https://app.example.com", http.StatusNoContent, "https://app.example.com", "true"},
+		{"wildcard preflight", []string{"*"}, http.MethodOptions, "https://app.example.com", http.StatusNoContent, "*", ""},
+		{"preflight from disallowed origin", allowlist, http.MethodOptions, "https://evil.example", http.StatusForbidden, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/instagram/user/alice", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := serveThrough(CORSMiddleware(tt.origins), req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.wantCredentials)
+			}
+			if tt.origins[0] != "*" && tt.origin != "" && w.Header().Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q, want Origin", w.Header().Get("Vary"))
+			}
+			if tt.wantStatus == http.StatusNoContent && !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "DELETE") {
+				t.Errorf("Access-Control-Allow-Methods = %q, want DELETE allowed", w.Header().Get("Access-Control-Allow-Methods"))
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		apiKey string
+		header string
+		value  string
+		want   int
+	}{
+		{"disabled", "", "X-API-Key", "secret", http.StatusForbidden},
+		{"missing key", "secret", "", "", http.StatusUnauthorized},
+		{"wrong key", "secret", "X-API-Key", "guess", http.StatusUnauthorized},
+		{"api key header", "secret", "X-API-Key", "secret", http.StatusOK},
+		{"bearer token", "secret", "Authorization", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/instagram/users/1/profile-pic/reupload", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			if w := serveThrough(AuthMiddleware(tt.apiKey), req); w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathLengthMiddleware(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"short username", "/api/v1/instagram/user/alice", http.StatusOK},
+		{"username at the limit", "/api/v1/instagram/user/" + strings.Repeat("a", 100), http.StatusOK},
+		{"overly long username", "/api/v1/instagram/user/" + strings.Repeat("a", 101), http.StatusRequestURITooLong},
+		{"overly long id", "/api/v1/instagram/users/" + strings.Repeat("1", 5000) + "/stats", http.StatusRequestURITooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveThrough(PathLengthMiddleware(100), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterRejectsLongUsernameBeforeDatabase(t *testing.T) {
+	fake := stubDatabase(t)
+	cfg := utils.LoadConfig()
+	cfg.MaxPathSegmentLength = 30
+	router := InitRouter(cfg)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/instagram/user/"+strings.Repeat("a", 31), nil))
+	if w.Code != http.StatusRequestURITooLong {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusRequestURITooLong)
+	}
+	if calls := fake.Calls(""); len(calls) != 0 {
+		t.Errorf("database queried %d times for a rejected path", len(calls))
+	}
+}
+
+func TestRouterErrorCodes(t *testing.T) {
+	stubDatabase(t)
+	cfg := utils.LoadConfig()
+	cfg.AdminAPIKey = "secret"
+	router := InitRouter(cfg)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"unknown route", http.MethodGet, "/api/v1/instagram/nope", http.StatusNotFound, "ROUTE_NOT_FOUND"},
+		{"admin route without key", http.MethodDelete, "/api/v1/instagram/users/42", http.StatusUnauthorized, "UNAUTHORIZED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			var body struct {
+				Code       string `json:"code"`
+				HTTPStatus int    `json:"http_status"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+			}
+			if w.Code != tt.wantStatus || body.Code != tt.wantCode || body.HTTPStatus != tt.wantStatus {
+				t.Errorf("got %d %+v, want %d %s", w.Code, body, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAdminDeleteIsAuditedAndListed(t *testing.T) {
+	fake := stubDatabase(t)
+	now := time.Now()
+	fake.OnRows("FROM instagram_users WHERE id = $1", []string{
+		"id", "username", "full_name", "biography", "is_verified",
+		"is_business_account", "is_professional_account", "is_private",
+		"category_name", "followers", "following", "posts", "profile_pic_url",
+		"profile_pic_storage_url", "scraped_at", "created_at", "updated_at",
+	}, []driver.Value{"42", "alice", nil, nil, false, false, false, false, nil, 100, 10, 5, nil, nil, now, now, now})
+	fake.OnExec("DELETE FROM", 1)
+	fake.OnExec("UPDATE audit_log", 0)
+	fake.OnExec("INSERT INTO audit_log", 1)
+	cfg := utils.LoadConfig()
+	cfg.AdminAPIKey = "secret"
+	router := InitRouter(cfg)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/instagram/users/42", nil)
+	req.Header.Set("X-API-Key", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d, body %s", w.Code, w.Body.String())
+	}
+
+	audits := fake.Calls("INSERT INTO audit_log")
+	if len(audits) != 1 {
+		t.Fatalf("recorded %d audit entries, want 1", len(audits))
+	}
+	if args := audits[0].Args; args[0] != "admin" || args[1] != "delete_user" || args[2] != "42" {
+		t.Errorf("audit entry = %v, want delete_user of 42 by admin", args)
+	}
+
+	// The admin audit endpoint serves the recorded row
+	fake.OnRows("FROM audit_log", []string{"id", "actor", "operation", "target", "details", "created_at"},
+		[]driver.Value{int64(1), "admin", "delete_user", "42", audits[0].Args[3], now})
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/instagram/admin/audit?limit=5", nil)
+	req.Header.Set("X-API-Key", "secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("audit status = %d, body %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Entries []database.AuditEntry `json:"entries"`
+		Count   int                   `json:"count"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+	}
+	if body.Count != 1 || body.Entries[0].Operation != "delete_user" || body.Entries[0].Target != "42" {
+		t.Errorf("audit log = %+v, want the delete", body)
+	}
+
+	// Without the key the audit log isn't readable
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/instagram/admin/audit", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated audit status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestInFlightMiddlewareCountsServedRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(InFlightMiddleware())
+	var during int64
+	r.GET("/request", func(c *gin.Context) {
+		during = InFlightRequests()
+		c.Status(http.StatusOK)
+	})
+
+	before := InFlightRequests()
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/request", nil))
+	if during != before+1 {
+		t.Errorf("in-flight requests while serving = %d, want %d", during, before+1)
+	}
+	if after := InFlightRequests(); after != before {
+		t.Errorf("in-flight requests after serving = %d, want %d", after, before)
+	}
+}
+
+func TestPprofRoutesOnlyWhenEnabled(t *testing.T) {
+	paths := []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap", "/debug/pprof/goroutine?debug=1"}
+
+	for _, enabled := range []bool{false, true} {
+		cfg := utils.LoadConfig()
+		cfg.EnablePprof = enabled
+		router := InitRouter(cfg)
+
+		for _, path := range paths {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			want := http.StatusNotFound
+			if enabled {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Errorf("enabled=%v: GET %s status = %d, want %d", enabled, path, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestPprofDisabledByDefault(t *testing.T) {
+	t.Setenv("ENABLE_PPROF", "")
+	if utils.LoadConfig().EnablePprof {
+		t.Error("pprof enabled without ENABLE_PPROF")
+	}
+}
+
+func TestMetricsRouteRecordsRequestsByRoute(t *testing.T) {
+	router := InitRouter(utils.LoadConfig())
+
+	// The metrics request itself is recorded once it completes, so the
+	// second scrape sees the first
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /metrics status = %d", w.Code)
+		}
+		if i == 0 {
+			continue
+		}
+		if body := w.Body.String(); !strings.Contains(body, `instagram_processor_http_requests_total{method="GET",route="/metrics",status="200"}`) {
+			t.Errorf("metrics output doesn't count GET /metrics:\n%s", body)
+		}
+	}
+}
+
+func TestRequestIDInResponseHeaderAndLogs(t *testing.T) {
+	var logs bytes.Buffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestIDMiddleware())
+	r.GET("/request", func(c *gin.Context) {
+		utils.LoggerFromContext(c.Request.Context()).Info().Msg("handled")
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name     string
+		incoming string
+		reused   bool
+	}{
+		{"client supplied", "req-abc-123", true},
+		{"missing", "", false},
+		{"unprintable", "bad id\n", false},
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/request", nil)
+			if tt.incoming != "" {
+				req.Header.Set("X-Request-ID", tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			requestID := w.Header().Get("X-Request-ID")
+			if tt.reused && requestID != tt.incoming {
+				t.Errorf("response request ID = %q, want the client's %q", requestID, tt.incoming)
+			}
+			if !tt.reused && !uuid.MatchString(requestID) {
+				t.Errorf("response request ID = %q, want a generated UUID", requestID)
+			}
+
+			var line struct {
+				RequestID string `json:"request_id"`
+				Message   string `json:"message"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+				t.Fatalf("log output %q: %v", logs.String(), err)
+			}
+			if line.Message != "handled" || line.RequestID != requestID {
+				t.Errorf("log line %+v, want request_id %q", line, requestID)
+			}
+		})
+	}
+}
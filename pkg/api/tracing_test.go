@@ -0,0 +1,133 @@
+package api
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"instagram-user-processor/pkg/external"
+	"instagram-user-processor/pkg/utils"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs an in-memory span recorder as the global tracer
+// provider. Tracers created before the first provider is set only follow
+// that one, so it is installed once per test binary.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spanRecorder
+}
+
+func TestSingleUserSpanHierarchy(t *testing.T) {
+	recorder := recordSpans()
+	gin.SetMode(gin.TestMode)
+
+	// An unstored user that is scraped and stored
+	fake := stubDatabase(t)
+	fake.OnRows("FROM instagram_users WHERE username = $1", []string{"id"})
+	fake.OnRows("FROM username_history", []string{"user_id"})
+	fake.OnRows("SET username = $1 || '#' || id", []string{"id"})
+	fake.OnRows("INSERT INTO instagram_users", []string{"inserted"}, []driver.Value{true})
+	fake.OnExec("INSERT INTO username_history", 1)
+	fake.OnExec("INSERT INTO audit_log", 1)
+
+	var upstreamTraceparent string
+	rocketAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		fmt.Fprint(w, `{"status":"done","response":{"status_code":200,"body":{"user":{"id":"42","username":"alice"}}}}`)
+	}))
+	defer rocketAPI.Close()
+
+	cfg := utils.LoadConfig()
+	cfg.RocketAPIBaseURL = rocketAPI.URL
+	cfg.CacheTTLSeconds = 0
+	external.InitRocketAPI(cfg)
+	router := InitRouter(cfg)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/instagram/user/alice?stats=false", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+
+	// Index this request's spans by name
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+
+	root, ok := spans["GET /api/v1/instagram/user/:username"]
+	if !ok {
+		t.Fatalf("no server span continuing the incoming trace, got %v", spanNames(spans))
+	}
+	if root.SpanKind() != trace.SpanKindServer {
+		t.Errorf("root span kind = %v, want server", root.SpanKind())
+	}
+
+	// child -> parent
+	hierarchy := map[string]string{
+		"fetchUser":                     root.Name(),
+		"db.GetUserByUsername":          "fetchUser",
+		"scrapeWithRetry":               "fetchUser",
+		"rocketapi.ScrapeInstagramUser": "scrapeWithRetry",
+		"rocketapi.attempt":             "rocketapi.ScrapeInstagramUser",
+		"db.UpsertUserWithResult":       "fetchUser",
+	}
+	for child, parent := range hierarchy {
+		span, ok := spans[child]
+		if !ok {
+			t.Errorf("missing span %s, got %v", child, spanNames(spans))
+			continue
+		}
+		if got := span.Parent().SpanID(); got != spans[parent].SpanContext().SpanID() {
+			t.Errorf("span %s has parent %s, want %s", child, spanName(spans, got), parent)
+		}
+	}
+
+	// The RocketAPI call carries the attempt span as its parent
+	if attempt, ok := spans["rocketapi.attempt"]; ok {
+		want := fmt.Sprintf("00-%s-%s-01", traceID, attempt.SpanContext().SpanID())
+		if upstreamTraceparent != want {
+			t.Errorf("RocketAPI traceparent = %q, want %q", upstreamTraceparent, want)
+		}
+	}
+}
+
+func spanNames(spans map[string]sdktrace.ReadOnlySpan) []string {
+	names := make([]string, 0, len(spans))
+	for name := range spans {
+		names = append(names, name)
+	}
+	return names
+}
+
+func spanName(spans map[string]sdktrace.ReadOnlySpan, id trace.SpanID) string {
+	for name, span := range spans {
+		if span.SpanContext().SpanID() == id {
+			return name
+		}
+	}
+	return id.String()
+}
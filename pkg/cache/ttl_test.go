@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetHitAndMiss(t *testing.T) {
+	c := NewTTLCache[string, int](time.Minute, 10)
+	c.Set("alice", 1)
+
+	if v, ok := c.Get("alice"); !ok || v != 1 {
+		t.Errorf("Get(alice) = %d, %v, want 1, true", v, ok)
+	}
+	if v, ok := c.Get("bob"); ok || v != 0 {
+		t.Errorf("Get(bob) = %d, %v, want a miss", v, ok)
+	}
+
+	c.Set("alice", 2)
+	if v, _ := c.Get("alice"); v != 2 {
+		t.Errorf("Get(alice) after update = %d, want 2", v)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len = %d after updating a key, want 1", c.Len())
+	}
+
+	c.Delete("alice")
+	if _, ok := c.Get("alice"); ok {
+		t.Error("deleted key still cached")
+	}
+}
+
+func TestGetExpiry(t *testing.T) {
+	c := NewTTLCache[string, int](100*time.Millisecond, 10)
+	c.Set("alice", 1)
+	time.Sleep(60 * time.Millisecond)
+	c.Set("bob", 2)
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.Get("alice"); ok {
+		t.Error("expired entry returned")
+	}
+	if _, ok := c.Get("bob"); !ok {
+		t.Error("unexpired entry missed")
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len = %d, want the expired entry evicted on read", c.Len())
+	}
+
+	// Setting again renews the TTL past bob's original expiry
+	c.Set("bob", 3)
+	time.Sleep(60 * time.Millisecond)
+	if v, ok := c.Get("bob"); !ok || v != 3 {
+		t.Errorf("Get(bob) after renewal = %d, %v, want 3, true", v, ok)
+	}
+}
+
+func TestSetEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewTTLCache[string, int](time.Minute, 3)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+
+	// Reading a makes b the least recently used
+	c.Get("a")
+	c.Set("d", 4)
+
+	if c.Len() != 3 {
+		t.Errorf("Len = %d, want 3", c.Len())
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s evicted", key)
+		}
+	}
+}
+
+func TestNewTTLCacheDefaultsSize(t *testing.T) {
+	c := NewTTLCache[int, int](time.Minute, 0)
+	for i := 0; i < 1001; i++ {
+		c.Set(i, i)
+	}
+	if c.Len() != 1000 {
+		t.Errorf("Len = %d, want the default bound of 1000", c.Len())
+	}
+}
+
+// TestConcurrentAccess is meant to be run with -race
+func TestConcurrentAccess(t *testing.T) {
+	c := NewTTLCache[string, int](time.Minute, 50)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("user%d", (g*31+i)%100)
+				switch i % 4 {
+				case 0:
+					c.Delete(key)
+				case 1:
+					c.Get(key)
+				default:
+					c.Set(key, i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n := c.Len(); n > 50 {
+		t.Errorf("Len = %d, want at most 50", n)
+	}
+}
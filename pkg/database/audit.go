@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// AuditEntry represents a recorded mutating operation
+type AuditEntry struct {
+	ID        int64           `json:"id" db:"id"`
+	Actor     string          `json:"actor" db:"actor"`
+	Operation string          `json:"operation" db:"operation"`
+	Target    string          `json:"target" db:"target"`
+	Details   json.RawMessage `json:"details,omitempty" db:"details"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+}
+
+type actorContextKey struct{}
+
+// WithActor returns a context carrying the actor recorded in audit entries
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the audit actor, or "system" for background work
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorContextKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return "system"
+}
+
+// RecordAudit records a mutating operation in the audit log. Failures are
+// logged rather than returned so auditing never fails the operation itself.
+func RecordAudit(ctx context.Context, operation, target string, details map[string]interface{}) {
+	var detailsJSON []byte
+	if len(details) > 0 {
+		var err error
+		if detailsJSON, err = json.Marshal(details); err != nil {
+			log.Warn().Err(err).Str("operation", operation).Msg("failed to marshal audit details")
+		}
+	}
+
+	query := `
+		INSERT INTO audit_log (actor, operation, target, details)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	actor := ActorFromContext(ctx)
+	if _, err := DB.ExecContext(ctx, query, actor, operation, target, detailsJSON); err != nil {
+		log.Error().
+			Err(err).
+			Str("actor", actor).
+			Str("operation", operation).
+			Str("target", target).
+			Msg("failed to record audit entry")
+	}
+}
+
+// GetRecentAuditEntries returns the most recent audit entries, newest first
+func GetRecentAuditEntries(ctx context.Context, limit int) (_ []*AuditEntry, err error) {
+	ctx, span := startSpan(ctx, "GetRecentAuditEntries", attribute.Int("limit", limit))
+	defer func() { endSpan(span, err) }()
+
+	query := `
+		SELECT id, actor, operation, target, details, created_at
+		FROM audit_log
+		ORDER BY created_at DESC, id DESC
+		LIMIT $1
+	`
+
+	rows, err := DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]*AuditEntry, 0, limit)
+	for rows.Next() {
+		var entry AuditEntry
+		var details []byte
+		if err := rows.Scan(&entry.ID, &entry.Actor, &entry.Operation, &entry.Target, &details, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entry.Details = details
+		entries = append(entries, &entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate audit log: %w", err)
+	}
+
+	setRows(span, len(entries))
+	return entries, nil
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestRecordAuditActor(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"background work", context.Background(), "system"},
+		{"request actor", WithActor(context.Background(), "203.0.113.7"), "203.0.113.7"},
+		{"empty actor", WithActor(context.Background(), ""), "system"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("INSERT INTO audit_log", 1)
+
+			RecordAudit(tt.ctx, "refresh_stats_cache", "user_stats_cache", nil)
+
+			calls := fake.Calls("INSERT INTO audit_log")
+			if len(calls) != 1 {
+				t.Fatalf("recorded %d audit entries, want 1", len(calls))
+			}
+			args := calls[0].Args
+			if args[0] != tt.want || args[1] != "refresh_stats_cache" || args[2] != "user_stats_cache" {
+				t.Errorf("audit entry = %v, want actor %q", args, tt.want)
+			}
+			if details, _ := args[3].([]byte); details != nil {
+				t.Errorf("audit details = %v, want none", args[3])
+			}
+		})
+	}
+}
+
+func TestGetRecentAuditEntries(t *testing.T) {
+	fake := useFakeDB(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	fake.OnRows("FROM audit_log", []string{"id", "actor", "operation", "target", "details", "created_at"},
+		[]driver.Value{int64(2), "admin", "delete_user", "42", []byte(`{"deleted_posts":3}`), now},
+		[]driver.Value{int64(1), "system", "refresh_stats_cache", "user_stats_cache", nil, now.Add(-time.Minute)},
+	)
+
+	entries, err := GetRecentAuditEntries(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("GetRecentAuditEntries: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	first := entries[0]
+	if first.Actor != "admin" || first.Operation != "delete_user" || first.Target != "42" || !first.CreatedAt.Equal(now) {
+		t.Errorf("first entry = %+v", first)
+	}
+	if string(first.Details) != `{"deleted_posts":3}` {
+		t.Errorf("first entry details = %s", first.Details)
+	}
+	if entries[1].Details != nil {
+		t.Errorf("second entry details = %s, want none", entries[1].Details)
+	}
+	if got := fake.Calls("FROM audit_log")[0].Args[0]; got != int64(10) {
+		t.Errorf("limit bound as %v, want 10", got)
+	}
+}
+
+func TestDeleteUserWritesAuditRow(t *testing.T) {
+	usePostgres(t)
+	ctx := WithActor(context.Background(), "admin")
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, followers) VALUES ('1', 'alice', 100)`,
+		`INSERT INTO instagram_posts (id, user_id, username) VALUES ('p1', '1', 'alice'), ('p2', '1', 'alice')`,
+	)
+
+	if err := DeleteUser(ctx, "1"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	entries, err := GetRecentAuditEntries(ctx, 10)
+	if err != nil {
+		t.Fatalf("GetRecentAuditEntries: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d audit entries, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Actor != "admin" || entry.Operation != "delete_user" || entry.Target != "1" {
+		t.Errorf("audit entry = %+v, want delete_user of 1 by admin", entry)
+	}
+	if string(entry.Details) != `{"deleted_posts": 2}` {
+		t.Errorf("audit details = %s, want 2 deleted posts", entry.Details)
+	}
+	if time.Since(entry.CreatedAt) > time.Minute {
+		t.Errorf("audit entry created at %v", entry.CreatedAt)
+	}
+}
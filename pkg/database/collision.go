@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// UsernameCollision describes a stored user whose username was claimed by
+// a different account
+type UsernameCollision struct {
+	Username      string
+	StaleID       string
+	StaleUsername string
+	ClaimingID    string
+}
+
+// staleUsername returns the placeholder username given to a row that lost
+// its username to another account. '#' never appears in a valid username,
+// so the placeholder cannot collide with a real account.
+func staleUsername(username, id string) string {
+	return fmt.Sprintf("%s#%s", username, id)
+}
+
+// HandleUsernameCollision re-keys any stored user that holds user.Username
+// under a different id, so the upsert of user cannot violate the unique
+// username constraint. Instagram usernames are reusable, so the old row
+// usually belongs to an account that has since been renamed; it keeps its
+// data under a placeholder username until it is scraped again or merged
+// manually. Returns nil when there is no collision.
+func HandleUsernameCollision(ctx context.Context, tx *sql.Tx, user *User) (*UsernameCollision, error) {
+	query := `
+		UPDATE instagram_users
+		SET username = $1 || '#' || id, updated_at = CURRENT_TIMESTAMP
+		WHERE username = $1 AND id <> $2
+		RETURNING id
+	`
+
+	var staleID string
+	err := tx.QueryRowContext(ctx, query, user.Username, user.ID).Scan(&staleID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve username collision for %s: %w", user.Username, err)
+	}
+
+	collision := &UsernameCollision{
+		Username:      user.Username,
+		StaleID:       staleID,
+		StaleUsername: staleUsername(user.Username, staleID),
+		ClaimingID:    user.ID,
+	}
+
+	log.Warn().
+		Str("username", collision.Username).
+		Str("stale_id", collision.StaleID).
+		Str("claiming_id", collision.ClaimingID).
+		Msg("username claimed by a different account, re-keyed stale user")
+
+	return collision, nil
+}
+
+// recordCollision audits a resolved collision so it can be merged manually
+func recordCollision(ctx context.Context, collision *UsernameCollision) {
+	RecordAudit(ctx, "username_collision", collision.StaleID, map[string]interface{}{
+		"username":       collision.Username,
+		"stale_username": collision.StaleUsername,
+		"claiming_id":    collision.ClaimingID,
+	})
+}
+
+// recordUsername remembers user.ID as the owner of user.Username. Must run
+// after the user row is written.
+func recordUsername(ctx context.Context, tx *sql.Tx, user *User) error {
+	query := `
+		INSERT INTO username_history (username, user_id, seen_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT (username) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			seen_at = EXCLUDED.seen_at
+	`
+	if _, err := tx.ExecContext(ctx, query, user.Username, user.ID); err != nil {
+		return fmt.Errorf("failed to record username history for %s: %w", user.Username, err)
+	}
+	return nil
+}
+
+// ResolveUserID returns the id of the account last seen with username,
+// which may since have been renamed. Returns sql.ErrNoRows if the username
+// has never been seen.
+func ResolveUserID(ctx context.Context, username string) (_ string, err error) {
+	ctx, span := startSpan(ctx, "ResolveUserID", attribute.String("username", username))
+	defer func() { endSpan(span, err) }()
+
+	var userID string
+	err = DB.QueryRowContext(ctx, `SELECT user_id FROM username_history WHERE username = $1`, username).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
@@ -0,0 +1,343 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"instagram-user-processor/pkg/database/dbtest"
+	"maps"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUpsert routes an upsert whose row is written when applied, of a user
+// claiming a username held by staleID (empty for no collision)
+func fakeUpsert(t *testing.T, staleID string, applied bool) *dbtest.DB {
+	t.Helper()
+	fake := useFakeDB(t)
+	var stale, upserted [][]driver.Value
+	if staleID != "" {
+		stale = append(stale, []driver.Value{staleID})
+	}
+	if applied {
+		upserted = append(upserted, []driver.Value{true})
+	}
+	fake.OnRows("SET username = $1 || '#' || id", []string{"id"}, stale...)
+	fake.OnRows("INSERT INTO instagram_users", []string{"inserted"}, upserted...)
+	fake.OnExec("INSERT INTO username_history", 1)
+	fake.OnExec("INSERT INTO audit_log", 1)
+	return fake
+}
+
+// collisionAudits returns the details of recorded username_collision
+// entries by target
+func collisionAudits(t *testing.T, fake *dbtest.DB) map[string]map[string]string {
+	t.Helper()
+	audits := make(map[string]map[string]string)
+	for _, call := range fake.Calls("INSERT INTO audit_log") {
+		if call.Args[1] != "username_collision" {
+			continue
+		}
+		var details map[string]string
+		if err := json.Unmarshal(call.Args[3].([]byte), &details); err != nil {
+			t.Fatalf("collision audit details: %v", err)
+		}
+		audits[call.Args[2].(string)] = details
+	}
+	return audits
+}
+
+func TestUpsertReKeysUserHoldingClaimedUsername(t *testing.T) {
+	fake := fakeUpsert(t, "1", true)
+
+	user := &User{ID: "2", Username: "alice", ScrapedAt: time.Now()}
+	if _, err := UpsertUserWithResult(context.Background(), user); err != nil {
+		t.Fatalf("UpsertUserWithResult: %v", err)
+	}
+
+	rekeys := fake.Calls("SET username = $1 || '#' || id")
+	if len(rekeys) != 1 || rekeys[0].Args[0] != "alice" || rekeys[0].Args[1] != "2" {
+		t.Fatalf("re-key queries = %v, want one for alice excluding id 2", rekeys)
+	}
+	want := map[string]string{"username": "alice", "stale_username": "alice#1", "claiming_id": "2"}
+	audits := collisionAudits(t, fake)
+	if len(audits) != 1 || !maps.Equal(audits["1"], want) {
+		t.Errorf("collision audits = %v, want %v for user 1", audits, want)
+	}
+}
+
+func TestUpsertWithoutCollisionRecordsNone(t *testing.T) {
+	fake := fakeUpsert(t, "", true)
+
+	if _, err := UpsertUserWithResult(context.Background(), &User{ID: "2", Username: "alice", ScrapedAt: time.Now()}); err != nil {
+		t.Fatalf("UpsertUserWithResult: %v", err)
+	}
+	if audits := collisionAudits(t, fake); len(audits) != 0 {
+		t.Errorf("collision audits = %v, want none", audits)
+	}
+}
+
+func TestSkippedUpsertRecordsNoCollision(t *testing.T) {
+	fake := fakeUpsert(t, "1", false)
+
+	result, err := UpsertUserWithResult(context.Background(), &User{ID: "2", Username: "alice", ScrapedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("UpsertUserWithResult: %v", err)
+	}
+	if result.Applied {
+		t.Error("stale scrape reported as applied")
+	}
+	// The re-key was rolled back with the upsert, so there is nothing to merge
+	if audits := collisionAudits(t, fake); len(audits) != 0 {
+		t.Errorf("collision audits = %v, want none", audits)
+	}
+}
+
+func TestTwoIDsClaimingTheSameUsername(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+	execAll(t, `INSERT INTO instagram_users (id, username, followers, scraped_at) VALUES ('1', 'alice', 100, NOW() - INTERVAL '1 day')`)
+
+	// Account 2 now holds the username
+	if err := UpsertUser(ctx, &User{ID: "2", Username: "alice", Followers: 5, ScrapedAt: time.Now()}); err != nil {
+		t.Fatalf("UpsertUser(2): %v", err)
+	}
+
+	claimed, err := GetUserByUsername(ctx, "alice")
+	if err != nil || claimed.ID != "2" {
+		t.Fatalf("GetUserByUsername(alice) = %+v, %v, want user 2", claimed, err)
+	}
+	stale, err := GetUserByID(ctx, "1")
+	if err != nil {
+		t.Fatalf("GetUserByID(1): %v", err)
+	}
+	if stale.Username != "alice#1" || stale.Followers != 100 {
+		t.Errorf("stale user = %s with %d followers, want alice#1 keeping its data", stale.Username, stale.Followers)
+	}
+	if id, err := ResolveUserID(ctx, "alice"); err != nil || id != "2" {
+		t.Errorf("ResolveUserID(alice) = %q, %v, want 2", id, err)
+	}
+
+	var audits int
+	err = DB.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM audit_log
+		WHERE operation = 'username_collision' AND target = '1' AND details->>'claiming_id' = '2'`).Scan(&audits)
+	if err != nil || audits != 1 {
+		t.Errorf("collision audit entries = %d, %v, want 1", audits, err)
+	}
+
+	// Rescraping account 1 under its new name gives it a real username again
+	if err := UpsertUser(ctx, &User{ID: "1", Username: "alice_new", Followers: 100, ScrapedAt: time.Now()}); err != nil {
+		t.Fatalf("UpsertUser(1): %v", err)
+	}
+	if renamed, err := GetUserByID(ctx, "1"); err != nil || renamed.Username != "alice_new" {
+		t.Errorf("renamed user = %+v, %v, want alice_new", renamed, err)
+	}
+}
+
+func TestRenamedUserResolvesByOldUsername(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+
+	if err := UpsertUser(ctx, &User{ID: "1", Username: "alice", ScrapedAt: time.Now()}); err != nil {
+		t.Fatalf("UpsertUser(alice): %v", err)
+	}
+	if err := UpsertUser(ctx, &User{ID: "1", Username: "alice_new", ScrapedAt: time.Now()}); err != nil {
+		t.Fatalf("UpsertUser(alice_new): %v", err)
+	}
+
+	if _, err := GetUserByUsername(ctx, "alice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("GetUserByUsername(alice) error = %v, want no rows after the rename", err)
+	}
+	for _, username := range []string{"alice", "alice_new"} {
+		if id, err := ResolveUserID(ctx, username); err != nil || id != "1" {
+			t.Errorf("ResolveUserID(%s) = %q, %v, want 1", username, id, err)
+		}
+	}
+	if _, err := ResolveUserID(ctx, "never_seen"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ResolveUserID(never_seen) error = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestUpsertRecordsUsernameOwner(t *testing.T) {
+	fake := fakeUpsert(t, "", true)
+
+	if err := UpsertUser(context.Background(), &User{ID: "7", Username: "alice", ScrapedAt: time.Now()}); err != nil {
+		t.Fatalf("UpsertUser: %v", err)
+	}
+	calls := fake.Calls("INSERT INTO username_history")
+	if len(calls) != 1 || calls[0].Args[0] != "alice" || calls[0].Args[1] != "7" {
+		t.Errorf("username history writes = %v, want alice owned by 7", calls)
+	}
+}
+
+func TestUpsertUserWithResultFlipsInserted(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnRows("SET username = $1 || '#' || id", []string{"id"})
+	fake.OnExec("INSERT INTO username_history", 1)
+	fake.OnExec("INSERT INTO audit_log", 1)
+	stored := map[string]bool{}
+	fake.On("INSERT INTO instagram_users", func(args []driver.Value) dbtest.Result {
+		id := args[0].(string)
+		inserted := !stored[id]
+		stored[id] = true
+		return dbtest.Result{Columns: []string{"inserted"}, Rows: [][]driver.Value{{inserted}}}
+	})
+
+	ctx := context.Background()
+	var got []UpsertResult
+	for i := 0; i < 2; i++ {
+		result, err := UpsertUserWithResult(ctx, &User{ID: "1", Username: "alice", ScrapedAt: time.Now()})
+		if err != nil {
+			t.Fatalf("UpsertUserWithResult: %v", err)
+		}
+		got = append(got, result)
+	}
+	want := []UpsertResult{{Inserted: true, Applied: true}, {Inserted: false, Applied: true}}
+	if got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("results = %+v, want %+v", got, want)
+	}
+
+	var audited []interface{}
+	for _, call := range fake.Calls("INSERT INTO audit_log") {
+		if call.Args[1] != "upsert_user" {
+			continue
+		}
+		var details map[string]interface{}
+		if err := json.Unmarshal(call.Args[3].([]byte), &details); err != nil {
+			t.Fatalf("upsert audit details: %v", err)
+		}
+		audited = append(audited, details["inserted"])
+	}
+	if len(audited) != 2 || audited[0] != true || audited[1] != false {
+		t.Errorf("audited inserted flags %v, want [true false]", audited)
+	}
+}
+
+func TestUpsertUserWithResultAgainstPostgres(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	steps := []struct {
+		name      string
+		scrapedAt time.Time
+		want      UpsertResult
+	}{
+		{"first scrape inserts", now.Add(-time.Hour), UpsertResult{Inserted: true, Applied: true}},
+		{"newer scrape updates", now, UpsertResult{Inserted: false, Applied: true}},
+		{"older scrape is skipped", now.Add(-2 * time.Hour), UpsertResult{}},
+	}
+	for _, step := range steps {
+		result, err := UpsertUserWithResult(ctx, &User{ID: "1", Username: "alice", ScrapedAt: step.scrapedAt})
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if result != step.want {
+			t.Errorf("%s: result = %+v, want %+v", step.name, result, step.want)
+		}
+	}
+}
+
+func TestBatchUpsertSkipsStaleScrapeAndKeepsOthers(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnExec("SAVEPOINT", 0)
+	fake.OnRows("SET username = $1 || '#' || id", []string{"id"})
+	fake.OnExec("INSERT INTO username_history", 1)
+	fake.OnExec("INSERT INTO audit_log", 1)
+	// User 2's stored scrape is newer, so its guarded update returns no row
+	fake.On("INSERT INTO instagram_users", func(args []driver.Value) dbtest.Result {
+		result := dbtest.Result{Columns: []string{"inserted"}}
+		if args[0] != "2" {
+			result.Rows = [][]driver.Value{{true}}
+		}
+		return result
+	})
+
+	users := []*User{
+		{ID: "1", Username: "alice", ScrapedAt: time.Now()},
+		{ID: "2", Username: "bob", ScrapedAt: time.Now().Add(-time.Hour)},
+		{ID: "3", Username: "carol", ScrapedAt: time.Now()},
+	}
+	if err := BatchUpsertUsers(context.Background(), users); err != nil {
+		t.Fatalf("BatchUpsertUsers: %v", err)
+	}
+
+	if n := len(fake.Calls("ROLLBACK TO SAVEPOINT")); n != 1 {
+		t.Errorf("rolled back to the savepoint %d times, want once for bob", n)
+	}
+	if ends := txEnds(fake); len(ends) != 1 || ends[0] != "COMMIT" {
+		t.Errorf("transaction ended with %v, want a single COMMIT", ends)
+	}
+	for _, call := range fake.Calls("INSERT INTO username_history") {
+		if call.Args[1] == "2" {
+			t.Error("recorded the username of a skipped scrape")
+		}
+	}
+
+	var written []string
+	for _, call := range fake.Calls("INSERT INTO audit_log") {
+		if call.Args[1] != "batch_upsert_users" {
+			continue
+		}
+		var details struct {
+			UserIDs []string `json:"user_ids"`
+		}
+		if err := json.Unmarshal(call.Args[3].([]byte), &details); err != nil {
+			t.Fatalf("batch audit details: %v", err)
+		}
+		written = details.UserIDs
+	}
+	if len(written) != 2 || written[0] != "1" || written[1] != "3" {
+		t.Errorf("audited user ids %v, want [1 3]", written)
+	}
+}
+
+func TestConcurrentScrapesNewestWins(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+	base := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+
+	// Scrapes land in random order; followers encode each scrape's age
+	const scrapes = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, scrapes)
+	for _, i := range rand.Perm(scrapes) {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := &User{ID: "1", Username: "alice", Followers: int64(i), ScrapedAt: base.Add(time.Duration(i) * time.Minute)}
+			if i%2 == 0 {
+				errs <- UpsertUser(ctx, user)
+			} else {
+				errs <- BatchUpsertUsers(ctx, []*User{user})
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+	}
+
+	user, err := GetUserByID(ctx, "1")
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	newest := base.Add((scrapes - 1) * time.Minute)
+	if user.Followers != scrapes-1 || !user.ScrapedAt.Equal(newest) {
+		t.Errorf("stored scrape has %d followers from %v, want the newest (%d from %v)", user.Followers, user.ScrapedAt, scrapes-1, newest)
+	}
+
+	// A late, older scrape still doesn't overwrite it
+	result, err := UpsertUserWithResult(ctx, &User{ID: "1", Username: "alice", Followers: -1, ScrapedAt: base})
+	if err != nil || result.Applied {
+		t.Errorf("stale upsert = %+v, %v, want it skipped", result, err)
+	}
+}
@@ -1,8 +1,13 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -11,25 +16,137 @@ import (
 
 var DB *sql.DB
 
+const (
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 5
+	defaultConnMaxLifetime = 5 * time.Minute
+)
+
+// maxIdleConns is the idle pool size set by Initialize, opened by WarmPool
+var maxIdleConns = defaultMaxIdleConns
+
+// Options configures the connection pool
+type Options struct {
+	MaxOpenConns    int           // defaults to 25
+	MaxIdleConns    int           // defaults to 5, capped at MaxOpenConns
+	ConnMaxLifetime time.Duration // defaults to 5 minutes
+
+	// StatementTimeout, if positive, is set as the session
+	// statement_timeout of every connection, so the server aborts runaway
+	// queries even when no context deadline applies
+	StatementTimeout time.Duration
+}
+
 // Initialize initializes the database connection
-func Initialize(databaseURL string) error {
-	var err error
-	DB, err = sql.Open("postgres", databaseURL)
+func Initialize(databaseURL string, opts Options) error {
+	if opts.MaxOpenConns <= 0 {
+		opts.MaxOpenConns = defaultMaxOpenConns
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = defaultMaxIdleConns
+	}
+	if opts.MaxIdleConns > opts.MaxOpenConns {
+		opts.MaxIdleConns = opts.MaxOpenConns
+	}
+	if opts.ConnMaxLifetime <= 0 {
+		opts.ConnMaxLifetime = defaultConnMaxLifetime
+	}
+
+	dsn, err := withStatementTimeout(databaseURL, opts.StatementTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid database URL: %w", err)
+	}
+
+	DB, err = sql.Open("postgres", dsn)
 	if err != nil {
 		return fmt.Errorf("failed to open database connection: %w", err)
 	}
 
 	// Configure connection pool
-	DB.SetMaxOpenConns(25)
-	DB.SetMaxIdleConns(5)
-	DB.SetConnMaxLifetime(5 * time.Minute)
+	DB.SetMaxOpenConns(opts.MaxOpenConns)
+	DB.SetMaxIdleConns(opts.MaxIdleConns)
+	DB.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	maxIdleConns = opts.MaxIdleConns
 
 	// Test the connection
 	if err = DB.Ping(); err != nil {
 		return fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	log.Info().Msg("database connection established")
+	log.Info().
+		Int("max_open_conns", opts.MaxOpenConns).
+		Int("max_idle_conns", opts.MaxIdleConns).
+		Dur("conn_max_lifetime", opts.ConnMaxLifetime).
+		Dur("statement_timeout", opts.StatementTimeout).
+		Msg("database connection established")
+	return nil
+}
+
+// withStatementTimeout adds statement_timeout to a URL or key=value DSN.
+// lib/pq sends unrecognized parameters to the server as run-time
+// parameters, so every connection starts with the timeout set.
+func withStatementTimeout(dsn string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return dsn, nil
+	}
+	millis := strconv.FormatInt(timeout.Milliseconds(), 10)
+
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " statement_timeout=" + millis, nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("statement_timeout", millis)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// WarmPool pre-opens the idle connections of the pool so the first requests
+// don't pay connection setup latency. Connections are checked out
+// concurrently and pinged, then returned to the pool as idle connections.
+func WarmPool(ctx context.Context) error {
+	if DB == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	conns := make([]*sql.Conn, maxIdleConns)
+	errs := make([]error, maxIdleConns)
+	var wg sync.WaitGroup
+
+	for i := 0; i < maxIdleConns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			conn, err := DB.Conn(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			conns[i] = conn
+			errs[i] = conn.PingContext(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	// Hold every connection until all are open, then release them as idle
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to warm connection pool: %w", err)
+		}
+	}
+
+	log.Info().Int("idle_connections", DB.Stats().Idle).Msg("database connection pool warmed")
 	return nil
 }
 
@@ -43,8 +160,14 @@ func Close() error {
 
 // IsHealthy checks if the database is healthy
 func IsHealthy() error {
+	return IsHealthyContext(context.Background())
+}
+
+// IsHealthyContext checks if the database is healthy, giving up when ctx
+// is done
+func IsHealthyContext(ctx context.Context) error {
 	if DB == nil {
 		return fmt.Errorf("database not initialized")
 	}
-	return DB.Ping()
+	return DB.PingContext(ctx)
 }
\ No newline at end of file
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// setMaxIdleConns sets the pool's idle size as Initialize would, for the
+// duration of the test
+func setMaxIdleConns(t *testing.T, n int) {
+	t.Helper()
+	prev := maxIdleConns
+	maxIdleConns = n
+	DB.SetMaxIdleConns(n)
+	t.Cleanup(func() { maxIdleConns = prev })
+}
+
+func TestWarmPoolOpensIdleConnections(t *testing.T) {
+	useFakeDB(t)
+	setMaxIdleConns(t, 4)
+
+	if idle := DB.Stats().Idle; idle != 0 {
+		t.Fatalf("new pool has %d idle connections", idle)
+	}
+	if err := WarmPool(context.Background()); err != nil {
+		t.Fatalf("WarmPool: %v", err)
+	}
+	if stats := DB.Stats(); stats.Idle != 4 || stats.OpenConnections != 4 {
+		t.Errorf("after warm-up idle = %d, open = %d, want 4 of each", stats.Idle, stats.OpenConnections)
+	}
+}
+
+func TestWarmPoolReportsFailedPing(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.SetPingError(errors.New("connection refused"))
+	setMaxIdleConns(t, 2)
+
+	if err := WarmPool(context.Background()); err == nil {
+		t.Error("WarmPool succeeded with a failing ping")
+	}
+}
+
+func TestWithStatementTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		dsn     string
+		timeout time.Duration
+		want    string
+	}{
+		{"disabled", "postgres://u:p@db:5432/app", 0, "postgres://u:p@db:5432/app"},
+		{"url", "postgres://u:p@db:5432/app", 30 * time.Second, "postgres://u:p@db:5432/app?statement_timeout=30000"},
+		{"url with parameters", "postgresql://db/app?sslmode=disable", 1500 * time.Millisecond, "postgresql://db/app?sslmode=disable&statement_timeout=1500"},
+		{"replaces existing", "postgres://db/app?statement_timeout=5", time.Second, "postgres://db/app?statement_timeout=1000"},
+		{"key value", "host=db dbname=app", 2 * time.Second, "host=db dbname=app statement_timeout=2000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withStatementTimeout(tt.dsn, tt.timeout)
+			if err != nil || got != tt.want {
+				t.Errorf("withStatementTimeout(%q, %v) = %q, %v, want %q", tt.dsn, tt.timeout, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatementTimeoutAbortsLongQuery(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	prev := DB
+	if err := Initialize(url, Options{MaxOpenConns: 2, StatementTimeout: 200 * time.Millisecond}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	t.Cleanup(func() {
+		DB.Close()
+		DB = prev
+	})
+
+	// No context deadline applies, so only the server can stop the query
+	ctx := context.Background()
+	startedAt := time.Now()
+	_, err := DB.ExecContext(ctx, `SELECT pg_sleep(5)`)
+	if !IsQueryTimeout(err) {
+		t.Fatalf("pg_sleep(5) error = %v, want a statement timeout", err)
+	}
+	if elapsed := time.Since(startedAt); elapsed > 2*time.Second {
+		t.Errorf("query ran for %v before being aborted", elapsed)
+	}
+
+	var setting string
+	if err := DB.QueryRowContext(ctx, `SHOW statement_timeout`).Scan(&setting); err != nil || setting != "200ms" {
+		t.Errorf("statement_timeout = %q, %v, want 200ms", setting, err)
+	}
+}
+
+func TestInitializeAppliesPoolOptions(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	prev, prevIdle := DB, maxIdleConns
+	t.Cleanup(func() {
+		DB.Close()
+		DB, maxIdleConns = prev, prevIdle
+	})
+
+	// Idle connections are capped at the open limit
+	if err := Initialize(url, Options{MaxOpenConns: 3, MaxIdleConns: 10, ConnMaxLifetime: time.Minute}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if got := DB.Stats().MaxOpenConnections; got != 3 {
+		t.Errorf("max open connections = %d, want 3", got)
+	}
+	if maxIdleConns != 3 {
+		t.Errorf("max idle connections = %d, want 3", maxIdleConns)
+	}
+}
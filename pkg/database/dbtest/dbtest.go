@@ -0,0 +1,261 @@
+// Package dbtest provides a scriptable in-memory database/sql driver for
+// tests of code that queries through database.DB. Queries are answered by
+// handlers matched on a substring of the SQL, so tests only script the
+// statements they care about.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Result is a handler's answer to a query or statement
+type Result struct {
+	Columns      []string
+	Rows         [][]driver.Value
+	RowsAffected int64
+	Err          error
+}
+
+// Handler answers a query given its arguments
+type Handler func(args []driver.Value) Result
+
+// Call is a recorded query or statement
+type Call struct {
+	Query string
+	Args  []driver.Value
+}
+
+type route struct {
+	substr  string
+	handler Handler
+}
+
+// DB is a fake database. Unmatched queries fail with an error naming the
+// query. Transactions have no effect, but their end is recorded as a
+// "COMMIT" or "ROLLBACK" call.
+type DB struct {
+	mu      sync.Mutex
+	routes  []route
+	calls   []Call
+	pingErr error
+}
+
+// New returns an empty fake database
+func New() *DB {
+	return &DB{}
+}
+
+// On answers queries containing substr with handler. Later routes win, so
+// tests can override a default route.
+func (d *DB) On(substr string, handler Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.routes = append(d.routes, route{substr: substr, handler: handler})
+}
+
+// OnRows answers queries containing substr with fixed rows
+func (d *DB) OnRows(substr string, columns []string, rows ...[]driver.Value) {
+	d.On(substr, func([]driver.Value) Result {
+		return Result{Columns: columns, Rows: rows}
+	})
+}
+
+// OnExec answers statements containing substr with rowsAffected
+func (d *DB) OnExec(substr string, rowsAffected int64) {
+	d.On(substr, func([]driver.Value) Result {
+		return Result{RowsAffected: rowsAffected}
+	})
+}
+
+// OnError fails queries containing substr with err
+func (d *DB) OnError(substr string, err error) {
+	d.On(substr, func([]driver.Value) Result {
+		return Result{Err: err}
+	})
+}
+
+// SetPingError makes pings fail with err, or succeed when err is nil
+func (d *DB) SetPingError(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pingErr = err
+}
+
+// Calls returns the recorded queries containing substr, in order
+func (d *DB) Calls(substr string) []Call {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var calls []Call
+	for _, call := range d.calls {
+		if strings.Contains(call.Query, substr) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Open returns a *sql.DB backed by the fake
+func (d *DB) Open() *sql.DB {
+	return sql.OpenDB(connector{db: d})
+}
+
+func (d *DB) run(query string, args []driver.NamedValue) Result {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+
+	d.mu.Lock()
+	d.calls = append(d.calls, Call{Query: query, Args: values})
+	var handler Handler
+	for i := len(d.routes) - 1; i >= 0; i-- {
+		if strings.Contains(query, d.routes[i].substr) {
+			handler = d.routes[i].handler
+			break
+		}
+	}
+	d.mu.Unlock()
+
+	if handler == nil {
+		return Result{Err: fmt.Errorf("dbtest: unexpected query: %s", strings.Join(strings.Fields(query), " "))}
+	}
+	return handler(values)
+}
+
+type connector struct {
+	db *DB
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c.db}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return fakeDriver{db: c.db}
+}
+
+type fakeDriver struct {
+	db *DB
+}
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return &conn{db: d.db}, nil
+}
+
+type conn struct {
+	db *DB
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) Close() error { return nil }
+
+func (c *conn) Begin() (driver.Tx, error) { return tx{db: c.db}, nil }
+
+func (c *conn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return tx{db: c.db}, nil
+}
+
+func (c *conn) Ping(context.Context) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.db.pingErr
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := c.db.run(query, args)
+	// Like a real driver, a query outlasting its context is cancelled
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return &rows{columns: result.Columns, rows: result.Rows}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := c.db.run(query, args)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return driver.RowsAffected(result.RowsAffected), nil
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, named(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	values := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		values[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return values
+}
+
+type tx struct {
+	db *DB
+}
+
+func (t tx) Commit() error   { return t.end("COMMIT") }
+func (t tx) Rollback() error { return t.end("ROLLBACK") }
+
+func (t tx) end(query string) error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	t.db.calls = append(t.db.calls, Call{Query: query})
+	return nil
+}
+
+type rows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *rows) Columns() []string { return r.columns }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"instagram-user-processor/pkg/database/dbtest"
+	"os"
+	"testing"
+)
+
+// useFakeDB installs a fake DB for the duration of the test
+func useFakeDB(t *testing.T) *dbtest.DB {
+	t.Helper()
+	fake := dbtest.New()
+	prev := DB
+	DB = fake.Open()
+	t.Cleanup(func() {
+		DB.Close()
+		DB = prev
+	})
+	return fake
+}
+
+// usePostgres connects DB to the database at TEST_DATABASE_URL for the
+// duration of the test, migrated and emptied, and skips the test when
+// it's unset. The database's tables are truncated, so never point it at
+// one holding data worth keeping.
+func usePostgres(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	prev := DB
+	if err := Initialize(url, Options{MaxOpenConns: 5}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	t.Cleanup(func() {
+		DB.Close()
+		DB = prev
+	})
+
+	ctx := context.Background()
+	if err := Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	_, err := DB.ExecContext(ctx, `
+		TRUNCATE instagram_assets, instagram_posts, user_stats_cache,
+		         username_history, audit_log, processing_jobs, instagram_users CASCADE`)
+	if err != nil {
+		t.Fatalf("failed to empty tables: %v", err)
+	}
+}
+
+// execAll runs each statement against DB, failing the test on the first
+// error
+func execAll(t *testing.T, statements ...string) {
+	t.Helper()
+	for _, stmt := range statements {
+		if _, err := DB.ExecContext(context.Background(), stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
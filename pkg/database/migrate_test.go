@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"instagram-user-processor/pkg/database/dbtest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0010_later.sql":   {Data: []byte("SELECT 10")},
+		"migrations/0002_second.sql":  {Data: []byte("SELECT 2")},
+		"migrations/0001_initial.sql": {Data: []byte("SELECT 1")},
+		"migrations/README.md":        {Data: []byte("not a migration")},
+	}
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	var got []string
+	for _, m := range migrations {
+		got = append(got, m.name+"="+m.sql)
+	}
+	if want := "initial=SELECT 1,second=SELECT 2,later=SELECT 10"; strings.Join(got, ",") != want {
+		t.Errorf("migrations = %v, want %s", got, want)
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"no version":           {"migrations/initial.sql": {}},
+		"version not a number": {"migrations/v1_initial.sql": {}},
+		"zero version":         {"migrations/0000_initial.sql": {}},
+		"duplicate version":    {"migrations/0001_a.sql": {}, "migrations/1_b.sql": {}},
+	} {
+		if _, err := loadMigrations(fsys); err == nil {
+			t.Errorf("%s: loadMigrations succeeded, want an error", name)
+		}
+	}
+}
+
+func TestEmbeddedMigrationsAreNumberedInOrder(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.name, m.version, i+1)
+		}
+		if strings.TrimSpace(m.sql) == "" {
+			t.Errorf("migration %d is empty", m.version)
+		}
+	}
+}
+
+// fakeMigrations routes Migrate's statements to a fake database with the
+// given versions already applied
+func fakeMigrations(t *testing.T, applied ...int64) *dbtest.DB {
+	t.Helper()
+	fake := useFakeDB(t)
+	fake.OnExec("", 0)
+	rows := make([][]driver.Value, len(applied))
+	for i, version := range applied {
+		rows[i] = []driver.Value{version}
+	}
+	fake.OnRows("SELECT version FROM schema_migrations", []string{"version"}, rows...)
+	return fake
+}
+
+// recordedVersions returns the versions Migrate recorded as applied
+func recordedVersions(fake *dbtest.DB) []int64 {
+	var versions []int64
+	for _, call := range fake.Calls("INSERT INTO schema_migrations") {
+		versions = append(versions, call.Args[0].(int64))
+	}
+	return versions
+}
+
+func TestMigrateAppliesOnlyPendingVersions(t *testing.T) {
+	total := len(mustLoadMigrations(t))
+
+	fake := fakeMigrations(t, 1)
+	if err := Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	versions := recordedVersions(fake)
+	if len(versions) != total-1 || versions[0] != 2 {
+		t.Errorf("recorded versions %v, want 2 through %d", versions, total)
+	}
+	if n := len(fake.Calls("CREATE TABLE IF NOT EXISTS instagram_users")); n != 0 {
+		t.Errorf("re-ran the applied initial migration %d times", n)
+	}
+	if n := len(fake.Calls("COMMIT")); n != total-1 {
+		t.Errorf("committed %d transactions, want one per pending migration", n)
+	}
+	if len(fake.Calls("pg_advisory_lock")) != 1 || len(fake.Calls("pg_advisory_unlock")) != 1 {
+		t.Error("migration lock wasn't taken and released once")
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	var all []int64
+	for _, m := range mustLoadMigrations(t) {
+		all = append(all, int64(m.version))
+	}
+
+	fake := fakeMigrations(t, all...)
+	if err := Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if versions := recordedVersions(fake); len(versions) != 0 {
+		t.Errorf("recorded versions %v with everything applied, want none", versions)
+	}
+	if n := len(fake.Calls("COMMIT")); n != 0 {
+		t.Errorf("ran %d migration transactions, want none", n)
+	}
+}
+
+func TestMigrateStopsAtFailedMigration(t *testing.T) {
+	fake := fakeMigrations(t)
+	fake.OnError("CREATE TABLE IF NOT EXISTS instagram_users", errors.New("permission denied"))
+
+	err := Migrate(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "migration 1") {
+		t.Fatalf("Migrate error = %v, want migration 1 to fail", err)
+	}
+	if versions := recordedVersions(fake); len(versions) != 0 {
+		t.Errorf("recorded versions %v after a failure, want none", versions)
+	}
+	if ends := txEnds(fake); len(ends) != 1 || ends[0] != "ROLLBACK" {
+		t.Errorf("transactions ended with %v, want the failed one rolled back", ends)
+	}
+	if len(fake.Calls("pg_advisory_unlock")) != 1 {
+		t.Error("migration lock not released after the failure")
+	}
+}
+
+func TestMigrateAgainstPostgres(t *testing.T) {
+	// usePostgres migrates once; migrating again must change nothing
+	usePostgres(t)
+	ctx := context.Background()
+	if err := Migrate(ctx); err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+
+	var count, maxVersion int
+	if err := DB.QueryRowContext(ctx, `SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&count, &maxVersion); err != nil {
+		t.Fatalf("reading schema_migrations: %v", err)
+	}
+	total := len(mustLoadMigrations(t))
+	if count != total || maxVersion != total {
+		t.Errorf("schema_migrations has %d rows up to version %d, want %d", count, maxVersion, total)
+	}
+	for _, table := range []string{"instagram_users", "instagram_posts", "instagram_assets", "processing_jobs"} {
+		var exists bool
+		if err := DB.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil || !exists {
+			t.Errorf("table %s missing after Migrate: %v", table, err)
+		}
+	}
+}
+
+func mustLoadMigrations(t *testing.T) []migration {
+	t.Helper()
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	return migrations
+}
+
+func TestProcessingJobParentAgainstPostgres(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+
+	parent, err := CreateProcessingJob(ctx, 5, 2, nil)
+	if err != nil {
+		t.Fatalf("CreateProcessingJob(parent): %v", err)
+	}
+	retry, err := CreateProcessingJob(ctx, 2, 2, &parent.ID)
+	if err != nil {
+		t.Fatalf("CreateProcessingJob(retry): %v", err)
+	}
+	if parent.ParentJobID != nil || retry.ParentJobID == nil || *retry.ParentJobID != parent.ID {
+		t.Fatalf("created parents = %v and %v, want none and %s", parent.ParentJobID, retry.ParentJobID, parent.ID)
+	}
+
+	stored, err := GetProcessingJobStatus(ctx, retry.ID)
+	if err != nil {
+		t.Fatalf("GetProcessingJobStatus: %v", err)
+	}
+	if stored.ParentJobID == nil || *stored.ParentJobID != parent.ID {
+		t.Errorf("stored parent = %v, want %s", stored.ParentJobID, parent.ID)
+	}
+}
+
+func TestProcessingJobFailedTargetsAgainstPostgres(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+
+	job, err := CreateProcessingJob(ctx, 2, 1, nil)
+	if err != nil {
+		t.Fatalf("CreateProcessingJob: %v", err)
+	}
+	job.Status = JobStatusCompleted
+	job.ProcessedUsers, job.FailedUsers = 2, 2
+	job.Errors = map[string]string{"bob": "timeout", "12345": "user not found"}
+	job.FailedTargets = []JobTarget{
+		{Identifier: "bob", Type: "username", Refresh: true},
+		{Identifier: "12345", Type: "username"},
+	}
+	if err := UpdateProcessingJob(ctx, job); err != nil {
+		t.Fatalf("UpdateProcessingJob: %v", err)
+	}
+
+	stored, err := GetProcessingJobStatus(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("GetProcessingJobStatus: %v", err)
+	}
+	if len(stored.FailedTargets) != 2 || stored.FailedTargets[0] != job.FailedTargets[0] || stored.FailedTargets[1] != job.FailedTargets[1] {
+		t.Errorf("stored failed targets = %+v, want %+v", stored.FailedTargets, job.FailedTargets)
+	}
+}
@@ -0,0 +1,3 @@
+-- Link retry jobs to the job whose failed users they re-run
+ALTER TABLE processing_jobs
+    ADD COLUMN IF NOT EXISTS parent_job_id UUID REFERENCES processing_jobs(id) ON DELETE SET NULL;
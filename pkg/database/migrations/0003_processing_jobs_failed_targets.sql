@@ -0,0 +1,4 @@
+-- Record how each failed user of a job was fetched, so retries re-run it
+-- as the same kind of target
+ALTER TABLE processing_jobs
+    ADD COLUMN IF NOT EXISTS failed_targets JSONB;
@@ -20,9 +20,15 @@ type User struct {
 	Followers             int64     `json:"followers" db:"followers"`
 	Following             int64     `json:"following" db:"following"`
 	Posts                 int64     `json:"posts" db:"posts"`
+	ProfilePicURL         sql.NullString `json:"profile_pic_url" db:"profile_pic_url"`
+	ProfilePicStorageURL  sql.NullString `json:"profile_pic_storage_url" db:"profile_pic_storage_url"` // our uploaded copy
 	ScrapedAt             time.Time `json:"scraped_at" db:"scraped_at"`
 	CreatedAt             time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt             time.Time `json:"updated_at" db:"updated_at"`
+
+	// UpstreamRequestID is the RocketAPI request id of the scrape that
+	// produced this record (not persisted)
+	UpstreamRequestID string `json:"-" db:"-"`
 }
 
 // UserStats represents detailed user statistics (from complex query)
@@ -34,7 +40,47 @@ type UserStats struct {
 	TotalTaggedInCount   int             `json:"total_tagged_in_count"`
 	TotalCoauthoredCount int             `json:"total_coauthored_count"`
 	EngagementRate       float64         `json:"engagement_rate"`
+	EngagementWindowDays int             `json:"engagement_window_days,omitempty"` // days of posts engagement_rate covers
 	AveragePostsPerWeek  float64         `json:"average_posts_per_week"`
+	CachedAt             *time.Time      `json:"cached_at,omitempty"` // set when served from user_stats_cache
+	Partial              bool            `json:"partial,omitempty"`   // only cheap counts, the full query timed out
+}
+
+// TaggedUsername is an account tagged in a user's post assets, with the
+// totals of the posts it was tagged in
+type TaggedUsername struct {
+	Username      string `json:"username"`
+	Count         int    `json:"count"` // tags across the user's assets
+	TotalLikes    int64  `json:"total_likes"`
+	TotalComments int64  `json:"total_comments"`
+	TotalPlays    int64  `json:"total_plays"`
+}
+
+// CoauthoredUsername is an author of a user's posts, with the totals of
+// those posts
+type CoauthoredUsername struct {
+	Collaborator       string `json:"collaborator"`
+	CollaborationCount int    `json:"collaboration_count"`
+	TotalLikes         int64  `json:"total_likes"`
+	TotalComments      int64  `json:"total_comments"`
+}
+
+// UserEngagement is a user ranked by engagement rate over recent posts
+type UserEngagement struct {
+	User           *User   `json:"user"`
+	EngagementRate float64 `json:"engagement_rate"`
+	RecentPosts    int     `json:"recent_posts"` // posts in the engagement window
+}
+
+// AggregateStats are headline numbers across all stored users
+type AggregateStats struct {
+	TotalUsers     int64   `json:"total_users"`
+	VerifiedUsers  int64   `json:"verified_users"`
+	BusinessUsers  int64   `json:"business_users"`
+	PrivateUsers   int64   `json:"private_users"`
+	TotalFollowers int64   `json:"total_followers"`
+	MaxFollowers   int64   `json:"max_followers"`
+	AvgFollowers   float64 `json:"avg_followers"`
 }
 
 // Post represents an Instagram post (simplified for demo)
@@ -63,6 +109,23 @@ type Asset struct {
 	UpdatedAt            time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// Processing job statuses
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// JobTarget is a batch entry as a job ran it, recorded for its failed
+// users so a retry re-runs them the same way
+type JobTarget struct {
+	Identifier string `json:"identifier"`
+	Type       string `json:"type"` // "username", "id"
+	Refresh    bool   `json:"refresh,omitempty"`
+}
+
 // ProcessingJob represents a batch processing job
 type ProcessingJob struct {
 	ID              string            `json:"id" db:"id"`
@@ -75,6 +138,56 @@ type ProcessingJob struct {
 	StartedAt       *time.Time        `json:"started_at,omitempty" db:"started_at"`
 	CompletedAt     *time.Time        `json:"completed_at,omitempty" db:"completed_at"`
 	Errors          map[string]string `json:"errors" db:"errors"`
+	FailedTargets   []JobTarget       `json:"-" db:"failed_targets"` // how to retry each user in Errors
+	ParentJobID     *string           `json:"parent_job_id,omitempty" db:"parent_job_id"` // job whose failed users this one retries
 	CreatedAt       time.Time         `json:"created_at" db:"created_at"`
 	UpdatedAt       time.Time         `json:"updated_at" db:"updated_at"`
-}
\ No newline at end of file
+}
+// EmptyAsNull controls how missing nullable text fields are rendered in
+// JSON responses: null when true, "" when false
+var EmptyAsNull = true
+
+// nullableText renders a nullable text column according to EmptyAsNull
+func nullableText(ns sql.NullString) interface{} {
+	if ns.Valid && ns.String != "" {
+		return ns.String
+	}
+	if EmptyAsNull {
+		return nil
+	}
+	return ""
+}
+
+// MarshalJSON renders nullable text fields as plain strings
+func (u User) MarshalJSON() ([]byte, error) {
+	type alias User
+	return json.Marshal(struct {
+		alias
+		FullName      interface{} `json:"full_name"`
+		Biography     interface{} `json:"biography"`
+		CategoryName  interface{} `json:"category_name"`
+		ProfilePicURL interface{} `json:"profile_pic_url"`
+
+		ProfilePicStorageURL interface{} `json:"profile_pic_storage_url"`
+	}{
+		alias:         alias(u),
+		FullName:      nullableText(u.FullName),
+		Biography:     nullableText(u.Biography),
+		CategoryName:  nullableText(u.CategoryName),
+		ProfilePicURL: nullableText(u.ProfilePicURL),
+
+		ProfilePicStorageURL: nullableText(u.ProfilePicStorageURL),
+	})
+}
+
+// MarshalJSON renders nullable text fields as plain strings
+func (p Post) MarshalJSON() ([]byte, error) {
+	type alias Post
+	return json.Marshal(struct {
+		alias
+		Caption interface{} `json:"caption"`
+	}{
+		alias:   alias(p),
+		Caption: nullableText(p.Caption),
+	})
+}
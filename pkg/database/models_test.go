@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+// setEmptyAsNull sets EmptyAsNull for the duration of the test
+func setEmptyAsNull(t *testing.T, v bool) {
+	t.Helper()
+	prev := EmptyAsNull
+	EmptyAsNull = v
+	t.Cleanup(func() { EmptyAsNull = prev })
+}
+
+func TestMissingTextRendering(t *testing.T) {
+	user := User{
+		ID:        "1",
+		Username:  "alice",
+		FullName:  sql.NullString{String: "Alice", Valid: true},
+		Biography: sql.NullString{String: "", Valid: true}, // stored empty
+		// CategoryName, ProfilePicURL and ProfilePicStorageURL are NULL
+	}
+	post := Post{ID: "p1", UserID: "1"}
+
+	tests := []struct {
+		emptyAsNull bool
+		missing     interface{}
+	}{
+		{true, nil},
+		{false, ""},
+	}
+	for _, tt := range tests {
+		setEmptyAsNull(t, tt.emptyAsNull)
+
+		fields := marshalFields(t, user)
+		if fields["full_name"] != "Alice" {
+			t.Errorf("emptyAsNull=%v: full_name = %#v, want \"Alice\"", tt.emptyAsNull, fields["full_name"])
+		}
+		for _, name := range []string{"biography", "category_name", "profile_pic_url", "profile_pic_storage_url"} {
+			value, ok := fields[name]
+			if !ok || value != tt.missing {
+				t.Errorf("emptyAsNull=%v: %s = %#v, want %#v", tt.emptyAsNull, name, value, tt.missing)
+			}
+		}
+
+		if caption := marshalFields(t, post)["caption"]; caption != tt.missing {
+			t.Errorf("emptyAsNull=%v: caption = %#v, want %#v", tt.emptyAsNull, caption, tt.missing)
+		}
+	}
+}
+
+// marshalFields renders v as JSON and decodes it back into its fields
+func marshalFields(t *testing.T, v interface{}) map[string]interface{} {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("Unmarshal %s: %v", b, err)
+	}
+	return fields
+}
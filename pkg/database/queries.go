@@ -6,110 +6,809 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// GetUserByUsername retrieves a user by username
-func GetUserByUsername(ctx context.Context, username string) (*User, error) {
-	query := `
-		SELECT id, username, full_name, biography, is_verified,
-		       is_business_account, is_professional_account, is_private,
-		       category_name, followers, following, posts, scraped_at,
-		       created_at, updated_at
-		FROM instagram_users
-		WHERE username = $1
-	`
+// userColumns is the instagram_users column list read by scanUser
+const userColumns = `
+	id, username, full_name, biography, is_verified,
+	is_business_account, is_professional_account, is_private,
+	category_name, followers, following, posts, profile_pic_url,
+	profile_pic_storage_url, scraped_at, created_at, updated_at
+`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+// scanUser scans a row selected with userColumns
+func scanUser(row rowScanner) (*User, error) {
 	var user User
-	err := DB.QueryRowContext(ctx, query, username).Scan(
+	err := row.Scan(
 		&user.ID, &user.Username, &user.FullName, &user.Biography,
 		&user.IsVerified, &user.IsBusinessAccount, &user.IsProfessionalAccount,
 		&user.IsPrivate, &user.CategoryName, &user.Followers, &user.Following,
-		&user.Posts, &user.ScrapedAt, &user.CreatedAt, &user.UpdatedAt,
+		&user.Posts, &user.ProfilePicURL, &user.ProfilePicStorageURL,
+		&user.ScrapedAt, &user.CreatedAt, &user.UpdatedAt,
 	)
-
 	if err != nil {
 		return nil, err
 	}
-
 	return &user, nil
 }
 
+// GetUserByUsername retrieves a user by username
+func GetUserByUsername(ctx context.Context, username string) (_ *User, err error) {
+	ctx, span := startSpan(ctx, "GetUserByUsername", attribute.String("username", username))
+	defer func() { endSpan(span, err) }()
+
+	query := `SELECT ` + userColumns + ` FROM instagram_users WHERE username = $1`
+
+	var user *User
+	err = withRetry(ctx, func() (err error) {
+		user, err = scanUser(DB.QueryRowContext(ctx, query, username))
+		return err
+	})
+	return user, err
+}
+
 // GetUserByID retrieves a user by ID
-func GetUserByID(ctx context.Context, userID string) (*User, error) {
-	query := `
-		SELECT id, username, full_name, biography, is_verified,
-		       is_business_account, is_professional_account, is_private,
-		       category_name, followers, following, posts, scraped_at,
-		       created_at, updated_at
+func GetUserByID(ctx context.Context, userID string) (_ *User, err error) {
+	ctx, span := startSpan(ctx, "GetUserByID", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	query := `SELECT ` + userColumns + ` FROM instagram_users WHERE id = $1`
+
+	var user *User
+	err = withRetry(ctx, func() (err error) {
+		user, err = scanUser(DB.QueryRowContext(ctx, query, userID))
+		return err
+	})
+	return user, err
+}
+
+// GetUsersByUsernames retrieves the stored users among usernames in a
+// single query. Usernames without a stored user are omitted; the result
+// order is unspecified.
+func GetUsersByUsernames(ctx context.Context, usernames []string) (_ []*User, err error) {
+	ctx, span := startSpan(ctx, "GetUsersByUsernames", attribute.Int("usernames", len(usernames)))
+	defer func() { endSpan(span, err) }()
+
+	query := `SELECT ` + userColumns + ` FROM instagram_users WHERE username = ANY($1)`
+
+	rows, err := DB.QueryContext(ctx, query, pq.Array(usernames))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0, len(usernames))
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate users: %w", err)
+	}
+
+	setRows(span, len(users))
+	return users, nil
+}
+
+// likeEscaper escapes LIKE wildcards and the escape character itself
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUsers returns up to limit stored users whose username or full name
+// contains q, case-insensitively, most followed first. Wildcards in q match
+// literally.
+func SearchUsers(ctx context.Context, q string, limit int) (_ []*User, err error) {
+	ctx, span := startSpan(ctx, "SearchUsers", attribute.String("query", q))
+	defer func() { endSpan(span, err) }()
+
+	// id breaks ties so results are stable
+	query := `SELECT ` + userColumns + `
 		FROM instagram_users
-		WHERE id = $1
-	`
+		WHERE username ILIKE $1 OR full_name ILIKE $1
+		ORDER BY followers DESC, id ASC
+		LIMIT $2`
 
-	var user User
-	err := DB.QueryRowContext(ctx, query, userID).Scan(
-		&user.ID, &user.Username, &user.FullName, &user.Biography,
-		&user.IsVerified, &user.IsBusinessAccount, &user.IsProfessionalAccount,
-		&user.IsPrivate, &user.CategoryName, &user.Followers, &user.Following,
-		&user.Posts, &user.ScrapedAt, &user.CreatedAt, &user.UpdatedAt,
-	)
+	pattern := "%" + likeEscaper.Replace(q) + "%"
+	rows, err := DB.QueryContext(ctx, query, pattern, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0, limit)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate users: %w", err)
+	}
 
+	setRows(span, len(users))
+	return users, nil
+}
+
+// userSortColumns whitelists the ORDER BY clauses ListUsers accepts
+var userSortColumns = map[string]string{
+	"followers":  "followers DESC",
+	"posts":      "posts DESC",
+	"username":   "username ASC",
+	"created_at": "created_at DESC",
+}
+
+// ErrInvalidSort is returned for sort columns outside the whitelist
+var ErrInvalidSort = errors.New("invalid sort column")
+
+// ListUsers returns a page of stored users ordered by orderBy (one of
+// followers, posts, username, created_at) and the total user count
+func ListUsers(ctx context.Context, limit, offset int, orderBy string) (_ []*User, _ int, err error) {
+	ctx, span := startSpan(ctx, "ListUsers", attribute.String("order_by", orderBy))
+	defer func() { endSpan(span, err) }()
+
+	orderClause, ok := userSortColumns[orderBy]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrInvalidSort, orderBy)
+	}
+
+	var total int
+	if err := DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM instagram_users`).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	// id breaks ties so pages are stable
+	query := `SELECT ` + userColumns + `
+		FROM instagram_users
+		ORDER BY ` + orderClause + `, id ASC
+		LIMIT $1 OFFSET $2`
+
+	rows, err := DB.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0, limit)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to iterate users: %w", err)
+	}
+
+	setRows(span, len(users))
+	return users, total, nil
+}
+
+// postColumns is the instagram_posts column list read by scanPost
+const postColumns = `
+	id, user_id, username, caption, COALESCE(like_count, 0),
+	COALESCE(comment_count, 0), play_count, COALESCE(is_ad, FALSE),
+	posted_at, created_at, updated_at
+`
+
+// scanPost scans a row selected with postColumns
+func scanPost(row rowScanner) (*Post, error) {
+	var post Post
+	err := row.Scan(
+		&post.ID, &post.UserID, &post.Username, &post.Caption, &post.LikeCount,
+		&post.CommentCount, &post.PlayCount, &post.IsAd,
+		&post.PostedAt, &post.CreatedAt, &post.UpdatedAt,
+	)
 	if err != nil {
 		return nil, err
 	}
+	return &post, nil
+}
 
-	return &user, nil
+// GetPostsByUser returns a page of a user's posts, newest first. The result
+// is empty, not nil, when the user has no posts.
+func GetPostsByUser(ctx context.Context, userID string, limit, offset int) (_ []*Post, err error) {
+	ctx, span := startSpan(ctx, "GetPostsByUser", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	// id breaks ties so pages are stable
+	query := `SELECT ` + postColumns + `
+		FROM instagram_posts
+		WHERE user_id = $1
+		ORDER BY posted_at DESC, id ASC
+		LIMIT $2 OFFSET $3`
+
+	rows, err := DB.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get posts: %w", err)
+	}
+	defer rows.Close()
+
+	posts := make([]*Post, 0, limit)
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan post: %w", err)
+		}
+		posts = append(posts, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate posts: %w", err)
+	}
+
+	setRows(span, len(posts))
+	return posts, nil
 }
 
-// UpsertUser inserts or updates a user
-func UpsertUser(ctx context.Context, user *User) error {
+// CountPostsByUser returns the number of stored posts for a user
+func CountPostsByUser(ctx context.Context, userID string) (_ int, err error) {
+	ctx, span := startSpan(ctx, "CountPostsByUser", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	var total int
+	err = DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM instagram_posts WHERE user_id = $1`, userID).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count posts: %w", err)
+	}
+	return total, nil
+}
+
+// taggedUsernamesFrom joins a user's posts ($1) to the usernames tagged in
+// their assets, as aggregated for the tagged_usernames stats list
+const taggedUsernamesFrom = `
+		FROM instagram_posts p
+			JOIN instagram_assets a ON a.post_id = p.id
+			CROSS JOIN LATERAL UNNEST(a.tagged_user_usernames) AS t(username)
+		WHERE p.user_id = $1 AND t.username IS NOT NULL`
+
+// GetTaggedUsernames returns a page of the accounts tagged in a user's post
+// assets, most tagged first. The stats query embeds the first page of this
+// list. The result is empty, not nil, when nobody is tagged.
+func GetTaggedUsernames(ctx context.Context, userID string, limit, offset int) (_ []*TaggedUsername, err error) {
+	ctx, span := startSpan(ctx, "GetTaggedUsernames", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	// username breaks ties so pages are stable
 	query := `
-		INSERT INTO instagram_users (
-			id, username, full_name, biography, is_verified,
-			is_business_account, is_professional_account, is_private,
-			category_name, followers, following, posts, scraped_at
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13
+		SELECT t.username,
+			   COUNT(p.id) AS count,
+			   SUM(COALESCE(p.like_count, 0)) AS total_likes,
+			   SUM(COALESCE(p.comment_count, 0)) AS total_comments,
+			   SUM(COALESCE(p.play_count, 0)) AS total_plays` + taggedUsernamesFrom + `
+		GROUP BY t.username
+		ORDER BY count DESC, t.username ASC
+		LIMIT $2 OFFSET $3`
+
+	rows, err := DB.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tagged usernames: %w", err)
+	}
+	defer rows.Close()
+
+	tagged := make([]*TaggedUsername, 0, limit)
+	for rows.Next() {
+		var t TaggedUsername
+		if err := rows.Scan(&t.Username, &t.Count, &t.TotalLikes, &t.TotalComments, &t.TotalPlays); err != nil {
+			return nil, fmt.Errorf("failed to scan tagged username: %w", err)
+		}
+		tagged = append(tagged, &t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate tagged usernames: %w", err)
+	}
+
+	setRows(span, len(tagged))
+	return tagged, nil
+}
+
+// CountTaggedUsernames returns the number of distinct accounts tagged in a
+// user's post assets
+func CountTaggedUsernames(ctx context.Context, userID string) (_ int, err error) {
+	ctx, span := startSpan(ctx, "CountTaggedUsernames", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	var total int
+	err = DB.QueryRowContext(ctx, `SELECT COUNT(DISTINCT t.username)`+taggedUsernamesFrom, userID).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count tagged usernames: %w", err)
+	}
+	return total, nil
+}
+
+// GetCoauthoredUsernames returns a page of the authors of a user's posts,
+// most posts first. The stats query embeds the first page of this list.
+// The result is empty, not nil, when the user has no posts.
+func GetCoauthoredUsernames(ctx context.Context, userID string, limit, offset int) (_ []*CoauthoredUsername, err error) {
+	ctx, span := startSpan(ctx, "GetCoauthoredUsernames", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	// username breaks ties so pages are stable
+	query := `
+		SELECT p.username,
+			   COUNT(p.id) AS collaboration_count,
+			   SUM(COALESCE(p.like_count, 0)) AS total_likes,
+			   SUM(COALESCE(p.comment_count, 0)) AS total_comments
+		FROM instagram_posts p
+		WHERE p.user_id = $1
+		GROUP BY p.username
+		ORDER BY collaboration_count DESC, p.username ASC
+		LIMIT $2 OFFSET $3`
+
+	rows, err := DB.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get coauthored usernames: %w", err)
+	}
+	defer rows.Close()
+
+	coauthored := make([]*CoauthoredUsername, 0, limit)
+	for rows.Next() {
+		var c CoauthoredUsername
+		if err := rows.Scan(&c.Collaborator, &c.CollaborationCount, &c.TotalLikes, &c.TotalComments); err != nil {
+			return nil, fmt.Errorf("failed to scan coauthored username: %w", err)
+		}
+		coauthored = append(coauthored, &c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate coauthored usernames: %w", err)
+	}
+
+	setRows(span, len(coauthored))
+	return coauthored, nil
+}
+
+// CountCoauthoredUsernames returns the number of distinct authors of a
+// user's posts
+func CountCoauthoredUsernames(ctx context.Context, userID string) (_ int, err error) {
+	ctx, span := startSpan(ctx, "CountCoauthoredUsernames", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	var total int
+	err = DB.QueryRowContext(ctx, `SELECT COUNT(DISTINCT username) FROM instagram_posts WHERE user_id = $1`, userID).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count coauthored usernames: %w", err)
+	}
+	return total, nil
+}
+
+// scanWithExtra scans a userColumns row followed by extra columns
+type scanWithExtra struct {
+	rowScanner
+	extra []interface{}
+}
+
+func (s scanWithExtra) Scan(dest ...interface{}) error {
+	return s.rowScanner.Scan(append(dest, s.extra...)...)
+}
+
+// GetAggregateStats computes headline numbers over all stored users in a
+// single query. An empty table yields zeros.
+func GetAggregateStats(ctx context.Context) (_ *AggregateStats, err error) {
+	ctx, span := startSpan(ctx, "GetAggregateStats")
+	defer func() { endSpan(span, err) }()
+
+	query := `
+		SELECT COUNT(*),
+		       COUNT(*) FILTER (WHERE is_verified),
+		       COUNT(*) FILTER (WHERE is_business_account),
+		       COUNT(*) FILTER (WHERE is_private),
+		       COALESCE(SUM(followers), 0)::bigint,
+		       COALESCE(MAX(followers), 0)::bigint,
+		       COALESCE(AVG(followers), 0)::float8
+		FROM instagram_users
+	`
+
+	var stats AggregateStats
+	err = withRetry(ctx, func() error {
+		return DB.QueryRowContext(ctx, query).Scan(
+			&stats.TotalUsers, &stats.VerifiedUsers, &stats.BusinessUsers, &stats.PrivateUsers,
+			&stats.TotalFollowers, &stats.MaxFollowers, &stats.AvgFollowers,
+		)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aggregate stats: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// GetTopUsersByEngagement ranks users with at least minFollowers followers
+// by engagement rate over their posts from the last windowDays days,
+// computed the same way as in GetUserStats. Users without posts in the
+// window are excluded. Ties are broken by followers, then id.
+func GetTopUsersByEngagement(ctx context.Context, limit int, minFollowers int64, windowDays int) (_ []*UserEngagement, err error) {
+	ctx, span := startSpan(ctx, "GetTopUsersByEngagement",
+		attribute.Int("limit", limit),
+		attribute.Int64("min_followers", minFollowers),
+		attribute.Int("engagement_window_days", windowDays),
+	)
+	defer func() { endSpan(span, err) }()
+
+	query := `
+		WITH recent AS (
+			SELECT user_id,
+			       AVG(COALESCE(like_count, 0) + COALESCE(comment_count, 0)) AS avg_engagement,
+			       COUNT(*) AS recent_posts
+			FROM instagram_posts
+			WHERE posted_at > NOW() - make_interval(days => $3)
+			GROUP BY user_id
 		)
-		ON CONFLICT (id) DO UPDATE SET
-			username = EXCLUDED.username,
-			full_name = EXCLUDED.full_name,
-			biography = EXCLUDED.biography,
-			is_verified = EXCLUDED.is_verified,
-			is_business_account = EXCLUDED.is_business_account,
-			is_professional_account = EXCLUDED.is_professional_account,
-			is_private = EXCLUDED.is_private,
-			category_name = EXCLUDED.category_name,
-			followers = EXCLUDED.followers,
-			following = EXCLUDED.following,
-			posts = EXCLUDED.posts,
-			scraped_at = EXCLUDED.scraped_at,
-			updated_at = CURRENT_TIMESTAMP
+		SELECT ` + userColumns + `,
+		       recent.avg_engagement / followers * 100 AS engagement_rate,
+		       recent.recent_posts
+		FROM instagram_users
+		JOIN recent ON recent.user_id = instagram_users.id
+		WHERE followers > 0 AND followers >= $2
+		ORDER BY engagement_rate DESC, followers DESC, id ASC
+		LIMIT $1
 	`
 
-	_, err := DB.ExecContext(ctx, query,
+	rows, err := DB.QueryContext(ctx, query, limit, minFollowers, windowDays)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get top users by engagement: %w", err)
+	}
+	defer rows.Close()
+
+	ranked := make([]*UserEngagement, 0, limit)
+	for rows.Next() {
+		var entry UserEngagement
+		user, err := scanUser(scanWithExtra{rows, []interface{}{&entry.EngagementRate, &entry.RecentPosts}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user engagement: %w", err)
+		}
+		entry.User = user
+		ranked = append(ranked, &entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate user engagement: %w", err)
+	}
+
+	setRows(span, len(ranked))
+	return ranked, nil
+}
+
+// Upserts truncate full names and biographies to these many runes, so
+// multibyte characters are never split
+var (
+	MaxFullNameRunes  = 150
+	MaxBiographyRunes = 1000
+)
+
+// truncateUserText cuts the user's full name and biography down to the
+// configured limits in place, logging each truncation
+func truncateUserText(user *User) {
+	truncateField(user, "full_name", &user.FullName, MaxFullNameRunes)
+	truncateField(user, "biography", &user.Biography, MaxBiographyRunes)
+}
+
+// truncateField cuts field to max runes
+func truncateField(user *User, name string, field *sql.NullString, max int) {
+	if !field.Valid || max <= 0 {
+		return
+	}
+
+	count := 0
+	for i := range field.String {
+		if count == max {
+			log.Warn().
+				Str("username", user.Username).
+				Str("field", name).
+				Int("runes", utf8.RuneCountInString(field.String)).
+				Int("max_runes", max).
+				Msg("truncating user text field")
+			field.String = field.String[:i]
+			return
+		}
+		count++
+	}
+}
+
+// upsertUserQuery inserts a user or updates the stored row. An update only
+// applies when the scrape is newer than the stored one, so concurrent
+// scrapes finishing out of order never overwrite fresher data; no row is
+// returned when it doesn't. inserted is true for new rows, since xmax is
+// only set on rows the conflict clause updated.
+const upsertUserQuery = `
+	INSERT INTO instagram_users (
+		id, username, full_name, biography, is_verified,
+		is_business_account, is_professional_account, is_private,
+		category_name, followers, following, posts, profile_pic_url, scraped_at
+	) VALUES (
+		$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14
+	)
+	ON CONFLICT (id) DO UPDATE SET
+		username = EXCLUDED.username,
+		full_name = EXCLUDED.full_name,
+		biography = EXCLUDED.biography,
+		is_verified = EXCLUDED.is_verified,
+		is_business_account = EXCLUDED.is_business_account,
+		is_professional_account = EXCLUDED.is_professional_account,
+		is_private = EXCLUDED.is_private,
+		category_name = EXCLUDED.category_name,
+		followers = EXCLUDED.followers,
+		following = EXCLUDED.following,
+		posts = EXCLUDED.posts,
+		profile_pic_url = EXCLUDED.profile_pic_url,
+		scraped_at = EXCLUDED.scraped_at,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE instagram_users.scraped_at IS NULL OR EXCLUDED.scraped_at > instagram_users.scraped_at
+	RETURNING (xmax = 0) AS inserted
+`
+
+// UpsertResult reports what an upsert did
+type UpsertResult struct {
+	Inserted bool // a new row was created
+	Applied  bool // the row was written; false when a newer scrape is already stored
+}
+
+// UpsertUser inserts or updates a user, retrying on lost connections
+func UpsertUser(ctx context.Context, user *User) error {
+	_, err := UpsertUserWithResult(ctx, user)
+	return err
+}
+
+// UpsertUserWithResult upserts a user like UpsertUser and reports whether
+// a new row was inserted, and whether the write applied at all. A scrape
+// older than the stored one is discarded without error.
+func UpsertUserWithResult(ctx context.Context, user *User) (_ UpsertResult, err error) {
+	ctx, span := startSpan(ctx, "UpsertUserWithResult", attribute.String("username", user.Username), attribute.String("user_id", user.ID))
+	defer func() { endSpan(span, err) }()
+
+	var result UpsertResult
+	err = withRetry(ctx, func() error {
+		var upsertErr error
+		result, upsertErr = upsertUser(ctx, user)
+		return upsertErr
+	})
+	span.SetAttributes(attribute.Bool("db.inserted", result.Inserted), attribute.Bool("db.applied", result.Applied))
+	return result, err
+}
+
+// upsertUser inserts or updates a user in a transaction
+func upsertUser(ctx context.Context, user *User) (UpsertResult, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return UpsertResult{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	collision, err := HandleUsernameCollision(ctx, tx, user)
+	if err != nil {
+		return UpsertResult{}, err
+	}
+
+	var inserted bool
+	truncateUserText(user)
+	err = tx.QueryRowContext(ctx, upsertUserQuery,
 		user.ID, user.Username, user.FullName, user.Biography,
 		user.IsVerified, user.IsBusinessAccount, user.IsProfessionalAccount,
 		user.IsPrivate, user.CategoryName, user.Followers, user.Following,
-		user.Posts, user.ScrapedAt,
-	)
+		user.Posts, user.ProfilePicURL, user.ScrapedAt,
+	).Scan(&inserted)
 
+	// A newer scrape is stored; the deferred Rollback also undoes the
+	// collision handling done on this scrape's behalf
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Debug().Str("username", user.Username).Time("scraped_at", user.ScrapedAt).Msg("skipped upsert of stale scrape")
+		return UpsertResult{}, nil
+	}
 	if err != nil {
 		log.Error().Err(err).Str("username", user.Username).Msg("failed to upsert user")
-		return fmt.Errorf("failed to upsert user: %w", err)
+		return UpsertResult{}, fmt.Errorf("failed to upsert user: %w", err)
 	}
 
-	log.Debug().Str("username", user.Username).Msg("upserted user")
+	if err = recordUsername(ctx, tx, user); err != nil {
+		return UpsertResult{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return UpsertResult{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if collision != nil {
+		recordCollision(ctx, collision)
+	}
+	RecordAudit(ctx, "upsert_user", user.ID, map[string]interface{}{"username": user.Username, "inserted": inserted})
+
+	log.Debug().Str("username", user.Username).Bool("inserted", inserted).Msg("upserted user")
+	return UpsertResult{Inserted: inserted, Applied: true}, nil
+}
+
+// SetProfilePicStorageURL records where a user's profile picture was
+// uploaded. Upserts leave this column untouched.
+func SetProfilePicStorageURL(ctx context.Context, userID, url string) (err error) {
+	ctx, span := startSpan(ctx, "SetProfilePicStorageURL", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	_, err = DB.ExecContext(ctx, `
+		UPDATE instagram_users
+		SET profile_pic_storage_url = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, userID, sql.NullString{String: url, Valid: url != ""})
+	if err != nil {
+		return fmt.Errorf("failed to set profile picture storage URL: %w", err)
+	}
 	return nil
 }
 
-// GetUserStats retrieves detailed user statistics using complex query
-// This is adapted from the actual Hendrix complex query
-func GetUserStats(ctx context.Context, userID string) (*UserStats, error) {
-	// Complex query adapted from Hendrix instagram_user_get.go
+// DeleteUser deletes a user together with their posts and the posts'
+// assets, which reference it without ON DELETE CASCADE. Cached stats and
+// username history are removed by their foreign keys, and usernames are
+// scrubbed from earlier audit entries about the user, so nothing
+// identifying is kept beyond the id. Returns sql.ErrNoRows if the user
+// doesn't exist.
+func DeleteUser(ctx context.Context, userID string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteUser", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM instagram_assets
+		WHERE post_id IN (SELECT id FROM instagram_posts WHERE user_id = $1)
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user assets: %w", err)
+	}
+
+	posts, err := tx.ExecContext(ctx, `DELETE FROM instagram_posts WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user posts: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM instagram_users WHERE id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE audit_log
+		SET details = details - 'username' - 'stale_username'
+		WHERE (target = $1 OR details->>'claiming_id' = $1)
+		  AND details ?| ARRAY['username', 'stale_username']
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to scrub user audit entries: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	deletedPosts, _ := posts.RowsAffected()
+	RecordAudit(ctx, "delete_user", userID, map[string]interface{}{"deleted_posts": deletedPosts})
+
+	log.Info().Str("user_id", userID).Int64("deleted_posts", deletedPosts).Msg("deleted user")
+	return nil
+}
+
+// CreateProcessingJob inserts a new pending processing job. parentJobID
+// links a retry to the job whose failures it re-runs, nil otherwise.
+func CreateProcessingJob(ctx context.Context, totalUsers, maxConcurrency int, parentJobID *string) (_ *ProcessingJob, err error) {
+	ctx, span := startSpan(ctx, "CreateProcessingJob", attribute.Int("total_users", totalUsers))
+	defer func() { endSpan(span, err) }()
+
 	query := `
-		SELECT
+		INSERT INTO processing_jobs (status, total_users, max_concurrency, parent_job_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, status, total_users, processed_users, successful_users,
+		          failed_users, max_concurrency, parent_job_id, created_at, updated_at
+	`
+
+	job := ProcessingJob{Errors: make(map[string]string)}
+	err = DB.QueryRowContext(ctx, query, JobStatusPending, totalUsers, maxConcurrency, parentJobID).Scan(
+		&job.ID, &job.Status, &job.TotalUsers, &job.ProcessedUsers,
+		&job.SuccessfulUsers, &job.FailedUsers, &job.MaxConcurrency,
+		&job.ParentJobID, &job.CreatedAt, &job.UpdatedAt,
+	)
+	if err != nil {
+		log.Error().Err(err).Int("total_users", totalUsers).Msg("failed to create processing job")
+		return nil, fmt.Errorf("failed to create processing job: %w", err)
+	}
+
+	span.SetAttributes(attribute.String("job_id", job.ID))
+	log.Debug().Str("job_id", job.ID).Int("total_users", totalUsers).Msg("created processing job")
+	return &job, nil
+}
+
+// UpdateProcessingJob persists the status, progress counters, timestamps,
+// errors and failed targets of a processing job
+func UpdateProcessingJob(ctx context.Context, job *ProcessingJob) (err error) {
+	ctx, span := startSpan(ctx, "UpdateProcessingJob", attribute.String("job_id", job.ID), attribute.String("status", job.Status))
+	defer func() { endSpan(span, err) }()
+
+	errorsJSON, err := json.Marshal(job.Errors)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job errors: %w", err)
+	}
+	failedTargetsJSON, err := json.Marshal(job.FailedTargets)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job failed targets: %w", err)
+	}
+
+	query := `
+		UPDATE processing_jobs SET
+			status = $2,
+			processed_users = $3,
+			successful_users = $4,
+			failed_users = $5,
+			started_at = $6,
+			completed_at = $7,
+			errors = $8,
+			failed_targets = $9
+		WHERE id = $1
+	`
+
+	result, err := DB.ExecContext(ctx, query,
+		job.ID, job.Status, job.ProcessedUsers, job.SuccessfulUsers,
+		job.FailedUsers, job.StartedAt, job.CompletedAt, errorsJSON,
+		failedTargetsJSON,
+	)
+	if err != nil {
+		log.Error().Err(err).Str("job_id", job.ID).Msg("failed to update processing job")
+		return fmt.Errorf("failed to update processing job: %w", err)
+	}
+
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// StatsOptions controls the list sizes and engagement window of GetUserStats
+type StatsOptions struct {
+	TaggedLimit          int // max tagged usernames returned
+	CoauthoredLimit      int // max coauthored usernames returned
+	EngagementWindowDays int // engagement rate covers posts from this many days back
+}
+
+// DefaultStatsOptions are the options the stats cache is computed with
+var DefaultStatsOptions = StatsOptions{
+	TaggedLimit:          10,
+	CoauthoredLimit:      10,
+	EngagementWindowDays: 30,
+}
+
+// userStatsColumns is the stats projection over instagram_users u, shared by
+// the live stats query and the stats cache refresh. $2 and $3 bind the
+// tagged and coauthored list limits, $4 the engagement window in days.
+// Complex query adapted from Hendrix instagram_user_get.go
+const userStatsColumns = `
 			row_to_json(u.*) AS user,
 			(SELECT coalesce(json_agg(t.*), '[]'::json)
 			 FROM (
@@ -123,7 +822,7 @@ func GetUserStats(ctx context.Context, userID string) (*UserStats, error) {
 				WHERE p.user_id = u.id AND a.tagged_user_usernames IS NOT NULL
 				GROUP BY UNNEST(a.tagged_user_usernames)
 				ORDER BY count DESC
-				LIMIT 10
+				LIMIT $2
 			 ) t) as tagged_usernames,
 			(SELECT coalesce(json_agg(t.*), '[]'::json)
 			 FROM (
@@ -135,7 +834,7 @@ func GetUserStats(ctx context.Context, userID string) (*UserStats, error) {
 				WHERE p.user_id = u.id
 				GROUP BY p.username
 				ORDER BY collaboration_count DESC
-				LIMIT 10
+				LIMIT $3
 			 ) t) as coauthored_usernames,
 			(SELECT COUNT(DISTINCT p.id)
 			 FROM instagram_posts p
@@ -147,15 +846,17 @@ func GetUserStats(ctx context.Context, userID string) (*UserStats, error) {
 			(SELECT COUNT(DISTINCT p.id)
 			 FROM instagram_posts p
 			 WHERE p.user_id = u.id AND p.is_ad = false) as total_coauthored_count,
-			-- Calculate engagement rate
+			-- Calculate engagement rate, 0 without posts in the window
+			-- (AVG over no rows is NULL)
 			CASE
 				WHEN u.followers > 0 THEN
-					(SELECT AVG(COALESCE(p.like_count, 0) + COALESCE(p.comment_count, 0))
+					COALESCE((SELECT AVG(COALESCE(p.like_count, 0) + COALESCE(p.comment_count, 0))
 					 FROM instagram_posts p
-					 WHERE p.user_id = u.id AND p.posted_at > NOW() - INTERVAL '30 days') / u.followers * 100
+					 WHERE p.user_id = u.id AND p.posted_at > NOW() - make_interval(days => $4)), 0) / u.followers * 100
 				ELSE 0
 			END as engagement_rate,
-			-- Calculate average posts per week
+			-- Calculate average posts per week, 0 without posts (MIN is NULL,
+			-- so the divisor falls back to 1)
 			(SELECT COUNT(*)::float /
 				CASE
 					WHEN EXTRACT(days FROM (NOW() - MIN(p.posted_at))) > 0
@@ -164,12 +865,35 @@ func GetUserStats(ctx context.Context, userID string) (*UserStats, error) {
 				END
 			 FROM instagram_posts p
 			 WHERE p.user_id = u.id) as average_posts_per_week
+`
+
+// GetUserStats retrieves detailed user statistics using complex query
+// This is adapted from the actual Hendrix complex query. Users present in
+// the stats cache (heavy accounts) are served from the cache instead when
+// the default options are requested. A user without posts gets zeroed
+// stats and empty lists rather than an error.
+func GetUserStats(ctx context.Context, userID string, opts StatsOptions) (_ *UserStats, err error) {
+	ctx, span := startSpan(ctx, "GetUserStats", attribute.String("user_id", userID), attribute.Int("engagement_window_days", opts.EngagementWindowDays))
+	defer func() { endSpan(span, err) }()
+
+	if opts == DefaultStatsOptions {
+		cached, err := getCachedUserStats(ctx, userID)
+		if err == nil {
+			span.SetAttributes(attribute.Bool("db.stats_cache_hit", true))
+			return cached, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Warn().Err(err).Str("user_id", userID).Msg("failed to read stats cache, using live query")
+		}
+	}
+
+	query := `SELECT ` + userStatsColumns + `
 		FROM instagram_users u
 		WHERE u.id = $1
 	`
 
-	var stats UserStats
-	err := DB.QueryRowContext(ctx, query, userID).Scan(
+	stats := UserStats{EngagementWindowDays: opts.EngagementWindowDays}
+	err = DB.QueryRowContext(ctx, query, userID, opts.TaggedLimit, opts.CoauthoredLimit, opts.EngagementWindowDays).Scan(
 		&stats.User,
 		&stats.TaggedUsernames,
 		&stats.CoauthoredUsernames,
@@ -191,8 +915,12 @@ func GetUserStats(ctx context.Context, userID string) (*UserStats, error) {
 	return &stats, nil
 }
 
-// BatchUpsertUsers efficiently inserts/updates multiple users
-func BatchUpsertUsers(ctx context.Context, users []*User) error {
+// BatchUpsertUsers efficiently inserts/updates multiple users. Users whose
+// scrape is older than the stored one are skipped.
+func BatchUpsertUsers(ctx context.Context, users []*User) (err error) {
+	ctx, span := startSpan(ctx, "BatchUpsertUsers", attribute.Int("users", len(users)))
+	defer func() { endSpan(span, err) }()
+
 	if len(users) == 0 {
 		return nil
 	}
@@ -203,75 +931,102 @@ func BatchUpsertUsers(ctx context.Context, users []*User) error {
 	}
 	defer tx.Rollback()
 
-	query := `
-		INSERT INTO instagram_users (
-			id, username, full_name, biography, is_verified,
-			is_business_account, is_professional_account, is_private,
-			category_name, followers, following, posts, scraped_at
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13
-		)
-		ON CONFLICT (id) DO UPDATE SET
-			username = EXCLUDED.username,
-			full_name = EXCLUDED.full_name,
-			biography = EXCLUDED.biography,
-			is_verified = EXCLUDED.is_verified,
-			is_business_account = EXCLUDED.is_business_account,
-			is_professional_account = EXCLUDED.is_professional_account,
-			is_private = EXCLUDED.is_private,
-			category_name = EXCLUDED.category_name,
-			followers = EXCLUDED.followers,
-			following = EXCLUDED.following,
-			posts = EXCLUDED.posts,
-			scraped_at = EXCLUDED.scraped_at,
-			updated_at = CURRENT_TIMESTAMP
-	`
-
-	stmt, err := tx.PrepareContext(ctx, query)
+	stmt, err := tx.PrepareContext(ctx, upsertUserQuery)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	defer stmt.Close()
 
-	for _, user := range users {
-		_, err = stmt.ExecContext(ctx,
+	var collisions []*UsernameCollision
+	written := make([]string, 0, len(users))
+	for i, user := range users {
+		// Stop writing as soon as the caller gives up; the deferred
+		// Rollback discards the rows written so far
+		select {
+		case <-ctx.Done():
+			log.Warn().Int("written", i).Int("count", len(users)).Msg("batch upsert cancelled, rolling back")
+			return fmt.Errorf("batch upsert cancelled after %d of %d users: %w", i, len(users), ctx.Err())
+		default:
+		}
+
+		// A stale scrape is rolled back to here, undoing its collision
+		// handling without losing the users written before it
+		if _, err = tx.ExecContext(ctx, "SAVEPOINT upsert_user"); err != nil {
+			return fmt.Errorf("failed to create savepoint: %w", err)
+		}
+
+		collision, err := HandleUsernameCollision(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+
+		var inserted bool
+		truncateUserText(user)
+		err = stmt.QueryRowContext(ctx,
 			user.ID, user.Username, user.FullName, user.Biography,
 			user.IsVerified, user.IsBusinessAccount, user.IsProfessionalAccount,
 			user.IsPrivate, user.CategoryName, user.Followers, user.Following,
-			user.Posts, user.ScrapedAt,
-		)
+			user.Posts, user.ProfilePicURL, user.ScrapedAt,
+		).Scan(&inserted)
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Debug().Str("username", user.Username).Time("scraped_at", user.ScrapedAt).Msg("skipped upsert of stale scrape")
+			if _, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT upsert_user"); err != nil {
+				return fmt.Errorf("failed to roll back stale scrape of %s: %w", user.Username, err)
+			}
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("failed to execute statement for user %s: %w", user.Username, err)
 		}
+		if collision != nil {
+			collisions = append(collisions, collision)
+		}
+
+		if err = recordUsername(ctx, tx, user); err != nil {
+			return err
+		}
+		written = append(written, user.ID)
 	}
 
 	if err = tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	log.Info().Int("count", len(users)).Msg("batch upserted users")
+	for _, collision := range collisions {
+		recordCollision(ctx, collision)
+	}
+
+	RecordAudit(ctx, "batch_upsert_users", fmt.Sprintf("%d users", len(written)), map[string]interface{}{"user_ids": written})
+
+	setRows(span, len(written))
+	log.Info().Int("count", len(written)).Int("skipped", len(users)-len(written)).Msg("batch upserted users")
 	return nil
 }
 
 // GetProcessingJobStatus gets the status of a processing job
-func GetProcessingJobStatus(ctx context.Context, jobID string) (*ProcessingJob, error) {
+func GetProcessingJobStatus(ctx context.Context, jobID string) (_ *ProcessingJob, err error) {
+	ctx, span := startSpan(ctx, "GetProcessingJobStatus", attribute.String("job_id", jobID))
+	defer func() { endSpan(span, err) }()
+
 	query := `
 		SELECT id, status, total_users, processed_users, successful_users,
 		       failed_users, max_concurrency, started_at, completed_at,
-		       errors, created_at, updated_at
+		       errors, failed_targets, parent_job_id, created_at, updated_at
 		FROM processing_jobs
 		WHERE id = $1
 	`
 
 	var job ProcessingJob
-	var errorsJSON []byte
+	var errorsJSON, failedTargetsJSON []byte
 
-	err := DB.QueryRowContext(ctx, query, jobID).Scan(
-		&job.ID, &job.Status, &job.TotalUsers, &job.ProcessedUsers,
-		&job.SuccessfulUsers, &job.FailedUsers, &job.MaxConcurrency,
-		&job.StartedAt, &job.CompletedAt, &errorsJSON,
-		&job.CreatedAt, &job.UpdatedAt,
-	)
+	err = withRetry(ctx, func() error {
+		return DB.QueryRowContext(ctx, query, jobID).Scan(
+			&job.ID, &job.Status, &job.TotalUsers, &job.ProcessedUsers,
+			&job.SuccessfulUsers, &job.FailedUsers, &job.MaxConcurrency,
+			&job.StartedAt, &job.CompletedAt, &errorsJSON, &failedTargetsJSON,
+			&job.ParentJobID, &job.CreatedAt, &job.UpdatedAt,
+		)
+	})
 
 	if err != nil {
 		return nil, err
@@ -287,5 +1042,169 @@ func GetProcessingJobStatus(ctx context.Context, jobID string) (*ProcessingJob,
 		job.Errors = make(map[string]string)
 	}
 
+	// Jobs finished before failed_targets was added have none
+	if len(failedTargetsJSON) > 0 {
+		if err := json.Unmarshal(failedTargetsJSON, &job.FailedTargets); err != nil {
+			log.Warn().Err(err).Msg("failed to parse job failed targets JSON")
+			job.FailedTargets = nil
+		}
+	}
+
 	return &job, nil
-}
\ No newline at end of file
+}
+
+// GetPartialUserStats returns only the cheap parts of the user stats (the
+// user row and posted count). Used when the full stats query times out.
+func GetPartialUserStats(ctx context.Context, userID string) (_ *UserStats, err error) {
+	ctx, span := startSpan(ctx, "GetPartialUserStats", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	query := `
+		SELECT
+			row_to_json(u.*) AS user,
+			(SELECT COUNT(*) FROM instagram_posts p WHERE p.user_id = u.id) AS total_posted_count
+		FROM instagram_users u
+		WHERE u.id = $1
+	`
+
+	stats := UserStats{
+		TaggedUsernames:     json.RawMessage(`[]`),
+		CoauthoredUsernames: json.RawMessage(`[]`),
+		Partial:             true,
+	}
+	err = DB.QueryRowContext(ctx, query, userID).Scan(&stats.User, &stats.TotalPostedCount)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, sql.ErrNoRows
+		}
+		return nil, fmt.Errorf("failed to get partial user stats: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// IsQueryTimeout reports whether err is a context deadline or a Postgres
+// statement cancellation
+func IsQueryTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "57014" // query_canceled
+}
+
+// getCachedUserStats reads precomputed stats from user_stats_cache.
+// Returns sql.ErrNoRows when the user isn't cached.
+func getCachedUserStats(ctx context.Context, userID string) (_ *UserStats, err error) {
+	ctx, span := startSpan(ctx, "getCachedUserStats", attribute.String("user_id", userID))
+	defer func() { endSpan(span, err) }()
+
+	query := `
+		SELECT user_json, tagged_usernames, coauthored_usernames,
+		       total_posted_count, total_tagged_in_count, total_coauthored_count,
+		       COALESCE(engagement_rate, 0), COALESCE(average_posts_per_week, 0),
+		       refreshed_at
+		FROM user_stats_cache
+		WHERE user_id = $1
+	`
+
+	var stats UserStats
+	var refreshedAt time.Time
+	err = DB.QueryRowContext(ctx, query, userID).Scan(
+		&stats.User,
+		&stats.TaggedUsernames,
+		&stats.CoauthoredUsernames,
+		&stats.TotalPostedCount,
+		&stats.TotalTaggedInCount,
+		&stats.TotalCoauthoredCount,
+		&stats.EngagementRate,
+		&stats.AveragePostsPerWeek,
+		&refreshedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.CachedAt = &refreshedAt
+	stats.EngagementWindowDays = DefaultStatsOptions.EngagementWindowDays
+	return &stats, nil
+}
+
+// RefreshUserStatsCache recomputes cached stats for every user with at least
+// minPosts stored posts and evicts users that dropped below the threshold
+func RefreshUserStatsCache(ctx context.Context, minPosts int) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "RefreshUserStatsCache", attribute.Int("min_posts", minPosts))
+	defer func() { endSpan(span, err) }()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM user_stats_cache c
+		WHERE (SELECT COUNT(*) FROM instagram_posts p WHERE p.user_id = c.user_id) < $1
+	`, minPosts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to evict stats cache: %w", err)
+	}
+
+	query := `
+		INSERT INTO user_stats_cache (
+			user_id, user_json, tagged_usernames, coauthored_usernames,
+			total_posted_count, total_tagged_in_count, total_coauthored_count,
+			engagement_rate, average_posts_per_week, refreshed_at
+		)
+		SELECT u.id, ` + userStatsColumns + `, NOW()
+		FROM instagram_users u
+		WHERE (SELECT COUNT(*) FROM instagram_posts p WHERE p.user_id = u.id) >= $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			user_json = EXCLUDED.user_json,
+			tagged_usernames = EXCLUDED.tagged_usernames,
+			coauthored_usernames = EXCLUDED.coauthored_usernames,
+			total_posted_count = EXCLUDED.total_posted_count,
+			total_tagged_in_count = EXCLUDED.total_tagged_in_count,
+			total_coauthored_count = EXCLUDED.total_coauthored_count,
+			engagement_rate = EXCLUDED.engagement_rate,
+			average_posts_per_week = EXCLUDED.average_posts_per_week,
+			refreshed_at = EXCLUDED.refreshed_at
+	`
+
+	result, err := tx.ExecContext(ctx, query, minPosts,
+		DefaultStatsOptions.TaggedLimit, DefaultStatsOptions.CoauthoredLimit, DefaultStatsOptions.EngagementWindowDays)
+	if err != nil {
+		return 0, fmt.Errorf("failed to refresh stats cache: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	refreshed, _ := result.RowsAffected()
+	setRows(span, int(refreshed))
+	RecordAudit(ctx, "refresh_stats_cache", "user_stats_cache", map[string]interface{}{"refreshed": refreshed, "min_posts": minPosts})
+	log.Info().Int64("count", refreshed).Int("min_posts", minPosts).Msg("refreshed user stats cache")
+	return refreshed, nil
+}
+
+// StartStatsCacheRefresher refreshes the stats cache every interval until
+// ctx is cancelled
+func StartStatsCacheRefresher(ctx context.Context, interval time.Duration, minPosts int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := RefreshUserStatsCache(ctx, minPosts); err != nil {
+				log.Error().Err(err).Msg("stats cache refresh failed")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
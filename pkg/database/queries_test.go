@@ -0,0 +1,828 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/database/dbtest"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopUsersByEngagementBindsWindow(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnRows("WITH recent AS", nil)
+
+	if _, err := GetTopUsersByEngagement(context.Background(), 10, 0, 7); err != nil {
+		t.Fatalf("GetTopUsersByEngagement: %v", err)
+	}
+	calls := fake.Calls("WITH recent AS")
+	if len(calls) != 1 {
+		t.Fatalf("ran %d queries, want 1", len(calls))
+	}
+	if got := calls[0].Args[2]; got != int64(7) {
+		t.Errorf("window bound as %v, want 7", got)
+	}
+}
+
+func TestTopUsersByEngagementWindows(t *testing.T) {
+	usePostgres(t)
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, followers) VALUES
+			('1', 'alice', 100), ('2', 'bob', 1000), ('3', 'carol', 50)`,
+		`INSERT INTO instagram_posts (id, user_id, username, like_count, comment_count, posted_at) VALUES
+			('a1', '1', 'alice', 8, 2, NOW() - INTERVAL '3 days'),
+			('a2', '1', 'alice', 900, 100, NOW() - INTERVAL '60 days'),
+			('b1', '2', 'bob', 500, 0, NOW() - INTERVAL '20 days'),
+			('c1', '3', 'carol', 100, 0, NOW() - INTERVAL '200 days')`,
+	)
+
+	type ranked struct {
+		username string
+		rate     float64
+		posts    int
+	}
+	tests := []struct {
+		days int
+		want []ranked
+	}{
+		{7, []ranked{{"alice", 10, 1}}},
+		{30, []ranked{{"bob", 50, 1}, {"alice", 10, 1}}},
+		{90, []ranked{{"alice", 505, 2}, {"bob", 50, 1}}},
+		{365, []ranked{{"alice", 505, 2}, {"carol", 200, 1}, {"bob", 50, 1}}},
+	}
+	for _, tt := range tests {
+		got, err := GetTopUsersByEngagement(context.Background(), 10, 0, tt.days)
+		if err != nil {
+			t.Fatalf("window %d: %v", tt.days, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("window %d: ranked %d users, want %d", tt.days, len(got), len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			entry := got[i]
+			if entry.User.Username != want.username || math.Abs(entry.EngagementRate-want.rate) > 1e-9 || entry.RecentPosts != want.posts {
+				t.Errorf("window %d rank %d = %s rate %v posts %d, want %s rate %v posts %d", tt.days, i+1,
+					entry.User.Username, entry.EngagementRate, entry.RecentPosts, want.username, want.rate, want.posts)
+			}
+		}
+	}
+}
+
+func TestTopUsersByEngagementRanking(t *testing.T) {
+	usePostgres(t)
+	// Rates: alice 20%, bob and carol 10% with carol more followed, dave
+	// and erin 10% with equal followers, frank below the follower floor and
+	// gina without followers
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, followers) VALUES
+			('1', 'alice', 100), ('2', 'bob', 200), ('3', 'carol', 400),
+			('5', 'erin', 200), ('4', 'dave', 200), ('6', 'frank', 10), ('7', 'gina', 0)`,
+		`INSERT INTO instagram_posts (id, user_id, username, like_count, comment_count, posted_at) VALUES
+			('a1', '1', 'alice', 15, 5, NOW() - INTERVAL '1 day'),
+			('b1', '2', 'bob', 10, 0, NOW() - INTERVAL '1 day'),
+			('b2', '2', 'bob', 30, 0, NOW() - INTERVAL '2 days'),
+			('c1', '3', 'carol', 40, 0, NOW() - INTERVAL '1 day'),
+			('d1', '4', 'dave', 20, 0, NOW() - INTERVAL '1 day'),
+			('e1', '5', 'erin', 20, 0, NOW() - INTERVAL '1 day'),
+			('f1', '6', 'frank', 100, 0, NOW() - INTERVAL '1 day'),
+			('g1', '7', 'gina', 100, 0, NOW() - INTERVAL '1 day')`,
+	)
+
+	tests := []struct {
+		limit        int
+		minFollowers int64
+		want         []string
+	}{
+		{10, 100, []string{"alice", "carol", "bob", "dave", "erin"}},
+		{2, 100, []string{"alice", "carol"}},
+		{10, 300, []string{"carol"}},
+		{10, 0, []string{"frank", "alice", "carol", "bob", "dave", "erin"}},
+	}
+	for _, tt := range tests {
+		got, err := GetTopUsersByEngagement(context.Background(), tt.limit, tt.minFollowers, 30)
+		if err != nil {
+			t.Fatalf("GetTopUsersByEngagement: %v", err)
+		}
+		var usernames []string
+		for _, entry := range got {
+			usernames = append(usernames, entry.User.Username)
+		}
+		if strings.Join(usernames, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("limit %d min followers %d ranked %v, want %v", tt.limit, tt.minFollowers, usernames, tt.want)
+		}
+	}
+}
+
+func TestDeleteUserAuditsOnlyTheID(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnExec("DELETE FROM instagram_assets", 1)
+	fake.OnExec("DELETE FROM instagram_posts", 2)
+	fake.OnExec("DELETE FROM instagram_users", 1)
+	fake.OnExec("UPDATE audit_log", 3)
+	fake.OnExec("INSERT INTO audit_log", 1)
+
+	if err := DeleteUser(context.Background(), "42"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	scrubs := fake.Calls("UPDATE audit_log")
+	if len(scrubs) != 1 || scrubs[0].Args[0] != "42" {
+		t.Errorf("audit scrubs = %v, want one for user 42", scrubs)
+	}
+	audits := fake.Calls("INSERT INTO audit_log")
+	if len(audits) != 1 {
+		t.Fatalf("recorded %d audit entries, want 1", len(audits))
+	}
+	if target := audits[0].Args[2]; target != "42" {
+		t.Errorf("audit target = %v, want 42", target)
+	}
+	if details := string(audits[0].Args[3].([]byte)); details != `{"deleted_posts":2}` {
+		t.Errorf("audit details = %s, want only the deleted post count", details)
+	}
+}
+
+func TestDeleteUserNotFound(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnExec("DELETE FROM", 0)
+
+	if err := DeleteUser(context.Background(), "42"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("DeleteUser error = %v, want sql.ErrNoRows", err)
+	}
+	if n := len(fake.Calls("audit_log")); n != 0 {
+		t.Errorf("touched the audit log %d times for a missing user", n)
+	}
+}
+
+func TestDeleteUserLeavesNoUsername(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, followers) VALUES ('1', 'alice', 100), ('2', 'bob', 100)`,
+		`INSERT INTO instagram_posts (id, user_id, username) VALUES ('p1', '1', 'alice'), ('p2', '2', 'bob')`,
+		`INSERT INTO instagram_assets (id, post_id, asset_type, url) VALUES ('a1', 'p1', 'image', 'https://example.com/a1')`,
+		`INSERT INTO username_history (username, user_id) VALUES ('alice', '1'), ('alice_old', '1'), ('bob', '2')`,
+	)
+	RecordAudit(ctx, "upsert_user", "1", map[string]interface{}{"username": "alice", "inserted": true})
+	RecordAudit(ctx, "username_collision", "3", map[string]interface{}{
+		"username": "alice", "stale_username": "alice#3", "claiming_id": "1",
+	})
+	RecordAudit(ctx, "upsert_user", "2", map[string]interface{}{"username": "bob", "inserted": true})
+
+	if err := DeleteUser(ctx, "1"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if err := DeleteUser(ctx, "1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second DeleteUser error = %v, want sql.ErrNoRows", err)
+	}
+
+	for query, want := range map[string]int{
+		`SELECT COUNT(*) FROM instagram_users WHERE id = '1'`:                             0,
+		`SELECT COUNT(*) FROM instagram_posts WHERE user_id = '1'`:                        0,
+		`SELECT COUNT(*) FROM instagram_assets`:                                           0,
+		`SELECT COUNT(*) FROM username_history WHERE user_id = '1'`:                       0,
+		`SELECT COUNT(*) FROM audit_log WHERE details::text LIKE '%alice%'`:               0,
+		`SELECT COUNT(*) FROM audit_log WHERE operation = 'delete_user' AND target = '1'`: 1,
+		`SELECT COUNT(*) FROM audit_log WHERE details->>'username' = 'bob'`:               1,
+		`SELECT COUNT(*) FROM username_history WHERE user_id = '2'`:                       1,
+	} {
+		var got int
+		if err := DB.QueryRowContext(ctx, query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if got != want {
+			t.Errorf("%s = %d, want %d", query, got, want)
+		}
+	}
+}
+
+var statsColumnNames = []string{
+	"user", "tagged_usernames", "coauthored_usernames", "total_posted_count",
+	"total_tagged_in_count", "total_coauthored_count", "engagement_rate", "average_posts_per_week",
+}
+
+func TestGetUserStatsPrefersCacheForDefaultOptions(t *testing.T) {
+	fake := useFakeDB(t)
+	refreshedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	fake.On("FROM user_stats_cache", func(args []driver.Value) dbtest.Result {
+		if args[0] != "heavy" {
+			return dbtest.Result{Columns: append(statsColumnNames, "refreshed_at")}
+		}
+		return dbtest.Result{
+			Columns: append(statsColumnNames, "refreshed_at"),
+			Rows:    [][]driver.Value{{[]byte(`{"id":"heavy"}`), []byte(`[]`), []byte(`[]`), int64(5000), int64(0), int64(0), 1.5, 7.0, refreshedAt}},
+		}
+	})
+	fake.OnRows("WHERE u.id = $1", statsColumnNames,
+		[]driver.Value{[]byte(`{"id":"live"}`), []byte(`[]`), []byte(`[]`), int64(3), int64(0), int64(0), 2.5, 1.0})
+
+	tests := []struct {
+		name      string
+		userID    string
+		opts      StatsOptions
+		wantCache bool
+	}{
+		{"cached user", "heavy", DefaultStatsOptions, true},
+		{"uncached user", "light", DefaultStatsOptions, false},
+		{"custom options", "heavy", StatsOptions{TaggedLimit: 5, CoauthoredLimit: 5, EngagementWindowDays: 7}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(fake.Calls("WHERE u.id = $1"))
+			stats, err := GetUserStats(context.Background(), tt.userID, tt.opts)
+			if err != nil {
+				t.Fatalf("GetUserStats: %v", err)
+			}
+			live := len(fake.Calls("WHERE u.id = $1")) > before
+
+			if tt.wantCache {
+				if live || stats.CachedAt == nil || !stats.CachedAt.Equal(refreshedAt) || stats.TotalPostedCount != 5000 {
+					t.Errorf("stats = %+v (live query %v), want the cached row", stats, live)
+				}
+				return
+			}
+			if !live || stats.CachedAt != nil || stats.EngagementWindowDays != tt.opts.EngagementWindowDays {
+				t.Errorf("stats = %+v (live query %v), want the live query", stats, live)
+			}
+		})
+	}
+}
+
+func TestStatsCacheRefreshThreshold(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, followers) VALUES ('1', 'heavy', 100), ('2', 'light', 100)`,
+		`INSERT INTO instagram_posts (id, user_id, username, like_count) VALUES
+			('h1', '1', 'heavy', 10), ('h2', '1', 'heavy', 10), ('h3', '1', 'heavy', 10),
+			('l1', '2', 'light', 10)`,
+	)
+
+	refreshed, err := RefreshUserStatsCache(ctx, 2)
+	if err != nil {
+		t.Fatalf("RefreshUserStatsCache: %v", err)
+	}
+	if refreshed != 1 {
+		t.Errorf("refreshed %d users, want 1", refreshed)
+	}
+
+	heavy, err := GetUserStats(ctx, "1", DefaultStatsOptions)
+	if err != nil {
+		t.Fatalf("GetUserStats(heavy): %v", err)
+	}
+	if heavy.CachedAt == nil || heavy.TotalPostedCount != 3 {
+		t.Errorf("heavy user stats = %+v, want 3 posts from the cache", heavy)
+	}
+	light, err := GetUserStats(ctx, "2", DefaultStatsOptions)
+	if err != nil {
+		t.Fatalf("GetUserStats(light): %v", err)
+	}
+	if light.CachedAt != nil || light.TotalPostedCount != 1 {
+		t.Errorf("light user stats = %+v, want 1 post from the live query", light)
+	}
+
+	// Dropping below the threshold evicts the user on the next refresh
+	execAll(t, `DELETE FROM instagram_posts WHERE id IN ('h2', 'h3')`)
+	if _, err := RefreshUserStatsCache(ctx, 2); err != nil {
+		t.Fatalf("RefreshUserStatsCache: %v", err)
+	}
+	if _, err := getCachedUserStats(ctx, "1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("cached stats after eviction: %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestGetUserStatsWithoutPostsAgainstPostgres(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+	// newbie and nobody have no posts, nobody no followers either, and
+	// lapsed's only post is outside the engagement window
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, followers) VALUES
+			('1', 'newbie', 100), ('2', 'nobody', 0), ('3', 'lapsed', 100)`,
+		`INSERT INTO instagram_posts (id, user_id, username, like_count, comment_count, posted_at) VALUES
+			('l1', '3', 'lapsed', 50, 5, NOW() - INTERVAL '90 days')`,
+	)
+
+	for _, opts := range []StatsOptions{DefaultStatsOptions, {TaggedLimit: 5, CoauthoredLimit: 5, EngagementWindowDays: 7}} {
+		for _, id := range []string{"1", "2"} {
+			stats, err := GetUserStats(ctx, id, opts)
+			if err != nil {
+				t.Fatalf("GetUserStats(%s, %+v): %v", id, opts, err)
+			}
+			if string(stats.TaggedUsernames) != "[]" || string(stats.CoauthoredUsernames) != "[]" {
+				t.Errorf("user %s lists = %s and %s, want empty", id, stats.TaggedUsernames, stats.CoauthoredUsernames)
+			}
+			if stats.TotalPostedCount != 0 || stats.TotalTaggedInCount != 0 || stats.TotalCoauthoredCount != 0 ||
+				stats.EngagementRate != 0 || stats.AveragePostsPerWeek != 0 {
+				t.Errorf("user %s stats = %+v, want zeros", id, stats)
+			}
+		}
+
+		lapsed, err := GetUserStats(ctx, "3", opts)
+		if err != nil {
+			t.Fatalf("GetUserStats(lapsed, %+v): %v", opts, err)
+		}
+		if lapsed.TotalPostedCount != 1 || lapsed.EngagementRate != 0 {
+			t.Errorf("lapsed stats = %+v, want 1 post and no engagement in the window", lapsed)
+		}
+	}
+}
+
+func TestGetUserStatsListLimits(t *testing.T) {
+	usePostgres(t)
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, followers) VALUES ('1', 'alice', 100)`,
+		`INSERT INTO instagram_posts (id, user_id, username) VALUES
+			('p1', '1', 'alice'), ('p2', '1', 'bob'), ('p3', '1', 'carol'), ('p4', '1', 'dave')`,
+		`INSERT INTO instagram_assets (id, post_id, asset_type, url, tagged_user_usernames) VALUES
+			('a1', 'p1', 'image', 'https://example.com/a1', ARRAY['t1', 't2', 't3', 't4', 't5'])`,
+	)
+
+	tests := []struct {
+		tagged, coauthored int
+	}{
+		{2, 3},
+		{3, 2},
+		{1, 4},
+		{5, 1},
+	}
+	for _, tt := range tests {
+		opts := StatsOptions{TaggedLimit: tt.tagged, CoauthoredLimit: tt.coauthored, EngagementWindowDays: 30}
+		stats, err := GetUserStats(context.Background(), "1", opts)
+		if err != nil {
+			t.Fatalf("GetUserStats(%+v): %v", opts, err)
+		}
+
+		var tagged, coauthored []json.RawMessage
+		if err := json.Unmarshal(stats.TaggedUsernames, &tagged); err != nil {
+			t.Fatalf("tagged usernames %s: %v", stats.TaggedUsernames, err)
+		}
+		if err := json.Unmarshal(stats.CoauthoredUsernames, &coauthored); err != nil {
+			t.Fatalf("coauthored usernames %s: %v", stats.CoauthoredUsernames, err)
+		}
+		if len(tagged) != tt.tagged || len(coauthored) != tt.coauthored {
+			t.Errorf("limits %d/%d returned %d tagged and %d coauthored", tt.tagged, tt.coauthored, len(tagged), len(coauthored))
+		}
+	}
+}
+
+func TestListUsersRejectsUnknownSort(t *testing.T) {
+	fake := useFakeDB(t)
+
+	for _, sort := range []string{"", "id", "followers; DROP TABLE instagram_users", "followers DESC"} {
+		if _, _, err := ListUsers(context.Background(), 10, 0, sort); !errors.Is(err, ErrInvalidSort) {
+			t.Errorf("ListUsers(sort %q) error = %v, want ErrInvalidSort", sort, err)
+		}
+	}
+	if calls := fake.Calls(""); len(calls) != 0 {
+		t.Errorf("ran %d queries for invalid sorts", len(calls))
+	}
+}
+
+func TestListUsersPages(t *testing.T) {
+	usePostgres(t)
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, followers, posts, created_at) VALUES
+			('1', 'dave', 300, 5, NOW() - INTERVAL '4 days'),
+			('2', 'alice', 100, 50, NOW() - INTERVAL '3 days'),
+			('3', 'carol', 300, 20, NOW() - INTERVAL '2 days'),
+			('4', 'bob', 200, 10, NOW() - INTERVAL '1 day'),
+			('5', 'erin', 50, 1, NOW())`,
+	)
+
+	tests := []struct {
+		sort string
+		want []string // ids in order
+	}{
+		// Equal follower counts fall back to id
+		{"followers", []string{"1", "3", "4", "2", "5"}},
+		{"posts", []string{"2", "3", "4", "1", "5"}},
+		{"username", []string{"2", "4", "3", "1", "5"}},
+		{"created_at", []string{"5", "4", "3", "2", "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			// Pages of two walk the full order with the same total
+			var got []string
+			for offset := 0; offset < 6; offset += 2 {
+				users, total, err := ListUsers(context.Background(), 2, offset, tt.sort)
+				if err != nil {
+					t.Fatalf("ListUsers(offset %d): %v", offset, err)
+				}
+				if total != 5 {
+					t.Errorf("total at offset %d = %d, want 5", offset, total)
+				}
+				for _, user := range users {
+					got = append(got, user.ID)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// txEnds returns the COMMIT and ROLLBACK calls recorded by fake, leaving
+// out savepoint rollbacks
+func txEnds(fake *dbtest.DB) []string {
+	var ends []string
+	for _, call := range fake.Calls("") {
+		if call.Query == "COMMIT" || call.Query == "ROLLBACK" {
+			ends = append(ends, call.Query)
+		}
+	}
+	return ends
+}
+
+func TestBatchUpsertUsersCancelledMidLoopRollsBack(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnExec("SAVEPOINT", 0)
+	fake.OnRows("SET username = $1 || '#' || id", []string{"id"})
+	fake.OnExec("INSERT INTO username_history", 1)
+	fake.OnExec("INSERT INTO audit_log", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var written int
+	fake.On("INSERT INTO instagram_users", func([]driver.Value) dbtest.Result {
+		// The client goes away while the second user is written
+		if written++; written == 2 {
+			cancel()
+		}
+		return dbtest.Result{Columns: []string{"inserted"}, Rows: [][]driver.Value{{true}}}
+	})
+
+	var users []*User
+	for i, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		users = append(users, &User{ID: strconv.Itoa(i + 1), Username: username, ScrapedAt: time.Now()})
+	}
+	err := BatchUpsertUsers(ctx, users)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("BatchUpsertUsers error = %v, want context.Canceled", err)
+	}
+	if written > 2 {
+		t.Errorf("wrote %d users after cancellation, want the loop to stop", written)
+	}
+	if ends := txEnds(fake); len(ends) != 1 || ends[0] != "ROLLBACK" {
+		t.Errorf("transaction ended with %v, want a single ROLLBACK", ends)
+	}
+	if audits := fake.Calls("INSERT INTO audit_log"); len(audits) != 0 {
+		t.Errorf("recorded %d audit entries for a rolled back batch", len(audits))
+	}
+}
+
+func TestBatchUpsertUsersCommits(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnExec("SAVEPOINT", 0)
+	fake.OnRows("SET username = $1 || '#' || id", []string{"id"})
+	fake.OnRows("INSERT INTO instagram_users", []string{"inserted"}, []driver.Value{true})
+	fake.OnExec("INSERT INTO username_history", 1)
+	fake.OnExec("INSERT INTO audit_log", 1)
+
+	users := []*User{
+		{ID: "1", Username: "alice", ScrapedAt: time.Now()},
+		{ID: "2", Username: "bob", ScrapedAt: time.Now()},
+	}
+	if err := BatchUpsertUsers(context.Background(), users); err != nil {
+		t.Fatalf("BatchUpsertUsers: %v", err)
+	}
+	if ends := txEnds(fake); len(ends) != 1 || ends[0] != "COMMIT" {
+		t.Errorf("transaction ended with %v, want a single COMMIT", ends)
+	}
+}
+
+var postColumnNames = []string{
+	"id", "user_id", "username", "caption", "like_count", "comment_count",
+	"play_count", "is_ad", "posted_at", "created_at", "updated_at",
+}
+
+func TestGetPostsByUserScansNullablePlayCount(t *testing.T) {
+	fake := useFakeDB(t)
+	now := time.Now()
+	fake.OnRows("FROM instagram_posts", postColumnNames,
+		[]driver.Value{"p2", "1", "alice", "a reel", int64(10), int64(2), int64(900), false, now, now, now},
+		[]driver.Value{"p1", "1", "alice", nil, int64(5), int64(0), nil, false, now.Add(-time.Hour), now, now},
+	)
+
+	posts, err := GetPostsByUser(context.Background(), "1", 20, 40)
+	if err != nil {
+		t.Fatalf("GetPostsByUser: %v", err)
+	}
+	if len(posts) != 2 {
+		t.Fatalf("got %d posts, want 2", len(posts))
+	}
+	if posts[0].PlayCount == nil || *posts[0].PlayCount != 900 {
+		t.Errorf("reel play count = %v, want 900", posts[0].PlayCount)
+	}
+	if posts[1].PlayCount != nil || posts[1].Caption.Valid {
+		t.Errorf("photo play count = %v, caption %v, want both null", posts[1].PlayCount, posts[1].Caption)
+	}
+
+	calls := fake.Calls("FROM instagram_posts")
+	if args := calls[0].Args; args[0] != "1" || args[1] != int64(20) || args[2] != int64(40) {
+		t.Errorf("query args = %v, want user 1, limit 20, offset 40", args)
+	}
+}
+
+func TestGetPostsByUserWithoutPostsIsEmpty(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnRows("FROM instagram_posts", postColumnNames)
+
+	posts, err := GetPostsByUser(context.Background(), "1", 20, 0)
+	if err != nil || posts == nil || len(posts) != 0 {
+		t.Errorf("GetPostsByUser = %v, %v, want an empty non-nil slice", posts, err)
+	}
+}
+
+func TestGetPostsByUserPagination(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+	execAll(t,
+		`INSERT INTO instagram_users (id, username) VALUES ('1', 'alice'), ('2', 'bob')`,
+		`INSERT INTO instagram_posts (id, user_id, username, play_count, posted_at) VALUES
+			('a', '1', 'alice', 100, NOW() - INTERVAL '1 day'),
+			('b', '1', 'alice', NULL, NOW() - INTERVAL '2 days'),
+			('c', '1', 'alice', NULL, NOW() - INTERVAL '3 days'),
+			('d', '1', 'alice', 7, NOW() - INTERVAL '4 days'),
+			('e', '1', 'alice', NULL, NOW() - INTERVAL '5 days'),
+			('x', '2', 'bob', NULL, NOW())`,
+	)
+
+	var ids []string
+	for offset := 0; offset < 6; offset += 2 {
+		page, err := GetPostsByUser(ctx, "1", 2, offset)
+		if err != nil {
+			t.Fatalf("GetPostsByUser(offset %d): %v", offset, err)
+		}
+		for _, post := range page {
+			ids = append(ids, post.ID)
+			if (post.PlayCount != nil) != (post.ID == "a" || post.ID == "d") {
+				t.Errorf("post %s play count = %v", post.ID, post.PlayCount)
+			}
+		}
+	}
+	if got := strings.Join(ids, ","); got != "a,b,c,d,e" {
+		t.Errorf("paged posts = %s, want a,b,c,d,e newest first", got)
+	}
+	if total, err := CountPostsByUser(ctx, "1"); err != nil || total != 5 {
+		t.Errorf("CountPostsByUser = %d, %v, want 5", total, err)
+	}
+}
+
+func TestTaggedAndCoauthoredUsernamesPaging(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+	// Authors: alice 3 posts, bob and carol 2, dave 1. Tags: zed in 3
+	// posts, amy and bea in 2, cat in 1. bob's own post tagging zed isn't
+	// alice's.
+	execAll(t,
+		`INSERT INTO instagram_users (id, username) VALUES ('1', 'alice'), ('2', 'bob')`,
+		`INSERT INTO instagram_posts (id, user_id, username, like_count) VALUES
+			('p1', '1', 'alice', 10), ('p2', '1', 'alice', 10), ('p3', '1', 'alice', 10),
+			('p4', '1', 'carol', 5), ('p5', '1', 'bob', 5), ('p6', '1', 'carol', 5),
+			('p7', '1', 'bob', 5), ('p8', '1', 'dave', 1), ('x1', '2', 'bob', 99)`,
+		`INSERT INTO instagram_assets (id, post_id, asset_type, url, tagged_user_usernames) VALUES
+			('a1', 'p1', 'image', 'https://example.com/a1', ARRAY['zed', 'amy']),
+			('a2', 'p2', 'image', 'https://example.com/a2', ARRAY['zed', 'bea']),
+			('a3', 'p3', 'image', 'https://example.com/a3', ARRAY['bea', 'zed', 'amy']),
+			('a4', 'p4', 'image', 'https://example.com/a4', ARRAY['cat']),
+			('x1', 'x1', 'image', 'https://example.com/x1', ARRAY['zed'])`,
+	)
+
+	var tagged []string
+	for offset := 0; offset < 6; offset += 2 {
+		page, err := GetTaggedUsernames(ctx, "1", 2, offset)
+		if err != nil {
+			t.Fatalf("GetTaggedUsernames(offset %d): %v", offset, err)
+		}
+		for _, entry := range page {
+			tagged = append(tagged, fmt.Sprintf("%s:%d", entry.Username, entry.Count))
+		}
+	}
+	if got := strings.Join(tagged, ","); got != "zed:3,amy:2,bea:2,cat:1" {
+		t.Errorf("paged tagged usernames = %s, want most tagged first, ties by name", got)
+	}
+
+	var coauthored []string
+	for offset := 0; offset < 6; offset += 2 {
+		page, err := GetCoauthoredUsernames(ctx, "1", 2, offset)
+		if err != nil {
+			t.Fatalf("GetCoauthoredUsernames(offset %d): %v", offset, err)
+		}
+		for _, entry := range page {
+			coauthored = append(coauthored, fmt.Sprintf("%s:%d", entry.Collaborator, entry.CollaborationCount))
+		}
+	}
+	if got := strings.Join(coauthored, ","); got != "alice:3,bob:2,carol:2,dave:1" {
+		t.Errorf("paged coauthored usernames = %s, want most posts first, ties by name", got)
+	}
+
+	if total, err := CountTaggedUsernames(ctx, "1"); err != nil || total != 4 {
+		t.Errorf("CountTaggedUsernames = %d, %v, want 4", total, err)
+	}
+	if total, err := CountCoauthoredUsernames(ctx, "1"); err != nil || total != 4 {
+		t.Errorf("CountCoauthoredUsernames = %d, %v, want 4", total, err)
+	}
+
+	// The combined stats still embed the top of each list
+	stats, err := GetUserStats(ctx, "1", DefaultStatsOptions)
+	if err != nil {
+		t.Fatalf("GetUserStats: %v", err)
+	}
+	var inlineTagged []TaggedUsername
+	var inlineCoauthored []CoauthoredUsername
+	if err := json.Unmarshal(stats.TaggedUsernames, &inlineTagged); err != nil || len(inlineTagged) != 4 || inlineTagged[0].Username != "zed" {
+		t.Errorf("inline tagged usernames = %s, %v, want all 4 led by zed", stats.TaggedUsernames, err)
+	}
+	if err := json.Unmarshal(stats.CoauthoredUsernames, &inlineCoauthored); err != nil || len(inlineCoauthored) != 4 || inlineCoauthored[0].Collaborator != "alice" {
+		t.Errorf("inline coauthored usernames = %s, %v, want all 4 led by alice", stats.CoauthoredUsernames, err)
+	}
+}
+
+func TestGetTaggedAndCoauthoredUsernamesBindPage(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnRows("GROUP BY t.username", []string{"username", "count", "total_likes", "total_comments", "total_plays"},
+		[]driver.Value{"zed", int64(3), int64(30), int64(3), int64(0)})
+	fake.OnRows("GROUP BY p.username", []string{"username", "collaboration_count", "total_likes", "total_comments"})
+	ctx := context.Background()
+
+	tagged, err := GetTaggedUsernames(ctx, "1", 20, 40)
+	if err != nil || len(tagged) != 1 || tagged[0].Username != "zed" || tagged[0].TotalLikes != 30 {
+		t.Errorf("GetTaggedUsernames = %v, %v, want zed with 30 likes", tagged, err)
+	}
+	coauthored, err := GetCoauthoredUsernames(ctx, "1", 20, 40)
+	if err != nil || coauthored == nil || len(coauthored) != 0 {
+		t.Errorf("GetCoauthoredUsernames = %v, %v, want an empty non-nil slice", coauthored, err)
+	}
+
+	for _, query := range []string{"GROUP BY t.username", "GROUP BY p.username"} {
+		calls := fake.Calls(query)
+		if len(calls) != 1 {
+			t.Fatalf("%s ran %d times, want 1", query, len(calls))
+		}
+		if args := calls[0].Args; args[0] != "1" || args[1] != int64(20) || args[2] != int64(40) {
+			t.Errorf("%s args = %v, want user 1, limit 20, offset 40", query, args)
+		}
+	}
+}
+
+func TestGetUsersByUsernamesPartialHits(t *testing.T) {
+	usePostgres(t)
+	execAll(t, `INSERT INTO instagram_users (id, username) VALUES ('1', 'alice'), ('2', 'bob'), ('3', 'carol')`)
+
+	users, err := GetUsersByUsernames(context.Background(), []string{"alice", "ghost", "carol"})
+	if err != nil {
+		t.Fatalf("GetUsersByUsernames: %v", err)
+	}
+	var ids []string
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "1,3" {
+		t.Errorf("found ids %v, want 1 and 3", ids)
+	}
+}
+
+func TestGetUsersByUsernamesBindsArray(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnRows("WHERE username = ANY($1)", nil)
+
+	users, err := GetUsersByUsernames(context.Background(), []string{"alice", "bob"})
+	if err != nil || users == nil || len(users) != 0 {
+		t.Fatalf("GetUsersByUsernames = %v, %v, want an empty non-nil slice", users, err)
+	}
+	calls := fake.Calls("WHERE username = ANY($1)")
+	if len(calls) != 1 || len(calls[0].Args) != 1 {
+		t.Fatalf("lookups = %v, want one query with a single array argument", calls)
+	}
+	if calls[0].Args[0] != `{"alice","bob"}` {
+		t.Errorf("usernames argument = %v, want the array {\"alice\",\"bob\"}", calls[0].Args[0])
+	}
+}
+
+func TestSearchUsersEscapesWildcards(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnRows("ILIKE $1", nil)
+
+	for q, want := range map[string]string{
+		"ali":     "%ali%",
+		"a_b":     `%a\_b%`,
+		"100%":    `%100\%%`,
+		`back\sl`: `%back\\sl%`,
+	} {
+		if _, err := SearchUsers(context.Background(), q, 10); err != nil {
+			t.Fatalf("SearchUsers(%q): %v", q, err)
+		}
+		calls := fake.Calls("ILIKE $1")
+		if args := calls[len(calls)-1].Args; args[0] != want || args[1] != int64(10) {
+			t.Errorf("SearchUsers(%q) args = %v, want pattern %q and limit 10", q, args, want)
+		}
+	}
+}
+
+func TestSearchUsersMatches(t *testing.T) {
+	usePostgres(t)
+	execAll(t,
+		`INSERT INTO instagram_users (id, username, full_name, followers) VALUES
+			('1', 'alice', 'Alice Smith', 100),
+			('2', 'malice', NULL, 500),
+			('3', 'bob', 'Bob Alison', 300),
+			('4', 'a_b', NULL, 10),
+			('5', 'axb', NULL, 20),
+			('6', 'carol', '100% Carol', 5),
+			('7', 'dave', '1000 Dave', 50)`,
+	)
+
+	tests := []struct {
+		q     string
+		limit int
+		want  []string // ids, most followed first
+	}{
+		{"ali", 10, []string{"2", "3", "1"}}, // substring of usernames and full names
+		{"ALICE", 10, []string{"2", "1"}},    // case-insensitive
+		{"mal", 10, []string{"2"}},           // prefix
+		{"ali", 2, []string{"2", "3"}},
+		{"a_b", 10, []string{"4"}},  // _ matches only itself
+		{"100%", 10, []string{"6"}}, // so does %
+		{"zzz", 10, nil},
+	}
+	for _, tt := range tests {
+		users, err := SearchUsers(context.Background(), tt.q, tt.limit)
+		if err != nil {
+			t.Fatalf("SearchUsers(%q): %v", tt.q, err)
+		}
+		var got []string
+		for _, user := range users {
+			got = append(got, user.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("SearchUsers(%q, %d) = %v, want %v", tt.q, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestGetAggregateStatsAgainstPostgres(t *testing.T) {
+	usePostgres(t)
+	ctx := context.Background()
+
+	// An empty table reports zeros rather than scanning NULL aggregates
+	stats, err := GetAggregateStats(ctx)
+	if err != nil {
+		t.Fatalf("GetAggregateStats on an empty table: %v", err)
+	}
+	if *stats != (AggregateStats{}) {
+		t.Errorf("empty table stats = %+v, want zeros", stats)
+	}
+
+	execAll(t, `
+		INSERT INTO instagram_users (id, username, is_verified, is_business_account, is_private, followers, scraped_at) VALUES
+			('1', 'alice', true,  false, false, 1000, NOW()),
+			('2', 'bob',   true,  true,  false, 200,  NOW()),
+			('3', 'carol', false, true,  true,  50,   NOW()),
+			('4', 'dave',  false, false, true,  0,    NOW())`)
+
+	stats, err = GetAggregateStats(ctx)
+	if err != nil {
+		t.Fatalf("GetAggregateStats: %v", err)
+	}
+	want := AggregateStats{
+		TotalUsers:     4,
+		VerifiedUsers:  2,
+		BusinessUsers:  2,
+		PrivateUsers:   2,
+		TotalFollowers: 1250,
+		MaxFollowers:   1000,
+		AvgFollowers:   312.5,
+	}
+	if *stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestGetAggregateStatsSingleQuery(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnRows("FROM instagram_users", []string{"count", "verified", "business", "private", "sum", "max", "avg"},
+		[]driver.Value{int64(4), int64(2), int64(2), int64(1), int64(1250), int64(1000), 312.5})
+
+	stats, err := GetAggregateStats(context.Background())
+	if err != nil {
+		t.Fatalf("GetAggregateStats: %v", err)
+	}
+	if stats.TotalUsers != 4 || stats.PrivateUsers != 1 || stats.AvgFollowers != 312.5 {
+		t.Errorf("stats = %+v, want the scanned row", stats)
+	}
+	if n := len(fake.Calls("FROM instagram_users")); n != 1 {
+		t.Errorf("ran %d queries, want 1", n)
+	}
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	retryAttempts  = 3
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = time.Second
+)
+
+// withRetry runs fn, retrying with a short capped backoff while it fails
+// with a connection-level error, e.g. while Postgres restarts. Other errors,
+// including sql.ErrNoRows, are returned as is. fn must be safe to repeat.
+func withRetry(ctx context.Context, fn func() error) error {
+	delay := retryBaseDelay
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || !isConnectionError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("retry_delay", delay).Msg("database connection error, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// isConnectionError reports whether err means the database connection was
+// lost or couldn't be established, rather than that the query failed
+func isConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is connection_exception; admin_shutdown, crash_shutdown
+		// and cannot_connect_now are sent while the server restarts
+		switch pqErr.Code {
+		case "57P01", "57P02", "57P03":
+			return true
+		}
+		return pqErr.Code.Class() == "08"
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// healthy is 1 while the last health check succeeded
+var healthy int32 = 1
+
+// StartHealthMonitor pings the database every interval until ctx is done,
+// logging when the connection is lost and when it recovers. The pool
+// replaces broken connections on its own; the monitor makes the outage
+// visible.
+func StartHealthMonitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			err := DB.PingContext(pingCtx)
+			cancel()
+
+			switch {
+			case err != nil && atomic.CompareAndSwapInt32(&healthy, 1, 0):
+				log.Error().Err(err).Msg("database connection lost")
+			case err == nil && atomic.CompareAndSwapInt32(&healthy, 0, 1):
+				log.Info().Msg("database connection recovered")
+			}
+		}
+	}()
+}
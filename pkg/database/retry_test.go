@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/database/dbtest"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{driver.ErrBadConn, true},
+		{io.EOF, true},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{syscall.ECONNRESET, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, true},
+		{&pq.Error{Code: "08006"}, true},  // connection_failure
+		{&pq.Error{Code: "57P01"}, true},  // admin_shutdown
+		{&pq.Error{Code: "57P03"}, true},  // cannot_connect_now
+		{&pq.Error{Code: "57014"}, false}, // query_canceled
+		{&pq.Error{Code: "23505"}, false}, // unique_violation
+		{sql.ErrNoRows, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("syntax error"), false},
+	}
+	for _, tt := range tests {
+		if got := isConnectionError(tt.err); got != tt.want {
+			t.Errorf("isConnectionError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	errSyntax := errors.New("syntax error")
+	connLost := &pq.Error{Code: "57P01", Message: "terminating connection due to administrator command"}
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantErr   error
+		wantCalls int
+	}{
+		{"transient then success", 1, connLost, nil, 2},
+		{"gives up after the last attempt", retryAttempts, connLost, connLost, retryAttempts},
+		{"no rows isn't retried", 1, sql.ErrNoRows, sql.ErrNoRows, 1},
+		{"query error isn't retried", 1, errSyntax, errSyntax, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := withRetry(context.Background(), func() error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsWhenContextEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := withRetry(ctx, func() error {
+		calls++
+		cancel()
+		return driver.ErrBadConn
+	})
+	if !errors.Is(err, driver.ErrBadConn) || calls != 1 {
+		t.Errorf("withRetry = %v after %d calls, want the connection error after 1", err, calls)
+	}
+}
+
+func TestGetUserByUsernameRecoversFromLostConnection(t *testing.T) {
+	fake := useFakeDB(t)
+	var calls int32
+	now := time.Now()
+	fake.On("FROM instagram_users WHERE username = $1", func([]driver.Value) dbtest.Result {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return dbtest.Result{Err: &pq.Error{Code: "57P01", Message: "terminating connection"}}
+		}
+		return dbtest.Result{
+			Columns: []string{
+				"id", "username", "full_name", "biography", "is_verified",
+				"is_business_account", "is_professional_account", "is_private",
+				"category_name", "followers", "following", "posts", "profile_pic_url",
+				"profile_pic_storage_url", "scraped_at", "created_at", "updated_at",
+			},
+			Rows: [][]driver.Value{{"1", "alice", nil, nil, false, false, false, false, nil, int64(10), int64(0), int64(0), nil, nil, now, now, now}},
+		}
+	})
+
+	user, err := GetUserByUsername(context.Background(), "alice")
+	if err != nil || user.ID != "1" {
+		t.Fatalf("GetUserByUsername = %+v, %v, want user 1 after a retry", user, err)
+	}
+	if calls != 2 {
+		t.Errorf("queried %d times, want 2", calls)
+	}
+
+	// A missing user is reported at once
+	fake.OnRows("FROM instagram_users WHERE username = $1", nil)
+	before := len(fake.Calls("WHERE username = $1"))
+	if _, err := GetUserByUsername(context.Background(), "ghost"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("missing user error = %v, want sql.ErrNoRows", err)
+	}
+	if n := len(fake.Calls("WHERE username = $1")) - before; n != 1 {
+		t.Errorf("queried %d times for a missing user, want 1", n)
+	}
+}
+
+func TestHealthMonitorTracksOutageAndRecovery(t *testing.T) {
+	fake := useFakeDB(t)
+	t.Cleanup(func() { atomic.StoreInt32(&healthy, 1) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartHealthMonitor(ctx, 5*time.Millisecond)
+
+	waitHealthy := func(want int32) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&healthy) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("healthy = %d, want %d", atomic.LoadInt32(&healthy), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	fake.SetPingError(errors.New("connection refused"))
+	waitHealthy(0)
+	fake.SetPingError(nil)
+	waitHealthy(1)
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"instagram-user-processor/pkg/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("instagram-user-processor/pkg/database")
+
+// startSpan starts a client span named after the query function
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "db."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attribute.String("db.system", "postgresql"))...),
+	)
+}
+
+// endSpan ends a query span. sql.ErrNoRows only means nothing matched, so
+// it isn't recorded as a failure.
+func endSpan(span trace.Span, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	tracing.EndSpan(span, err)
+}
+
+// setRows records the number of rows a query returned or wrote
+func setRows(span trace.Span, n int) {
+	span.SetAttributes(attribute.Int("db.rows", n))
+}
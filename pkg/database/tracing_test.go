@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordQuerySpans points the package tracer at an in-memory recorder for
+// the duration of the test
+func recordQuerySpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	prev := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	t.Cleanup(func() { tracer = prev })
+	return recorder
+}
+
+func TestQueriesRecordSpans(t *testing.T) {
+	recorder := recordQuerySpans(t)
+
+	// Every query fails, which must still end its span as failed
+	useFakeDB(t)
+	ctx := context.Background()
+	calls := map[string]func(){
+		"db.GetAggregateStats":       func() { GetAggregateStats(ctx) },
+		"db.GetTopUsersByEngagement": func() { GetTopUsersByEngagement(ctx, 10, 0, 30) },
+		"db.CreateProcessingJob":     func() { CreateProcessingJob(ctx, 3, 2, nil) },
+		"db.UpdateProcessingJob":     func() { UpdateProcessingJob(ctx, &ProcessingJob{ID: "job"}) },
+		"db.GetProcessingJobStatus":  func() { GetProcessingJobStatus(ctx, "job") },
+		"db.RefreshUserStatsCache":   func() { RefreshUserStatsCache(ctx, 5) },
+		"db.getCachedUserStats":      func() { getCachedUserStats(ctx, "42") },
+		"db.GetRecentAuditEntries":   func() { GetRecentAuditEntries(ctx, 10) },
+	}
+
+	for name, call := range calls {
+		call()
+
+		ended := recorder.Ended()
+		var span sdktrace.ReadOnlySpan
+		for _, s := range ended {
+			if s.Name() == name {
+				span = s
+			}
+		}
+		if span == nil {
+			t.Errorf("%s: no span recorded", name)
+			continue
+		}
+		if span.SpanKind() != trace.SpanKindClient {
+			t.Errorf("%s: span kind = %v, want client", name, span.SpanKind())
+		}
+		if span.Status().Code != codes.Error {
+			t.Errorf("%s: span status = %v, want error", name, span.Status().Code)
+		}
+	}
+}
+
+func TestQuerySpanIsChildOfCaller(t *testing.T) {
+	recorder := recordQuerySpans(t)
+	fake := useFakeDB(t)
+	fake.OnRows("FROM audit_log", []string{"id", "actor", "operation", "target", "details", "created_at"})
+
+	ctx, parent := tracer.Start(context.Background(), "caller")
+	if _, err := GetRecentAuditEntries(ctx, 10); err != nil {
+		t.Fatalf("GetRecentAuditEntries: %v", err)
+	}
+	parent.End()
+
+	for _, span := range recorder.Ended() {
+		if span.Name() != "db.GetRecentAuditEntries" {
+			continue
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Error("query span is not a child of the caller's span")
+		}
+		if span.Status().Code == codes.Error {
+			t.Errorf("successful query span has status %v", span.Status())
+		}
+		return
+	}
+	t.Error("no db.GetRecentAuditEntries span recorded")
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// limitText sets the truncation limits for the duration of the test
+func limitText(t *testing.T, fullName, biography int) {
+	t.Helper()
+	prevName, prevBio := MaxFullNameRunes, MaxBiographyRunes
+	MaxFullNameRunes, MaxBiographyRunes = fullName, biography
+	t.Cleanup(func() { MaxFullNameRunes, MaxBiographyRunes = prevName, prevBio })
+}
+
+func TestTruncateFieldCountsRunes(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		max   int
+		want  string
+	}{
+		{"shorter", "abc", 5, "abc"},
+		{"exactly max", "abcde", 5, "abcde"},
+		{"ascii over", "abcdef", 5, "abcde"},
+		{"emoji at the boundary", "abcd😀😀", 5, "abcd😀"},
+		{"emoji only", "😀😀😀", 2, "😀😀"},
+		{"emoji straddling the byte limit", "a😀b", 2, "a😀"},
+		{"accented", "ééééé", 3, "ééé"},
+		{"zero disables", "abcdef", 0, "abcdef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &User{Username: "alice"}
+			field := sql.NullString{String: tt.value, Valid: true}
+			truncateField(user, "biography", &field, tt.max)
+			if field.String != tt.want {
+				t.Errorf("truncated to %q, want %q", field.String, tt.want)
+			}
+			if !utf8.ValidString(field.String) {
+				t.Errorf("truncated to invalid UTF-8 %q", field.String)
+			}
+		})
+	}
+
+	null := sql.NullString{}
+	truncateField(&User{}, "full_name", &null, 1)
+	if null.Valid {
+		t.Error("NULL field became valid")
+	}
+}
+
+// upsertedText returns the full_name and biography arguments of a user
+// insert
+func upsertedText(args []driver.Value) (string, string) {
+	name, _ := args[2].(string)
+	bio, _ := args[3].(string)
+	return name, bio
+}
+
+func TestUpsertTruncatesLongText(t *testing.T) {
+	limitText(t, 4, 6)
+	fake := fakeUpsert(t, "", true)
+
+	user := &User{
+		ID:        "1",
+		Username:  "alice",
+		FullName:  sql.NullString{String: "Ali😀ce", Valid: true},
+		Biography: sql.NullString{String: strings.Repeat("🌍", 10), Valid: true},
+		ScrapedAt: time.Now(),
+	}
+	if err := UpsertUser(context.Background(), user); err != nil {
+		t.Fatalf("UpsertUser: %v", err)
+	}
+
+	inserts := fake.Calls("INSERT INTO instagram_users")
+	if len(inserts) != 1 {
+		t.Fatalf("got %d inserts, want 1", len(inserts))
+	}
+	name, bio := upsertedText(inserts[0].Args)
+	if name != "Ali😀" || bio != strings.Repeat("🌍", 6) {
+		t.Errorf("stored full_name %q and biography %q, want them cut to 4 and 6 runes", name, bio)
+	}
+	if !utf8.ValidString(name) || !utf8.ValidString(bio) {
+		t.Error("stored invalid UTF-8")
+	}
+	// The caller's user matches what was stored
+	if user.FullName.String != name || user.Biography.String != bio {
+		t.Errorf("user left with %q and %q, want the stored text", user.FullName.String, user.Biography.String)
+	}
+}
+
+func TestBatchUpsertTruncatesLongText(t *testing.T) {
+	limitText(t, 3, 3)
+	fake := useFakeDB(t)
+	fake.OnExec("SAVEPOINT", 0)
+	fake.OnRows("SET username = $1 || '#' || id", []string{"id"})
+	fake.OnRows("INSERT INTO instagram_users", []string{"inserted"}, []driver.Value{true})
+	fake.OnExec("INSERT INTO username_history", 1)
+	fake.OnExec("INSERT INTO audit_log", 1)
+
+	users := []*User{
+		{ID: "1", Username: "alice", FullName: sql.NullString{String: "ab👩‍💻", Valid: true}, ScrapedAt: time.Now()},
+		{ID: "2", Username: "bob", Biography: sql.NullString{String: "hi", Valid: true}, ScrapedAt: time.Now()},
+	}
+	if err := BatchUpsertUsers(context.Background(), users); err != nil {
+		t.Fatalf("BatchUpsertUsers: %v", err)
+	}
+
+	inserts := fake.Calls("INSERT INTO instagram_users")
+	if len(inserts) != 2 {
+		t.Fatalf("got %d inserts, want 2", len(inserts))
+	}
+	// The emoji's zero-width joiner sequence is cut between runes, never
+	// inside one
+	if name, _ := upsertedText(inserts[0].Args); name != "ab👩" || !utf8.ValidString(name) {
+		t.Errorf("stored full_name %q, want %q", name, "ab👩")
+	}
+	if _, bio := upsertedText(inserts[1].Args); bio != "hi" {
+		t.Errorf("stored biography %q, want it unchanged", bio)
+	}
+}
@@ -0,0 +1,83 @@
+package external
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCircuitOpen is returned without calling RocketAPI while the circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("RocketAPI circuit breaker open")
+
+// circuitBreaker stops calls to RocketAPI after threshold consecutive
+// upstream failures. Once cooldown has passed it half-opens and lets a
+// single probe call through: a success closes it, a failure reopens it.
+// A probe that never reports back is replaced after another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+
+	probing      bool
+	probeStarted time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow returns ErrCircuitOpen while the breaker is open, or half-open
+// with a probe already in flight
+func (b *circuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	if b.probing && time.Since(b.probeStarted) < b.cooldown {
+		return ErrCircuitOpen
+	}
+
+	b.probing = true
+	b.probeStarted = time.Now()
+	log.Info().Msg("RocketAPI circuit breaker half-open, probing")
+	return nil
+}
+
+// RecordSuccess closes the breaker
+func (b *circuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures >= b.threshold {
+		log.Info().Msg("RocketAPI circuit breaker closed")
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+// RecordFailure counts an upstream failure, opening the breaker when the
+// threshold is reached
+func (b *circuitBreaker) RecordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		log.Warn().
+			Int("consecutive_failures", b.failures).
+			Dur("cooldown", b.cooldown).
+			Msg("RocketAPI circuit breaker open")
+	}
+}
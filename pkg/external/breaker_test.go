@@ -0,0 +1,193 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	b := newCircuitBreaker(2, 50*time.Millisecond)
+
+	b.RecordFailure()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("open after 1 of 2 failures: %v", err)
+	}
+	b.RecordFailure()
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow after 2 failures = %v, want ErrCircuitOpen", err)
+	}
+
+	// After the cooldown a single probe is let through
+	time.Sleep(60 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe refused after cooldown: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second call during probe = %v, want ErrCircuitOpen", err)
+	}
+
+	// A failed probe reopens it, a successful one closes it
+	b.RecordFailure()
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow after failed probe = %v, want ErrCircuitOpen", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe refused after cooldown: %v", err)
+	}
+	b.RecordSuccess()
+	for i := 0; i < 3; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow after successful probe = %v", err)
+		}
+	}
+}
+
+func TestPersistent503OpensBreakerAndStopsRetries(t *testing.T) {
+	scaleBackoff(t, 1000)
+
+	var calls int32
+	client := testClient(t, RocketAPIOptions{BreakerThreshold: 3, BreakerCooldown: time.Hour}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// Retries stop at the threshold rather than using every attempt
+	_, err := client.ScrapeInstagramUser(context.Background(), "alice")
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("error = %v, want ErrCircuitOpen", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("RocketAPI called %d times, want 3 before the breaker opened", n)
+	}
+
+	// Later requests fail fast without calling RocketAPI
+	for _, username := range []string{"bob", "carol"} {
+		if _, err := client.ScrapeInstagramUser(context.Background(), username); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("%s error = %v, want ErrCircuitOpen", username, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("RocketAPI called %d times while the breaker was open", n)
+	}
+}
+
+func TestClientErrorsDontOpenBreaker(t *testing.T) {
+	scaleBackoff(t, 1000)
+
+	var calls int32
+	client := testClient(t, RocketAPIOptions{BreakerThreshold: 2, BreakerCooldown: time.Hour}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.ScrapeInstagramUser(context.Background(), "alice"); errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("scrape %d: breaker opened on 4xx responses", i+1)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n < 2 {
+		t.Errorf("RocketAPI called %d times, want every scrape to reach it", n)
+	}
+}
+
+func TestBreakerRecoversThroughHalfOpenProbe(t *testing.T) {
+	scaleBackoff(t, 1000)
+
+	var calls int32
+	var healthy atomic.Bool
+	client := testClient(t, RocketAPIOptions{BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(userBody("1", "alice")))
+	})
+	ctx := context.Background()
+
+	// Closed to open: the outage trips the breaker
+	if _, err := client.ScrapeInstagramUser(ctx, "alice"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("scrape during the outage = %v, want ErrCircuitOpen", err)
+	}
+	tripped := atomic.LoadInt32(&calls)
+
+	// Half-open: after the cooldown one probe reaches RocketAPI, fails, and
+	// reopens the breaker
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.ScrapeInstagramUser(ctx, "alice"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("scrape after a failed probe = %v, want ErrCircuitOpen", err)
+	}
+	if n := atomic.LoadInt32(&calls) - tripped; n != 1 {
+		t.Errorf("half-open breaker let %d calls through, want 1 probe", n)
+	}
+
+	// Half-open to closed: RocketAPI is back, the probe succeeds and
+	// calls flow again
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	for _, username := range []string{"alice", "alice"} {
+		if _, err := client.ScrapeInstagramUser(ctx, username); err != nil {
+			t.Fatalf("scrape after recovery: %v", err)
+		}
+	}
+}
+
+func TestUserNotFoundDoesntCountAsBreakerFailure(t *testing.T) {
+	scaleBackoff(t, 1000)
+
+	var calls int32
+	client := testClient(t, RocketAPIOptions{BreakerThreshold: 2, BreakerCooldown: time.Hour}, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	// Each 503 is followed by a 404, which shows RocketAPI is up and resets
+	// the consecutive failure count
+	for i := 0; i < 4; i++ {
+		_, err := client.ScrapeInstagramUser(context.Background(), "ghost")
+		var notFound UserNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Fatalf("scrape %d error = %v, want user not found", i+1, err)
+		}
+	}
+	if err := client.breaker.Allow(); err != nil {
+		t.Errorf("breaker = %v after missing users, want closed", err)
+	}
+}
+
+func TestHalfOpenBreakerAdmitsOneConcurrentProbe(t *testing.T) {
+	b := newCircuitBreaker(1, 20*time.Millisecond)
+	b.RecordFailure()
+	time.Sleep(30 * time.Millisecond)
+
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.Allow() == nil {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 1 {
+		t.Errorf("%d concurrent calls got through the half-open breaker, want 1", allowed)
+	}
+
+	// A probe that never reports back is replaced after another cooldown
+	time.Sleep(30 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Errorf("replacement probe refused: %v", err)
+	}
+}
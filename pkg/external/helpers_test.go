@@ -0,0 +1,48 @@
+package external
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// testClient returns a client for a fake RocketAPI served by handler,
+// allowing plenty of requests per second and failures before its breaker
+// opens unless opts says otherwise
+func testClient(t *testing.T, opts RocketAPIOptions, handler http.HandlerFunc) *RocketAPIClient {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	opts.BaseURL = srv.URL
+	if opts.RateLimit == 0 {
+		opts.RateLimit = 1000
+	}
+	if opts.BreakerThreshold == 0 {
+		opts.BreakerThreshold = 100
+	}
+	return NewRocketAPIClient(opts)
+}
+
+// scaleBackoff shrinks retry delays by factor for the duration of the test
+func scaleBackoff(t *testing.T, factor time.Duration) {
+	t.Helper()
+	prev := backoffJitter
+	backoffJitter = func(delay time.Duration, _ *rand.Rand) time.Duration { return delay / factor }
+	t.Cleanup(func() { backoffJitter = prev })
+}
+
+// userBody is a successful get_info response body for username
+func userBody(id, username string) string {
+	return `{"status":"done","response":{"status_code":200,"body":{"user":{"id":"` + id + `","username":"` + username + `"}}}}`
+}
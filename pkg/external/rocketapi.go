@@ -1,62 +1,224 @@
 package external
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"instagram-user-processor/pkg/database"
+	"instagram-user-processor/pkg/metrics"
+	"instagram-user-processor/pkg/tracing"
+	"instagram-user-processor/pkg/utils"
 	"io"
 	"math"
+	"math/rand"
+	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
-var (
-	client      *http.Client
-	rateLimiter *rate.Limiter
-	apiKey      string
-)
+var tracer = otel.Tracer("instagram-user-processor/pkg/external")
 
 const (
 	maxRetries  = 5
 	baseDelayMS = 500 // Base delay in milliseconds
+
+	// rateLimitBackoffFactor stretches the backoff after a rate limit,
+	// since quota takes longer to free up than a transient failure clears
+	rateLimitBackoffFactor = 4
+
+	defaultBaseURL = "https://v1.rocketapi.io"
+	defaultAPIKey  = "demo_key_123"
+
+	// defaultRateLimit is RocketAPI's base plan limit in requests per second
+	defaultRateLimit = 10
 )
 
-// Initialize the RocketAPI client
-func InitRocketAPI() {
-	client = &http.Client{
-		Timeout: 30 * time.Second,
+// RocketAPIClient calls the RocketAPI Instagram endpoints. Each client has
+// its own rate limiter and circuit breaker, shared by every caller, so the
+// request rate holds however many batches or workers use it.
+type RocketAPIClient struct {
+	baseURL     string
+	apiKey      string
+	httpClient  *http.Client
+	rateLimiter *rate.Limiter
+	breaker     *circuitBreaker
+
+	// maxRetryAfter caps the Retry-After delay honored on 429 responses
+	maxRetryAfter time.Duration
+}
+
+// RocketAPIOptions configures a RocketAPIClient. Zero values use defaults.
+type RocketAPIOptions struct {
+	BaseURL          string
+	APIKey           string
+	Timeout          time.Duration
+	MaxRetryAfter    time.Duration
+	RateLimit        int           // requests per second, spaced evenly without bursts
+	BreakerThreshold int           // consecutive upstream failures that open the breaker
+	BreakerCooldown  time.Duration // how long the breaker stays open
+}
+
+// NewRocketAPIClient creates a RocketAPI client
+func NewRocketAPIClient(opts RocketAPIOptions) *RocketAPIClient {
+	if opts.BaseURL == "" {
+		opts.BaseURL = defaultBaseURL
+	}
+	if opts.APIKey == "" {
+		opts.APIKey = defaultAPIKey
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.MaxRetryAfter <= 0 {
+		opts.MaxRetryAfter = 60 * time.Second
+	}
+	if opts.RateLimit <= 0 {
+		opts.RateLimit = defaultRateLimit
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = 5
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = 30 * time.Second
+	}
+
+	return &RocketAPIClient{
+		baseURL: strings.TrimRight(opts.BaseURL, "/"),
+		apiKey:  opts.APIKey,
+		httpClient: &http.Client{
+			Timeout: opts.Timeout,
+		},
+		rateLimiter:   rate.NewLimiter(rate.Limit(opts.RateLimit), 1),
+		breaker:       newCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+		maxRetryAfter: opts.MaxRetryAfter,
 	}
+}
+
+// Scraper fetches Instagram user data. *RocketAPIClient implements it.
+type Scraper interface {
+	ScrapeInstagramUser(ctx context.Context, username string) (*database.User, error)
+}
+
+// ScraperFunc adapts a function to the Scraper interface
+type ScraperFunc func(ctx context.Context, username string) (*database.User, error)
 
-	// Rate limiter: 10 requests per second (RocketAPI limit)
-	rateLimiter = rate.NewLimiter(rate.Every(100*time.Millisecond), 10)
+// ScrapeInstagramUser calls f
+func (f ScraperFunc) ScrapeInstagramUser(ctx context.Context, username string) (*database.User, error) {
+	return f(ctx, username)
+}
+
+// IDScraper fetches Instagram user data by user id. *RocketAPIClient and
+// DefaultScraper implement it.
+type IDScraper interface {
+	ScrapeInstagramUserByID(ctx context.Context, userID string) (*database.User, error)
+}
+
+// defaultScraper scrapes with the client set up by InitRocketAPI
+type defaultScraper struct{}
+
+func (defaultScraper) ScrapeInstagramUser(ctx context.Context, username string) (*database.User, error) {
+	return ScrapeInstagramUser(ctx, username)
+}
 
-	apiKey = os.Getenv("ROCKETAPI_KEY")
-	if apiKey == "" {
+func (defaultScraper) ScrapeInstagramUserByID(ctx context.Context, userID string) (*database.User, error) {
+	return ScrapeInstagramUserByID(ctx, userID)
+}
+
+// DefaultScraper scrapes with the client set up by InitRocketAPI
+var DefaultScraper Scraper = defaultScraper{}
+
+// defaultClient is the client used by the package-level functions
+var defaultClient *RocketAPIClient
+
+// Initialize the RocketAPI client
+func InitRocketAPI(config *utils.Config) {
+	if config.RocketAPIKey == defaultAPIKey {
 		log.Warn().Msg("ROCKETAPI_KEY not set, using demo key")
-		apiKey = "demo_key_123"
 	}
 
-	log.Info().Msg("RocketAPI client initialized")
+	defaultClient = NewRocketAPIClient(RocketAPIOptions{
+		BaseURL:          config.RocketAPIBaseURL,
+		APIKey:           config.RocketAPIKey,
+		Timeout:          time.Duration(config.RocketAPITimeoutSeconds) * time.Second,
+		MaxRetryAfter:    time.Duration(config.RocketAPIMaxRetryAfterSeconds) * time.Second,
+		RateLimit:        config.RateLimit,
+		BreakerThreshold: config.RocketAPIBreakerThreshold,
+		BreakerCooldown:  time.Duration(config.RocketAPIBreakerCooldown) * time.Second,
+	})
+
+	log.Info().
+		Str("base_url", defaultClient.baseURL).
+		Float64("rate_limit", float64(defaultClient.RateLimit())).
+		Msg("RocketAPI client initialized")
+}
+
+// RateLimit returns the client's request rate
+func (c *RocketAPIClient) RateLimit() rate.Limit {
+	return c.rateLimiter.Limit()
+}
+
+// Ping checks the default client's RocketAPI host is reachable
+func Ping(ctx context.Context) error {
+	if defaultClient == nil {
+		return fmt.Errorf("RocketAPI client not initialized")
+	}
+	return defaultClient.Ping(ctx)
+}
+
+// Ping checks that the RocketAPI host is reachable without spending an API
+// request. Any response below 500 counts as reachable.
+func (c *RocketAPIClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.baseURL+"/", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("RocketAPI unreachable: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("RocketAPI returned status %d", resp.StatusCode)
+	}
+	return nil
 }
 
 // RocketAPIResponse represents the wrapper response from RocketAPI
 type RocketAPIResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
 	Response struct {
 		StatusCode int             `json:"status_code"`
 		Body       json.RawMessage `json:"body"`
 	} `json:"response"`
 }
 
+// getInfoRequest is the request body for the user get_info endpoint
+type getInfoRequest struct {
+	Username string `json:"username"`
+}
+
+// getInfoByIDRequest is the request body for the user get_info_by_id
+// endpoint
+type getInfoByIDRequest struct {
+	ID int64 `json:"id"`
+}
+
 // RocketAPIUser represents the user data from RocketAPI
 type RocketAPIUser struct {
 	ID              string `json:"id"`
@@ -68,6 +230,8 @@ type RocketAPIUser struct {
 	IsProfessionalAccount bool `json:"is_professional_account"`
 	IsPrivate       bool   `json:"is_private"`
 	CategoryName    string `json:"category_name"`
+	ProfilePicURL   string `json:"profile_pic_url"`
+	ProfilePicURLHD string `json:"profile_pic_url_hd"`
 
 	EdgeFollow struct {
 		Count int64 `json:"count"`
@@ -80,6 +244,34 @@ type RocketAPIUser struct {
 	EdgeOwnerToTimelineMedia struct {
 		Count int64 `json:"count"`
 	} `json:"edge_owner_to_timeline_media"`
+
+	// get_info_by_id returns the mobile API shape, which has these in
+	// place of id, the edge counts and profile_pic_url_hd
+	PK                  json.Number `json:"pk"`
+	FollowerCount       int64       `json:"follower_count"`
+	FollowingCount      int64       `json:"following_count"`
+	MediaCount          int64       `json:"media_count"`
+	HDProfilePicURLInfo struct {
+		URL string `json:"url"`
+	} `json:"hd_profile_pic_url_info"`
+}
+
+// id returns the user id from either response shape
+func (u RocketAPIUser) id() string {
+	if u.ID != "" {
+		return u.ID
+	}
+	return u.PK.String()
+}
+
+// counts returns the follower, following and post counts from either
+// response shape
+func (u RocketAPIUser) counts() (followers, following, posts int64) {
+	followers, following, posts = u.EdgeFollowedBy.Count, u.EdgeFollow.Count, u.EdgeOwnerToTimelineMedia.Count
+	if followers == 0 && following == 0 && posts == 0 {
+		followers, following, posts = u.FollowerCount, u.FollowingCount, u.MediaCount
+	}
+	return followers, following, posts
 }
 
 // UserNotFoundError represents a user not found error
@@ -92,13 +284,179 @@ func (e UserNotFoundError) Error() string {
 	return fmt.Sprintf("user %s not found: %s", e.Username, e.Message)
 }
 
-// retryWithBackoff implements exponential backoff retry logic
-func retryWithBackoff(ctx context.Context, operation func() (*RocketAPIResponse, []byte, error), operationName string) (*RocketAPIResponse, []byte, error) {
+// UpstreamError is returned when RocketAPI responds with a 5xx status
+type UpstreamError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e UpstreamError) Error() string {
+	return fmt.Sprintf("RocketAPI upstream error %d: %s", e.StatusCode, e.Body)
+}
+
+// RateLimitedError is returned when RocketAPI rejects a request for rate
+// limit or quota exhaustion, by HTTP 429 or in the response body
+type RateLimitedError struct {
+	RetryAfter time.Duration // zero when no usable Retry-After was sent
+	Body       string
+}
+
+func (e RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited by RocketAPI (retry after %s): %s", e.RetryAfter, e.Body)
+}
+
+// IsRateLimited reports whether err is a RocketAPI rate limit rejection,
+// including as the final attempt of a RetryError
+func IsRateLimited(err error) bool {
+	var rateLimitedErr RateLimitedError
+	return errors.As(err, &rateLimitedErr)
+}
+
+// RetryAfterHint returns the Retry-After delay RocketAPI sent with a rate
+// limit rejection in err, or zero
+func RetryAfterHint(err error) time.Duration {
+	var rateLimitedErr RateLimitedError
+	if errors.As(err, &rateLimitedErr) {
+		return rateLimitedErr.RetryAfter
+	}
+	return 0
+}
+
+// IsTransient reports whether err is a RocketAPI failure that may succeed
+// when retried: a 5xx, a 429 or a network timeout, including as the final
+// attempt of a RetryError. Not-found users, an open circuit breaker and
+// ended contexts are not transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var upstreamErr UpstreamError
+	var rateLimitedErr RateLimitedError
+	var netErr net.Error
+	return errors.As(err, &upstreamErr) ||
+		errors.As(err, &rateLimitedErr) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// IsTimeout reports whether err is a RocketAPI call that ran out of time,
+// either the caller's deadline or the HTTP client timeout
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsUpstream reports whether err is a RocketAPI failure: a call that
+// exhausted its retries, a 5xx or an open circuit breaker
+func IsUpstream(err error) bool {
+	var retryErr RetryError
+	var upstreamErr UpstreamError
+	return errors.As(err, &retryErr) || errors.As(err, &upstreamErr) || errors.Is(err, ErrCircuitOpen)
+}
+
+// isQuotaMessage reports whether a RocketAPI error message describes rate
+// limit or quota exhaustion
+func isQuotaMessage(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "rate limit") ||
+		strings.Contains(message, "too many requests") ||
+		strings.Contains(message, "quota")
+}
+
+// parseRetryAfter parses a Retry-After header given either as delay
+// seconds or as an HTTP-date. Returns zero for a missing or invalid value.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// RetryAttempt records the outcome of a single failed attempt
+type RetryAttempt struct {
+	Attempt int           `json:"attempt"`
+	Err     error         `json:"-"`
+	Delay   time.Duration `json:"delay"` // Backoff applied after this attempt
+}
+
+// RetryError is returned when all retry attempts are exhausted
+type RetryError struct {
+	Operation string
+	Attempts  []RetryAttempt
+}
+
+func (e RetryError) Error() string {
+	parts := make([]string, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		parts = append(parts, fmt.Sprintf("attempt %d: %v (delay %s)", a.Attempt, a.Err, a.Delay))
+	}
+	return fmt.Sprintf("%s failed after %d attempts: [%s]", e.Operation, len(e.Attempts), strings.Join(parts, "; "))
+}
+
+// Unwrap returns the error from the final attempt
+func (e RetryError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+// jitterFunc randomizes a computed backoff delay
+type jitterFunc func(delay time.Duration, rng *rand.Rand) time.Duration
+
+// noJitter uses the computed delay unchanged
+func noJitter(delay time.Duration, _ *rand.Rand) time.Duration {
+	return delay
+}
+
+// fullJitter picks a delay uniformly from [0, delay]
+func fullJitter(delay time.Duration, rng *rand.Rand) time.Duration {
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int63n(int64(delay) + 1))
+}
+
+// equalJitter keeps half the delay and randomizes the other half
+func equalJitter(delay time.Duration, rng *rand.Rand) time.Duration {
+	half := delay / 2
+	return half + fullJitter(delay-half, rng)
+}
+
+// backoffJitter spreads out retries so workers hitting the same outage
+// don't retry in lockstep. Set to noJitter for deterministic delays.
+var backoffJitter jitterFunc = fullJitter
+
+// retryWithBackoff implements exponential backoff retry logic with jitter.
+// Each attempt gets its own span, and operation runs under its context.
+func (c *RocketAPIClient) retryWithBackoff(ctx context.Context, operation func(ctx context.Context) (*RocketAPIResponse, []byte, error), operationName string) (*RocketAPIResponse, []byte, error) {
+	logger := utils.LoggerFromContext(ctx)
+
 	var lastErr error
 	var lastBody []byte
+	attempts := make([]RetryAttempt, 0, maxRetries)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		resp, body, err := operation()
+		attemptCtx, span := tracer.Start(ctx, "rocketapi.attempt", trace.WithAttributes(
+			attribute.String("operation", operationName),
+			attribute.Int("retry.attempt", attempt+1),
+		))
+		resp, body, err := operation(attemptCtx)
+		tracing.EndSpan(span, err)
 
 		// If no error and response status is not "error", return success
 		if err == nil && resp != nil && resp.Status != "error" {
@@ -111,24 +469,50 @@ func retryWithBackoff(ctx context.Context, operation func() (*RocketAPIResponse,
 			return resp, body, err
 		}
 
+		// Don't retry while the circuit breaker is open
+		if errors.Is(err, ErrCircuitOpen) {
+			return resp, body, err
+		}
+
+		if err == nil {
+			err = fmt.Errorf("RocketAPI returned status %q", resp.Status)
+		}
+
 		// Store the error/body for potential final return
 		lastErr = err
 		lastBody = body
 
 		// If this was the last attempt, don't wait
 		if attempt == maxRetries-1 {
+			attempts = append(attempts, RetryAttempt{Attempt: attempt + 1, Err: err})
 			break
 		}
 
 		// Calculate exponential backoff delay: baseDelay * 2^attempt
 		delay := time.Duration(baseDelayMS*int(math.Pow(2, float64(attempt)))) * time.Millisecond
+		delay = backoffJitter(delay, rng)
+
+		// Back off longer after a rate limit, and at least as long as
+		// RocketAPI asked, up to maxRetryAfter
+		var rateLimitedErr RateLimitedError
+		if errors.As(err, &rateLimitedErr) {
+			delay *= rateLimitBackoffFactor
+			if rateLimitedErr.RetryAfter > delay {
+				delay = rateLimitedErr.RetryAfter
+			}
+			if delay > c.maxRetryAfter {
+				delay = c.maxRetryAfter
+			}
+		}
+		attempts = append(attempts, RetryAttempt{Attempt: attempt + 1, Err: err, Delay: delay})
 
-		log.Warn().
+		logger.Warn().
 			Err(err).
 			Str("operation", operationName).
 			Int("attempt", attempt+1).
 			Dur("retry_delay", delay).
 			Msg("operation failed, retrying")
+		metrics.IncScrapeRetry()
 
 		// Wait with context cancellation support
 		select {
@@ -140,40 +524,107 @@ func retryWithBackoff(ctx context.Context, operation func() (*RocketAPIResponse,
 	}
 
 	// All retries exhausted
-	log.Error().Err(lastErr).Msgf("%s failed after %d attempts", operationName, maxRetries)
-	return nil, lastBody, lastErr
+	retryErr := RetryError{Operation: operationName, Attempts: attempts}
+	logger.Error().Err(lastErr).Str("history", retryErr.Error()).Msgf("%s failed after %d attempts", operationName, maxRetries)
+	return nil, lastBody, retryErr
 }
 
-// ScrapeInstagramUser scrapes user data from Instagram via RocketAPI
+// ScrapeInstagramUser scrapes user data using the default client
 func ScrapeInstagramUser(ctx context.Context, username string) (*database.User, error) {
-	if username == "" {
-		return nil, errors.New("username cannot be empty")
+	if defaultClient == nil {
+		return nil, fmt.Errorf("RocketAPI client not initialized - call InitRocketAPI() first")
 	}
+	return defaultClient.ScrapeInstagramUser(ctx, username)
+}
 
-	log.Debug().Str("username", username).Msg("scraping Instagram user")
+// ScrapeInstagramUserByID scrapes user data by user id using the default
+// client
+func ScrapeInstagramUserByID(ctx context.Context, userID string) (*database.User, error) {
+	if defaultClient == nil {
+		return nil, fmt.Errorf("RocketAPI client not initialized - call InitRocketAPI() first")
+	}
+	return defaultClient.ScrapeInstagramUserByID(ctx, userID)
+}
 
-	operation := func() (*RocketAPIResponse, []byte, error) {
-		// Respect rate limit
-		if rateLimiter == nil {
-			return nil, nil, fmt.Errorf("rate limiter not initialized - call InitRocketAPI() first")
+// ScrapeInstagramUser scrapes user data from Instagram via RocketAPI
+func (c *RocketAPIClient) ScrapeInstagramUser(ctx context.Context, username string) (_ *database.User, err error) {
+	ctx, span := tracer.Start(ctx, "rocketapi.ScrapeInstagramUser", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("username", username)))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	logger := utils.LoggerFromContext(ctx)
+
+	// Only well-formed usernames reach RocketAPI
+	username, err = utils.NormalizeUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug().Str("username", username).Msg("scraping Instagram user")
+
+	return c.scrapeUser(ctx, "/instagram/user/get_info", getInfoRequest{Username: username}, username, "ScrapeInstagramUser")
+}
+
+// ScrapeInstagramUserByID scrapes user data from Instagram via RocketAPI by
+// the numeric user id, which still finds accounts that were renamed
+func (c *RocketAPIClient) ScrapeInstagramUserByID(ctx context.Context, userID string) (_ *database.User, err error) {
+	ctx, span := tracer.Start(ctx, "rocketapi.ScrapeInstagramUserByID", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("user_id", userID)))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	logger := utils.LoggerFromContext(ctx)
+
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("invalid user id %q", userID)
+	}
+
+	logger.Debug().Str("user_id", userID).Msg("scraping Instagram user by id")
+
+	return c.scrapeUser(ctx, "/instagram/user/get_info_by_id", getInfoByIDRequest{ID: id}, userID, "ScrapeInstagramUserByID")
+}
+
+// scrapeUser POSTs reqBody to a RocketAPI user info endpoint with retries
+// and converts the returned user. lookup is the username or id being
+// fetched, used in errors and logs.
+func (c *RocketAPIClient) scrapeUser(ctx context.Context, endpoint string, reqBody interface{}, lookup, operationName string) (*database.User, error) {
+	logger := utils.LoggerFromContext(ctx)
+
+	operation := func(ctx context.Context) (*RocketAPIResponse, []byte, error) {
+		// Fail fast while RocketAPI is failing
+		if err := c.breaker.Allow(); err != nil {
+			return nil, nil, err
 		}
-		if err := rateLimiter.Wait(ctx); err != nil {
+
+		metrics.IncScrapeAttempt()
+
+		// Respect rate limit
+		if err := c.rateLimiter.Wait(ctx); err != nil {
 			return nil, nil, fmt.Errorf("rate limit wait failed: %w", err)
 		}
 
-		requestURL := "https://v1.rocketapi.io/instagram/user/get_info"
-		reqBody := fmt.Sprintf(`{"username": "%s"}`, username)
+		requestURL := c.baseURL + endpoint
+		payload, err := json.Marshal(reqBody)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode request: %w", err)
+		}
 
-		req, err := http.NewRequestWithContext(ctx, "POST", requestURL, strings.NewReader(reqBody))
+		req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewReader(payload))
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to create request: %w", err)
 		}
 
 		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Token %s", apiKey))
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.apiKey))
+
+		// Link the upstream call to this attempt's span
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-		res, err := client.Do(req)
+		res, err := c.httpClient.Do(req)
 		if err != nil {
+			if ctx.Err() == nil {
+				c.breaker.RecordFailure()
+			}
 			return nil, nil, fmt.Errorf("HTTP request failed: %w", err)
 		}
 		defer res.Body.Close()
@@ -183,9 +634,24 @@ func ScrapeInstagramUser(ctx context.Context, username string) (*database.User,
 			return nil, nil, fmt.Errorf("failed to read response body: %w", err)
 		}
 
+		// 5xx is retryable, but counts towards opening the circuit breaker.
+		// Anything else, including a missing user, shows RocketAPI is up.
+		if res.StatusCode >= http.StatusInternalServerError {
+			c.breaker.RecordFailure()
+			return nil, body, UpstreamError{StatusCode: res.StatusCode, Body: string(body)}
+		}
+		c.breaker.RecordSuccess()
+
 		// Handle HTTP errors
 		if res.StatusCode == http.StatusNotFound {
-			return nil, body, UserNotFoundError{Username: username, Message: "HTTP 404"}
+			return nil, body, UserNotFoundError{Username: lookup, Message: "HTTP 404"}
+		}
+
+		if res.StatusCode == http.StatusTooManyRequests {
+			return nil, body, RateLimitedError{
+				RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+				Body:       string(body),
+			}
 		}
 
 		if res.StatusCode != http.StatusOK {
@@ -198,10 +664,26 @@ func ScrapeInstagramUser(ctx context.Context, username string) (*database.User,
 			return nil, body, fmt.Errorf("failed to parse RocketAPI response: %w", err)
 		}
 
+		// Prefer the body request id, falling back to the response header
+		if resp.RequestID == "" {
+			resp.RequestID = res.Header.Get("X-Request-Id")
+		}
+		if resp.RequestID != "" {
+			logger.Debug().Str("lookup", lookup).Str("rocketapi_request_id", resp.RequestID).Msg("RocketAPI response received")
+		}
+
+		// Quota exhaustion can also arrive wrapped in a 200
+		if resp.Response.StatusCode == http.StatusTooManyRequests {
+			return &resp, body, RateLimitedError{Body: string(body)}
+		}
+
 		// Handle RocketAPI-level errors
 		if resp.Status == "error" || resp.Status == "fail" {
 			if strings.Contains(resp.Message, "user not found") || strings.Contains(resp.Message, "User not found") {
-				return &resp, body, UserNotFoundError{Username: username, Message: resp.Message}
+				return &resp, body, UserNotFoundError{Username: lookup, Message: resp.Message}
+			}
+			if isQuotaMessage(resp.Message) {
+				return &resp, body, RateLimitedError{Body: resp.Message}
 			}
 			return &resp, body, fmt.Errorf("RocketAPI error: %s", resp.Message)
 		}
@@ -209,8 +691,14 @@ func ScrapeInstagramUser(ctx context.Context, username string) (*database.User,
 		return &resp, body, nil
 	}
 
-	resp, _, err := retryWithBackoff(ctx, operation, "ScrapeInstagramUser")
+	resp, _, err := c.retryWithBackoff(ctx, operation, operationName)
 	if err != nil {
+		var userNotFoundErr UserNotFoundError
+		if errors.As(err, &userNotFoundErr) {
+			metrics.ObserveScrape(metrics.ScrapeNotFound)
+		} else {
+			metrics.ObserveScrape(metrics.ScrapeFailure)
+		}
 		return nil, err
 	}
 
@@ -220,12 +708,24 @@ func ScrapeInstagramUser(ctx context.Context, username string) (*database.User,
 	}
 
 	if err := json.Unmarshal(resp.Response.Body, &userResp); err != nil {
+		metrics.ObserveScrape(metrics.ScrapeFailure)
 		return nil, fmt.Errorf("failed to parse user data: %w", err)
 	}
+	metrics.ObserveScrape(metrics.ScrapeSuccess)
+
+	// Prefer the HD profile picture when RocketAPI provides one
+	profilePicURL := userResp.User.ProfilePicURLHD
+	if profilePicURL == "" {
+		profilePicURL = userResp.User.HDProfilePicURLInfo.URL
+	}
+	if profilePicURL == "" {
+		profilePicURL = userResp.User.ProfilePicURL
+	}
 
 	// Convert RocketAPI user to our database user model
+	followers, following, posts := userResp.User.counts()
 	user := &database.User{
-		ID:                    userResp.User.ID,
+		ID:                    userResp.User.id(),
 		Username:              userResp.User.Username,
 		FullName:              sql.NullString{String: userResp.User.FullName, Valid: userResp.User.FullName != ""},
 		Biography:             sql.NullString{String: userResp.User.Biography, Valid: userResp.User.Biography != ""},
@@ -234,17 +734,20 @@ func ScrapeInstagramUser(ctx context.Context, username string) (*database.User,
 		IsProfessionalAccount: userResp.User.IsProfessionalAccount,
 		IsPrivate:             userResp.User.IsPrivate,
 		CategoryName:          sql.NullString{String: userResp.User.CategoryName, Valid: userResp.User.CategoryName != ""},
-		Followers:             userResp.User.EdgeFollowedBy.Count,
-		Following:             userResp.User.EdgeFollow.Count,
-		Posts:                 userResp.User.EdgeOwnerToTimelineMedia.Count,
+		Followers:             followers,
+		Following:             following,
+		Posts:                 posts,
+		ProfilePicURL:         sql.NullString{String: profilePicURL, Valid: profilePicURL != ""},
 		ScrapedAt:             time.Now(),
+		UpstreamRequestID:     resp.RequestID,
 	}
 
-	log.Debug().
-		Str("username", username).
+	logger.Debug().
+		Str("username", user.Username).
 		Str("user_id", user.ID).
 		Int64("followers", user.Followers).
 		Bool("verified", user.IsVerified).
+		Str("rocketapi_request_id", user.UpstreamRequestID).
 		Msg("successfully scraped Instagram user")
 
 	return user, nil
@@ -0,0 +1,559 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/metrics"
+	"instagram-user-processor/pkg/utils"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryErrorCarriesEveryAttempt(t *testing.T) {
+	scaleBackoff(t, 1000)
+
+	var calls int32
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "outage %d", n)
+	})
+
+	_, err := client.ScrapeInstagramUser(context.Background(), "alice")
+	var retryErr RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("error = %v, want a RetryError", err)
+	}
+	if retryErr.Operation != "ScrapeInstagramUser" || len(retryErr.Attempts) != maxRetries {
+		t.Fatalf("retry error for %q has %d attempts, want %d", retryErr.Operation, len(retryErr.Attempts), maxRetries)
+	}
+
+	for i, attempt := range retryErr.Attempts {
+		var upstreamErr UpstreamError
+		if attempt.Attempt != i+1 || !errors.As(attempt.Err, &upstreamErr) || upstreamErr.Body != fmt.Sprintf("outage %d", i+1) {
+			t.Errorf("attempt %d = #%d %v, want the upstream error of call %d", i, attempt.Attempt, attempt.Err, i+1)
+		}
+
+		wantDelay := time.Duration(0)
+		if i < maxRetries-1 {
+			wantDelay = (baseDelayMS << i) * time.Millisecond / 1000
+		}
+		if attempt.Delay != wantDelay {
+			t.Errorf("attempt %d delay = %s, want %s", i+1, attempt.Delay, wantDelay)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("attempt %d: %v", i+1, attempt.Err)) {
+			t.Errorf("error %q doesn't mention attempt %d", err, i+1)
+		}
+	}
+
+	// The final attempt's error stays reachable
+	var upstreamErr UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.Body != fmt.Sprintf("outage %d", maxRetries) {
+		t.Errorf("unwrapped error = %v, want the last attempt's", upstreamErr)
+	}
+}
+
+func TestScrapeSurfacesRocketAPIRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		want   string
+	}{
+		{"body", "", `{"status":"done","request_id":"req-body","response":{"status_code":200,"body":{"user":{"id":"1","username":"alice"}}}}`, "req-body"},
+		{"header fallback", "req-header", userBody("1", "alice"), "req-header"},
+		{"body preferred", "req-header", `{"status":"done","request_id":"req-body","response":{"status_code":200,"body":{"user":{"id":"1","username":"alice"}}}}`, "req-body"},
+		{"absent", "", userBody("1", "alice"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+				if tt.header != "" {
+					w.Header().Set("X-Request-Id", tt.header)
+				}
+				fmt.Fprint(w, tt.body)
+			})
+
+			user, err := client.ScrapeInstagramUser(context.Background(), "alice")
+			if err != nil {
+				t.Fatalf("ScrapeInstagramUser: %v", err)
+			}
+			if user.UpstreamRequestID != tt.want {
+				t.Errorf("request id = %q, want %q", user.UpstreamRequestID, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"2", 2 * time.Second},
+		{" 120 ", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+// rateLimitedOnce answers the first request with a 429 carrying retryAfter
+// and later ones with a user, recording when each request arrived
+func rateLimitedOnce(retryAfter string, arrivals *[]time.Time) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*arrivals = append(*arrivals, time.Now())
+		first := len(*arrivals) == 1
+		mu.Unlock()
+
+		if first {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, "too many requests")
+			return
+		}
+		fmt.Fprint(w, userBody("1", "alice"))
+	}
+}
+
+func TestRetryWaitsForRetryAfter(t *testing.T) {
+	scaleBackoff(t, 1000)
+
+	var arrivals []time.Time
+	client := testClient(t, RocketAPIOptions{}, rateLimitedOnce("2", &arrivals))
+
+	if _, err := client.ScrapeInstagramUser(context.Background(), "alice"); err != nil {
+		t.Fatalf("ScrapeInstagramUser: %v", err)
+	}
+	if len(arrivals) != 2 {
+		t.Fatalf("RocketAPI called %d times, want 2", len(arrivals))
+	}
+	if wait := arrivals[1].Sub(arrivals[0]); wait < 2*time.Second || wait > 2500*time.Millisecond {
+		t.Errorf("retried after %v, want about 2s", wait)
+	}
+}
+
+func TestRetryAfterIsCapped(t *testing.T) {
+	scaleBackoff(t, 1000)
+
+	var arrivals []time.Time
+	client := testClient(t, RocketAPIOptions{MaxRetryAfter: 100 * time.Millisecond}, rateLimitedOnce("3600", &arrivals))
+
+	if _, err := client.ScrapeInstagramUser(context.Background(), "alice"); err != nil {
+		t.Fatalf("ScrapeInstagramUser: %v", err)
+	}
+	if len(arrivals) != 2 {
+		t.Fatalf("RocketAPI called %d times, want 2", len(arrivals))
+	}
+	if wait := arrivals[1].Sub(arrivals[0]); wait < 100*time.Millisecond || wait > time.Second {
+		t.Errorf("retried after %v, want the 100ms cap", wait)
+	}
+}
+
+func TestQuotaExhaustionIsRateLimitedAndBacksOffLonger(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"HTTP 429", http.StatusTooManyRequests, "slow down"},
+		{"wrapped 429", http.StatusOK, `{"status":"done","response":{"status_code":429,"body":{}}}`},
+		{"quota message", http.StatusOK, `{"status":"error","message":"Monthly quota exceeded"}`},
+		{"too many requests message", http.StatusOK, `{"status":"fail","message":"Too Many Requests"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scaleBackoff(t, 1000)
+			client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+
+			_, err := client.ScrapeInstagramUser(context.Background(), "alice")
+			if !IsRateLimited(err) {
+				t.Fatalf("error = %v, want a RateLimitedError", err)
+			}
+			var retryErr RetryError
+			if !errors.As(err, &retryErr) || len(retryErr.Attempts) != maxRetries {
+				t.Fatalf("error = %v, want %d retried attempts", err, maxRetries)
+			}
+			for i, attempt := range retryErr.Attempts[:maxRetries-1] {
+				want := rateLimitBackoffFactor * (baseDelayMS << i) * time.Millisecond / 1000
+				if attempt.Delay != want {
+					t.Errorf("attempt %d delay = %s, want %s", i+1, attempt.Delay, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOtherRocketAPIErrorsAreNotRateLimited(t *testing.T) {
+	scaleBackoff(t, 1000)
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"error","message":"account is private"}`)
+	})
+
+	_, err := client.ScrapeInstagramUser(context.Background(), "alice")
+	if err == nil || IsRateLimited(err) {
+		t.Errorf("error = %v, want a non rate limit failure", err)
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const delay = time.Second
+
+	tests := []struct {
+		name     string
+		jitter   jitterFunc
+		min, max time.Duration
+	}{
+		{"none", noJitter, delay, delay},
+		{"full", fullJitter, 0, delay},
+		{"equal", equalJitter, delay / 2, delay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 1000; i++ {
+				got := tt.jitter(delay, rng)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("delay %s outside [%s, %s]", got, tt.min, tt.max)
+				}
+				seen[got] = true
+			}
+			if tt.min != tt.max && len(seen) < 900 {
+				t.Errorf("only %d distinct delays in 1000, want them spread", len(seen))
+			}
+		})
+	}
+
+	if got := fullJitter(0, rng); got != 0 {
+		t.Errorf("fullJitter(0) = %s, want 0", got)
+	}
+}
+
+func TestRetryDelaysAreJittered(t *testing.T) {
+	// Full jitter over delays scaled down to keep the test fast
+	prev := backoffJitter
+	backoffJitter = func(delay time.Duration, rng *rand.Rand) time.Duration { return fullJitter(delay/100, rng) }
+	t.Cleanup(func() { backoffJitter = prev })
+
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// Two runs of the same outage retry on different schedules
+	var schedules [2][]time.Duration
+	for run := range schedules {
+		_, err := client.ScrapeInstagramUser(context.Background(), "alice")
+		var retryErr RetryError
+		if !errors.As(err, &retryErr) || len(retryErr.Attempts) != maxRetries {
+			t.Fatalf("error = %v, want a RetryError with %d attempts", err, maxRetries)
+		}
+		for i, attempt := range retryErr.Attempts[:maxRetries-1] {
+			if max := (baseDelayMS << i) * time.Millisecond / 100; attempt.Delay < 0 || attempt.Delay > max {
+				t.Errorf("attempt %d delay = %s, want within [0, %s]", i+1, attempt.Delay, max)
+			}
+			schedules[run] = append(schedules[run], attempt.Delay)
+		}
+	}
+	if fmt.Sprint(schedules[0]) == fmt.Sprint(schedules[1]) {
+		t.Errorf("both runs retried after %v, want independent jitter", schedules[0])
+	}
+}
+
+func TestScrapeRejectsMalformedUsernamesBeforeRequest(t *testing.T) {
+	var calls int32
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(w, userBody("1", "alice"))
+	})
+
+	for _, username := range []string{`a"b`, `a\b`, "../x", strings.Repeat("a", 40), `alice","username":"bob`, ""} {
+		if _, err := client.ScrapeInstagramUser(context.Background(), username); !errors.Is(err, utils.ErrInvalidUsername) {
+			t.Errorf("ScrapeInstagramUser(%q) error = %v, want ErrInvalidUsername", username, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("RocketAPI called %d times for invalid usernames", n)
+	}
+}
+
+func TestScrapeSendsUsernameAsJSON(t *testing.T) {
+	var got getInfoRequest
+	var decodeErr error
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		decodeErr = dec.Decode(&got)
+		fmt.Fprint(w, userBody("1", "alice.smith_1"))
+	})
+
+	if _, err := client.ScrapeInstagramUser(context.Background(), "@Alice.Smith_1"); err != nil {
+		t.Fatalf("ScrapeInstagramUser: %v", err)
+	}
+	if decodeErr != nil {
+		t.Fatalf("request body isn't a get_info request: %v", decodeErr)
+	}
+	if got.Username != "alice.smith_1" {
+		t.Errorf("requested username %q, want the normalized alice.smith_1", got.Username)
+	}
+}
+
+func TestInitRocketAPIUsesConfiguredBaseURLAndTimeout(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, userBody("1", "alice"))
+	}))
+	defer srv.Close()
+
+	t.Setenv("ROCKETAPI_BASE_URL", srv.URL+"/")
+	t.Setenv("ROCKETAPI_TIMEOUT_SECONDS", "7")
+	prev := defaultClient
+	t.Cleanup(func() { defaultClient = prev })
+	InitRocketAPI(utils.LoadConfig())
+
+	if got := defaultClient.httpClient.Timeout; got != 7*time.Second {
+		t.Errorf("client timeout = %v, want 7s", got)
+	}
+	user, err := ScrapeInstagramUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("ScrapeInstagramUser: %v", err)
+	}
+	if user.Username != "alice" {
+		t.Errorf("username = %q, want alice", user.Username)
+	}
+	if len(paths) != 1 || strings.HasPrefix(paths[0], "//") {
+		t.Errorf("mock server saw paths %q, want one request under the base URL", paths)
+	}
+}
+
+func TestRateLimiterAllowsConfiguredRate(t *testing.T) {
+	client := NewRocketAPIClient(RocketAPIOptions{RateLimit: 2})
+	if got := client.RateLimit(); got != 2 {
+		t.Fatalf("rate limit = %v, want 2", got)
+	}
+
+	// The first request goes at once, then one every half second
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := client.rateLimiter.Wait(ctx); err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("3 requests took %v at 2/s, want about 1s", elapsed)
+	}
+}
+
+func TestInitRocketAPIUsesConfiguredRateLimit(t *testing.T) {
+	prev := defaultClient
+	t.Cleanup(func() { defaultClient = prev })
+
+	for _, tt := range []struct {
+		value string
+		want  float64
+	}{
+		{"", defaultRateLimit},
+		{"2", 2},
+		{"50", 50},
+		{"0", defaultRateLimit},
+		{"-3", defaultRateLimit},
+	} {
+		t.Setenv("RATE_LIMIT", tt.value)
+		InitRocketAPI(utils.LoadConfig())
+		if got := float64(defaultClient.RateLimit()); got != tt.want {
+			t.Errorf("RATE_LIMIT=%q gives %v requests per second, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestClientsWithDifferentBaseURLsCoexist(t *testing.T) {
+	var firstCalls, secondCalls int32
+	first := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&firstCalls, 1)
+		fmt.Fprint(w, userBody("1", "alice"))
+	})
+	second := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondCalls, 1)
+		fmt.Fprint(w, userBody("2", "bob"))
+	})
+
+	a, err := first.ScrapeInstagramUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("first client: %v", err)
+	}
+	b, err := second.ScrapeInstagramUser(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("second client: %v", err)
+	}
+	if a.Username != "alice" || b.Username != "bob" {
+		t.Errorf("got users %q and %q, want alice and bob", a.Username, b.Username)
+	}
+	if firstCalls != 1 || secondCalls != 1 {
+		t.Errorf("servers called %d and %d times, want once each", firstCalls, secondCalls)
+	}
+}
+
+// metricValue returns the value of a series in the metrics exposition, or
+// 0 if it hasn't been recorded
+func metricValue(t *testing.T, series string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s value %q: %v", series, value, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestScrapeRecordsAttemptRetryAndOutcomeMetrics(t *testing.T) {
+	scaleBackoff(t, 1000)
+	var calls int32
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, userBody("1", "alice"))
+	})
+
+	const (
+		attempts  = "instagram_processor_rocketapi_scrape_attempts_total"
+		retries   = "instagram_processor_rocketapi_scrape_retries_total"
+		successes = `instagram_processor_rocketapi_scrapes_total{outcome="success"}`
+	)
+	before := map[string]float64{}
+	for _, series := range []string{attempts, retries, successes} {
+		before[series] = metricValue(t, series)
+	}
+
+	if _, err := client.ScrapeInstagramUser(context.Background(), "alice"); err != nil {
+		t.Fatalf("ScrapeInstagramUser: %v", err)
+	}
+
+	for series, want := range map[string]float64{attempts: 2, retries: 1, successes: 1} {
+		if got := metricValue(t, series) - before[series]; got != want {
+			t.Errorf("%s grew by %v, want %v", series, got, want)
+		}
+	}
+}
+
+func TestScrapeCapturesProfilePictureURL(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		want string
+	}{
+		{"hd preferred", `"profile_pic_url":"https://cdn/sd.jpg","profile_pic_url_hd":"https://cdn/hd.jpg"`, "https://cdn/hd.jpg"},
+		{"hd info", `"profile_pic_url":"https://cdn/sd.jpg","hd_profile_pic_url_info":{"url":"https://cdn/info.jpg"}`, "https://cdn/info.jpg"},
+		{"standard only", `"profile_pic_url":"https://cdn/sd.jpg"`, "https://cdn/sd.jpg"},
+		{"none", `"profile_pic_url":""`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"status":"done","response":{"status_code":200,"body":{"user":{"id":"1","username":"alice",`+tt.user+`}}}}`)
+			})
+			user, err := client.ScrapeInstagramUser(context.Background(), "alice")
+			if err != nil {
+				t.Fatalf("ScrapeInstagramUser: %v", err)
+			}
+			if user.ProfilePicURL.String != tt.want || user.ProfilePicURL.Valid != (tt.want != "") {
+				t.Errorf("profile picture URL = %+v, want %q", user.ProfilePicURL, tt.want)
+			}
+		})
+	}
+}
+
+// mobileUserBody is a get_info_by_id response in the mobile API shape
+const mobileUserBody = `{"status":"done","response":{"status_code":200,"body":{"user":{
+	"pk":123456,"username":"alice_renamed","full_name":"Alice","follower_count":1500,
+	"following_count":20,"media_count":42,"is_verified":true,
+	"hd_profile_pic_url_info":{"url":"https://cdn.example.com/alice_hd.jpg"}}}}}`
+
+func TestScrapeByIDParsesMobileResponse(t *testing.T) {
+	var path string
+	var body getInfoByIDRequest
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprint(w, mobileUserBody)
+	})
+
+	user, err := client.ScrapeInstagramUserByID(context.Background(), "123456")
+	if err != nil {
+		t.Fatalf("ScrapeInstagramUserByID: %v", err)
+	}
+	if path != "/instagram/user/get_info_by_id" || body.ID != 123456 {
+		t.Errorf("requested %s with id %d, want get_info_by_id for 123456", path, body.ID)
+	}
+	if user.ID != "123456" || user.Username != "alice_renamed" || !user.IsVerified {
+		t.Errorf("user = %s (%s) verified %v, want 123456 alice_renamed verified", user.ID, user.Username, user.IsVerified)
+	}
+	if user.Followers != 1500 || user.Following != 20 || user.Posts != 42 {
+		t.Errorf("counts = %d/%d/%d, want 1500/20/42", user.Followers, user.Following, user.Posts)
+	}
+	if user.ProfilePicURL.String != "https://cdn.example.com/alice_hd.jpg" {
+		t.Errorf("profile picture = %q, want the HD URL", user.ProfilePicURL.String)
+	}
+}
+
+func TestScrapeByIDRejectsInvalidIDsBeforeRequest(t *testing.T) {
+	var calls int32
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	})
+	for _, id := range []string{"", "abc", "-1", "0", "12345678901234567890123"} {
+		if _, err := client.ScrapeInstagramUserByID(context.Background(), id); err == nil {
+			t.Errorf("ScrapeInstagramUserByID(%q) succeeded, want an error", id)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("RocketAPI called %d times for invalid ids", calls)
+	}
+}
+
+func TestScrapeByIDNotFound(t *testing.T) {
+	client := testClient(t, RocketAPIOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	_, err := client.ScrapeInstagramUserByID(context.Background(), "999")
+	var notFound UserNotFoundError
+	if !errors.As(err, &notFound) || notFound.Username != "999" {
+		t.Errorf("error = %v, want user 999 not found", err)
+	}
+}
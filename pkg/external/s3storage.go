@@ -0,0 +1,193 @@
+package external
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"instagram-user-processor/pkg/utils"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxProfilePicBytes bounds downloaded profile pictures
+	maxProfilePicBytes = 10 << 20
+
+	defaultDownloadTimeout = 30 * time.Second
+)
+
+// profilePicExtensions maps accepted image content types to object key
+// extensions
+var profilePicExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+	"image/heic": ".heic",
+}
+
+// S3PutObjectAPI is the subset of the S3 client used by S3StorageClient
+type S3PutObjectAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// S3StorageOptions configures an S3StorageClient
+type S3StorageOptions struct {
+	Bucket     string
+	Region     string
+	Prefix     string       // object key prefix, e.g. "profile-pics/"
+	HTTPClient *http.Client // downloads source images, defaults to a 30s timeout client
+}
+
+// S3StorageClient stores profile pictures in an S3 bucket. Images are
+// downloaded from their source URL and uploaded under Prefix + user ID.
+type S3StorageClient struct {
+	api        S3PutObjectAPI
+	httpClient *http.Client
+	bucket     string
+	region     string
+	prefix     string
+
+	mu      sync.RWMutex
+	uploads map[string]string // userID -> object key
+}
+
+// NewS3StorageClient creates an S3 storage client using api for uploads
+func NewS3StorageClient(api S3PutObjectAPI, opts S3StorageOptions) *S3StorageClient {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: defaultDownloadTimeout}
+	}
+
+	return &S3StorageClient{
+		api:        api,
+		httpClient: opts.HTTPClient,
+		bucket:     opts.Bucket,
+		region:     opts.Region,
+		prefix:     opts.Prefix,
+		uploads:    make(map[string]string),
+	}
+}
+
+// newS3StorageClientFromConfig creates an S3 storage client for the
+// configured bucket. Credentials come from the default AWS chain
+// (AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY, shared config or an IAM role).
+func newS3StorageClientFromConfig(ctx context.Context, config *utils.Config) (*S3StorageClient, error) {
+	if config.S3Bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required for the s3 storage backend")
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(config.S3Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return NewS3StorageClient(s3.NewFromConfig(awsCfg), S3StorageOptions{
+		Bucket: config.S3Bucket,
+		Region: config.S3Region,
+		Prefix: config.S3Prefix,
+	}), nil
+}
+
+// UploadProfilePicture downloads imageURL and uploads it to S3. Sources
+// that don't respond 200 with an image content type are rejected.
+func (c *S3StorageClient) UploadProfilePicture(ctx context.Context, userID string, imageURL string) error {
+	if userID == "" {
+		return fmt.Errorf("userID cannot be empty")
+	}
+
+	if imageURL == "" {
+		return fmt.Errorf("imageURL cannot be empty")
+	}
+
+	image, contentType, err := c.download(ctx, imageURL)
+	if err != nil {
+		return err
+	}
+
+	key := c.prefix + userID + profilePicExtensions[contentType]
+	_, err = c.api.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(c.bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(image),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(int64(len(image))),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload profile picture to s3://%s/%s: %w", c.bucket, key, err)
+	}
+
+	c.mu.Lock()
+	c.uploads[userID] = key
+	c.mu.Unlock()
+
+	log.Debug().
+		Str("user_id", userID).
+		Str("bucket", c.bucket).
+		Str("key", key).
+		Int("bytes", len(image)).
+		Msg("uploaded profile picture to s3")
+
+	return nil
+}
+
+// download fetches an image, returning its body and media type
+func (c *S3StorageClient) download(ctx context.Context, imageURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image URL: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download profile picture: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to download profile picture: status %d", resp.StatusCode)
+	}
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("profile picture has unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	image, err := io.ReadAll(io.LimitReader(resp.Body, maxProfilePicBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read profile picture: %w", err)
+	}
+	if len(image) > maxProfilePicBytes {
+		return nil, "", fmt.Errorf("profile picture exceeds %d bytes", maxProfilePicBytes)
+	}
+
+	return image, contentType, nil
+}
+
+// GetUploadURL returns the S3 object URL of a user's profile picture, or
+// "" if none was uploaded by this client
+func (c *S3StorageClient) GetUploadURL(userID string) string {
+	c.mu.RLock()
+	key, ok := c.uploads[userID]
+	c.mu.RUnlock()
+
+	if !ok {
+		return ""
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   fmt.Sprintf("%s.s3.%s.amazonaws.com", c.bucket, c.region),
+		Path:   "/" + key,
+	}
+	return u.String()
+}
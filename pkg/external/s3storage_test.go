@@ -0,0 +1,126 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"instagram-user-processor/pkg/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeS3 records PutObject calls, failing them with err when set
+type fakeS3 struct {
+	err    error
+	puts   []*s3.PutObjectInput
+	bodies []string
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.puts = append(f.puts, params)
+	body, _ := io.ReadAll(params.Body)
+	f.bodies = append(f.bodies, string(body))
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+// imageServer serves body with contentType and status for every request
+func imageServer(t *testing.T, status int, contentType, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/pic"
+}
+
+func TestS3UploadProfilePicture(t *testing.T) {
+	api := &fakeS3{}
+	client := NewS3StorageClient(api, S3StorageOptions{Bucket: "pics", Region: "eu-west-1", Prefix: "profile-pics/"})
+	imageURL := imageServer(t, http.StatusOK, "image/png", "png bytes")
+
+	if err := client.UploadProfilePicture(context.Background(), "42", imageURL); err != nil {
+		t.Fatalf("UploadProfilePicture: %v", err)
+	}
+	if len(api.puts) != 1 {
+		t.Fatalf("PutObject called %d times, want 1", len(api.puts))
+	}
+	put := api.puts[0]
+	if aws.ToString(put.Bucket) != "pics" || aws.ToString(put.Key) != "profile-pics/42.png" || aws.ToString(put.ContentType) != "image/png" {
+		t.Errorf("put s3://%s/%s as %s, want s3://pics/profile-pics/42.png as image/png",
+			aws.ToString(put.Bucket), aws.ToString(put.Key), aws.ToString(put.ContentType))
+	}
+	if api.bodies[0] != "png bytes" || aws.ToInt64(put.ContentLength) != int64(len("png bytes")) {
+		t.Errorf("uploaded %q (%d bytes), want the downloaded image", api.bodies[0], aws.ToInt64(put.ContentLength))
+	}
+	if got, want := client.GetUploadURL("42"), "https://pics.s3.eu-west-1.amazonaws.com/profile-pics/42.png"; got != want {
+		t.Errorf("GetUploadURL = %q, want %q", got, want)
+	}
+}
+
+func TestS3UploadProfilePictureFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		ctype   string
+		putErr  error
+		wantPut bool
+		wantErr string
+	}{
+		{"upload error", http.StatusOK, "image/jpeg", errors.New("AccessDenied"), true, "AccessDenied"},
+		{"download error", http.StatusNotFound, "image/jpeg", nil, false, "status 404"},
+		{"not an image", http.StatusOK, "text/html; charset=utf-8", nil, false, "unexpected content type"},
+		{"no content type", http.StatusOK, "", nil, false, "unexpected content type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeS3{err: tt.putErr}
+			client := NewS3StorageClient(api, S3StorageOptions{Bucket: "pics", Region: "eu-west-1"})
+			imageURL := imageServer(t, tt.status, tt.ctype, "body")
+
+			err := client.UploadProfilePicture(context.Background(), "42", imageURL)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+			if (len(api.puts) > 0) != tt.wantPut {
+				t.Errorf("PutObject called %d times", len(api.puts))
+			}
+			if url := client.GetUploadURL("42"); url != "" {
+				t.Errorf("GetUploadURL = %q after a failed upload, want none", url)
+			}
+		})
+	}
+}
+
+func TestInitStorageSelectsBackend(t *testing.T) {
+	resetStorage(t)
+
+	err := InitStorage(context.Background(), &utils.Config{StorageBackend: StorageBackendS3})
+	if err == nil || !strings.Contains(err.Error(), "S3_BUCKET") {
+		t.Errorf("s3 backend without a bucket: error = %v, want S3_BUCKET required", err)
+	}
+
+	err = InitStorage(context.Background(), &utils.Config{StorageBackend: StorageBackendS3, S3Bucket: "pics", S3Region: "eu-west-1"})
+	if err != nil {
+		t.Fatalf("InitStorage(s3): %v", err)
+	}
+	if client, ok := GetStorageClient().(*S3StorageClient); !ok || client.bucket != "pics" {
+		t.Errorf("s3 backend selected %T", GetStorageClient())
+	}
+
+	if err := InitStorage(context.Background(), &utils.Config{StorageBackend: StorageBackendMock}); err != nil {
+		t.Fatalf("InitStorage(mock): %v", err)
+	}
+	if _, ok := GetStorageClient().(*MockStorageClient); !ok {
+		t.Errorf("mock backend selected %T", GetStorageClient())
+	}
+}
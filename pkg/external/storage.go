@@ -3,6 +3,7 @@ package external
 import (
 	"context"
 	"fmt"
+	"instagram-user-processor/pkg/utils"
 	"sync"
 	"time"
 
@@ -91,18 +92,52 @@ func (m *MockStorageClient) GetUploads() map[string]string {
 }
 
 // Global mock storage client instance
-var mockStorage *MockStorageClient
+var (
+	mockStorage     *MockStorageClient
+	mockStorageOnce sync.Once
+)
+
+// storageClient is the client selected by InitStorage
+var storageClient StorageClient
+
+// Storage backends selectable with STORAGE_BACKEND
+const (
+	StorageBackendMock = "mock"
+	StorageBackendS3   = "s3"
+)
 
-// InitMockStorage initializes the global mock storage client
+// InitStorage selects the storage client for config.StorageBackend
+func InitStorage(ctx context.Context, config *utils.Config) error {
+	switch config.StorageBackend {
+	case StorageBackendS3:
+		client, err := newS3StorageClientFromConfig(ctx, config)
+		if err != nil {
+			return err
+		}
+		storageClient = client
+		log.Info().Str("bucket", config.S3Bucket).Str("region", config.S3Region).Msg("S3 storage client initialized")
+	default:
+		InitMockStorage()
+		storageClient = mockStorage
+	}
+	return nil
+}
+
+// InitMockStorage initializes the global mock storage client. Only the
+// first call has an effect.
 func InitMockStorage() {
-	mockStorage = NewMockStorageClient()
-	log.Info().Msg("Mock storage client initialized")
+	mockStorageOnce.Do(func() {
+		mockStorage = NewMockStorageClient()
+		log.Info().Msg("Mock storage client initialized")
+	})
 }
 
-// GetStorageClient returns the global storage client
+// GetStorageClient returns the storage client selected by InitStorage, or
+// the mock client if InitStorage wasn't called. Safe for concurrent use.
 func GetStorageClient() StorageClient {
-	if mockStorage == nil {
-		InitMockStorage()
+	if storageClient != nil {
+		return storageClient
 	}
+	InitMockStorage()
 	return mockStorage
-}
\ No newline at end of file
+}
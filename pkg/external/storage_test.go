@@ -0,0 +1,63 @@
+package external
+
+import (
+	"context"
+	"instagram-user-processor/pkg/utils"
+	"sync"
+	"testing"
+)
+
+// resetStorage clears the storage globals for the duration of the test
+func resetStorage(t *testing.T) {
+	t.Helper()
+	prevMock, prevClient := mockStorage, storageClient
+	mockStorage, mockStorageOnce, storageClient = nil, sync.Once{}, nil
+	t.Cleanup(func() {
+		mockStorage, mockStorageOnce, storageClient = prevMock, sync.Once{}, prevClient
+	})
+}
+
+func TestGetStorageClientConcurrentFirstCallsShareOneClient(t *testing.T) {
+	resetStorage(t)
+
+	const callers = 50
+	clients := make([]StorageClient, callers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			clients[i] = GetStorageClient()
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, client := range clients {
+		if client == nil || client != clients[0] {
+			t.Fatalf("caller %d got client %p, want the shared %p", i, client, clients[0])
+		}
+	}
+
+	// Uploads through any caller's client land in the same store
+	if err := clients[callers-1].UploadProfilePicture(context.Background(), "1", "https://example.com/1.jpg"); err != nil {
+		t.Fatalf("UploadProfilePicture: %v", err)
+	}
+	if url := clients[0].GetUploadURL("1"); url == "" {
+		t.Error("upload not visible through another caller's client")
+	}
+}
+
+func TestInitStorageMockMatchesLazyClient(t *testing.T) {
+	resetStorage(t)
+
+	lazy := GetStorageClient()
+	if err := InitStorage(context.Background(), &utils.Config{StorageBackend: StorageBackendMock}); err != nil {
+		t.Fatalf("InitStorage: %v", err)
+	}
+	if GetStorageClient() != lazy {
+		t.Error("InitStorage replaced the lazily created mock client")
+	}
+}
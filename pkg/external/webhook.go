@@ -0,0 +1,300 @@
+package external
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"instagram-user-processor/pkg/utils"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader carries "sha256=<hex HMAC>" of the timestamp,
+	// a ".", and the request body
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// WebhookTimestampHeader carries the unix time the delivery was signed
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+
+	maxWebhookAttempts   = 4
+	webhookBaseDelayMS   = 500
+	webhookLookupTimeout = 5 * time.Second
+	maxCallbackURLLength = 2048
+)
+
+// ErrWebhooksDisabled is returned when no webhook secret is configured
+var ErrWebhooksDisabled = errors.New("webhook callbacks are disabled")
+
+// errDisallowedDestination is returned when a callback resolves to an
+// internal address at dial time
+var errDisallowedDestination = errors.New("webhook destination is not allowed")
+
+// WebhookClient delivers signed JSON payloads to callback URLs. Requests
+// to loopback, private and link-local addresses are refused at dial time,
+// so a hostname that resolves to one after validation is still blocked.
+type WebhookClient struct {
+	secret       []byte
+	httpClient   *http.Client
+	allowPrivate bool
+}
+
+// WebhookOptions configures a WebhookClient. Zero values use defaults.
+type WebhookOptions struct {
+	Secret  string
+	Timeout time.Duration // per delivery attempt
+
+	// AllowPrivate permits loopback and private destinations, for tests
+	// and local development only
+	AllowPrivate bool
+}
+
+// NewWebhookClient creates a webhook client
+func NewWebhookClient(opts WebhookOptions) *WebhookClient {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	c := &WebhookClient{
+		secret:       []byte(opts.Secret),
+		allowPrivate: opts.AllowPrivate,
+	}
+
+	dialer := &net.Dialer{
+		Timeout: opts.Timeout,
+		Control: c.checkDialAddress,
+	}
+	c.httpClient = &http.Client{
+		Timeout: opts.Timeout,
+		// No proxy: the dial check must see the callback's own address
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: opts.Timeout,
+		},
+		// Redirects could point a validated URL at an internal address
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return c
+}
+
+// webhookClient is used by the package-level webhook functions, nil when
+// callbacks are disabled
+var webhookClient *WebhookClient
+
+// InitWebhooks sets up the webhook client from config. Callbacks stay
+// disabled when WEBHOOK_SECRET is unset.
+func InitWebhooks(config *utils.Config) {
+	if config.WebhookSecret == "" {
+		webhookClient = nil
+		return
+	}
+
+	webhookClient = NewWebhookClient(WebhookOptions{
+		Secret:  config.WebhookSecret,
+		Timeout: time.Duration(config.WebhookTimeoutSeconds) * time.Second,
+	})
+}
+
+// SetWebhookClient replaces the client used for batch job callbacks, e.g.
+// with one allowing loopback receivers in tests. nil disables callbacks.
+func SetWebhookClient(c *WebhookClient) {
+	webhookClient = c
+}
+
+// ValidateCallbackURL checks rawURL with the configured webhook client
+func ValidateCallbackURL(ctx context.Context, rawURL string) error {
+	if webhookClient == nil {
+		return ErrWebhooksDisabled
+	}
+	return webhookClient.ValidateURL(ctx, rawURL)
+}
+
+// DeliverWebhook sends payload with the configured webhook client
+func DeliverWebhook(ctx context.Context, callbackURL string, payload interface{}) error {
+	if webhookClient == nil {
+		return ErrWebhooksDisabled
+	}
+	return webhookClient.Deliver(ctx, callbackURL, payload)
+}
+
+// ValidateURL accepts absolute http(s) URLs whose host is not, and does
+// not resolve to, a loopback, private or link-local address
+func (c *WebhookClient) ValidateURL(ctx context.Context, rawURL string) error {
+	if len(rawURL) > maxCallbackURLLength {
+		return fmt.Errorf("callback URL exceeds %d characters", maxCallbackURLLength)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid callback URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback URL must use http or https")
+	}
+	if u.User != nil {
+		return fmt.Errorf("callback URL must not contain credentials")
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("callback URL must include a host")
+	}
+	if c.allowPrivate {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if disallowedWebhookIP(ip) {
+			return fmt.Errorf("callback URL must not point at a private or loopback address")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookLookupTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("callback host %q could not be resolved", host)
+	}
+	for _, addr := range addrs {
+		if disallowedWebhookIP(addr.IP) {
+			return fmt.Errorf("callback URL must not point at a private or loopback address")
+		}
+	}
+	return nil
+}
+
+// Deliver POSTs payload as signed JSON to callbackURL, retrying network
+// errors, 429 and 5xx responses with exponential backoff. Other non-2xx
+// responses fail without retrying.
+func (c *WebhookClient) Deliver(ctx context.Context, callbackURL string, payload interface{}) error {
+	logger := utils.LoggerFromContext(ctx)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	attempts := make([]RetryAttempt, 0, maxWebhookAttempts)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for attempt := 0; attempt < maxWebhookAttempts; attempt++ {
+		retryable, err := c.post(ctx, callbackURL, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt == maxWebhookAttempts-1 {
+			attempts = append(attempts, RetryAttempt{Attempt: attempt + 1, Err: err})
+			break
+		}
+
+		delay := time.Duration(webhookBaseDelayMS*int(math.Pow(2, float64(attempt)))) * time.Millisecond
+		delay = backoffJitter(delay, rng)
+		attempts = append(attempts, RetryAttempt{Attempt: attempt + 1, Err: err, Delay: delay})
+
+		logger.Warn().
+			Err(err).
+			Int("attempt", attempt+1).
+			Dur("retry_delay", delay).
+			Msg("webhook delivery failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	return RetryError{Operation: "webhook delivery", Attempts: attempts}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying
+func (c *WebhookClient) post(ctx context.Context, callbackURL string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(c.secret, timestamp, body))
+	if requestID := utils.RequestIDFromContext(ctx); requestID != "" {
+		req.Header.Set(utils.RequestIDHeader, requestID)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		retryable := ctx.Err() == nil && !errors.Is(err, errDisallowedDestination)
+		return retryable, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("webhook receiver returned status %d", resp.StatusCode)
+}
+
+// SignWebhookPayload returns the signature header value for body signed at
+// timestamp. Receivers recompute it with the shared secret and compare
+// with hmac.Equal.
+func SignWebhookPayload(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkDialAddress refuses connections to disallowed addresses after DNS
+// resolution
+func (c *WebhookClient) checkDialAddress(_, address string, _ syscall.RawConn) error {
+	if c.allowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || disallowedWebhookIP(ip) {
+		return fmt.Errorf("%w: %s", errDisallowedDestination, host)
+	}
+	return nil
+}
+
+// cgnatRange is the carrier-grade NAT shared address space, not covered by
+// net.IP.IsPrivate
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// disallowedWebhookIP reports whether ip is internal to the deployment
+func disallowedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		cgnatRange.Contains(ip)
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "instagram_processor"
+
+// Scrape outcomes recorded by ObserveScrape
+const (
+	ScrapeSuccess  = "success"
+	ScrapeNotFound = "not_found"
+	ScrapeFailure  = "failure"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	scrapeAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rocketapi_scrape_attempts_total",
+		Help:      "RocketAPI requests made, including retries.",
+	})
+
+	scrapeRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rocketapi_scrape_retries_total",
+		Help:      "RocketAPI requests retried after a failed attempt.",
+	})
+
+	scrapeResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rocketapi_scrapes_total",
+		Help:      "User scrapes by final outcome (success, not_found, failure).",
+	}, []string{"outcome"})
+
+	workerTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "worker_pool_tasks_total",
+		Help:      "Worker pool tasks processed by result (ok, error).",
+	}, []string{"result"})
+
+	workerQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_pool_queued_tasks",
+		Help:      "Tasks waiting in worker pool buffers.",
+	})
+
+	workerInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_pool_in_flight_tasks",
+		Help:      "Tasks being processed by worker pool workers.",
+	})
+
+	userUpserts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "user_upserts_total",
+		Help:      "Scraped user writes by result (inserted, updated, skipped).",
+	}, []string{"result"})
+
+	batchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_duration_seconds",
+		Help:      "Batch processing duration by mode (sync, stream, async).",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"mode"})
+)
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveHTTPRequest records a served HTTP request
+func ObserveHTTPRequest(method, route string, status int, duration time.Duration) {
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// IncScrapeAttempt records a single RocketAPI request
+func IncScrapeAttempt() {
+	scrapeAttempts.Inc()
+}
+
+// IncScrapeRetry records a RocketAPI request being retried
+func IncScrapeRetry() {
+	scrapeRetries.Inc()
+}
+
+// ObserveScrape records the final outcome of a user scrape
+func ObserveScrape(outcome string) {
+	scrapeResults.WithLabelValues(outcome).Inc()
+}
+
+// ObserveWorkerTask records a processed worker pool task
+func ObserveWorkerTask(err error) {
+	if err != nil {
+		workerTasks.WithLabelValues("error").Inc()
+		return
+	}
+	workerTasks.WithLabelValues("ok").Inc()
+}
+
+// AddWorkerQueued adjusts the number of tasks waiting in worker pools
+func AddWorkerQueued(delta int64) {
+	workerQueued.Add(float64(delta))
+}
+
+// AddWorkerInFlight adjusts the number of tasks being processed by
+// worker pools
+func AddWorkerInFlight(delta int64) {
+	workerInFlight.Add(float64(delta))
+}
+
+// ObserveUserUpsert records the result of writing a scraped user:
+// "inserted" for a newly discovered account, "updated", or "skipped" when
+// a newer scrape was already stored
+func ObserveUserUpsert(result string) {
+	userUpserts.WithLabelValues(result).Inc()
+}
+
+// ObserveBatch records how long a batch took to process
+func ObserveBatch(mode string, duration time.Duration) {
+	batchDuration.WithLabelValues(mode).Observe(duration.Seconds())
+}
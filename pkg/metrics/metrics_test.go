@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the metrics exposition served by Handler
+func scrape(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics status = %d", w.Code)
+	}
+	body, _ := io.ReadAll(w.Body)
+	return string(body)
+}
+
+func TestMetricFamiliesAreExposed(t *testing.T) {
+	ObserveHTTPRequest(http.MethodGet, "/api/v1/instagram/user/:username", http.StatusOK, 10*time.Millisecond)
+	IncScrapeAttempt()
+	IncScrapeRetry()
+	ObserveScrape(ScrapeSuccess)
+	ObserveWorkerTask(nil)
+	ObserveWorkerTask(errors.New("failed"))
+	AddWorkerQueued(0)
+	AddWorkerInFlight(0)
+	ObserveUserUpsert("inserted")
+	ObserveBatch("sync", time.Second)
+
+	out := scrape(t)
+	for _, family := range []string{
+		"http_requests_total",
+		"http_request_duration_seconds",
+		"rocketapi_scrape_attempts_total",
+		"rocketapi_scrape_retries_total",
+		"rocketapi_scrapes_total",
+		"worker_pool_tasks_total",
+		"worker_pool_queued_tasks",
+		"worker_pool_in_flight_tasks",
+		"user_upserts_total",
+		"batch_duration_seconds",
+	} {
+		if !strings.Contains(out, "# TYPE "+namespace+"_"+family+" ") {
+			t.Errorf("metrics output has no %s family", family)
+		}
+	}
+
+	for _, series := range []string{
+		`instagram_processor_http_requests_total{method="GET",route="/api/v1/instagram/user/:username",status="200"}`,
+		`instagram_processor_rocketapi_scrapes_total{outcome="success"}`,
+		`instagram_processor_worker_pool_tasks_total{result="error"}`,
+		`instagram_processor_batch_duration_seconds_count{mode="sync"}`,
+	} {
+		if !strings.Contains(out, series) {
+			t.Errorf("metrics output has no %s series", series)
+		}
+	}
+}
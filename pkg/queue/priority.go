@@ -0,0 +1,66 @@
+package queue
+
+import "container/heap"
+
+// PriorityTask is a Task with a priority. Priority worker pools run higher
+// priorities first.
+type PriorityTask interface {
+	Task
+	Priority() int
+}
+
+// priorityOf returns a task's priority, 0 for tasks without one
+func priorityOf(task Task) int {
+	if retry, ok := task.(*retryTask); ok {
+		task = retry.Task
+	}
+	if prioritized, ok := task.(PriorityTask); ok {
+		return prioritized.Priority()
+	}
+	return 0
+}
+
+// queuedTask is a task waiting in a taskHeap
+type queuedTask struct {
+	task     Task
+	priority int
+	seq      uint64 // enqueue order, breaks priority ties
+}
+
+// taskHeap orders tasks by descending priority, then enqueue order. It
+// isn't safe for concurrent use.
+type taskHeap struct {
+	items []queuedTask
+	seq   uint64
+}
+
+// pushTask adds a task to the heap
+func (h *taskHeap) pushTask(task Task) {
+	h.seq++
+	heap.Push(h, queuedTask{task: task, priority: priorityOf(task), seq: h.seq})
+}
+
+// popTask removes and returns the next task, which must exist
+func (h *taskHeap) popTask() Task {
+	return heap.Pop(h).(queuedTask).task
+}
+
+func (h *taskHeap) Len() int { return len(h.items) }
+
+func (h *taskHeap) Less(i, j int) bool {
+	if h.items[i].priority != h.items[j].priority {
+		return h.items[i].priority > h.items[j].priority
+	}
+	return h.items[i].seq < h.items[j].seq
+}
+
+func (h *taskHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *taskHeap) Push(x interface{}) { h.items = append(h.items, x.(queuedTask)) }
+
+func (h *taskHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items[len(h.items)-1] = queuedTask{}
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// plainTask is a Task without a priority
+type plainTask struct {
+	name string
+	run  func(name string)
+}
+
+func (t plainTask) ID() string { return t.name }
+
+func (t plainTask) Process(context.Context) error {
+	t.run(t.name)
+	return nil
+}
+
+func TestPriorityPoolDequeuesHighestFirst(t *testing.T) {
+	wp := NewPriorityWorkerPool(WorkerPoolOptions{NumWorkers: 1, BufferSize: 10, Logger: &quietLogger})
+	wp.Start()
+
+	// Hold the only worker so every task below is queued before any runs
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	if err := wp.EnqueueTask(blockingTask(0, started, release)); err != nil {
+		t.Fatalf("EnqueueTask: %v", err)
+	}
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+	prioritized := func(name string, level int) Task {
+		return &UserProcessingTask{
+			Username:  name,
+			Level:     level,
+			Processor: func(_ context.Context, username string) error { record(username); return nil },
+		}
+	}
+
+	tasks := []Task{
+		prioritized("low", -1),
+		plainTask{name: "plain1", run: record},
+		prioritized("creator1", 10),
+		prioritized("mid", 5),
+		plainTask{name: "plain2", run: record},
+		prioritized("creator2", 10),
+		prioritized("zero", 0),
+	}
+	for _, task := range tasks {
+		if err := wp.EnqueueTask(task); err != nil {
+			t.Fatalf("EnqueueTask %s: %v", task.ID(), err)
+		}
+	}
+	close(release)
+	wp.Stop()
+
+	// Equal priorities, including tasks without one, keep enqueue order
+	want := []string{"creator1", "creator2", "mid", "plain1", "plain2", "zero", "low"}
+	if !slices.Equal(order, want) {
+		t.Errorf("ran %v, want %v", order, want)
+	}
+	if stats := wp.QueueStats(); stats.Processed != int64(len(tasks)+1) || stats.Queued != 0 {
+		t.Errorf("stats = %+v, want %d processed", stats, len(tasks)+1)
+	}
+}
+
+func TestPriorityPoolBufferBoundsQueuedTasks(t *testing.T) {
+	wp := NewPriorityWorkerPool(WorkerPoolOptions{NumWorkers: 1, BufferSize: 2, Logger: &quietLogger})
+	wp.Start()
+
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	defer func() {
+		close(release)
+		wp.Stop()
+	}()
+
+	if err := wp.EnqueueTask(blockingTask(0, started, release)); err != nil {
+		t.Fatalf("EnqueueTask: %v", err)
+	}
+	<-started
+	for i := 1; i <= 2; i++ {
+		if err := wp.EnqueueTask(blockingTask(i, started, release)); err != nil {
+			t.Fatalf("EnqueueTask %d: %v", i, err)
+		}
+	}
+
+	if err := wp.EnqueueTask(blockingTask(3, started, release)); err == nil {
+		t.Error("EnqueueTask on a full priority pool succeeded")
+	}
+	if stats := wp.QueueStats(); stats.Queued != 2 {
+		t.Errorf("queued = %d, want 2", stats.Queued)
+	}
+}
+
+func TestEnqueueRacingStopDoesntPanic(t *testing.T) {
+	for name, newPool := range map[string]func(WorkerPoolOptions) *WorkerPool{
+		"fifo":     NewWorkerPool,
+		"priority": NewPriorityWorkerPool,
+	} {
+		t.Run(name, func(t *testing.T) {
+			for round := 0; round < 50; round++ {
+				wp := newPool(WorkerPoolOptions{NumWorkers: 2, BufferSize: 4, Logger: &quietLogger})
+				wp.Start()
+
+				var mu sync.Mutex
+				var ran, accepted int
+				var wg sync.WaitGroup
+				for g := 0; g < 4; g++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < 20; i++ {
+							task := plainTask{name: "task", run: func(string) {
+								mu.Lock()
+								ran++
+								mu.Unlock()
+							}}
+							if wp.EnqueueTask(task) == nil {
+								mu.Lock()
+								accepted++
+								mu.Unlock()
+							}
+						}
+					}()
+				}
+				wp.Stop()
+				wg.Wait()
+
+				if err := wp.EnqueueTask(plainTask{name: "late", run: func(string) {}}); !errors.Is(err, ErrPoolStopped) {
+					t.Fatalf("EnqueueTask after Stop = %v, want ErrPoolStopped", err)
+				}
+				if ran != accepted {
+					t.Fatalf("ran %d of %d accepted tasks", ran, accepted)
+				}
+			}
+		})
+	}
+}
+
+func TestTaskHeapOrder(t *testing.T) {
+	h := &taskHeap{}
+	for _, task := range []Task{
+		&UserProcessingTask{Username: "a", Level: 1},
+		&UserProcessingTask{Username: "b", Level: 3},
+		&retryTask{Task: &UserProcessingTask{Username: "c", Level: 2}, attempt: 1},
+		&UserProcessingTask{Username: "d", Level: 3},
+	} {
+		h.pushTask(task)
+	}
+
+	var got []string
+	for h.Len() > 0 {
+		got = append(got, h.popTask().ID())
+	}
+	want := []string{"user_processing:b", "user_processing:d", "user_processing:c", "user_processing:a"}
+	if !slices.Equal(got, want) {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+}
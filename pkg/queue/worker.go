@@ -2,12 +2,15 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"instagram-user-processor/pkg/metrics"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -17,6 +20,24 @@ type Task interface {
 	Process(ctx context.Context) error
 }
 
+// RetryableTask is a Task that is re-enqueued with backoff when it fails,
+// up to MaxRetries times before its error is recorded
+type RetryableTask interface {
+	Task
+	MaxRetries() int
+}
+
+// retryTask is a RetryableTask re-entering the queue after a failure
+type retryTask struct {
+	Task
+	attempt int // retries so far
+}
+
+const (
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	maxRetryDelay         = 30 * time.Second
+)
+
 // WorkerPool manages a pool of workers processing tasks
 type WorkerPool struct {
 	numWorkers     int
@@ -26,9 +47,50 @@ type WorkerPool struct {
 	cancel         context.CancelFunc
 	processedCount int64
 	errorCount     int64
+	queuedCount    int64 // enqueued tasks not yet picked up by a worker
+	inFlightCount  int64 // tasks currently being processed
 	mu             sync.RWMutex
 	errors         []error
 	maxErrors      int
+	logger         *zerolog.Logger
+
+	// pending counts enqueued tasks until they succeed or fail for good,
+	// including retries waiting out their backoff
+	pending        sync.WaitGroup
+	retryBaseDelay time.Duration
+
+	// closeMu keeps enqueues and retries from sending on taskChan once
+	// it's closed. draining refuses new tasks once Stop has begun.
+	closeMu  sync.RWMutex
+	closed   bool
+	draining bool
+
+	// In priority mode tasks wait in tasks, ordered by priority, and
+	// taskChan carries one nil wakeup per task. slots bounds the heap to
+	// the buffer size so enqueues block or fail like FIFO ones do.
+	tasks   *taskHeap
+	tasksMu sync.Mutex
+	slots   chan Task
+
+	// results is nil unless WorkerPoolOptions.EmitResults is set;
+	// resultsMu keeps late publishers off it once it's closed
+	results       chan TaskResult
+	resultsMu     sync.RWMutex
+	resultsClosed bool
+
+	// stopping is closed when Stop begins. From then on results that
+	// don't fit in the channel wait in overflow instead of blocking Stop.
+	stopping   chan struct{}
+	stopOnce   sync.Once
+	overflow   []TaskResult
+	overflowMu sync.Mutex
+}
+
+// TaskResult reports a task's final outcome on WorkerPool.Results
+type TaskResult struct {
+	TaskID   string
+	Err      error
+	Duration time.Duration // of the final attempt
 }
 
 // WorkerPoolOptions configures the worker pool
@@ -37,6 +99,15 @@ type WorkerPoolOptions struct {
 	BufferSize     int
 	MaxErrors      int
 	WorkerTimeout  time.Duration
+	Logger         *zerolog.Logger // defaults to the global logger
+	RetryBaseDelay time.Duration   // delay before a RetryableTask's first retry, doubled per retry
+
+	// EmitResults publishes a TaskResult per finished task on Results.
+	// The channel holds BufferSize results and workers wait while it's
+	// full, so it must be consumed while tasks run. Once Stop begins,
+	// results that don't fit are held back instead, so Stop never waits
+	// on the consumer.
+	EmitResults bool
 }
 
 // NewWorkerPool creates a new worker pool
@@ -50,51 +121,248 @@ func NewWorkerPool(opts WorkerPoolOptions) *WorkerPool {
 	if opts.MaxErrors <= 0 {
 		opts.MaxErrors = 100
 	}
+	if opts.Logger == nil {
+		opts.Logger = &log.Logger
+	}
+	if opts.RetryBaseDelay <= 0 {
+		opts.RetryBaseDelay = defaultRetryBaseDelay
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	var results chan TaskResult
+	if opts.EmitResults {
+		results = make(chan TaskResult, opts.BufferSize)
+	}
+
 	return &WorkerPool{
-		numWorkers: opts.NumWorkers,
-		taskChan:   make(chan Task, opts.BufferSize),
-		ctx:        ctx,
-		cancel:     cancel,
-		errors:     make([]error, 0),
-		maxErrors:  opts.MaxErrors,
+		numWorkers:     opts.NumWorkers,
+		taskChan:       make(chan Task, opts.BufferSize),
+		ctx:            ctx,
+		cancel:         cancel,
+		errors:         make([]error, 0),
+		maxErrors:      opts.MaxErrors,
+		logger:         opts.Logger,
+		retryBaseDelay: opts.RetryBaseDelay,
+		results:        results,
+		stopping:       make(chan struct{}),
 	}
 }
 
+// NewPriorityWorkerPool creates a worker pool that dequeues PriorityTasks
+// with higher Priority() first. Tasks without a priority count as 0, and
+// equal priorities run in enqueue order.
+func NewPriorityWorkerPool(opts WorkerPoolOptions) *WorkerPool {
+	wp := NewWorkerPool(opts)
+	wp.tasks = &taskHeap{}
+	wp.slots = make(chan Task, cap(wp.taskChan))
+	return wp
+}
+
 // Start starts the worker pool
 func (wp *WorkerPool) Start() {
-	log.Info().Int("workers", wp.numWorkers).Msg("starting worker pool")
+	wp.logger.Info().Int("workers", wp.numWorkers).Msg("starting worker pool")
 
 	for i := 0; i < wp.numWorkers; i++ {
 		wp.wg.Add(1)
 		go wp.worker(i)
 	}
+
+	// Tasks left in the buffer of a cancelled pool are never picked up,
+	// so take them off the queued gauge once the workers are gone
+	go func() {
+		wp.wg.Wait()
+		metrics.AddWorkerQueued(-atomic.SwapInt64(&wp.queuedCount, 0))
+	}()
 }
 
-// EnqueueTask adds a task to the queue
+// ErrPoolStopped is returned when enqueueing a task once Stop has begun
+var ErrPoolStopped = errors.New("worker pool stopped")
+
+// EnqueueTask adds a task to the queue without waiting, failing fast with
+// "task queue is full" when the buffer has no room. Use EnqueueTaskBlocking
+// to wait for space instead.
 func (wp *WorkerPool) EnqueueTask(task Task) error {
-	select {
-	case wp.taskChan <- task:
-		return nil
-	case <-wp.ctx.Done():
-		return wp.ctx.Err()
-	default:
-		return fmt.Errorf("task queue is full")
+	return wp.enqueue(wp.ctx, task, false)
+}
+
+// EnqueueTaskBlocking adds a task to the queue, waiting for buffer space
+// until ctx is done. It returns ctx's error if ctx ends first, or the
+// pool's if the pool is cancelled.
+func (wp *WorkerPool) EnqueueTaskBlocking(ctx context.Context, task Task) error {
+	return wp.enqueue(ctx, task, true)
+}
+
+// enqueue counts a new task as pending and sends it, refusing it once Stop
+// has begun so the queue is never sent on after it's closed
+func (wp *WorkerPool) enqueue(ctx context.Context, task Task, wait bool) error {
+	wp.closeMu.RLock()
+	defer wp.closeMu.RUnlock()
+
+	if wp.draining {
+		return ErrPoolStopped
+	}
+
+	wp.pending.Add(1)
+	if err := wp.send(ctx, task, wait); err != nil {
+		wp.pending.Done()
+		return err
+	}
+	return nil
+}
+
+// send puts a task on the queue. With wait set it waits for buffer space
+// until ctx or the pool is done, otherwise it fails fast when full. Callers
+// hold closeMu.RLock and have checked the queue isn't closed.
+func (wp *WorkerPool) send(ctx context.Context, task Task, wait bool) error {
+	admit, item := wp.taskChan, task
+	if wp.tasks != nil {
+		admit, item = wp.slots, nil
+	}
+
+	// Count the task before a worker can pick it up, so queued never
+	// goes negative
+	wp.addQueued(1)
+
+	if !wait {
+		select {
+		case admit <- item:
+		case <-wp.ctx.Done():
+			wp.addQueued(-1)
+			return wp.ctx.Err()
+		default:
+			wp.addQueued(-1)
+			return fmt.Errorf("task queue is full")
+		}
+	} else {
+		select {
+		case admit <- item:
+		case <-ctx.Done():
+			wp.addQueued(-1)
+			return ctx.Err()
+		case <-wp.ctx.Done():
+			wp.addQueued(-1)
+			return wp.ctx.Err()
+		}
 	}
+
+	if wp.tasks != nil {
+		wp.tasksMu.Lock()
+		wp.tasks.pushTask(task)
+		wp.tasksMu.Unlock()
+
+		// Never blocks: there is at most one wakeup per slot
+		wp.taskChan <- nil
+	}
+
+	return nil
 }
 
-// Stop gracefully stops the worker pool
+// addQueued adjusts the queued task count and gauge
+func (wp *WorkerPool) addQueued(delta int64) {
+	atomic.AddInt64(&wp.queuedCount, delta)
+	metrics.AddWorkerQueued(delta)
+}
+
+// addInFlight adjusts the in-flight task count and gauge
+func (wp *WorkerPool) addInFlight(delta int64) {
+	atomic.AddInt64(&wp.inFlightCount, delta)
+	metrics.AddWorkerInFlight(delta)
+}
+
+// nextPriorityTask pops the highest priority task and frees its slot. A
+// wakeup is only sent after its task is pushed, so the heap isn't empty.
+func (wp *WorkerPool) nextPriorityTask() Task {
+	wp.tasksMu.Lock()
+	task := wp.tasks.popTask()
+	wp.tasksMu.Unlock()
+
+	<-wp.slots
+	return task
+}
+
+// ErrStopTimeout is returned by StopWithTimeout when workers didn't drain
+// the queue in time and were cancelled
+var ErrStopTimeout = errors.New("worker pool did not drain in time, remaining tasks were cancelled")
+
+// Stop gracefully stops the worker pool, waiting for queued and running
+// tasks to finish however long they take
 func (wp *WorkerPool) Stop() {
-	close(wp.taskChan)
-	wp.wg.Wait()
-	wp.cancel()
+	wp.StopWithTimeout(0)
+}
+
+// StopWithTimeout refuses new tasks with ErrPoolStopped and waits up to d
+// for workers to drain the queue, including pending retries, then stops
+// them. If d passes first, the pool context is
+// cancelled so running tasks can abort, and ErrStopTimeout is returned
+// without waiting for them. d <= 0 waits without a deadline.
+func (wp *WorkerPool) StopWithTimeout(d time.Duration) error {
+	wp.stopOnce.Do(func() { close(wp.stopping) })
 
-	log.Info().
+	done := make(chan struct{})
+	go func() {
+		// Refuse new tasks before waiting on pending ones. An enqueue
+		// holding closeMu may be waiting on workers, which no longer
+		// block on a full Results now that stopping is closed.
+		wp.closeMu.Lock()
+		wp.draining = true
+		wp.closeMu.Unlock()
+
+		// Failed tasks may re-enter the queue, so it can only be closed
+		// once every task has finished
+		wp.waitPending()
+		wp.closeMu.Lock()
+		if !wp.closed {
+			wp.closed = true
+			close(wp.taskChan)
+		}
+		wp.closeMu.Unlock()
+
+		wp.wg.Wait()
+		wp.closeResults()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-done:
+		wp.cancel()
+	case <-timeout:
+		wp.cancel()
+		wp.logger.Warn().
+			Dur("timeout", d).
+			Int64("in_flight", atomic.LoadInt64(&wp.inFlightCount)).
+			Int64("queued", atomic.LoadInt64(&wp.queuedCount)).
+			Msg("worker pool stop timed out, cancelling tasks")
+		return ErrStopTimeout
+	}
+
+	wp.logger.Info().
 		Int64("processed", atomic.LoadInt64(&wp.processedCount)).
 		Int64("errors", atomic.LoadInt64(&wp.errorCount)).
 		Msg("worker pool stopped")
+	return nil
+}
+
+// waitPending waits until every enqueued task has finished or the pool is
+// cancelled
+func (wp *WorkerPool) waitPending() {
+	drained := make(chan struct{})
+	go func() {
+		wp.pending.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-wp.ctx.Done():
+	}
 }
 
 // WaitForCompletion waits for all tasks to complete or context to be cancelled
@@ -107,18 +375,105 @@ func (wp *WorkerPool) WaitForCompletion(ctx context.Context) {
 
 	select {
 	case <-done:
-		log.Debug().Msg("all workers completed")
+		wp.logger.Debug().Msg("all workers completed")
 	case <-ctx.Done():
-		log.Warn().Msg("worker pool cancelled")
+		wp.logger.Warn().Msg("worker pool cancelled")
 		wp.cancel()
 	}
 }
 
+// Results returns the channel of per-task outcomes, or nil unless the pool
+// was created with EmitResults. It is closed after the last result once
+// Stop has drained the pool and its workers have exited, so consumers can
+// range over it. Results held back during Stop are delivered after the
+// buffered ones, possibly after Stop returns.
+func (wp *WorkerPool) Results() <-chan TaskResult {
+	return wp.results
+}
+
+// publishResult sends a finished task's outcome to Results, giving up if
+// the pool is cancelled while the channel is full. Once Stop has begun a
+// result that doesn't fit is held in overflow, since Stop waits for every
+// task and there may be no consumer.
+func (wp *WorkerPool) publishResult(result TaskResult) {
+	if wp.results == nil {
+		return
+	}
+
+	wp.resultsMu.RLock()
+	defer wp.resultsMu.RUnlock()
+
+	if wp.resultsClosed {
+		return
+	}
+	select {
+	case wp.results <- result:
+	case <-wp.ctx.Done():
+	case <-wp.stopping:
+		select {
+		case wp.results <- result:
+		default:
+			wp.overflowMu.Lock()
+			wp.overflow = append(wp.overflow, result)
+			wp.overflowMu.Unlock()
+		}
+	}
+}
+
+// closeResults closes Results once no more tasks can finish. Results held
+// in overflow are delivered first, as the consumer makes room.
+func (wp *WorkerPool) closeResults() {
+	if wp.results == nil {
+		return
+	}
+
+	wp.resultsMu.Lock()
+	defer wp.resultsMu.Unlock()
+
+	wp.resultsClosed = true
+
+	wp.overflowMu.Lock()
+	overflow := wp.overflow
+	wp.overflow = nil
+	wp.overflowMu.Unlock()
+
+	if len(overflow) == 0 {
+		close(wp.results)
+		return
+	}
+	go func() {
+		for _, result := range overflow {
+			wp.results <- result
+		}
+		close(wp.results)
+	}()
+}
+
 // GetStats returns processing statistics
 func (wp *WorkerPool) GetStats() (processed int64, errors int64) {
 	return atomic.LoadInt64(&wp.processedCount), atomic.LoadInt64(&wp.errorCount)
 }
 
+// QueueStats is a snapshot of a worker pool's task counters
+type QueueStats struct {
+	Queued    int64 // waiting in the buffer
+	InFlight  int64 // being processed by a worker
+	Processed int64
+	Errors    int64
+}
+
+// QueueStats returns the pool's current backlog and totals. Queued near
+// the buffer size with InFlight at the worker count means the pool is
+// saturated.
+func (wp *WorkerPool) QueueStats() QueueStats {
+	return QueueStats{
+		Queued:    atomic.LoadInt64(&wp.queuedCount),
+		InFlight:  atomic.LoadInt64(&wp.inFlightCount),
+		Processed: atomic.LoadInt64(&wp.processedCount),
+		Errors:    atomic.LoadInt64(&wp.errorCount),
+	}
+}
+
 // GetErrors returns all errors encountered
 func (wp *WorkerPool) GetErrors() []error {
 	wp.mu.RLock()
@@ -129,24 +484,36 @@ func (wp *WorkerPool) GetErrors() []error {
 	return errors
 }
 
+// ClearErrors discards recorded errors so a long-lived pool can be reused
+// for a new job without reporting errors from the previous one
+func (wp *WorkerPool) ClearErrors() {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	wp.errors = make([]error, 0)
+}
+
 // worker processes tasks from the queue
 func (wp *WorkerPool) worker(workerID int) {
 	defer wp.wg.Done()
 
-	log.Debug().Int("worker_id", workerID).Msg("worker started")
+	wp.logger.Debug().Int("worker_id", workerID).Msg("worker started")
 
 	for {
 		select {
 		case task, ok := <-wp.taskChan:
 			if !ok {
-				log.Debug().Int("worker_id", workerID).Msg("worker stopped - channel closed")
+				wp.logger.Debug().Int("worker_id", workerID).Msg("worker stopped - channel closed")
 				return
 			}
+			if wp.tasks != nil {
+				task = wp.nextPriorityTask()
+			}
 
 			wp.processTask(workerID, task)
 
 		case <-wp.ctx.Done():
-			log.Debug().Int("worker_id", workerID).Msg("worker stopped - context cancelled")
+			wp.logger.Debug().Int("worker_id", workerID).Msg("worker stopped - context cancelled")
 			return
 		}
 	}
@@ -154,40 +521,109 @@ func (wp *WorkerPool) worker(workerID int) {
 
 // processTask processes a single task
 func (wp *WorkerPool) processTask(workerID int, task Task) {
+	wp.addQueued(-1)
+	wp.addInFlight(1)
+	defer wp.addInFlight(-1)
+
+	attempt := 0
+	if retry, ok := task.(*retryTask); ok {
+		task, attempt = retry.Task, retry.attempt
+	}
+
 	start := time.Now()
 
-	log.Debug().
+	wp.logger.Debug().
 		Int("worker_id", workerID).
 		Str("task_id", task.ID()).
+		Int("attempt", attempt+1).
 		Msg("processing task")
 
 	err := task.Process(wp.ctx)
 	duration := time.Since(start)
 
+	if err != nil && wp.scheduleRetry(task, attempt, err) {
+		return
+	}
+
+	wp.finishTask(task, err, duration)
+}
+
+// scheduleRetry re-enqueues a failed RetryableTask after an exponential
+// backoff, reporting false if it has no retries left. The worker doesn't
+// wait, so a full buffer can't block every worker on its own retries.
+func (wp *WorkerPool) scheduleRetry(task Task, attempt int, err error) bool {
+	retryable, ok := task.(RetryableTask)
+	if !ok || attempt >= retryable.MaxRetries() || wp.ctx.Err() != nil {
+		return false
+	}
+
+	delay := wp.retryBaseDelay << attempt
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	wp.logger.Warn().
+		Err(err).
+		Str("task_id", task.ID()).
+		Int("attempt", attempt+1).
+		Dur("retry_delay", delay).
+		Msg("task failed, retrying")
+
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-wp.ctx.Done():
+			wp.finishTask(task, err, 0)
+			return
+		}
+
+		wp.closeMu.RLock()
+		defer wp.closeMu.RUnlock()
+
+		sendErr := ErrPoolStopped
+		if !wp.closed {
+			sendErr = wp.send(wp.ctx, &retryTask{Task: task, attempt: attempt + 1}, true)
+		}
+		if sendErr != nil {
+			wp.finishTask(task, err, 0)
+		}
+	}()
+
+	return true
+}
+
+// finishTask records a task's final outcome
+func (wp *WorkerPool) finishTask(task Task, err error, duration time.Duration) {
+	defer wp.pending.Done()
+
+	metrics.ObserveWorkerTask(err)
+
 	if err != nil {
 		atomic.AddInt64(&wp.errorCount, 1)
 		wp.recordError(fmt.Errorf("task %s failed: %w", task.ID(), err))
 
-		log.Error().
+		wp.logger.Error().
 			Err(err).
-			Int("worker_id", workerID).
 			Str("task_id", task.ID()).
 			Dur("duration", duration).
 			Msg("task failed")
 	} else {
-		log.Debug().
-			Int("worker_id", workerID).
+		wp.logger.Debug().
 			Str("task_id", task.ID()).
 			Dur("duration", duration).
 			Msg("task completed")
 	}
 
 	atomic.AddInt64(&wp.processedCount, 1)
+	wp.publishResult(TaskResult{TaskID: task.ID(), Err: err, Duration: duration})
 
 	// Log progress periodically
 	processed := atomic.LoadInt64(&wp.processedCount)
 	if processed%10 == 0 {
-		log.Info().
+		wp.logger.Info().
 			Int64("processed", processed).
 			Int64("errors", atomic.LoadInt64(&wp.errorCount)).
 			Msg("processing progress")
@@ -208,6 +644,18 @@ func (wp *WorkerPool) recordError(err error) {
 type UserProcessingTask struct {
 	Username string
 	Processor func(ctx context.Context, username string) error
+	Retries   int // times a failed run is retried
+	Level     int // priority in a priority worker pool, higher runs first
+}
+
+// Priority returns the task's priority level
+func (t *UserProcessingTask) Priority() int {
+	return t.Level
+}
+
+// MaxRetries returns how many times a failed run is retried
+func (t *UserProcessingTask) MaxRetries() int {
+	return t.Retries
 }
 
 // ID returns the task ID
@@ -0,0 +1,560 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var quietLogger = zerolog.Nop()
+
+// blockingTask returns a task that signals started and then waits for
+// release
+func blockingTask(i int, started chan<- struct{}, release <-chan struct{}) Task {
+	return &UserProcessingTask{
+		Username: fmt.Sprintf("user%d", i),
+		Processor: func(ctx context.Context, username string) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		},
+	}
+}
+
+// waitForStats polls the pool until cond holds
+func waitForStats(t *testing.T, wp *WorkerPool, cond func(QueueStats) bool) QueueStats {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := wp.QueueStats()
+		if cond(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue stats stuck at %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueStatsInFlightMatchesWorkers(t *testing.T) {
+	const workers, tasks = 3, 7
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: workers, BufferSize: 10, Logger: &quietLogger})
+	wp.Start()
+
+	started := make(chan struct{}, tasks)
+	release := make(chan struct{})
+	for i := 0; i < tasks; i++ {
+		if err := wp.EnqueueTask(blockingTask(i, started, release)); err != nil {
+			t.Fatalf("EnqueueTask: %v", err)
+		}
+	}
+	for i := 0; i < workers; i++ {
+		<-started
+	}
+
+	stats := waitForStats(t, wp, func(s QueueStats) bool { return s.InFlight == workers })
+	if stats.Queued != tasks-workers {
+		t.Errorf("queued = %d with every worker busy, want %d", stats.Queued, tasks-workers)
+	}
+
+	close(release)
+	wp.Stop()
+
+	stats = wp.QueueStats()
+	if stats != (QueueStats{Processed: tasks}) {
+		t.Errorf("stats after stop = %+v, want %d processed and nothing queued or in flight", stats, tasks)
+	}
+}
+
+func TestQueueStatsUncountRejectedTasks(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, BufferSize: 1, Logger: &quietLogger})
+	wp.Start()
+
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	defer func() {
+		close(release)
+		wp.Stop()
+	}()
+
+	// One task runs and one fills the buffer
+	for i := 0; i < 2; i++ {
+		if err := wp.EnqueueTask(blockingTask(i, started, release)); err != nil {
+			t.Fatalf("EnqueueTask: %v", err)
+		}
+		if i == 0 {
+			<-started
+		}
+	}
+	waitForStats(t, wp, func(s QueueStats) bool { return s.InFlight == 1 && s.Queued == 1 })
+
+	if err := wp.EnqueueTask(blockingTask(2, started, release)); err == nil {
+		t.Fatal("EnqueueTask on a full queue succeeded")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wp.EnqueueTaskBlocking(ctx, blockingTask(3, started, release)); err == nil {
+		t.Fatal("EnqueueTaskBlocking on a full queue succeeded")
+	}
+
+	if stats := wp.QueueStats(); stats.Queued != 1 || stats.InFlight != 1 {
+		t.Errorf("stats after rejected enqueues = %+v, want 1 queued and 1 in flight", stats)
+	}
+}
+
+func TestQueueStatsNeverNegative(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 8, BufferSize: 1, Logger: &quietLogger})
+	wp.Start()
+
+	// Workers pick tasks up as soon as they're sent, so a count made after
+	// the send would briefly dip below zero
+	done := make(chan struct{})
+	negative := make(chan QueueStats, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if stats := wp.QueueStats(); stats.Queued < 0 {
+				select {
+				case negative <- stats:
+				default:
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		task := &UserProcessingTask{Username: fmt.Sprint(i), Processor: func(context.Context, string) error { return nil }}
+		if err := wp.EnqueueTaskBlocking(context.Background(), task); err != nil {
+			t.Fatalf("EnqueueTaskBlocking: %v", err)
+		}
+	}
+	wp.Stop()
+	close(done)
+
+	select {
+	case stats := <-negative:
+		t.Errorf("queued went negative: %+v", stats)
+	default:
+	}
+}
+
+// failingTask returns a task for username that fails with err
+func failingTask(username string, err error) Task {
+	return &UserProcessingTask{
+		Username:  username,
+		Processor: func(context.Context, string) error { return err },
+	}
+}
+
+func TestClearErrorsSeparatesJobs(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 2, Logger: &quietLogger})
+	wp.Start()
+	defer wp.Stop()
+
+	runJob := func(done int64, usernames ...string) []error {
+		wp.ClearErrors()
+		for _, username := range usernames {
+			if err := wp.EnqueueTaskBlocking(context.Background(), failingTask(username, errors.New("not found"))); err != nil {
+				t.Fatalf("EnqueueTaskBlocking: %v", err)
+			}
+		}
+		waitForStats(t, wp, func(s QueueStats) bool { return s.Processed == done })
+		return wp.GetErrors()
+	}
+
+	if errs := runJob(2, "a1", "a2"); len(errs) != 2 {
+		t.Fatalf("job A recorded %d errors, want 2", len(errs))
+	}
+
+	errs := runJob(3, "b1")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "user_processing:b1") {
+		t.Errorf("job B errors = %v, want only b1's", errs)
+	}
+}
+
+func TestEnqueueTaskBlockingWaitsForSlowConsumer(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, BufferSize: 1, Logger: &quietLogger})
+	wp.Start()
+
+	var mu sync.Mutex
+	var order []string
+	slow := func(i int) Task {
+		return &UserProcessingTask{
+			Username: fmt.Sprintf("user%d", i),
+			Processor: func(_ context.Context, username string) error {
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				order = append(order, username)
+				mu.Unlock()
+				return nil
+			},
+		}
+	}
+
+	// The buffer has room for one task, so the rest wait for the worker
+	// rather than being dropped
+	rejected := 0
+	for i := 0; i < 5; i++ {
+		if err := wp.EnqueueTaskBlocking(context.Background(), slow(i)); err != nil {
+			t.Fatalf("EnqueueTaskBlocking %d: %v", i, err)
+		}
+		if err := wp.EnqueueTask(slow(100 + i)); err != nil {
+			rejected++
+		}
+	}
+	wp.Stop()
+
+	if rejected == 0 {
+		t.Error("EnqueueTask never failed fast on the full buffer")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := 5 + (5 - rejected); len(order) != want {
+		t.Errorf("processed %d tasks, want %d", len(order), want)
+	}
+	if processed, errs := wp.GetStats(); processed != int64(len(order)) || errs != 0 {
+		t.Errorf("stats processed=%d errors=%d, want %d and 0", processed, errs, len(order))
+	}
+}
+
+func TestEnqueueTaskBlockingReturnsContextError(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, BufferSize: 1, Logger: &quietLogger})
+	wp.Start()
+
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	defer func() {
+		close(release)
+		wp.Stop()
+	}()
+
+	// One task runs and one fills the buffer
+	if err := wp.EnqueueTask(blockingTask(0, started, release)); err != nil {
+		t.Fatalf("EnqueueTask: %v", err)
+	}
+	<-started
+	if err := wp.EnqueueTask(blockingTask(1, started, release)); err != nil {
+		t.Fatalf("EnqueueTask: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- wp.EnqueueTaskBlocking(ctx, blockingTask(2, started, release)) }()
+
+	select {
+	case err := <-errc:
+		t.Fatalf("EnqueueTaskBlocking returned %v with the buffer full", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("EnqueueTaskBlocking = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("EnqueueTaskBlocking still blocked after cancellation")
+	}
+	if stats := wp.QueueStats(); stats.Queued != 1 {
+		t.Errorf("queued = %d after the cancelled enqueue, want 1", stats.Queued)
+	}
+}
+
+func TestStopWithTimeoutCancelsStuckTask(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, Logger: &quietLogger})
+	wp.Start()
+
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	stuck := &UserProcessingTask{
+		Username: "stuck",
+		Processor: func(ctx context.Context, _ string) error {
+			close(started)
+			select {
+			case <-ctx.Done():
+				cancelled <- ctx.Err()
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		},
+	}
+	if err := wp.EnqueueTask(stuck); err != nil {
+		t.Fatalf("EnqueueTask: %v", err)
+	}
+	<-started
+
+	start := time.Now()
+	if err := wp.StopWithTimeout(50 * time.Millisecond); !errors.Is(err, ErrStopTimeout) {
+		t.Errorf("StopWithTimeout = %v, want ErrStopTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("StopWithTimeout took %v, want about the timeout", elapsed)
+	}
+
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("task context error = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stuck task wasn't cancelled")
+	}
+}
+
+func TestStopWithTimeoutDrainsCleanly(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 2, BufferSize: 10, Logger: &quietLogger})
+	wp.Start()
+
+	var cancelled int32
+	for i := 0; i < 6; i++ {
+		task := &UserProcessingTask{
+			Username: fmt.Sprint(i),
+			Processor: func(ctx context.Context, _ string) error {
+				time.Sleep(5 * time.Millisecond)
+				if ctx.Err() != nil {
+					atomic.AddInt32(&cancelled, 1)
+				}
+				return nil
+			},
+		}
+		if err := wp.EnqueueTask(task); err != nil {
+			t.Fatalf("EnqueueTask: %v", err)
+		}
+	}
+
+	if err := wp.StopWithTimeout(5 * time.Second); err != nil {
+		t.Errorf("StopWithTimeout = %v, want a clean drain", err)
+	}
+	if stats := wp.QueueStats(); stats.Processed != 6 || stats.Queued != 0 || stats.InFlight != 0 {
+		t.Errorf("stats after drain = %+v, want 6 processed", stats)
+	}
+	if cancelled != 0 {
+		t.Errorf("%d tasks saw a cancelled context during a clean drain", cancelled)
+	}
+}
+
+// flakyTask returns a task that fails its first failures runs, counting
+// every run in attempts
+func flakyTask(username string, failures, retries int, attempts *int32) *UserProcessingTask {
+	return &UserProcessingTask{
+		Username: username,
+		Retries:  retries,
+		Processor: func(context.Context, string) error {
+			if atomic.AddInt32(attempts, 1) <= int32(failures) {
+				return errors.New("connection reset")
+			}
+			return nil
+		},
+	}
+}
+
+func TestRetryableTaskSucceedsAfterFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		retries      int
+		wantAttempts int32
+		wantErrors   int64
+	}{
+		{"fails twice then succeeds", 2, 3, 3, 0},
+		{"runs out of retries", 5, 2, 3, 1},
+		{"no retries", 1, 0, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, Logger: &quietLogger, RetryBaseDelay: time.Millisecond})
+			wp.Start()
+
+			var attempts int32
+			if err := wp.EnqueueTask(flakyTask("flaky", tt.failures, tt.retries, &attempts)); err != nil {
+				t.Fatalf("EnqueueTask: %v", err)
+			}
+			wp.Stop()
+
+			if attempts != tt.wantAttempts {
+				t.Errorf("ran %d times, want %d", attempts, tt.wantAttempts)
+			}
+			if stats := wp.QueueStats(); stats.Processed != 1 || stats.Errors != tt.wantErrors {
+				t.Errorf("stats = %+v, want 1 processed and %d errors", stats, tt.wantErrors)
+			}
+			if errs := wp.GetErrors(); int64(len(errs)) != tt.wantErrors {
+				t.Errorf("recorded errors %v, want %d", errs, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestRetriesDontDeadlockOnFullBuffer(t *testing.T) {
+	const tasks = 20
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, BufferSize: 1, Logger: &quietLogger, RetryBaseDelay: time.Millisecond})
+	wp.Start()
+
+	attempts := make([]int32, tasks)
+	for i := 0; i < tasks; i++ {
+		if err := wp.EnqueueTaskBlocking(context.Background(), flakyTask(fmt.Sprint(i), 2, 2, &attempts[i])); err != nil {
+			t.Fatalf("EnqueueTaskBlocking: %v", err)
+		}
+	}
+	if err := wp.StopWithTimeout(5 * time.Second); err != nil {
+		t.Fatalf("StopWithTimeout = %v, want every retry to finish", err)
+	}
+
+	if stats := wp.QueueStats(); stats.Processed != tasks || stats.Errors != 0 {
+		t.Errorf("stats = %+v, want %d processed and no errors", stats, tasks)
+	}
+	for i, n := range attempts {
+		if n != 3 {
+			t.Errorf("task %d ran %d times, want 3", i, n)
+		}
+	}
+}
+
+func TestPendingRetriesEndWithThePool(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, Logger: &quietLogger, RetryBaseDelay: time.Hour})
+	wp.Start()
+
+	var attempts int32
+	if err := wp.EnqueueTask(flakyTask("flaky", 1, 3, &attempts)); err != nil {
+		t.Fatalf("EnqueueTask: %v", err)
+	}
+	waitForStats(t, wp, func(QueueStats) bool { return atomic.LoadInt32(&attempts) == 1 })
+
+	// The retry waits out an hour's backoff, so only cancellation ends it
+	if err := wp.StopWithTimeout(20 * time.Millisecond); !errors.Is(err, ErrStopTimeout) {
+		t.Errorf("StopWithTimeout = %v, want ErrStopTimeout", err)
+	}
+	stats := waitForStats(t, wp, func(s QueueStats) bool { return s.Processed == 1 })
+	if stats.Errors != 1 || attempts != 1 {
+		t.Errorf("stats = %+v after %d runs, want the task failed after 1 run", stats, attempts)
+	}
+}
+
+func TestResultsPublishesOneEventPerTask(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 3, BufferSize: 4, EmitResults: true, Logger: &quietLogger, RetryBaseDelay: time.Millisecond})
+	wp.Start()
+
+	// Consume results concurrently, as the channel holds only BufferSize
+	events := make(chan []TaskResult)
+	go func() {
+		var got []TaskResult
+		for result := range wp.Results() {
+			got = append(got, result)
+		}
+		events <- got
+	}()
+
+	want := map[string]bool{} // task id to whether it fails
+	var attempts int32
+	for i := 0; i < 10; i++ {
+		username := fmt.Sprintf("user%d", i)
+		var task Task = &UserProcessingTask{
+			Username:  username,
+			Processor: func(context.Context, string) error { time.Sleep(time.Millisecond); return nil },
+		}
+		if i%3 == 0 {
+			task = failingTask(username, errors.New("not found"))
+		}
+		want[task.ID()] = i%3 == 0
+		if err := wp.EnqueueTaskBlocking(context.Background(), task); err != nil {
+			t.Fatalf("EnqueueTaskBlocking: %v", err)
+		}
+	}
+	// A retried task reports only its final outcome
+	retried := flakyTask("retried", 1, 2, &attempts)
+	want[retried.ID()] = false
+	if err := wp.EnqueueTaskBlocking(context.Background(), retried); err != nil {
+		t.Fatalf("EnqueueTaskBlocking: %v", err)
+	}
+	wp.Stop()
+
+	var got []TaskResult
+	select {
+	case got = <-events:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Results wasn't closed after Stop")
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d results, want %d", len(got), len(want))
+	}
+	seen := map[string]bool{}
+	for _, result := range got {
+		fails, ok := want[result.TaskID]
+		if !ok || seen[result.TaskID] {
+			t.Errorf("unexpected or repeated result for %q", result.TaskID)
+			continue
+		}
+		seen[result.TaskID] = true
+		if (result.Err != nil) != fails {
+			t.Errorf("%s error = %v, want failure %v", result.TaskID, result.Err, fails)
+		}
+		if result.Err == nil && result.Duration <= 0 {
+			t.Errorf("%s duration = %v, want the run time", result.TaskID, result.Duration)
+		}
+	}
+}
+
+func TestStopReturnsWithoutResultsConsumer(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, BufferSize: 2, EmitResults: true, Logger: &quietLogger})
+	wp.Start()
+
+	// Nothing reads Results until Stop returns, so the worker fills it and
+	// blocks publishing the third result
+	const tasks = 5
+	for i := 0; i < tasks; i++ {
+		task := &UserProcessingTask{Username: fmt.Sprint(i), Processor: func(context.Context, string) error { return nil }}
+		if err := wp.EnqueueTaskBlocking(context.Background(), task); err != nil {
+			t.Fatalf("EnqueueTaskBlocking: %v", err)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wp.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop hung on a full Results channel")
+	}
+
+	// Results held back during Stop are still delivered
+	seen := map[string]bool{}
+	for result := range wp.Results() {
+		seen[result.TaskID] = true
+	}
+	if len(seen) != tasks {
+		t.Errorf("got results for %d tasks, want %d", len(seen), tasks)
+	}
+}
+
+func TestResultsNilUnlessEnabled(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolOptions{NumWorkers: 1, Logger: &quietLogger})
+	wp.Start()
+	if err := wp.EnqueueTask(failingTask("a", errors.New("not found"))); err != nil {
+		t.Fatalf("EnqueueTask: %v", err)
+	}
+	wp.Stop()
+
+	if wp.Results() != nil {
+		t.Error("Results is non-nil without EmitResults")
+	}
+	if stats := wp.QueueStats(); stats.Processed != 1 {
+		t.Errorf("stats = %+v, want the task processed without a results consumer", stats)
+	}
+}
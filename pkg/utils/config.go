@@ -15,8 +15,71 @@ type Config struct {
 	DatabaseURL    string
 	RocketAPIKey   string
 	RateLimit      int  // requests per second
-	MaxConcurrency int  // max concurrent workers
+	MaxConcurrency int  // max concurrent workers, also the ceiling for a batch's max_concurrency
+	MaxBatchSize   int  // max usernames and ids per batch request
 	LogLevel       string
+	LogOutput      string // "stderr", "stdout" or a file path
+	LogSampleRate  int    // emit one in this many debug and trace messages
+	AdminAPIKey    string // required for admin/mutating endpoints
+	DBWarmPool     bool   // pre-open idle DB connections on startup
+	RunMigrations  bool   // apply pending schema migrations on startup
+	EmptyAsNull    bool   // render missing text fields as null instead of ""
+	Provenance     bool   // report per-section data sources in user responses
+	EnablePprof    bool   // mount /debug/pprof profiling endpoints
+
+	LogMaxSizeMB  int // rotate a LOG_OUTPUT file at this size
+	LogMaxBackups int // rotated log files kept, 0 keeps all
+	LogMaxAgeDays int // days rotated log files are kept, 0 keeps all
+
+	ShutdownTimeoutSeconds int // max time to drain requests and jobs on shutdown
+	DBQueryTimeout         int // Postgres statement_timeout in seconds, 0 disables
+
+	DBMaxOpenConns    int // max open database connections
+	DBMaxIdleConns    int // idle database connections kept in the pool
+	DBConnMaxLifetime int // seconds before a database connection is recycled
+	DBHealthInterval  int // seconds between database health pings, 0 disables
+
+	RocketAPIBaseURL              string // RocketAPI endpoint, e.g. a mock server or staging
+	RocketAPITimeoutSeconds       int    // RocketAPI HTTP client timeout
+	RocketAPIMaxRetryAfterSeconds int    // cap on honored RocketAPI Retry-After delays
+	RocketAPIBreakerThreshold     int    // consecutive upstream failures that open the circuit breaker
+	RocketAPIBreakerCooldown      int    // seconds the circuit breaker stays open
+
+	ClientRateLimit int // requests per second per client IP, 0 disables
+	ClientRateBurst int // requests a client may burst above ClientRateLimit
+
+	CORSAllowedOrigins []string // origins allowed by CORS, "*" allows any
+
+	WebhookSecret         string // HMAC key for batch job callbacks, callbacks disabled when unset
+	WebhookTimeoutSeconds int    // HTTP timeout per callback delivery attempt
+
+	StrictJSON           bool  // reject request bodies with unknown fields
+	StrictBatch          bool  // reject whole batches containing an invalid username or id
+	MaxSummaryFailures   int   // failed identifiers listed with their errors in a batch summary, 0 lists none
+	MaxBodyBytes         int64 // max request body size for JSON endpoints
+	MaxPathSegmentLength int   // longest allowed URL path segment
+	GzipMinBytes         int   // gzip responses at least this large, 0 disables
+
+	StorageBackend string // profile picture storage: "mock" or "s3"
+	S3Bucket       string // bucket for the s3 storage backend
+	S3Region       string
+	S3Prefix       string // object key prefix for profile pictures
+
+	UsernameFallback  bool // resolve renamed accounts by a previously seen username
+	StaleAfterSeconds int  // stored users older than this are refreshed by refresh-if-stale
+
+	MaxFullNameLength  int // full names are truncated to this many characters on upsert
+	MaxBiographyLength int // biographies are truncated to this many characters on upsert
+
+	CacheTTLSeconds int // user cache entry lifetime, 0 disables the cache
+	CacheMaxEntries int // user cache size before LRU eviction
+
+	StatsCacheMinPosts        int // users with at least this many posts get cached stats
+	StatsCacheRefreshInterval int // seconds between stats cache refreshes, 0 disables
+	StatsQueryTimeout         int // seconds the full stats query may run before falling back to partial stats
+
+	OTLPEndpoint    string // OTLP/HTTP collector URL for traces, tracing is a no-op when unset
+	OTELServiceName string // service.name reported on exported spans
 }
 
 // LoadConfig loads configuration from environment variables
@@ -28,7 +91,70 @@ func LoadConfig() *Config {
 		RocketAPIKey:   getEnvWithDefault("ROCKETAPI_KEY", "demo_key_123"),
 		RateLimit:      getEnvIntWithDefault("RATE_LIMIT", 10),
 		MaxConcurrency: getEnvIntWithDefault("MAX_CONCURRENCY", 5),
+		MaxBatchSize:   getEnvIntWithDefault("MAX_BATCH_SIZE", 100),
 		LogLevel:       getEnvWithDefault("LOG_LEVEL", "info"),
+		LogOutput:      getEnvWithDefault("LOG_OUTPUT", "stderr"),
+		LogSampleRate:  getEnvIntWithDefault("LOG_SAMPLE_RATE", 1),
+		AdminAPIKey:    getEnvWithDefault("ADMIN_API_KEY", ""),
+		DBWarmPool:     getEnvBoolWithDefault("DB_WARM_POOL", false),
+		RunMigrations:  getEnvBoolWithDefault("RUN_MIGRATIONS", false),
+		EmptyAsNull:    getEnvBoolWithDefault("EMPTY_AS_NULL", true),
+		Provenance:     getEnvBoolWithDefault("RESPONSE_PROVENANCE", true),
+		EnablePprof:    getEnvBoolWithDefault("ENABLE_PPROF", false),
+
+		LogMaxSizeMB:  getEnvIntWithDefault("LOG_MAX_SIZE_MB", 100),
+		LogMaxBackups: getEnvIntWithDefault("LOG_MAX_BACKUPS", 5),
+		LogMaxAgeDays: getEnvIntWithDefault("LOG_MAX_AGE_DAYS", 30),
+
+		ShutdownTimeoutSeconds: getEnvIntWithDefault("SHUTDOWN_TIMEOUT_SECONDS", 30),
+		DBQueryTimeout:         getEnvIntWithDefault("DB_QUERY_TIMEOUT_SECONDS", 60),
+
+		DBMaxOpenConns:    getEnvIntWithDefault("DB_MAX_OPEN_CONNS", 25),
+		DBMaxIdleConns:    getEnvIntWithDefault("DB_MAX_IDLE_CONNS", 5),
+		DBConnMaxLifetime: getEnvIntWithDefault("DB_CONN_MAX_LIFETIME_SECONDS", 300),
+		DBHealthInterval:  getEnvIntWithDefault("DB_HEALTH_CHECK_SECONDS", 15),
+
+		RocketAPIBaseURL:              getEnvWithDefault("ROCKETAPI_BASE_URL", "https://v1.rocketapi.io"),
+		RocketAPITimeoutSeconds:       getEnvIntWithDefault("ROCKETAPI_TIMEOUT_SECONDS", 30),
+		RocketAPIMaxRetryAfterSeconds: getEnvIntWithDefault("ROCKETAPI_MAX_RETRY_AFTER_SECONDS", 60),
+		RocketAPIBreakerThreshold:     getEnvIntWithDefault("ROCKETAPI_BREAKER_THRESHOLD", 5),
+		RocketAPIBreakerCooldown:      getEnvIntWithDefault("ROCKETAPI_BREAKER_COOLDOWN_SECONDS", 30),
+
+		ClientRateLimit: getEnvIntWithDefault("HTTP_RATE_LIMIT", getEnvIntWithDefault("CLIENT_RATE_LIMIT", 20)),
+		ClientRateBurst: getEnvIntWithDefault("HTTP_RATE_BURST", getEnvIntWithDefault("CLIENT_RATE_BURST", 40)),
+
+		CORSAllowedOrigins: splitList(getEnvWithDefault("CORS_ALLOWED_ORIGINS", "*")),
+
+		WebhookSecret:         getEnvWithDefault("WEBHOOK_SECRET", ""),
+		WebhookTimeoutSeconds: getEnvIntWithDefault("WEBHOOK_TIMEOUT_SECONDS", 10),
+
+		StrictJSON:           getEnvBoolWithDefault("STRICT_JSON", false),
+		StrictBatch:          getEnvBoolWithDefault("STRICT_BATCH_VALIDATION", false),
+		MaxSummaryFailures:   getEnvIntWithDefault("MAX_SUMMARY_FAILURES", 50),
+		MaxBodyBytes:         int64(getEnvIntWithDefault("MAX_BODY_BYTES", 64*1024)),
+		MaxPathSegmentLength: getEnvIntWithDefault("MAX_PATH_SEGMENT_LENGTH", 100),
+		GzipMinBytes:         getEnvIntWithDefault("GZIP_MIN_BYTES", 1024),
+
+		StorageBackend: strings.ToLower(getEnvWithDefault("STORAGE_BACKEND", "mock")),
+		S3Bucket:       getEnvWithDefault("S3_BUCKET", ""),
+		S3Region:       getEnvWithDefault("S3_REGION", "us-east-1"),
+		S3Prefix:       getEnvWithDefault("S3_PREFIX", "profile-pics/"),
+
+		UsernameFallback:  getEnvBoolWithDefault("USERNAME_FALLBACK", true),
+		StaleAfterSeconds: getEnvIntWithDefault("STALE_AFTER_SECONDS", 86400),
+
+		MaxFullNameLength:  getEnvIntWithDefault("MAX_FULL_NAME_LENGTH", 150),
+		MaxBiographyLength: getEnvIntWithDefault("MAX_BIOGRAPHY_LENGTH", 1000),
+
+		CacheTTLSeconds: getEnvIntWithDefault("CACHE_TTL_SECONDS", 300),
+		CacheMaxEntries: getEnvIntWithDefault("CACHE_MAX_ENTRIES", 10000),
+
+		StatsCacheMinPosts:        getEnvIntWithDefault("STATS_CACHE_MIN_POSTS", 1000),
+		StatsCacheRefreshInterval: getEnvIntWithDefault("STATS_CACHE_REFRESH_SECONDS", 600),
+		StatsQueryTimeout:         getEnvIntWithDefault("STATS_QUERY_TIMEOUT_SECONDS", 10),
+
+		OTLPEndpoint:    getEnvWithDefault("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		OTELServiceName: getEnvWithDefault("OTEL_SERVICE_NAME", "instagram-user-processor"),
 	}
 
 	// Validate configuration
@@ -47,13 +173,184 @@ func LoadConfig() *Config {
 		log.Warn().Msg("MAX_CONCURRENCY too high, limiting to: 50")
 	}
 
+	if config.MaxBatchSize <= 0 {
+		config.MaxBatchSize = 100
+		log.Warn().Msg("invalid MAX_BATCH_SIZE, using default: 100")
+	}
+
+	if config.MaxBatchSize > 10000 {
+		config.MaxBatchSize = 10000
+		log.Warn().Msg("MAX_BATCH_SIZE too high, limiting to: 10000")
+	}
+
+	if config.MaxSummaryFailures < 0 {
+		config.MaxSummaryFailures = 50
+		log.Warn().Msg("invalid MAX_SUMMARY_FAILURES, using default: 50")
+	}
+
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = 64 * 1024
+		log.Warn().Msg("invalid MAX_BODY_BYTES, using default: 65536")
+	}
+
+	if config.GzipMinBytes < 0 {
+		config.GzipMinBytes = 1024
+		log.Warn().Msg("invalid GZIP_MIN_BYTES, using default: 1024")
+	}
+
+	if config.LogSampleRate < 1 {
+		config.LogSampleRate = 1
+		log.Warn().Msg("invalid LOG_SAMPLE_RATE, using default: 1")
+	}
+
+	if config.LogMaxSizeMB <= 0 {
+		config.LogMaxSizeMB = 100
+		log.Warn().Msg("invalid LOG_MAX_SIZE_MB, using default: 100")
+	}
+
+	if config.LogMaxBackups < 0 {
+		config.LogMaxBackups = 5
+		log.Warn().Msg("invalid LOG_MAX_BACKUPS, using default: 5")
+	}
+
+	if config.LogMaxAgeDays < 0 {
+		config.LogMaxAgeDays = 30
+		log.Warn().Msg("invalid LOG_MAX_AGE_DAYS, using default: 30")
+	}
+
+	if config.ShutdownTimeoutSeconds <= 0 {
+		config.ShutdownTimeoutSeconds = 30
+		log.Warn().Msg("invalid SHUTDOWN_TIMEOUT_SECONDS, using default: 30")
+	}
+
+	if config.DBQueryTimeout < 0 {
+		config.DBQueryTimeout = 60
+		log.Warn().Msg("invalid DB_QUERY_TIMEOUT_SECONDS, using default: 60")
+	}
+
+	if config.DBMaxOpenConns < 1 {
+		config.DBMaxOpenConns = 25
+		log.Warn().Msg("invalid DB_MAX_OPEN_CONNS, using default: 25")
+	}
+
+	if config.DBMaxIdleConns < 1 {
+		config.DBMaxIdleConns = 5
+		log.Warn().Msg("invalid DB_MAX_IDLE_CONNS, using default: 5")
+	}
+
+	if config.DBMaxIdleConns > config.DBMaxOpenConns {
+		config.DBMaxIdleConns = config.DBMaxOpenConns
+		log.Warn().Int("db_max_idle_conns", config.DBMaxIdleConns).Msg("DB_MAX_IDLE_CONNS exceeds DB_MAX_OPEN_CONNS, capping")
+	}
+
+	if config.DBConnMaxLifetime < 1 {
+		config.DBConnMaxLifetime = 300
+		log.Warn().Msg("invalid DB_CONN_MAX_LIFETIME_SECONDS, using default: 300")
+	}
+
+	if config.DBHealthInterval < 0 {
+		config.DBHealthInterval = 15
+		log.Warn().Msg("invalid DB_HEALTH_CHECK_SECONDS, using default: 15")
+	}
+
+	if len(config.CORSAllowedOrigins) == 0 {
+		config.CORSAllowedOrigins = []string{"*"}
+		log.Warn().Msg("empty CORS_ALLOWED_ORIGINS, using default: *")
+	}
+
+	if config.WebhookTimeoutSeconds <= 0 {
+		config.WebhookTimeoutSeconds = 10
+		log.Warn().Msg("invalid WEBHOOK_TIMEOUT_SECONDS, using default: 10")
+	}
+
+	if config.StorageBackend != "mock" && config.StorageBackend != "s3" {
+		log.Warn().Str("storage_backend", config.StorageBackend).Msg("invalid STORAGE_BACKEND, using default: mock")
+		config.StorageBackend = "mock"
+	}
+
+	if config.OTELServiceName == "" {
+		config.OTELServiceName = "instagram-user-processor"
+		log.Warn().Msg("empty OTEL_SERVICE_NAME, using default: instagram-user-processor")
+	}
+
+	if config.StaleAfterSeconds <= 0 {
+		config.StaleAfterSeconds = 86400
+		log.Warn().Msg("invalid STALE_AFTER_SECONDS, using default: 86400")
+	}
+
+	if config.MaxFullNameLength <= 0 {
+		config.MaxFullNameLength = 150
+		log.Warn().Msg("invalid MAX_FULL_NAME_LENGTH, using default: 150")
+	}
+
+	if config.MaxBiographyLength <= 0 {
+		config.MaxBiographyLength = 1000
+		log.Warn().Msg("invalid MAX_BIOGRAPHY_LENGTH, using default: 1000")
+	}
+
+	if config.RocketAPITimeoutSeconds <= 0 {
+		config.RocketAPITimeoutSeconds = 30
+		log.Warn().Msg("invalid ROCKETAPI_TIMEOUT_SECONDS, using default: 30")
+	}
+
+	if config.RocketAPIMaxRetryAfterSeconds <= 0 {
+		config.RocketAPIMaxRetryAfterSeconds = 60
+		log.Warn().Msg("invalid ROCKETAPI_MAX_RETRY_AFTER_SECONDS, using default: 60")
+	}
+
+	if config.RocketAPIBreakerThreshold <= 0 {
+		config.RocketAPIBreakerThreshold = 5
+		log.Warn().Msg("invalid ROCKETAPI_BREAKER_THRESHOLD, using default: 5")
+	}
+
+	if config.RocketAPIBreakerCooldown <= 0 {
+		config.RocketAPIBreakerCooldown = 30
+		log.Warn().Msg("invalid ROCKETAPI_BREAKER_COOLDOWN_SECONDS, using default: 30")
+	}
+
+	if config.ClientRateBurst <= 0 {
+		config.ClientRateBurst = config.ClientRateLimit
+		log.Warn().Msgf("invalid HTTP_RATE_BURST, using HTTP_RATE_LIMIT: %d", config.ClientRateLimit)
+	}
+
+	if config.MaxPathSegmentLength <= 0 {
+		config.MaxPathSegmentLength = 100
+		log.Warn().Msg("invalid MAX_PATH_SEGMENT_LENGTH, using default: 100")
+	}
+
+	if config.CacheMaxEntries <= 0 {
+		config.CacheMaxEntries = 10000
+		log.Warn().Msg("invalid CACHE_MAX_ENTRIES, using default: 10000")
+	}
+
+	if config.StatsCacheMinPosts <= 0 {
+		config.StatsCacheMinPosts = 1000
+		log.Warn().Msg("invalid STATS_CACHE_MIN_POSTS, using default: 1000")
+	}
+
+	if config.StatsQueryTimeout <= 0 {
+		config.StatsQueryTimeout = 10
+		log.Warn().Msg("invalid STATS_QUERY_TIMEOUT_SECONDS, using default: 10")
+	}
+
+	if config.EnablePprof {
+		log.Warn().Msg("ENABLE_PPROF set, profiling endpoints are exposed at /debug/pprof")
+	}
+
+	if config.AdminAPIKey == "" {
+		log.Warn().Msg("ADMIN_API_KEY not set, admin endpoints are disabled")
+	}
+
 	// Log configuration (without sensitive data)
 	log.Info().
 		Str("environment", config.Environment).
 		Str("port", config.ServerPort).
 		Int("rate_limit", config.RateLimit).
 		Int("max_concurrency", config.MaxConcurrency).
+		Int("max_batch_size", config.MaxBatchSize).
 		Str("log_level", config.LogLevel).
+		Bool("strict_json", config.StrictJSON).
+		Int64("max_body_bytes", config.MaxBodyBytes).
 		Msg("configuration loaded")
 
 	return config
@@ -78,11 +375,33 @@ func getEnvIntWithDefault(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvBoolWithDefault gets a boolean environment variable with a default value
+func getEnvBoolWithDefault(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			return boolVal
+		}
+		log.Warn().Str("key", key).Str("value", value).Msg("invalid boolean environment variable, using default")
+	}
+	return defaultValue
+}
+
 // IsDevelopment returns true if running in development mode
 func (c *Config) IsDevelopment() bool {
 	return strings.ToLower(c.Environment) == "development"
 }
 
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // IsProduction returns true if running in production mode
 func (c *Config) IsProduction() bool {
 	return strings.ToLower(c.Environment) == "production"
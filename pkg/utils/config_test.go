@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLoadConfigDatabasePool(t *testing.T) {
+	tests := []struct {
+		name                 string
+		open, idle, lifetime string
+		wantOpen, wantIdle   int
+		wantLifetime         int
+	}{
+		{"defaults", "", "", "", 25, 5, 300},
+		{"overrides", "50", "10", "60", 50, 10, 60},
+		{"idle capped at open", "4", "10", "", 4, 4, 300},
+		{"zero falls back", "0", "0", "0", 25, 5, 300},
+		{"negative falls back", "-1", "-5", "-30", 25, 5, 300},
+		{"not a number falls back", "many", "few", "1h", 25, 5, 300},
+		{"surrounding spaces", " 40 ", " 8 ", " 120 ", 40, 8, 120},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DB_MAX_OPEN_CONNS", tt.open)
+			t.Setenv("DB_MAX_IDLE_CONNS", tt.idle)
+			t.Setenv("DB_CONN_MAX_LIFETIME_SECONDS", tt.lifetime)
+
+			cfg := LoadConfig()
+			if cfg.DBMaxOpenConns != tt.wantOpen || cfg.DBMaxIdleConns != tt.wantIdle || cfg.DBConnMaxLifetime != tt.wantLifetime {
+				t.Errorf("pool = open %d, idle %d, lifetime %ds; want %d, %d, %ds",
+					cfg.DBMaxOpenConns, cfg.DBMaxIdleConns, cfg.DBConnMaxLifetime,
+					tt.wantOpen, tt.wantIdle, tt.wantLifetime)
+			}
+		})
+	}
+}
+
+func TestLoadConfigClientRateLimit(t *testing.T) {
+	tests := []struct {
+		name                   string
+		clientLimit, httpLimit string
+		burst                  string
+		wantLimit, wantBurst   int
+	}{
+		{"defaults", "", "", "", 20, 40},
+		{"HTTP_RATE_LIMIT", "", "5", "", 5, 40},
+		{"CLIENT_RATE_LIMIT fallback", "7", "", "", 7, 40},
+		{"HTTP_RATE_LIMIT wins", "7", "5", "", 5, 40},
+		{"burst override", "", "5", "10", 5, 10},
+		{"invalid burst falls back to limit", "", "5", "0", 5, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CLIENT_RATE_LIMIT", tt.clientLimit)
+			t.Setenv("HTTP_RATE_LIMIT", tt.httpLimit)
+			t.Setenv("HTTP_RATE_BURST", tt.burst)
+
+			cfg := LoadConfig()
+			if cfg.ClientRateLimit != tt.wantLimit || cfg.ClientRateBurst != tt.wantBurst {
+				t.Errorf("rate limit = %d burst %d, want %d burst %d",
+					cfg.ClientRateLimit, cfg.ClientRateBurst, tt.wantLimit, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCORSAllowedOrigins(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", []string{"*"}},
+		{"https://app.example.com", []string{"https://app.example.com"}},
+		{" https://a.example.com , https://b.example.com ,", []string{"https://a.example.com", "https://b.example.com"}},
+		{" , ", []string{"*"}},
+	}
+	for _, tt := range tests {
+		t.Setenv("CORS_ALLOWED_ORIGINS", tt.value)
+		if got := LoadConfig().CORSAllowedOrigins; !slices.Equal(got, tt.want) {
+			t.Errorf("CORS_ALLOWED_ORIGINS=%q gives %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigTextLimits(t *testing.T) {
+	tests := []struct {
+		name                  string
+		fullName, biography   string
+		wantFullName, wantBio int
+	}{
+		{"defaults", "", "", 150, 1000},
+		{"overrides", "60", "300", 60, 300},
+		{"invalid falls back", "0", "-1", 150, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAX_FULL_NAME_LENGTH", tt.fullName)
+			t.Setenv("MAX_BIOGRAPHY_LENGTH", tt.biography)
+
+			cfg := LoadConfig()
+			if cfg.MaxFullNameLength != tt.wantFullName || cfg.MaxBiographyLength != tt.wantBio {
+				t.Errorf("limits = %d and %d, want %d and %d",
+					cfg.MaxFullNameLength, cfg.MaxBiographyLength, tt.wantFullName, tt.wantBio)
+			}
+		})
+	}
+}
+
+func TestLoadConfigBatchLimits(t *testing.T) {
+	tests := []struct {
+		name                      string
+		batchSize, concurrency    string
+		wantBatch, wantConcurrent int
+	}{
+		{"defaults", "", "", 100, 5},
+		{"overrides", "500", "20", 500, 20},
+		{"invalid falls back", "0", "-3", 100, 5},
+		{"clamped", "20000", "80", 10000, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAX_BATCH_SIZE", tt.batchSize)
+			t.Setenv("MAX_CONCURRENCY", tt.concurrency)
+
+			cfg := LoadConfig()
+			if cfg.MaxBatchSize != tt.wantBatch || cfg.MaxConcurrency != tt.wantConcurrent {
+				t.Errorf("limits = %d users and %d workers, want %d and %d",
+					cfg.MaxBatchSize, cfg.MaxConcurrency, tt.wantBatch, tt.wantConcurrent)
+			}
+		})
+	}
+}
+
+func TestLoadConfigLogSampleRate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 1},
+		{"10", 10},
+		{"0", 1},
+		{"-4", 1},
+	}
+	for _, tt := range tests {
+		t.Setenv("LOG_SAMPLE_RATE", tt.value)
+		if got := LoadConfig().LogSampleRate; got != tt.want {
+			t.Errorf("LOG_SAMPLE_RATE=%q gives %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigStatsQueryTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 10},
+		{"3", 3},
+		{"0", 10},
+		{"-1", 10},
+	}
+	for _, tt := range tests {
+		t.Setenv("STATS_QUERY_TIMEOUT_SECONDS", tt.value)
+		if got := LoadConfig().StatsQueryTimeout; got != tt.want {
+			t.Errorf("STATS_QUERY_TIMEOUT_SECONDS=%q gives %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigMaxBodyBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"", 64 * 1024},
+		{"1048576", 1 << 20},
+		{"0", 64 * 1024},
+		{"-1", 64 * 1024},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_BODY_BYTES", tt.value)
+		if got := LoadConfig().MaxBodyBytes; got != tt.want {
+			t.Errorf("MAX_BODY_BYTES=%q gives %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigMaxSummaryFailures(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 50},
+		{"200", 200},
+		{"0", 0},
+		{"-1", 50},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_SUMMARY_FAILURES", tt.value)
+		if got := LoadConfig().MaxSummaryFailures; got != tt.want {
+			t.Errorf("MAX_SUMMARY_FAILURES=%q gives %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
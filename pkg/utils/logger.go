@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -9,8 +11,15 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// InitLogger initializes the global logger
-func InitLogger(environment string) {
+// InitLogger initializes the global logger, writing to config.LogOutput
+func InitLogger(config *Config) error {
+	environment := config.Environment
+
+	out, toFile, err := logOutput(config)
+	if err != nil {
+		return err
+	}
+
 	// Set log level
 	level := strings.ToLower(os.Getenv("LOG_LEVEL"))
 	switch level {
@@ -36,21 +45,55 @@ func InitLogger(environment string) {
 	if environment == "development" {
 		// Pretty console output for development
 		log.Logger = log.Output(zerolog.ConsoleWriter{
-			Out:        os.Stderr,
+			Out:        out,
 			TimeFormat: time.RFC3339,
-			NoColor:    false,
+			NoColor:    toFile, // no escape codes in files
 		})
 	} else {
 		// JSON output for production
-		log.Logger = zerolog.New(os.Stderr).
+		log.Logger = zerolog.New(out).
 			With().
 			Timestamp().
 			Str("service", "instagram-user-processor").
 			Logger()
 	}
 
+	// Keep only every Nth debug and trace message; info and above are
+	// never sampled
+	if config.LogSampleRate > 1 {
+		sampler := &zerolog.BasicSampler{N: uint32(config.LogSampleRate)}
+		log.Logger = log.Logger.Sample(zerolog.LevelSampler{
+			TraceSampler: sampler,
+			DebugSampler: sampler,
+		})
+	}
+
 	log.Info().
 		Str("level", zerolog.GlobalLevel().String()).
 		Str("environment", environment).
+		Str("output", config.LogOutput).
+		Int("debug_sample_rate", config.LogSampleRate).
 		Msg("logger initialized")
+	return nil
+}
+
+// logOutput returns the writer named by LOG_OUTPUT: "stderr", "stdout" or
+// a file path, which is rotated by size. toFile reports the latter.
+func logOutput(config *Config) (out io.Writer, toFile bool, err error) {
+	switch strings.ToLower(config.LogOutput) {
+	case "", "stderr":
+		return os.Stderr, false, nil
+	case "stdout":
+		return os.Stdout, false, nil
+	}
+
+	file, err := NewRotatingFile(config.LogOutput, RotateOptions{
+		MaxSizeMB:  config.LogMaxSizeMB,
+		MaxBackups: config.LogMaxBackups,
+		MaxAgeDays: config.LogMaxAgeDays,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open LOG_OUTPUT %s: %w", config.LogOutput, err)
+	}
+	return file, true, nil
 }
\ No newline at end of file
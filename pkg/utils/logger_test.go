@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// restoreLogger puts back the global logger and level after the test
+func restoreLogger(t *testing.T) {
+	prevLogger, prevLevel := log.Logger, zerolog.GlobalLevel()
+	t.Cleanup(func() {
+		log.Logger = prevLogger
+		zerolog.SetGlobalLevel(prevLevel)
+	})
+}
+
+func TestInitLoggerWritesToFile(t *testing.T) {
+	tests := []struct {
+		environment string
+		want        []string
+	}{
+		{"production", []string{`"message":"written to file"`, `"service":"instagram-user-processor"`}},
+		{"development", []string{"written to file", "INF"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.environment, func(t *testing.T) {
+			restoreLogger(t)
+			t.Setenv("LOG_LEVEL", "info")
+			path := filepath.Join(t.TempDir(), "logs", "app.log")
+
+			err := InitLogger(&Config{Environment: tt.environment, LogOutput: path, LogMaxSizeMB: 1})
+			if err != nil {
+				t.Fatalf("InitLogger: %v", err)
+			}
+			log.Info().Msg("written to file")
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read log file: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("log file doesn't contain %q:\n%s", want, data)
+				}
+			}
+			if strings.Contains(string(data), "\x1b[") {
+				t.Errorf("log file has color escape codes:\n%q", data)
+			}
+		})
+	}
+}
+
+func TestInitLoggerUnwritableOutput(t *testing.T) {
+	restoreLogger(t)
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A regular file can't be a log directory
+	err := InitLogger(&Config{Environment: "production", LogOutput: filepath.Join(blocker, "app.log")})
+	if err == nil || !strings.Contains(err.Error(), "LOG_OUTPUT") {
+		t.Errorf("error = %v, want a LOG_OUTPUT failure", err)
+	}
+}
+
+func TestRotatingFileRotatesAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	f, err := NewRotatingFile(path, RotateOptions{MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %v", err)
+	}
+	defer f.Close()
+	f.maxSize = 10
+
+	// A backup from long ago, the first to go past MaxBackups, and an
+	// unrelated file sharing the prefix
+	stale := f.backupName(time.Now().Add(-365 * 24 * time.Hour))
+	unrelated := filepath.Join(dir, "app-notes.log")
+	for _, name := range []string{stale, unrelated} {
+		if err := os.WriteFile(name, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, line := range []string{"line one\n", "line two\n", "line three\n", "line four\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond) // backups are named to the millisecond
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil || string(current) != "line four\n" {
+		t.Errorf("current file = %q, %v, want only the last line", current, err)
+	}
+	prefix, ext := f.backupPattern()
+	backups, _ := filepath.Glob(prefix + "2*" + ext)
+	if len(backups) != 2 || backups[0] == stale {
+		t.Fatalf("backups = %v, want the newest 2", backups)
+	}
+	for i, want := range []string{"line two\n", "line three\n"} {
+		if data, _ := os.ReadFile(backups[i]); string(data) != want {
+			t.Errorf("backup %s = %q, want %q", backups[i], data, want)
+		}
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("unrelated file was removed: %v", err)
+	}
+}
+
+func TestRotatingFilePrunesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := NewRotatingFile(path, RotateOptions{MaxAgeDays: 7})
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %v", err)
+	}
+	defer f.Close()
+	f.maxSize = 1
+
+	old := f.backupName(time.Now().Add(-8 * 24 * time.Hour))
+	recent := f.backupName(time.Now().Add(-6 * 24 * time.Hour))
+	for _, name := range []string{old, recent} {
+		if err := os.WriteFile(name, []byte("backup"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("backup older than MaxAgeDays still exists: %v", err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("recent backup was removed: %v", err)
+	}
+}
+
+func TestRotatingFileWriteAfterClose(t *testing.T) {
+	f, err := NewRotatingFile(filepath.Join(t.TempDir(), "app.log"), RotateOptions{})
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %v", err)
+	}
+	f.Close()
+	if _, err := f.Write([]byte("late\n")); err != os.ErrClosed {
+		t.Errorf("Write after Close = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestInitLoggerSamplesDebugLogs(t *testing.T) {
+	restoreLogger(t)
+	t.Setenv("LOG_LEVEL", "debug")
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	if err := InitLogger(&Config{Environment: "production", LogOutput: path, LogSampleRate: 10}); err != nil {
+		t.Fatalf("InitLogger: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		log.Debug().Int("i", i).Msg("sampled")
+	}
+	for i := 0; i < 5; i++ {
+		log.Warn().Msg("unsampled warning")
+		log.Error().Msg("unsampled error")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log file: %v", err)
+	}
+	counts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		for _, message := range []string{"sampled", "unsampled warning", "unsampled error"} {
+			if strings.Contains(line, `"message":"`+message+`"`) {
+				counts[message]++
+			}
+		}
+	}
+	if counts["sampled"] != 10 {
+		t.Errorf("wrote %d of 100 debug messages, want 10", counts["sampled"])
+	}
+	if counts["unsampled warning"] != 5 || counts["unsampled error"] != 5 {
+		t.Errorf("wrote %d warnings and %d errors, want all 5 of each", counts["unsampled warning"], counts["unsampled error"])
+	}
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// RequestIDHeader carries the request ID on requests and responses
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDContextKey struct{}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID, or "" outside a request
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// NewRequestID generates a random (version 4) UUID
+func NewRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Warn().Err(err).Msg("failed to generate request ID")
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// LoggerFromContext returns the global logger with the request ID from ctx
+// attached, so log lines of one request can be correlated
+func LoggerFromContext(ctx context.Context) *zerolog.Logger {
+	requestID := RequestIDFromContext(ctx)
+	if requestID == "" {
+		return &log.Logger
+	}
+	logger := log.With().Str("request_id", requestID).Logger()
+	return &logger
+}
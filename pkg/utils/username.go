@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxUsernameLength is Instagram's maximum username length
+const MaxUsernameLength = 30
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._]+$`)
+
+// ErrInvalidUsername is returned when a username fails validation
+var ErrInvalidUsername = errors.New("invalid username")
+
+// NormalizeUsername trims whitespace and a leading "@", lowercases the
+// username and validates it against Instagram's allowed charset
+// (letters, digits, dot, underscore; at most 30 characters). Periods may
+// not lead, trail or repeat. The returned value is always ASCII and safe
+// to use as a query parameter or cache key.
+func NormalizeUsername(username string) (string, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(username), "@")
+
+	if trimmed == "" {
+		return "", fmt.Errorf("%w: username cannot be empty", ErrInvalidUsername)
+	}
+
+	// Check the byte length before lowercasing so oversized input is
+	// rejected without being copied
+	if len(trimmed) > MaxUsernameLength {
+		return "", fmt.Errorf("%w: username exceeds %d characters", ErrInvalidUsername, MaxUsernameLength)
+	}
+
+	// Validate before lowercasing: some non-ASCII runes (e.g. the Kelvin
+	// sign) lowercase to ASCII letters
+	if !usernamePattern.MatchString(trimmed) {
+		return "", fmt.Errorf("%w: username may only contain letters, digits, dots and underscores", ErrInvalidUsername)
+	}
+
+	normalized := strings.ToLower(trimmed)
+
+	if strings.HasPrefix(normalized, ".") || strings.HasSuffix(normalized, ".") || strings.Contains(normalized, "..") {
+		return "", fmt.Errorf("%w: username cannot start or end with a period or contain consecutive periods", ErrInvalidUsername)
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // empty when rejected
+	}{
+		{"alice", "alice"},
+		{"  @Alice.Smith_1 ", "alice.smith_1"},
+		{strings.Repeat("a", MaxUsernameLength), strings.Repeat("a", MaxUsernameLength)},
+		{strings.Repeat("a", MaxUsernameLength+1), ""},
+		{strings.Repeat("a", 1<<20), ""},
+		{"", ""},
+		{"@", ""},
+		{"   ", ""},
+		{".alice", ""},
+		{"alice.", ""},
+		{"al..ice", ""},
+		{"al ice", ""},
+		{"alice\x00", ""},
+		{"alice\n", "alice"}, // trailing whitespace is trimmed
+		{"al\tice", ""},
+		{"'; DROP TABLE instagram_users; --", ""},
+		{"ålice", ""},
+		{"\u212Aelvin", ""}, // the Kelvin sign lowercases to an ASCII k
+		{"@@alice", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizeUsername(tt.input)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidUsername) {
+				t.Errorf("NormalizeUsername(%q) = %q, %v, want ErrInvalidUsername", tt.input, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizeUsername(%q) = %q, %v, want %q", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func FuzzNormalizeUsername(f *testing.F) {
+	for _, seed := range []string{
+		"alice", "@Alice", " alice.smith ", ".alice", "al..ice", "\u212Aelvin",
+		"ålice", "alice\x00", strings.Repeat("a", 31), "@", "",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		got, err := NormalizeUsername(input)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidUsername) || got != "" {
+				t.Fatalf("NormalizeUsername(%q) = %q, %v, want a clear rejection", input, got, err)
+			}
+			return
+		}
+
+		if got == "" || len(got) > MaxUsernameLength {
+			t.Fatalf("NormalizeUsername(%q) = %q, want 1 to %d characters", input, got, MaxUsernameLength)
+		}
+		for _, r := range got {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '_') {
+				t.Fatalf("NormalizeUsername(%q) = %q, contains %q", input, got, r)
+			}
+		}
+		if strings.HasPrefix(got, ".") || strings.HasSuffix(got, ".") || strings.Contains(got, "..") {
+			t.Fatalf("NormalizeUsername(%q) = %q, misplaced period", input, got)
+		}
+
+		// Normalizing is idempotent
+		if again, err := NormalizeUsername(got); err != nil || again != got {
+			t.Fatalf("NormalizeUsername(%q) = %q, %v, want it unchanged", got, again, err)
+		}
+	})
+}